@@ -0,0 +1,142 @@
+package ccq
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	"github.com/gagliardetto/solana-go"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+)
+
+// AuditEvent records a single call in an authorized request. It identifies the user by name, and never contains the API key.
+type AuditEvent struct {
+	Timestamp time.Time   `json:"timestamp"`
+	UserName  string      `json:"userName"`
+	CallType  string      `json:"callType"`
+	Chain     vaa.ChainID `json:"chain"`
+	Contract  string      `json:"contract"`           // The contract address for eth calls, or the account or program address for Solana calls.
+	Selector  string      `json:"selector,omitempty"` // Only set for eth calls.
+	TraceId   string      `json:"traceId,omitempty"`  // The trace ID of the HTTP request, if any.
+}
+
+// AuditHook is called by validateRequest for every call in an authorized request. It must not block.
+type AuditHook func(AuditEvent)
+
+// AuditLogger is an AuditHook implementation that writes the events to an io.Writer as JSON lines. The events are buffered in a channel
+// and written by a separate go routine, so a slow writer does not stall request validation. If the buffer is full, events are dropped.
+type AuditLogger struct {
+	w      io.Writer
+	events chan AuditEvent
+	done   chan struct{} // Closed once the go routine has written the remaining events on shutdown.
+}
+
+// NewAuditLogger creates an audit logger that writes to the specified writer, buffering up to bufferSize events.
+func NewAuditLogger(w io.Writer, bufferSize int) *AuditLogger {
+	return &AuditLogger{
+		w:      w,
+		events: make(chan AuditEvent, bufferSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// Log queues an event to be written. It never blocks. It can be used as an AuditHook.
+func (al *AuditLogger) Log(event AuditEvent) {
+	select {
+	case al.events <- event:
+	default:
+		auditEventsDropped.Inc()
+	}
+}
+
+// Start starts a go routine to write the queued events. When the context is cancelled, it writes the events that are still queued and
+// flushes the writer before exiting, so use Wait before closing the writer. Events logged after that are not written.
+func (al *AuditLogger) Start(ctx context.Context, logger *zap.Logger, errC chan error) {
+	common.RunWithScissors(ctx, errC, "audit_logger", func(ctx context.Context) error {
+		defer close(al.done)
+		encoder := json.NewEncoder(al.w)
+		write := func(event AuditEvent) {
+			if err := encoder.Encode(event); err != nil {
+				logger.Error("failed to write audit event", zap.String("userName", event.UserName), zap.Error(err))
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				for {
+					select {
+					case event := <-al.events:
+						write(event)
+					default:
+						al.flush(logger)
+						return nil
+					}
+				}
+			case event := <-al.events:
+				write(event)
+			}
+		}
+	})
+}
+
+// Wait blocks until the go routine started by Start has written the remaining events and exited.
+func (al *AuditLogger) Wait() {
+	<-al.done
+}
+
+// flush flushes the writer if it is buffered, or syncs it to disk if it is a file.
+func (al *AuditLogger) flush(logger *zap.Logger) {
+	var err error
+	switch w := al.w.(type) {
+	case interface{ Flush() error }:
+		err = w.Flush()
+	case interface{ Sync() error }:
+		err = w.Sync()
+	}
+	if err != nil {
+		logger.Error("failed to flush the audit log", zap.Error(err))
+	}
+}
+
+// auditEvents returns the audit events for all of the calls in a query request.
+func auditEvents(userName string, queryRequest *query.QueryRequest, now time.Time) []AuditEvent {
+	var events []AuditEvent
+	for _, pcq := range queryRequest.PerChainQueries {
+		newEvent := func(callType string, contract string, selector string) AuditEvent {
+			return AuditEvent{Timestamp: now, UserName: userName, CallType: callType, Chain: pcq.ChainId, Contract: contract, Selector: selector}
+		}
+
+		var callType string
+		var callData []*query.EthCallData
+		switch q := pcq.Query.(type) {
+		case *query.EthCallQueryRequest:
+			callType, callData = "ethCall", q.CallData
+		case *query.EthCallByTimestampQueryRequest:
+			callType, callData = "ethCallByTimestamp", q.CallData
+		case *query.EthCallWithFinalityQueryRequest:
+			callType, callData = "ethCallWithFinality", q.CallData
+		case *query.SolanaAccountQueryRequest:
+			for _, acct := range q.Accounts {
+				events = append(events, newEvent("solAccount", solana.PublicKey(acct).String(), ""))
+			}
+		case *query.SolanaPdaQueryRequest:
+			for _, pda := range q.PDAs {
+				events = append(events, newEvent("solPDA", solana.PublicKey(pda.ProgramAddress).String(), ""))
+			}
+		}
+
+		for _, cd := range callData {
+			var selector string
+			if len(cd.Data) >= ETH_CALL_SIG_LENGTH {
+				selector = "0x" + hex.EncodeToString(cd.Data[:ETH_CALL_SIG_LENGTH])
+			}
+			events = append(events, newEvent(callType, "0x"+hex.EncodeToString(cd.To), selector))
+		}
+	}
+	return events
+}
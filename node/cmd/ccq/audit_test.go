@@ -0,0 +1,115 @@
+package ccq
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+)
+
+func TestValidateRequestAuditHook(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	var events []AuditEvent
+	audit := func(event AuditEvent) { events = append(events, event) }
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, audit, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(events))
+	assert.Equal(t, "Test User", events[0].UserName)
+	assert.Equal(t, "ethCall", events[0].CallType)
+	assert.Equal(t, vaa.ChainIDEthereum, events[0].Chain)
+	assert.Equal(t, "0xb4fbf271143f4fbf7b91a5ded31805e42b2208d6", events[0].Contract)
+	assert.Equal(t, "0x06fdde03", events[0].Selector)
+	assert.False(t, events[0].Timestamp.IsZero())
+
+	// Denied requests are not audited.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, audit, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.Error(t, err)
+	assert.Equal(t, 1, len(events))
+}
+
+// syncBuffer is a bytes.Buffer that is safe to use from multiple go routines.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	return sb.buf.String()
+}
+
+func TestAuditLogger(t *testing.T) {
+	var buf syncBuffer
+	al := NewAuditLogger(&buf, 10)
+
+	event := AuditEvent{Timestamp: time.Unix(1700000000, 0).UTC(), UserName: "Test User", CallType: "ethCall", Chain: vaa.ChainIDEthereum, Contract: "0xb4fbf271143f4fbf7b91a5ded31805e42b2208d6", Selector: "0x06fdde03"}
+	al.Log(event)
+	al.Log(event)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	al.Start(ctx, zap.NewNop(), make(chan error, 1))
+
+	require.Eventually(t, func() bool { return strings.Count(buf.String(), "\n") == 2 }, time.Second, 10*time.Millisecond)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, `{"timestamp":"2023-11-14T22:13:20Z","userName":"Test User","callType":"ethCall","chain":2,"contract":"0xb4fbf271143f4fbf7b91a5ded31805e42b2208d6","selector":"0x06fdde03"}`, lines[0])
+
+	var decoded AuditEvent
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &decoded))
+	assert.Equal(t, event, decoded)
+}
+
+func TestAuditLoggerDrainsOnShutdown(t *testing.T) {
+	var buf syncBuffer
+	writer := bufio.NewWriter(&buf)
+	al := NewAuditLogger(writer, 100)
+	for i := 0; i < 100; i++ {
+		al.Log(AuditEvent{UserName: "Test User"})
+	}
+
+	// The events that are still queued when the context is cancelled are written, and the buffered writer is flushed.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	al.Start(ctx, zap.NewNop(), make(chan error, 1))
+	al.Wait()
+	assert.Equal(t, 100, strings.Count(buf.String(), "\n"))
+	assert.Zero(t, writer.Buffered())
+}
+
+func TestAuditLoggerDoesNotBlock(t *testing.T) {
+	// The logger is never started, so once the buffer is full, events are dropped rather than blocking.
+	al := NewAuditLogger(&bytes.Buffer{}, 1)
+	before, err := getCounterValue(auditEventsDropped)
+	require.NoError(t, err)
+
+	al.Log(AuditEvent{UserName: "Test User"})
+	al.Log(AuditEvent{UserName: "Test User"})
+
+	after, err := getCounterValue(auditEventsDropped)
+	require.NoError(t, err)
+	assert.Equal(t, before+1, after)
+}
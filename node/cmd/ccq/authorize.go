@@ -0,0 +1,391 @@
+package ccq
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	"github.com/gagliardetto/solana-go"
+	"github.com/spf13/cobra"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+)
+
+var (
+	authorizeEnvStr      *string
+	authorizePermFile    *string
+	authorizeApiKey      *string
+	authorizeRequestFile *string
+)
+
+func init() {
+	authorizeEnvStr = AuthorizeCmd.Flags().String("env", "", "environment (devnet, testnet, mainnet)")
+	authorizePermFile = AuthorizeCmd.Flags().String("permFile", "", "JSON file containing permissions configuration")
+	authorizeApiKey = AuthorizeCmd.Flags().String("key", "", "API key to check the request for")
+	authorizeRequestFile = AuthorizeCmd.Flags().String("request", "", "File containing the query request, either as the JSON body sent to the proxy or as hex")
+	QueryServerCmd.AddCommand(AuthorizeCmd)
+}
+
+var AuthorizeCmd = &cobra.Command{
+	Use:   "authorize",
+	Short: "Print which of the calls in a query request would be allowed for an API key, exiting non-zero if any would be denied",
+	Run:   runAuthorize,
+	Args:  cobra.NoArgs,
+}
+
+// CallAuthResult is the authorization decision for a single call in a query request.
+type CallAuthResult struct {
+	ChainId vaa.ChainID `json:"chainId"`
+	CallKey string      `json:"callKey"`          // Has the same format as in the permissions, such as "ethCall:2:<contract>:<selector>".
+	Allowed bool        `json:"allowed"`          // If set, the call would pass the permission checks.
+	Reason  string      `json:"reason,omitempty"` // Why the call would be rejected. Empty if it is allowed.
+}
+
+// Authorize reports whether each call in a query request would be allowed for an API key, without executing the query. Unlike validateRequest,
+// it carries on past failures, so there is a result for every call. It does not use up any rate limits, mark calls as used, or peg any metrics,
+// so it is suitable for pre-flight checks. An error is only returned for a problem with the request as a whole, such as an unknown API key.
+func (perms *Permissions) Authorize(apiKey string, qr *query.QueryRequest) ([]CallAuthResult, error) {
+	pe, exists := perms.GetUserEntry(apiKey)
+	if !exists {
+		return nil, ErrInvalidAPIKey
+	}
+	if pe.isExpired(time.Now()) {
+		return nil, ErrAPIKeyExpired
+	}
+	if pe.maxCalls != 0 {
+		if numCalls := numCallsInRequest(qr); numCalls > pe.maxCalls {
+			return nil, fmt.Errorf("%w: request contains %d calls, which exceeds the maximum of %d", ErrTooManyCalls, numCalls, pe.maxCalls)
+		}
+	}
+	if pe.maxChains != 0 && len(qr.PerChainQueries) > pe.maxChains {
+		return nil, fmt.Errorf("%w: request contains %d per chain queries, which exceeds the maximum of %d", ErrTooManyChains, len(qr.PerChainQueries), pe.maxChains)
+	}
+
+	var results []CallAuthResult
+	for _, pcq := range qr.PerChainQueries {
+		if isEmptyPerChainQuery(pcq) {
+			return nil, ErrEmptyPerChainQuery
+		}
+
+		// Failures that apply to the whole per chain query are reported against each of its calls.
+		var chainReason string
+		if !pe.chainAllowed(pcq.ChainId) {
+			chainReason = ErrChainNotAllowed.Error()
+		} else if !pe.hasCallsForChain(pcq.ChainId) {
+			chainReason = ErrNoPermissionsForChain.Error()
+		}
+
+		switch q := pcq.Query.(type) {
+		case *query.EthCallQueryRequest:
+			results = append(results, authorizeEthCalls(pe, "ethCall", pcq.ChainId, q.CallData, "", chainReason, q.BlockId)...)
+		case *query.EthCallByTimestampQueryRequest:
+			results = append(results, authorizeEthCalls(pe, "ethCallByTimestamp", pcq.ChainId, q.CallData, "", chainReason, q.TargetBlockIdHint, q.FollowingBlockIdHint)...)
+		case *query.EthCallWithFinalityQueryRequest:
+			results = append(results, authorizeEthCalls(pe, "ethCallWithFinality", pcq.ChainId, q.CallData, q.Finality, chainReason, q.BlockId)...)
+		case *query.SolanaAccountQueryRequest:
+			for _, acct := range q.Accounts {
+				callKey := fmt.Sprintf("solAccount:%d:%s", pcq.ChainId, solana.PublicKey(acct).String())
+				results = append(results, authorizeSolanaCall(pe, pcq.ChainId, callKey, 0, chainReason))
+			}
+		case *query.SolanaPdaQueryRequest:
+			for _, pda := range q.PDAs {
+				callKey := fmt.Sprintf("solPDA:%d:%s", pcq.ChainId, solana.PublicKey(pda.ProgramAddress).String())
+				results = append(results, authorizeSolanaCall(pe, pcq.ChainId, callKey, len(pda.Seeds), chainReason))
+			}
+		default:
+			return nil, ErrUnsupportedQueryType
+		}
+	}
+
+	return results, nil
+}
+
+// authorizeEthCalls returns the results for the calls in an eth query. The finality should only be specified for eth_call_with_finality.
+// If the chain reason is set, every call is rejected with it.
+func authorizeEthCalls(pe *permissionEntry, callTag string, chainId vaa.ChainID, callData []*query.EthCallData, finality string, chainReason string, blockIds ...string) []CallAuthResult {
+	// The maximum block depth is not checked, since that would need an RPC call for the head block, which a pre-flight check should not make.
+	if chainReason == "" {
+		if _, _, err := checkBlockIds(pe, chainId, blockIds...); err != nil {
+			chainReason = err.Error()
+		}
+	}
+
+	results := make([]CallAuthResult, 0, len(callData))
+	for _, cd := range callData {
+		result := CallAuthResult{ChainId: chainId, CallKey: fmt.Sprintf("%s:%d:%s", callTag, chainId, hex.EncodeToString(cd.To))}
+		contractAddress, err := vaa.BytesToAddress(cd.To)
+		if err != nil {
+			result.Reason = fmt.Sprintf("failed to parse contract address: %v", err)
+			results = append(results, result)
+			continue
+		}
+		if len(cd.Data) < ETH_CALL_SIG_LENGTH {
+			result.Reason = "eth call data must be at least four bytes"
+			results = append(results, result)
+			continue
+		}
+		k := newEthCallKey(callTag, chainId, contractAddress, cd.Data)
+		result.CallKey = k.String()
+		result.Reason = ethCallDeniedReason(pe, k, cd.Data, finality, chainReason)
+		result.Allowed = result.Reason == ""
+		results = append(results, result)
+	}
+	return results
+}
+
+// ethCallDeniedReason returns why an eth call would be rejected, or an empty string if it would be allowed. The checks are the same as in
+// validateCallData, in the same order.
+func ethCallDeniedReason(pe *permissionEntry, k ethCallKey, data []byte, finality string, chainReason string) string {
+	if chainReason != "" {
+		return chainReason
+	}
+	if _, denied := lookupEthCall(pe.deniedCalls, k); denied {
+		return "call is denied"
+	}
+	if pe.allowAnything {
+		return ""
+	}
+	opts, allowed := lookupEthCall(pe.allowedCalls, k)
+	if !allowed {
+		return ErrCallNotAuthorized.Error()
+	}
+	if finality != "" && len(opts.allowedFinality) != 0 {
+		if _, exists := opts.allowedFinality[finality]; !exists {
+			return fmt.Sprintf(`finality "%s" not allowed`, finality)
+		}
+	}
+	if opts.argLayout != nil {
+		if err := opts.argLayout.check(len(data) - ETH_CALL_SIG_LENGTH); err != nil {
+			return err.Error()
+		}
+	}
+	if opts.innerCallCheck != nil {
+		if err := opts.innerCallCheck(data); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// authorizeSolanaCall returns the result for a single account or program address in a solana query. The number of seeds is only used for PDAs.
+func authorizeSolanaCall(pe *permissionEntry, chainId vaa.ChainID, callKey string, numSeeds int, chainReason string) CallAuthResult {
+	result := CallAuthResult{ChainId: chainId, CallKey: callKey}
+	if chainReason != "" {
+		result.Reason = chainReason
+		return result
+	}
+	if pe.deniedCalls.has(callKey) {
+		result.Reason = "call is denied"
+		return result
+	}
+	if !pe.allowAnything {
+		opts, exists := pe.allowedCalls.get(callKey)
+		if !exists {
+			result.Reason = ErrCallNotAuthorized.Error()
+			return result
+		}
+		if opts.maxSeeds != 0 && numSeeds > opts.maxSeeds {
+			result.Reason = fmt.Sprintf("has %d seeds, which exceeds the maximum of %d", numSeeds, opts.maxSeeds)
+			return result
+		}
+	}
+	result.Allowed = true
+	return result
+}
+
+// checkResponse is the body returned by the check endpoint.
+type checkResponse struct {
+	Results []CallAuthResult `json:"results"`
+	Cost    Cost             `json:"cost"`
+}
+
+// handleCheck reports which of the calls in a query request would be allowed for the API key, without sending the request to the guardians.
+// The body is the same as for a query, although the signature is not required. The response also includes the estimated cost of the request.
+// Requests still count against the user's rate limit.
+func (s *httpServer) handleCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Api-Key")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var q queryRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE)).Decode(&q); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	permissions := s.permissions.Load()
+	apiKey, status, err := apiKeyFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if permissions.InMaintenance() {
+		http.Error(w, ErrMaintenanceMode.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	permEntry, err := permissions.Lookup(apiKey)
+	if err != nil {
+		s.logger.Debug("invalid api key on check", zap.String("apiKeyHash", apiKeyHash(apiKey)))
+		status, err := missingApiKey(r, http.StatusForbidden, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if slices.Contains(permEntry.apiKeys, anonymousApiKey) {
+		// Like a query, the check is made against the anonymous user, whichever unknown key was presented.
+		apiKey = anonymousApiKey
+	}
+	if status, err := validateSource(s.logger, permEntry, clientIPFromRequest(r, s.trustForwardedFor)); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if permEntry.rateLimiter != nil && !permEntry.rateLimiter.Allow() {
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		rateLimitExceededByUser.WithLabelValues(permEntry.userName).Inc()
+		return
+	}
+
+	queryRequestBytes, err := hex.DecodeString(q.Bytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var qr query.QueryRequest
+	if err := qr.Unmarshal(queryRequestBytes); err != nil {
+		http.Error(w, fmt.Sprintf("failed to unmarshal request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	results, err := permissions.Authorize(apiKey, &qr)
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, ErrTooManyCalls) || errors.Is(err, ErrTooManyChains) || errors.Is(err, ErrUnsupportedQueryType) || errors.Is(err, ErrEmptyPerChainQuery) {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Authorize has already rejected any empty queries and query types that the proxy does not support, which are the only things that can
+	// make this fail.
+	cost, err := permissions.EstimateCost(&qr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Debug("checked request", zap.String("userName", permEntry.userName), zap.Int("numCalls", len(results)))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(checkResponse{Results: results, Cost: cost}); err != nil {
+		s.logger.Error("failed to encode check response", zap.String("userName", permEntry.userName), zap.Error(err))
+	}
+}
+
+func runAuthorize(cmd *cobra.Command, args []string) {
+	env, err := common.ParseEnvironment(*authorizeEnvStr)
+	if err != nil || (env != common.UnsafeDevNet && env != common.TestNet && env != common.MainNet) {
+		if *authorizeEnvStr == "" {
+			fmt.Println("Please specify --env")
+		} else {
+			fmt.Println("Invalid value for --env, should be devnet, testnet or mainnet")
+		}
+		os.Exit(1)
+	}
+
+	if *authorizePermFile == "" {
+		fmt.Println("Please specify --permFile")
+		os.Exit(1)
+	}
+	if *authorizeApiKey == "" {
+		fmt.Println("Please specify --key")
+		os.Exit(1)
+	}
+	if *authorizeRequestFile == "" {
+		fmt.Println("Please specify --request")
+		os.Exit(1)
+	}
+
+	perms, err := NewPermissions(*authorizePermFile, env, DefaultMaxConfigSize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	qr, err := readQueryRequestFile(*authorizeRequestFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	results, err := perms.Authorize(strings.ToLower(*authorizeApiKey), qr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if denied := WriteAuthResults(os.Stdout, results); denied != 0 {
+		os.Exit(1)
+	}
+}
+
+// readQueryRequestFile reads a serialized query request from a file. The file may contain the JSON body that is sent to the proxy, in
+// which case any signature is ignored, or just the request bytes in hex, with or without a "0x" prefix.
+func readQueryRequestFile(fileName string) (*query.QueryRequest, error) {
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to read request file "%s": %w`, fileName, err)
+	}
+
+	reqHex := string(bytes.TrimSpace(contents))
+	if strings.HasPrefix(reqHex, "{") {
+		var q queryRequest
+		if err := json.Unmarshal(contents, &q); err != nil {
+			return nil, fmt.Errorf(`failed to parse request file "%s": %w`, fileName, err)
+		}
+		reqHex = q.Bytes
+	}
+
+	queryRequestBytes, err := hex.DecodeString(strings.TrimPrefix(reqHex, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf(`failed to decode request in "%s": %w`, fileName, err)
+	}
+	var qr query.QueryRequest
+	if err := qr.Unmarshal(queryRequestBytes); err != nil {
+		return nil, fmt.Errorf(`failed to unmarshal request in "%s": %w`, fileName, err)
+	}
+	return &qr, nil
+}
+
+// WriteAuthResults writes a table of the authorization results, with the reason for each denied call, followed by a summary line. It
+// returns the number of calls that would be denied.
+func WriteAuthResults(w io.Writer, results []CallAuthResult) int {
+	denied := 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESULT\tCALL\tREASON")
+	for _, result := range results {
+		if result.Allowed {
+			fmt.Fprintf(tw, "allowed\t%s\t-\n", result.CallKey)
+		} else {
+			denied++
+			fmt.Fprintf(tw, "denied\t%s\t%s\n", result.CallKey, result.Reason)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d of %d calls allowed\n", len(results)-denied, len(results))
+	return denied
+}
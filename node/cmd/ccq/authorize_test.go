@@ -0,0 +1,190 @@
+package ccq
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	"github.com/gagliardetto/solana-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+)
+
+// createMixedQueryRequest creates a request with an allowed call and an unauthorized call on Ethereum, and a call on BSC, where the test user has no permissions.
+func createMixedQueryRequest(t testing.TB) *query.QueryRequest {
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	ethQuery := qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest)
+	ethQuery.CallData = append(ethQuery.CallData, &query.EthCallData{To: ethCommon.HexToAddress("0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6").Bytes(), Data: ethCommon.FromHex("0x18160ddd")})
+	qr.PerChainQueries = append(qr.PerChainQueries, createEthCallQueryRequest(t, vaa.ChainIDBSC, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03").PerChainQueries[0])
+	return qr
+}
+
+func TestAuthorizeReportsEveryCall(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+
+	results, err := perms.Authorize("my_secret_key", createMixedQueryRequest(t))
+	require.NoError(t, err)
+	assert.Equal(t, []CallAuthResult{
+		{ChainId: vaa.ChainIDEthereum, CallKey: "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03", Allowed: true},
+		{ChainId: vaa.ChainIDEthereum, CallKey: "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd", Reason: "call not authorized"},
+		{ChainId: vaa.ChainIDBSC, CallKey: "ethCall:4:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03", Reason: "no permissions for chain"},
+	}, results)
+
+	// A pre-flight check does not count as using the call.
+	opts, _ := perms.permMap["my_secret_key"].allowedCalls.get("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03")
+	before := opts.lastUsed.Load()
+	_, err = perms.Authorize("my_secret_key", createMixedQueryRequest(t))
+	require.NoError(t, err)
+	assert.Equal(t, before, opts.lastUsed.Load())
+
+	_, err = perms.Authorize("my_unknown_key", createMixedQueryRequest(t))
+	require.ErrorIs(t, err, ErrInvalidAPIKey)
+}
+
+func TestAuthorizeSolanaCalls(t *testing.T) {
+	perms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedCalls": [
+        {
+          "solPDA": {
+            "chain": 1,
+            "programAddress": "Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o",
+            "maxSeeds": 1
+          }
+        },`, 1))
+
+	programAddress := solana.MustPublicKeyFromBase58("Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o")
+	qr := &query.QueryRequest{
+		Nonce: 1,
+		PerChainQueries: []*query.PerChainQueryRequest{
+			{
+				ChainId: vaa.ChainIDSolana,
+				Query: &query.SolanaPdaQueryRequest{
+					Commitment: "finalized",
+					PDAs: []query.SolanaPDAEntry{
+						{ProgramAddress: programAddress, Seeds: [][]byte{[]byte("GuardianSet")}},
+						{ProgramAddress: programAddress, Seeds: [][]byte{[]byte("GuardianSet"), {0}}},
+					},
+				},
+			},
+		},
+	}
+
+	results, err := perms.Authorize("my_secret_key", qr)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.True(t, results[0].Allowed)
+	assert.Equal(t, "solPDA:1:Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o", results[0].CallKey)
+	assert.False(t, results[1].Allowed)
+	assert.Equal(t, "has 2 seeds, which exceeds the maximum of 1", results[1].Reason)
+}
+
+func TestAuthorizeEmptyPerChainQuery(t *testing.T) {
+	perms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true, "maxCallsPerRequest": 10,`, 1))
+
+	for name, pcq := range map[string]*query.PerChainQueryRequest{
+		"nil per chain query": nil,
+		"nil query":           {ChainId: vaa.ChainIDEthereum},
+		"nil eth query":       {ChainId: vaa.ChainIDEthereum, Query: (*query.EthCallQueryRequest)(nil)},
+		"nil solana query":    {ChainId: vaa.ChainIDSolana, Query: (*query.SolanaPdaQueryRequest)(nil)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+			qr.PerChainQueries = append(qr.PerChainQueries, pcq)
+			_, err := perms.Authorize("my_secret_key", qr)
+			require.ErrorIs(t, err, ErrEmptyPerChainQuery)
+			assert.Equal(t, "empty per chain query", err.Error())
+			_, err = perms.EstimateCost(qr)
+			require.ErrorIs(t, err, ErrEmptyPerChainQuery)
+		})
+	}
+}
+
+func TestHandleCheck(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	s := &httpServer{logger: zap.NewNop(), env: common.UnsafeDevNet, permissions: NewPermissionsStore(perms, nil)}
+
+	qrBytes, err := createMixedQueryRequest(t).Marshal()
+	require.NoError(t, err)
+	body, err := json.Marshal(queryRequest{Bytes: hex.EncodeToString(qrBytes)})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/check", strings.NewReader(string(body)))
+	r.Header.Set("X-Api-Key", "my_secret_key")
+	w := httptest.NewRecorder()
+	s.handleCheck(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp checkResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Results, 3)
+	assert.True(t, resp.Results[0].Allowed)
+	assert.False(t, resp.Results[1].Allowed)
+	assert.False(t, resp.Results[2].Allowed)
+	assert.Equal(t, Cost{Calls: 3, Chains: 2, PerChainQueries: 2, Weighted: 3}, resp.Cost)
+
+	r = httptest.NewRequest(http.MethodPost, "/v1/check", strings.NewReader(string(body)))
+	r.Header.Set("X-Api-Key", "my_unknown_key")
+	w = httptest.NewRecorder()
+	s.handleCheck(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestReadQueryRequestFile(t *testing.T) {
+	qr := createMixedQueryRequest(t)
+	queryRequestBytes, err := qr.Marshal()
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	// The JSON body sent to the proxy, as attached to a support ticket.
+	body, err := json.Marshal(queryRequest{Bytes: hex.EncodeToString(queryRequestBytes), Signature: "0102"})
+	require.NoError(t, err)
+	jsonFile := filepath.Join(dir, "req.json")
+	require.NoError(t, os.WriteFile(jsonFile, body, 0600))
+	parsed, err := readQueryRequestFile(jsonFile)
+	require.NoError(t, err)
+	assert.True(t, qr.Equal(parsed))
+
+	// Just the request bytes in hex.
+	hexFile := filepath.Join(dir, "req.hex")
+	require.NoError(t, os.WriteFile(hexFile, []byte("0x"+hex.EncodeToString(queryRequestBytes)+"\n"), 0600))
+	parsed, err = readQueryRequestFile(hexFile)
+	require.NoError(t, err)
+	assert.True(t, qr.Equal(parsed))
+
+	require.NoError(t, os.WriteFile(hexFile, []byte("not hex"), 0600))
+	_, err = readQueryRequestFile(hexFile)
+	require.ErrorContains(t, err, `failed to decode request in "`+hexFile+`"`)
+
+	_, err = readQueryRequestFile(filepath.Join(dir, "missing.json"))
+	require.ErrorContains(t, err, "failed to read request file")
+}
+
+func TestWriteAuthResults(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	results, err := perms.Authorize("my_secret_key", createMixedQueryRequest(t))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.Equal(t, 2, WriteAuthResults(&buf, results))
+	assert.Equal(t, `RESULT   CALL                                                                                 REASON
+allowed  ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03  -
+denied   ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd  call not authorized
+denied   ethCall:4:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03  no permissions for chain
+1 of 3 calls allowed
+`, buf.String())
+
+	buf.Reset()
+	assert.Equal(t, 0, WriteAuthResults(&buf, results[:1]))
+	assert.Contains(t, buf.String(), "1 of 1 calls allowed")
+}
@@ -0,0 +1,160 @@
+package ccq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	eth_common "github.com/ethereum/go-ethereum/common"
+	ethClient "github.com/ethereum/go-ethereum/ethclient"
+	ethRpc "github.com/ethereum/go-ethereum/rpc"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+)
+
+const (
+	// headBlockCacheTTL is how long the RPC head block provider reuses the head block of a chain, so that a busy proxy does not make an
+	// RPC call for every request.
+	headBlockCacheTTL = time.Second
+
+	// headBlockFetchTimeout limits how long a request waits on the RPC for the head block.
+	headBlockFetchTimeout = 2 * time.Second
+)
+
+// HeadBlockProvider returns the latest block number on a chain. It is used to enforce the "maxBlockDepth" of a user.
+type HeadBlockProvider interface {
+	HeadBlock(ctx context.Context, chainId vaa.ChainID) (uint64, error)
+}
+
+// checkBlockDepth returns an error if any of the block numbers is further behind the head of the chain than the user's maximum block
+// depth, which is read from the head block provider. The provider may be nil if none is configured. Since only a block number can be
+// compared to the head, anything else is rejected for a user with a maximum depth, including a block hash and the empty hints of an
+// eth_call_by_timestamp. Otherwise, either could be used to query a block of any age. The head block is only looked up once all of the
+// block IDs have been parsed. On failure, it also returns the metric label for the failure.
+func checkBlockDepth(ctx context.Context, headBlocks HeadBlockProvider, permsForUser *permissionEntry, chainId vaa.ChainID, blockIds ...string) (int, string, error) {
+	if permsForUser.maxBlockDepth == 0 {
+		return http.StatusOK, "", nil
+	}
+
+	var minBlockNum uint64
+	for i, blockId := range blockIds {
+		if blockId == "" {
+			return http.StatusForbidden, "block_not_allowed", fmt.Errorf("%w: a block number is required to check the maximum block depth on chain %s", ErrBlockNotAllowed, chainId)
+		}
+		blockIdHex, isHex := strings.CutPrefix(blockId, "0x")
+		blockNum, err := strconv.ParseUint(blockIdHex, 16, 64)
+		if !isHex || len(blockIdHex) == 2*eth_common.HashLength || err != nil {
+			return http.StatusForbidden, "block_not_allowed", fmt.Errorf("%w: block %s is not a block number, so it cannot be checked against the maximum block depth on chain %s", ErrBlockNotAllowed, blockId, chainId)
+		}
+		if i == 0 || blockNum < minBlockNum {
+			minBlockNum = blockNum
+		}
+	}
+	if len(blockIds) == 0 {
+		return http.StatusOK, "", nil
+	}
+
+	if headBlocks == nil {
+		return http.StatusServiceUnavailable, "head_block_unavailable", fmt.Errorf("%w for chain %s: no head block provider", ErrHeadBlockUnavailable, chainId)
+	}
+	head, err := headBlocks.HeadBlock(ctx, chainId)
+	if err != nil {
+		return http.StatusServiceUnavailable, "head_block_unavailable", fmt.Errorf("%w for chain %s: %w", ErrHeadBlockUnavailable, chainId, err)
+	}
+	if minBlockNum < head && head-minBlockNum > permsForUser.maxBlockDepth {
+		return http.StatusForbidden, "block_not_allowed", fmt.Errorf("%w: block %d is more than %d blocks behind the head of chain %s", ErrBlockNotAllowed, minBlockNum, permsForUser.maxBlockDepth, chainId)
+	}
+	return http.StatusOK, "", nil
+}
+
+// rpcHeadBlockProvider is a HeadBlockProvider that reads the latest block number from an RPC for each chain.
+type rpcHeadBlockProvider struct {
+	rpcUrls map[vaa.ChainID]string
+
+	mu     sync.Mutex
+	chains map[vaa.ChainID]*rpcHeadBlock
+}
+
+// rpcHeadBlock is the connection and cached head block for one chain. Its lock is held while fetching, so that concurrent requests wait
+// for a single RPC call rather than each making their own.
+type rpcHeadBlock struct {
+	mu        sync.Mutex
+	client    *ethClient.Client
+	head      uint64
+	fetchedAt time.Time
+}
+
+// NewRPCHeadBlockProvider creates a HeadBlockProvider that reads the head block of each chain from the specified RPC URL. The URLs must be
+// permitted by the RPC policy. The connections are made on first use.
+func NewRPCHeadBlockProvider(rpcUrls map[vaa.ChainID]string, rpcPolicy RPCPolicy) (HeadBlockProvider, error) {
+	for chainId, rpcUrl := range rpcUrls {
+		if err := rpcPolicy.Check(rpcUrl); err != nil {
+			return nil, fmt.Errorf("head block rpc for chain %s: %w", chainId, err)
+		}
+	}
+	return &rpcHeadBlockProvider{rpcUrls: rpcUrls, chains: make(map[vaa.ChainID]*rpcHeadBlock)}, nil
+}
+
+// HeadBlock implements HeadBlockProvider.
+func (p *rpcHeadBlockProvider) HeadBlock(ctx context.Context, chainId vaa.ChainID) (uint64, error) {
+	rpcUrl, exists := p.rpcUrls[chainId]
+	if !exists {
+		return 0, fmt.Errorf("no head block rpc for chain %s", chainId)
+	}
+
+	p.mu.Lock()
+	hb, exists := p.chains[chainId]
+	if !exists {
+		hb = &rpcHeadBlock{}
+		p.chains[chainId] = hb
+	}
+	p.mu.Unlock()
+
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	if !hb.fetchedAt.IsZero() && time.Since(hb.fetchedAt) < headBlockCacheTTL {
+		return hb.head, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, headBlockFetchTimeout)
+	defer cancel()
+	if hb.client == nil {
+		rawClient, err := ethRpc.DialContext(ctx, rpcUrl)
+		if err != nil {
+			return 0, errors.New("failed to connect to rpc")
+		}
+		hb.client = ethClient.NewClient(rawClient)
+	}
+	head, err := hb.client.BlockNumber(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read head block: %w", err)
+	}
+	hb.head, hb.fetchedAt = head, time.Now()
+	return head, nil
+}
+
+// parseHeadBlockRPCs parses a comma separated list of chain=url entries, such as "2=https://eth.example.com,4=https://bsc.example.com".
+func parseHeadBlockRPCs(str string) (map[vaa.ChainID]string, error) {
+	rpcUrls := make(map[vaa.ChainID]string)
+	for i, entry := range strings.Split(str, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		chainStr, rpcUrl, found := strings.Cut(entry, "=")
+		chain, err := strconv.ParseUint(strings.TrimSpace(chainStr), 10, 16)
+		if !found || err != nil || chain == 0 || strings.TrimSpace(rpcUrl) == "" {
+			// The entry is not included, since RPC URLs often contain an API key.
+			return nil, fmt.Errorf("head block rpc entry %d is invalid, must be chain=url", i+1)
+		}
+		if _, exists := rpcUrls[vaa.ChainID(chain)]; exists {
+			return nil, fmt.Errorf("chain %d has more than one head block rpc", chain)
+		}
+		rpcUrls[vaa.ChainID(chain)] = strings.TrimSpace(rpcUrl)
+	}
+	return rpcUrls, nil
+}
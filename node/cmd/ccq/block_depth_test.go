@@ -0,0 +1,137 @@
+package ccq
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+)
+
+// fakeHeadBlockProvider returns a fixed head block, and counts how many times it is asked.
+type fakeHeadBlockProvider struct {
+	head  uint64
+	err   error
+	calls int
+}
+
+func (p *fakeHeadBlockProvider) HeadBlock(ctx context.Context, chainId vaa.ChainID) (uint64, error) {
+	p.calls++
+	return p.head, p.err
+}
+
+func TestCheckBlockDepth(t *testing.T) {
+	permsForUser := &permissionEntry{userName: "Test User", maxBlockDepth: 100}
+	blockHash := "0x" + strings.Repeat("ab", 32)
+
+	// Without a limit, the head block is never needed.
+	status, _, err := checkBlockDepth(context.Background(), nil, &permissionEntry{userName: "Test User"}, vaa.ChainIDEthereum, "0x1")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// With a limit but no provider, a block number cannot be checked.
+	status, label, err := checkBlockDepth(context.Background(), nil, permsForUser, vaa.ChainIDEthereum, "0x1")
+	require.ErrorIs(t, err, ErrHeadBlockUnavailable)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "head_block_unavailable", label)
+
+	provider := &fakeHeadBlockProvider{head: 1000}
+
+	tests := []struct {
+		label    string
+		blockIds []string
+		errText  string
+	}{
+		{"block at the maximum depth", []string{"0x384"}, ""},
+		{"block within the maximum depth", []string{"0x3e7"}, ""},
+		{"block at the head", []string{"0x3e8"}, ""},
+		{"block after the head", []string{"0x3e9"}, ""},
+		{"block beyond the maximum depth", []string{"0x383"}, "block not allowed: block 899 is more than 100 blocks behind the head of chain ethereum"},
+		{"any block beyond the maximum depth", []string{"0x3e8", "0x1"}, "block not allowed: block 1 is more than 100 blocks behind the head of chain ethereum"},
+		{"block hash", []string{blockHash}, "block not allowed: block " + blockHash + " is not a block number"},
+		{"block hash with a block number", []string{"0x3e8", blockHash}, "block not allowed: block " + blockHash + " is not a block number"},
+		{"empty block id", []string{""}, "block not allowed: a block number is required to check the maximum block depth on chain ethereum"},
+		{"empty timestamp hints", []string{"", ""}, "block not allowed: a block number is required"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.label, func(t *testing.T) {
+			_, err := validateBlockIds(context.Background(), zap.NewNop(), provider, permsForUser, vaa.ChainIDEthereum, tc.blockIds...)
+			if tc.errText == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.errText)
+				assert.True(t, errors.Is(err, ErrBlockNotAllowed))
+			}
+		})
+	}
+
+	// The head block is looked up once per check, and not at all if a block ID is rejected without it.
+	provider.calls = 0
+	_, _, err = checkBlockDepth(context.Background(), provider, permsForUser, vaa.ChainIDEthereum, "0x3e8", "0x3e7")
+	require.NoError(t, err)
+	assert.Equal(t, 1, provider.calls)
+	status, _, err = checkBlockDepth(context.Background(), provider, permsForUser, vaa.ChainIDEthereum, blockHash)
+	require.ErrorIs(t, err, ErrBlockNotAllowed)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, 1, provider.calls)
+
+	provider.err = errors.New("rpc is down")
+	status, _, err = checkBlockDepth(context.Background(), provider, permsForUser, vaa.ChainIDEthereum, "0x3e8")
+	require.ErrorIs(t, err, ErrHeadBlockUnavailable)
+	assert.ErrorContains(t, err, "rpc is down")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestValidateRequestMaxBlockDepth(t *testing.T) {
+	perms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true, "maxBlockDepth": 100,`, 1))
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	// The test request queries block 0x28d9630.
+	provider := &fakeHeadBlockProvider{head: 0x28d9630 + 100}
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, provider, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	provider.head++
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, provider, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrBlockNotAllowed)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// An old block could otherwise be queried by its hash, or by a timestamp without any block hints.
+	provider.head = 0x28d9630
+	qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest).BlockId = "0x" + strings.Repeat("ab", 32)
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, provider, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrBlockNotAllowed)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	qr.PerChainQueries[0].Query = &query.EthCallByTimestampQueryRequest{
+		TargetTimestamp: 1,
+		CallData:        qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest).CallData,
+	}
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, provider, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrBlockNotAllowed)
+	assert.ErrorContains(t, err, "a block number is required")
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestParseHeadBlockRPCs(t *testing.T) {
+	rpcUrls, err := parseHeadBlockRPCs("2=https://eth.example.com, 4=https://bsc.example.com/?key=secret,")
+	require.NoError(t, err)
+	assert.Equal(t, map[vaa.ChainID]string{vaa.ChainIDEthereum: "https://eth.example.com", vaa.ChainIDBSC: "https://bsc.example.com/?key=secret"}, rpcUrls)
+
+	_, err = parseHeadBlockRPCs("2=https://eth.example.com,https://bsc.example.com/?key=secret")
+	require.EqualError(t, err, "head block rpc entry 2 is invalid, must be chain=url")
+	_, err = parseHeadBlockRPCs("0=https://eth.example.com")
+	require.Error(t, err)
+	_, err = parseHeadBlockRPCs("2=https://eth.example.com,2=https://eth2.example.com")
+	require.EqualError(t, err, "chain 2 has more than one head block rpc")
+}
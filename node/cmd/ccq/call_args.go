@@ -0,0 +1,162 @@
+package ccq
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const abiWordSize = 32
+
+var (
+	// abiArraySuffixRegex matches the array dimensions at the end of a type, such as "[]" or "[2][]".
+	abiArraySuffixRegex = regexp.MustCompile(`(\[[0-9]*\])+$`)
+
+	// abiSizedTypeRegex matches the elementary types that take a size, such as "uint256" or "bytes32".
+	abiSizedTypeRegex = regexp.MustCompile(`^(uint|int|bytes)([0-9]*)$`)
+)
+
+// argLayout describes the ABI encoded arguments of a function, so the length of the call data can be checked against it.
+type argLayout struct {
+	headSize int  // The size in bytes of the fixed part of the encoding. Dynamic arguments take one word for their offset.
+	dynamic  bool // If set, the encoding has a tail after the head, so the head size is only a minimum.
+}
+
+// parseArgLayout returns the argument layout of a canonical function signature, such as "transfer(address,uint256)".
+func parseArgLayout(sig string) (*argLayout, error) {
+	start := strings.Index(sig, "(")
+	if start < 0 || !strings.HasSuffix(sig, ")") {
+		return nil, fmt.Errorf(`invalid function signature "%s"`, sig)
+	}
+	params := sig[start+1 : len(sig)-1]
+	size, err := headSize(params)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid function signature "%s": %w`, sig, err)
+	}
+	_, dynamic, err := tupleLayout(params)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid function signature "%s": %w`, sig, err)
+	}
+	return &argLayout{headSize: size, dynamic: dynamic}, nil
+}
+
+// check returns an error if the length of the arguments in the call data, which excludes the selector, is not consistent with the layout.
+func (layout *argLayout) check(argsLen int) error {
+	if argsLen%abiWordSize != 0 {
+		return fmt.Errorf("call data arguments are %d bytes, which is not a multiple of %d", argsLen, abiWordSize)
+	}
+	if layout.dynamic {
+		if argsLen < layout.headSize {
+			return fmt.Errorf("call data arguments are %d bytes, expected at least %d", argsLen, layout.headSize)
+		}
+	} else if argsLen != layout.headSize {
+		return fmt.Errorf("call data arguments are %d bytes, expected %d", argsLen, layout.headSize)
+	}
+	return nil
+}
+
+// headSize returns the size of the encoding of a comma separated list of types when it appears at the top level, where each dynamic type
+// takes a single word for its offset.
+func headSize(types string) (int, error) {
+	size := 0
+	for _, t := range splitTypes(types) {
+		typeSize, dynamic, err := typeLayout(t)
+		if err != nil {
+			return 0, err
+		}
+		if dynamic {
+			typeSize = abiWordSize
+		}
+		size += typeSize
+	}
+	return size, nil
+}
+
+// tupleLayout returns the encoded size of a tuple with the comma separated list of component types, and whether it is dynamic.
+// The size is only meaningful if the tuple is static.
+func tupleLayout(types string) (int, bool, error) {
+	size := 0
+	for _, t := range splitTypes(types) {
+		typeSize, dynamic, err := typeLayout(t)
+		if err != nil {
+			return 0, false, err
+		}
+		if dynamic {
+			return 0, true, nil
+		}
+		size += typeSize
+	}
+	return size, false, nil
+}
+
+// typeLayout returns the encoded size of a single type, and whether it is dynamic. The size is only meaningful if the type is static.
+func typeLayout(t string) (int, bool, error) {
+	// Handle the array dimensions from the outside in, so "uint256[2][]" is a dynamic array of "uint256[2]".
+	if suffix := abiArraySuffixRegex.FindString(t); suffix != "" {
+		lastDim := strings.LastIndex(t, "[")
+		elemSize, elemDynamic, err := typeLayout(t[:lastDim])
+		if err != nil {
+			return 0, false, err
+		}
+		lenStr := t[lastDim+1 : len(t)-1]
+		if lenStr == "" || elemDynamic {
+			return 0, true, nil
+		}
+		length, err := strconv.Atoi(lenStr)
+		if err != nil || length <= 0 {
+			return 0, false, fmt.Errorf(`invalid array length in type "%s"`, t)
+		}
+		return length * elemSize, false, nil
+	}
+
+	if strings.HasPrefix(t, "(") && strings.HasSuffix(t, ")") {
+		return tupleLayout(t[1 : len(t)-1])
+	}
+
+	switch t {
+	case "address", "bool", "function":
+		return abiWordSize, false, nil
+	case "bytes", "string":
+		return 0, true, nil
+	}
+
+	if match := abiSizedTypeRegex.FindStringSubmatch(t); match != nil {
+		bits, err := strconv.Atoi(match[2])
+		if match[2] == "" && match[1] != "bytes" {
+			// "uint" and "int" are aliases for the 256 bit versions.
+			return abiWordSize, false, nil
+		}
+		if err == nil && match[1] == "bytes" && bits >= 1 && bits <= abiWordSize {
+			return abiWordSize, false, nil
+		}
+		if err == nil && match[1] != "bytes" && bits >= 8 && bits <= 256 && bits%8 == 0 {
+			return abiWordSize, false, nil
+		}
+	}
+
+	return 0, false, fmt.Errorf(`unsupported type "%s"`, t)
+}
+
+// splitTypes splits a comma separated list of types, ignoring the commas inside tuples.
+func splitTypes(types string) []string {
+	if types == "" {
+		return nil
+	}
+	var ret []string
+	depth, start := 0, 0
+	for idx, c := range types {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				ret = append(ret, types[start:idx])
+				start = idx + 1
+			}
+		}
+	}
+	return append(ret, types[start:])
+}
@@ -0,0 +1,59 @@
+package ccq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArgLayout(t *testing.T) {
+	tests := []struct {
+		sig      string
+		headSize int
+		dynamic  bool
+	}{
+		{"name()", 0, false},
+		{"balanceOf(address)", 32, false},
+		{"allowance(address,address)", 64, false},
+		{"f(uint8,int,bytes4,bool)", 128, false},
+		{"f(uint256[3])", 96, false},
+		{"f(uint256[2][3])", 192, false},
+		{"f((address,uint256),bool)", 96, false},
+		{"f(string)", 32, true},
+		{"f(address,bytes)", 64, true},
+		{"f(uint256[])", 32, true},
+		{"f(string[2])", 32, true},
+		{"aggregate((address,bytes)[])", 32, true},
+		{"f((address,bytes),uint256)", 64, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.sig, func(t *testing.T) {
+			layout, err := parseArgLayout(tc.sig)
+			require.NoError(t, err)
+			assert.Equal(t, tc.headSize, layout.headSize)
+			assert.Equal(t, tc.dynamic, layout.dynamic)
+		})
+	}
+}
+
+func TestParseArgLayoutInvalid(t *testing.T) {
+	for _, sig := range []string{"f(uint7)", "f(bytes33)", "f(foo)", "f(uint256[0])", "f(address,)"} {
+		_, err := parseArgLayout(sig)
+		assert.Error(t, err, sig)
+	}
+}
+
+func TestArgLayoutCheck(t *testing.T) {
+	static := &argLayout{headSize: 64}
+	assert.NoError(t, static.check(64))
+	assert.EqualError(t, static.check(32), "call data arguments are 32 bytes, expected 64")
+	assert.EqualError(t, static.check(96), "call data arguments are 96 bytes, expected 64")
+	assert.EqualError(t, static.check(65), "call data arguments are 65 bytes, which is not a multiple of 32")
+
+	dynamic := &argLayout{headSize: 64, dynamic: true}
+	assert.NoError(t, dynamic.check(64))
+	assert.NoError(t, dynamic.check(160))
+	assert.EqualError(t, dynamic.check(32), "call data arguments are 32 bytes, expected at least 64")
+}
@@ -0,0 +1,224 @@
+package ccq
+
+import (
+	"encoding/hex"
+	"iter"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+)
+
+// The call types that are stored as an ethCallKey. Zero is not used.
+const (
+	ethCallTypeEthCall uint8 = iota + 1
+	ethCallTypeByTimestamp
+	ethCallTypeWithFinality
+)
+
+// ethCallTypes are the call tags of the ethCallKey call types, indexed by the call type.
+var ethCallTypes = [...]string{"", "ethCall", "ethCallByTimestamp", "ethCallWithFinality"}
+
+// ethCallKey is the compact form of an eth call permission key, such as "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03".
+// It is a fixed size and contains no pointers, so it takes much less memory than the formatted key, and can be built for a lookup without
+// formatting a string.
+type ethCallKey struct {
+	callType    uint8 // The index in ethCallTypes.
+	anyContract bool  // The contract address is a wild card.
+	anyCall     bool  // The call is a wild card.
+	chain       vaa.ChainID
+	contract    vaa.Address
+	selector    [ETH_CALL_SIG_LENGTH]byte
+}
+
+// newEthCallKey returns the key of an eth call, taking the selector from the start of the call data, which must be at least four bytes.
+func newEthCallKey(callTag string, chainId vaa.ChainID, contractAddress vaa.Address, data []byte) ethCallKey {
+	k := ethCallKey{callType: ethCallType(callTag), chain: chainId, contract: contractAddress}
+	copy(k.selector[:], data)
+	return k
+}
+
+// ethCallType returns the index of the call type in ethCallTypes, or zero if it is not stored as an ethCallKey.
+func ethCallType(callTag string) uint8 {
+	for i, callType := range ethCallTypes[1:] {
+		if callType == callTag {
+			return uint8(i + 1)
+		}
+	}
+	return 0
+}
+
+// String returns the formatted permission key.
+func (k ethCallKey) String() string {
+	contract, call := "*", "*"
+	if !k.anyContract {
+		contract = k.contract.String()
+	}
+	if !k.anyCall {
+		call = hex.EncodeToString(k.selector[:])
+	}
+	return ethCallTypes[k.callType] + ":" + strconv.FormatUint(uint64(k.chain), 10) + ":" + contract + ":" + call
+}
+
+// parseEthCallKey returns the compact form of a permission key. It returns false if the key is not for an eth call, or is not exactly how
+// parseConfig formats the keys, in which case it must be stored as a string so that only the same string matches it. It does not allocate.
+func parseEthCallKey(callKey string) (ethCallKey, bool) {
+	callTag, rest, _ := strings.Cut(callKey, ":")
+	chainStr, rest, _ := strings.Cut(rest, ":")
+	contract, call, found := strings.Cut(rest, ":")
+	k := ethCallKey{callType: ethCallType(callTag)}
+	if !found || k.callType == 0 || (len(chainStr) > 1 && chainStr[0] == '0') {
+		return ethCallKey{}, false
+	}
+	chain, err := strconv.ParseUint(chainStr, 10, 16)
+	if err != nil {
+		return ethCallKey{}, false
+	}
+	k.chain = vaa.ChainID(chain)
+	if contract == "*" {
+		k.anyContract = true
+	} else if !decodeLowerHex(k.contract[:], contract) {
+		return ethCallKey{}, false
+	}
+	if call == "*" {
+		k.anyCall = true
+	} else if !decodeLowerHex(k.selector[:], call) {
+		return ethCallKey{}, false
+	}
+	return k, true
+}
+
+// decodeLowerHex decodes the string into dst, and returns false unless it is exactly long enough and only contains lower case hex digits.
+func decodeLowerHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) {
+		return false
+	}
+	for i := range s {
+		var nibble byte
+		switch c := s[i]; {
+		case '0' <= c && c <= '9':
+			nibble = c - '0'
+		case 'a' <= c && c <= 'f':
+			nibble = c - 'a' + 10
+		default:
+			return false
+		}
+		dst[i/2] = dst[i/2]<<4 | nibble
+	}
+	return true
+}
+
+// allowedCallsForUser holds the allowed or denied calls of a user by permission key. The eth calls, which make up most of a large config,
+// are stored by their compact key, and everything else, such as Solana calls, by the formatted key. The zero value is empty
+// and ready to use.
+type allowedCallsForUser struct {
+	ethCalls map[ethCallKey]allowedCallOptions
+	others   map[string]allowedCallOptions
+}
+
+// get returns the options for a permission key, and false if there is no entry for it. Wild cards are not expanded.
+func (calls allowedCallsForUser) get(callKey string) (allowedCallOptions, bool) {
+	if k, ok := parseEthCallKey(callKey); ok {
+		opts, exists := calls.ethCalls[k]
+		return opts, exists
+	}
+	opts, exists := calls.others[callKey]
+	return opts, exists
+}
+
+// has returns true if there is an entry for the permission key.
+func (calls allowedCallsForUser) has(callKey string) bool {
+	_, exists := calls.get(callKey)
+	return exists
+}
+
+// getEthCall returns the options for an eth call, and false if there is no entry for it.
+func (calls allowedCallsForUser) getEthCall(k ethCallKey) (allowedCallOptions, bool) {
+	opts, exists := calls.ethCalls[k]
+	return opts, exists
+}
+
+// set adds or replaces the entry for a permission key.
+func (calls *allowedCallsForUser) set(callKey string, opts allowedCallOptions) {
+	if k, ok := parseEthCallKey(callKey); ok {
+		if calls.ethCalls == nil {
+			calls.ethCalls = make(map[ethCallKey]allowedCallOptions)
+		}
+		calls.ethCalls[k] = opts
+		return
+	}
+	if calls.others == nil {
+		calls.others = make(map[string]allowedCallOptions)
+	}
+	calls.others[callKey] = opts
+}
+
+// len returns the number of entries.
+func (calls allowedCallsForUser) len() int {
+	return len(calls.ethCalls) + len(calls.others)
+}
+
+// all returns the permission key and options of each entry, in no particular order.
+func (calls allowedCallsForUser) all() iter.Seq2[string, allowedCallOptions] {
+	return func(yield func(string, allowedCallOptions) bool) {
+		for k, opts := range calls.ethCalls {
+			if !yield(k.String(), opts) {
+				return
+			}
+		}
+		for callKey, opts := range calls.others {
+			if !yield(callKey, opts) {
+				return
+			}
+		}
+	}
+}
+
+// keys returns the permission key of each entry, in no particular order.
+func (calls allowedCallsForUser) keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for callKey := range calls.all() {
+			if !yield(callKey) {
+				return
+			}
+		}
+	}
+}
+
+// copyFrom adds the entries of other, replacing any that already exist. The options themselves are not deep copied.
+func (calls *allowedCallsForUser) copyFrom(other allowedCallsForUser) {
+	if len(other.ethCalls) != 0 {
+		if calls.ethCalls == nil {
+			calls.ethCalls = make(map[ethCallKey]allowedCallOptions, len(other.ethCalls))
+		}
+		maps.Copy(calls.ethCalls, other.ethCalls)
+	}
+	if len(other.others) != 0 {
+		if calls.others == nil {
+			calls.others = make(map[string]allowedCallOptions, len(other.others))
+		}
+		maps.Copy(calls.others, other.others)
+	}
+}
+
+// chains returns the set of chains that have at least one entry.
+func (calls allowedCallsForUser) chains() map[vaa.ChainID]struct{} {
+	ret := make(map[vaa.ChainID]struct{})
+	for k := range calls.ethCalls {
+		ret[k.chain] = struct{}{}
+	}
+	// Every key starts with the call type and chain.
+	for callKey := range calls.others {
+		fields := strings.SplitN(callKey, ":", 3)
+		if len(fields) < 2 {
+			continue
+		}
+		chain, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			continue
+		}
+		ret[vaa.ChainID(chain)] = struct{}{}
+	}
+	return ret
+}
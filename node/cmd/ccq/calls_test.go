@@ -0,0 +1,143 @@
+package ccq
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+)
+
+func TestEthCallKeyRoundTrip(t *testing.T) {
+	for _, callKey := range []string{
+		"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03",
+		"ethCallByTimestamp:2:*:06fdde03",
+		"ethCallWithFinality:65000:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:*",
+		"ethCall:0:*:*",
+	} {
+		k, ok := parseEthCallKey(callKey)
+		require.True(t, ok, callKey)
+		assert.Equal(t, callKey, k.String())
+	}
+
+	// Anything that is not exactly how parseConfig formats an eth call key is kept as a string.
+	for _, callKey := range []string{
+		"ethCall:2:000000000000000000000000B4FBF271143F4FBF7B91A5DED31805E42B2208D6:06fdde03",
+		"ethCall:02:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03",
+		"ethCall:2:b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03",
+		"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde0300",
+		"ethCall:2:*:06fdde03:extra",
+		"ethCall:65536:*:06fdde03",
+		"solAccount:1:BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna",
+	} {
+		_, ok := parseEthCallKey(callKey)
+		assert.False(t, ok, callKey)
+	}
+}
+
+func TestAllowedCallsForUser(t *testing.T) {
+	const ethKey = "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03"
+	const upperKey = "ethCall:2:000000000000000000000000B4FBF271143F4FBF7B91A5DED31805E42B2208D6:06fdde03"
+	const solKey = "solAccount:1:BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna"
+
+	var calls allowedCallsForUser
+	assert.Zero(t, calls.len())
+	assert.False(t, calls.has(ethKey))
+	calls.set(ethKey, allowedCallOptions{label: "eth"})
+	calls.set(upperKey, allowedCallOptions{label: "upper"})
+	calls.set(solKey, allowedCallOptions{maxSeeds: 2})
+	assert.Equal(t, 3, calls.len())
+	assert.ElementsMatch(t, []string{ethKey, upperKey, solKey}, slices.Collect(calls.keys()))
+
+	// A key is only matched by the same string, as it was when the keys were stored as strings.
+	opts, exists := calls.get(ethKey)
+	require.True(t, exists)
+	assert.Equal(t, "eth", opts.label)
+	opts, exists = calls.get(upperKey)
+	require.True(t, exists)
+	assert.Equal(t, "upper", opts.label)
+
+	// The compact lookup finds the same entry, and the wild cards are only matched by lookupEthCall.
+	contract, err := vaa.StringToAddress("b4fbf271143f4fbf7b91a5ded31805e42b2208d6")
+	require.NoError(t, err)
+	opts, exists = calls.getEthCall(newEthCallKey("ethCall", vaa.ChainIDEthereum, contract, []byte{0x06, 0xfd, 0xde, 0x03, 0xff}))
+	require.True(t, exists)
+	assert.Equal(t, "eth", opts.label)
+	_, exists = lookupEthCall(calls, newEthCallKey("ethCallWithFinality", vaa.ChainIDEthereum, contract, []byte{0x06, 0xfd, 0xde, 0x03}))
+	assert.True(t, exists)
+	_, exists = lookupEthCall(calls, newEthCallKey("ethCall", vaa.ChainIDEthereum, contract, []byte{0x18, 0x16, 0x0d, 0xdd}))
+	assert.False(t, exists)
+	calls.set("ethCall:2:*:18160ddd", allowedCallOptions{})
+	_, exists = lookupEthCall(calls, newEthCallKey("ethCall", vaa.ChainIDEthereum, contract, []byte{0x18, 0x16, 0x0d, 0xdd}))
+	assert.True(t, exists)
+
+	assert.Equal(t, map[vaa.ChainID]struct{}{vaa.ChainIDSolana: {}, vaa.ChainIDEthereum: {}}, calls.chains())
+
+	var copied allowedCallsForUser
+	copied.copyFrom(calls)
+	copied.set("ethCall:4:*:*", allowedCallOptions{})
+	assert.Equal(t, 5, copied.len())
+	assert.Equal(t, 4, calls.len())
+}
+
+// largeConfig returns a config with a single user that has numCalls allowed eth calls, each on a different contract.
+func largeConfig(numCalls int) []byte {
+	var calls strings.Builder
+	for i := 0; i < numCalls; i++ {
+		if i != 0 {
+			calls.WriteString(",\n")
+		}
+		fmt.Fprintf(&calls, `{ "ethCall": { "chain": 2, "contractAddress": "%040x", "call": "0x06fdde03" } }`, i+1)
+	}
+	return []byte(`{ "permissions": [{ "userName": "Large User", "apiKey": "large_key", "allowUnsigned": true, "allowedCalls": [` + calls.String() + `] }] }`)
+}
+
+// BenchmarkParseLargeConfig reports the memory retained for each allowed call, as well as the cost of parsing.
+func BenchmarkParseLargeConfig(b *testing.B) {
+	const numCalls = 20000
+	config := largeConfig(numCalls)
+	b.ReportAllocs()
+	var retained uint64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		perms, err := parseConfig(config, common.UnsafeDevNet)
+		require.NoError(b, err)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		retained += after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(perms)
+	}
+	b.ReportMetric(float64(retained)/float64(b.N)/numCalls, "retained-B/call")
+}
+
+// BenchmarkValidateRequestLargeConfig measures validating a request against a user with many allowed calls.
+func BenchmarkValidateRequestLargeConfig(b *testing.B) {
+	perms, err := ParsePermissions(largeConfig(20000), common.UnsafeDevNet)
+	require.NoError(b, err)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(b, err)
+	qr := &query.QueryRequest{Nonce: 1}
+	for i := 0; i < 10; i++ {
+		pcq := createEthCallQueryRequest(b, vaa.ChainIDEthereum, fmt.Sprintf("0x%040x", i*1000+1), "0x06fdde03").PerChainQueries[0]
+		qr.PerChainQueries = append(qr.PerChainQueries, pcq)
+	}
+	sqr := createSignedQueryRequest(b, key, qr)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "large_key", sqr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package ccq
+
+import (
+	"github.com/certusone/wormhole/node/pkg/query"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+)
+
+// Cost is an estimate of how expensive a query request is for the guardians to serve, which can be used to prioritize or bill requests.
+type Cost struct {
+	Calls           int     `json:"calls"`           // The number of calls, counted the same way as for the calls per request limit.
+	Chains          int     `json:"chains"`          // The number of distinct chains queried.
+	PerChainQueries int     `json:"perChainQueries"` // The number of per chain queries, which may query the same chain more than once.
+	Weighted        float64 `json:"weighted"`        // The calls weighted by the "chainWeights" in the config. Chains without a weight count one per call.
+}
+
+// EstimateCost tallies the cost of a query request. It only looks at the request, so it has no side effects and does not depend on the user.
+// An error is returned if the request contains an empty per chain query, or a query type that the proxy does not support, since its cost
+// is unknown.
+func (perms *Permissions) EstimateCost(qr *query.QueryRequest) (Cost, error) {
+	var chainWeights map[vaa.ChainID]float64
+	if perms.defaults != nil {
+		chainWeights = perms.defaults.chainWeights
+	}
+
+	cost := Cost{PerChainQueries: len(qr.PerChainQueries)}
+	chains := make(map[vaa.ChainID]struct{})
+	for _, pcq := range qr.PerChainQueries {
+		if isEmptyPerChainQuery(pcq) {
+			return Cost{}, ErrEmptyPerChainQuery
+		}
+
+		var numCalls int
+		switch q := pcq.Query.(type) {
+		case *query.EthCallQueryRequest:
+			numCalls = len(q.CallData)
+		case *query.EthCallByTimestampQueryRequest:
+			numCalls = len(q.CallData)
+		case *query.EthCallWithFinalityQueryRequest:
+			numCalls = len(q.CallData)
+		case *query.SolanaAccountQueryRequest:
+			numCalls = len(q.Accounts)
+		case *query.SolanaPdaQueryRequest:
+			numCalls = len(q.PDAs)
+		default:
+			return Cost{}, ErrUnsupportedQueryType
+		}
+
+		weight, exists := chainWeights[pcq.ChainId]
+		if !exists {
+			weight = 1
+		}
+		cost.Calls += numCalls
+		cost.Weighted += float64(numCalls) * weight
+		chains[pcq.ChainId] = struct{}{}
+	}
+	cost.Chains = len(chains)
+	return cost, nil
+}
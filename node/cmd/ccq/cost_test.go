@@ -0,0 +1,87 @@
+package ccq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	"github.com/gagliardetto/solana-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+)
+
+func TestEstimateCost(t *testing.T) {
+	// Two calls on Ethereum and one on BSC, then a second query against Ethereum and one for two Solana accounts.
+	qr := createMixedQueryRequest(t)
+	qr.PerChainQueries = append(qr.PerChainQueries,
+		createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x313ce567").PerChainQueries[0],
+		&query.PerChainQueryRequest{
+			ChainId: vaa.ChainIDSolana,
+			Query: &query.SolanaAccountQueryRequest{
+				Commitment: "finalized",
+				Accounts: [][query.SolanaPublicKeyLength]byte{
+					solana.MustPublicKeyFromBase58("BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna"),
+					solana.MustPublicKeyFromBase58("Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o"),
+				},
+			},
+		},
+	)
+
+	// Without any weights, every call counts as one.
+	cost, err := createTestPermissions(t, validateRequestTestConfig).EstimateCost(qr)
+	require.NoError(t, err)
+	assert.Equal(t, Cost{Calls: 6, Chains: 3, PerChainQueries: 4, Weighted: 6}, cost)
+
+	perms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"permissions"`, `"chainWeights": [
+    { "chain": 2, "weight": 2.5 },
+    { "chain": 1, "weight": 0.5 }
+  ],
+  "permissions"`, 1))
+	cost, err = perms.EstimateCost(qr)
+	require.NoError(t, err)
+	assert.Equal(t, Cost{Calls: 6, Chains: 3, PerChainQueries: 4, Weighted: 3*2.5 + 1 + 2*0.5}, cost)
+
+	// The weights survive a user being added.
+	perms, err = perms.UpsertUser(User{
+		UserName:     "New User",
+		ApiKey:       "new_key",
+		AllowedCalls: []AllowedCall{{EthCall: &EthCall{Chain: 2, ContractAddress: "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", Call: "totalSupply()"}}},
+	})
+	require.NoError(t, err)
+	cost, err = perms.EstimateCost(qr)
+	require.NoError(t, err)
+	assert.Equal(t, 9.5, cost.Weighted)
+
+	// The cost of an unknown query type, or of a per chain query without a query, cannot be estimated.
+	_, err = perms.EstimateCost(&query.QueryRequest{PerChainQueries: []*query.PerChainQueryRequest{{ChainId: vaa.ChainIDEthereum, Query: unsupportedQuery{}}}})
+	require.ErrorIs(t, err, ErrUnsupportedQueryType)
+	_, err = perms.EstimateCost(&query.QueryRequest{PerChainQueries: []*query.PerChainQueryRequest{{ChainId: vaa.ChainIDEthereum}}})
+	require.ErrorIs(t, err, ErrEmptyPerChainQuery)
+}
+
+// unsupportedQuery is a query type that the proxy does not know about.
+type unsupportedQuery struct {
+	query.ChainSpecificQuery
+}
+
+func TestParseConfigChainWeights(t *testing.T) {
+	withWeights := func(weights string) string {
+		return strings.Replace(validateRequestTestConfig, `"permissions"`, `"chainWeights": `+weights+`, "permissions"`, 1)
+	}
+
+	_, err := parseConfig([]byte(withWeights(`[{ "chain": 0, "weight": 1 }]`)), common.MainNet)
+	require.EqualError(t, err, "invalid chain weight chain 0")
+
+	_, err = parseConfig([]byte(withWeights(`[{ "chain": 2, "weight": -1 }]`)), common.MainNet)
+	require.EqualError(t, err, "invalid weight -1 for chain 2, may not be negative")
+
+	_, err = parseConfig([]byte(withWeights(`[{ "chain": 2, "weight": 1 }, { "chain": 2, "weight": 2 }]`)), common.MainNet)
+	require.EqualError(t, err, "chain 2 has a duplicate chain weight")
+
+	// A weight of zero makes calls on the chain free.
+	_, defaults, err := parseConfigWithDefaults([]byte(withWeights(`[{ "chain": 2, "weight": 0 }]`)), common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	assert.Equal(t, map[vaa.ChainID]float64{vaa.ChainIDEthereum: 0}, defaults.chainWeights)
+}
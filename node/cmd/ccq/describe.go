@@ -0,0 +1,177 @@
+package ccq
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/spf13/cobra"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+)
+
+var (
+	describeEnvStr   *string
+	describePermFile *string
+)
+
+func init() {
+	describeEnvStr = DescribeCmd.Flags().String("env", "", "environment (devnet, testnet, mainnet)")
+	describePermFile = DescribeCmd.Flags().String("permFile", "", "JSON file containing permissions configuration")
+	QueryServerCmd.AddCommand(DescribeCmd)
+}
+
+var DescribeCmd = &cobra.Command{
+	Use:   "describe [API_KEY]",
+	Short: "Print everything an API key is allowed to do, grouped by chain",
+	Run:   runDescribe,
+	Args:  cobra.ExactArgs(1),
+}
+
+// knownSignatures maps the selectors of commonly queried functions to their signatures, so they can be displayed in a readable form.
+var knownSignatures = func() map[string]string {
+	sigs := []string{
+		"name()",
+		"symbol()",
+		"decimals()",
+		"totalSupply()",
+		"balanceOf(address)",
+		"allowance(address,address)",
+		"owner()",
+		"getReserves()",
+		"token0()",
+		"token1()",
+		"latestRoundData()",
+		"latestAnswer()",
+		"aggregate((address,bytes)[])",
+		"aggregate3((address,bool,bytes)[])",
+		"tryAggregate(bool,(address,bytes)[])",
+		"getBlockNumber()",
+		"getCurrentBlockTimestamp()",
+	}
+	ret := make(map[string]string, len(sigs))
+	for _, sig := range sigs {
+		selector, canonical, err := functionSelector(sig)
+		if err != nil {
+			panic(err)
+		}
+		ret[selector] = canonical
+	}
+	return ret
+}()
+
+func runDescribe(cmd *cobra.Command, args []string) {
+	env, err := common.ParseEnvironment(*describeEnvStr)
+	if err != nil || (env != common.UnsafeDevNet && env != common.TestNet && env != common.MainNet) {
+		if *describeEnvStr == "" {
+			fmt.Println("Please specify --env")
+		} else {
+			fmt.Println("Invalid value for --env, should be devnet, testnet or mainnet")
+		}
+		os.Exit(1)
+	}
+
+	if *describePermFile == "" {
+		fmt.Println("Please specify --permFile")
+		os.Exit(1)
+	}
+
+	perms, err := NewPermissions(*describePermFile, env, DefaultMaxConfigSize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := perms.Describe(os.Stdout, args[0]); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Describe writes a human readable table of everything the API key is allowed to do, grouped by chain. It is read only.
+func (perms *Permissions) Describe(w io.Writer, apiKey string) error {
+	pe, exists := perms.GetUserEntry(strings.ToLower(apiKey))
+	if !exists {
+		return fmt.Errorf("%w with hash %s", ErrInvalidAPIKey, apiKeyHash(strings.ToLower(apiKey)))
+	}
+
+	fmt.Fprintf(w, "User: %s\n", pe.userName)
+	if !pe.expiresAt.IsZero() {
+		fmt.Fprintf(w, "Expires: %s\n", pe.expiresAt.Format(time.RFC3339))
+	}
+	if pe.allowUnsigned {
+		fmt.Fprintln(w, "Unsigned requests are allowed")
+	}
+	if pe.unrestricted {
+		fmt.Fprintln(w, "Unrestricted, any call is allowed on any supported chain")
+	} else if pe.allowAnything {
+		fmt.Fprintln(w, "Any call is allowed on any supported chain")
+	}
+	if len(pe.allowedChains) != 0 {
+		chains := make([]string, 0, len(pe.allowedChains))
+		for _, chainId := range slices.Sorted(maps.Keys(pe.allowedChains)) {
+			chains = append(chains, fmt.Sprintf("%d (%s)", chainId, chainId))
+		}
+		fmt.Fprintf(w, "Allowed chains: %s\n", strings.Join(chains, ", "))
+	}
+
+	// The call keys are "<callType>:<chain>:<contract>:<call>" for eth calls, and "<callType>:<chain>:<account>" for Solana calls.
+	callsByChain := make(map[vaa.ChainID][][]string)
+	for callKey := range pe.allowedCalls.keys() {
+		fields := strings.Split(callKey, ":")
+		chain, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			return fmt.Errorf(`invalid call key "%s": %w`, callKey, err)
+		}
+		callsByChain[vaa.ChainID(chain)] = append(callsByChain[vaa.ChainID(chain)], fields)
+	}
+
+	for _, chainId := range slices.Sorted(maps.Keys(callsByChain)) {
+		calls := callsByChain[chainId]
+		slices.SortFunc(calls, func(a, b []string) int { return strings.Compare(strings.Join(a, ":"), strings.Join(b, ":")) })
+
+		fmt.Fprintf(w, "\nChain %d (%s)\n", chainId, chainId)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  TYPE\tCONTRACT / ACCOUNT\tSELECTOR\tSIGNATURE")
+		for _, fields := range calls {
+			opts, _ := pe.allowedCalls.get(strings.Join(fields, ":"))
+			label := opts.label
+			if len(fields) == 4 {
+				selector, sig := fields[3], knownSignatures[fields[3]]
+				if selector == "*" {
+					sig = "any call"
+				} else {
+					selector = "0x" + selector
+				}
+				if sig == "" {
+					sig = "-"
+				}
+				if label != "" {
+					sig += fmt.Sprintf(" (%s)", label)
+				}
+				// EVM addresses are stored left padded to 32 bytes, so display them in the usual 20 byte form.
+				contract := fields[2]
+				if contract != "*" {
+					contract = "0x" + strings.TrimPrefix(contract, "000000000000000000000000")
+				}
+				fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", fields[0], contract, selector, sig)
+			} else {
+				if label == "" {
+					label = "-"
+				}
+				fmt.Fprintf(tw, "  %s\t%s\t-\t%s\n", fields[0], fields[2], label)
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package ccq
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionsDescribe(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedChains": [2, 1],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Any call on WETH on Goerli",
+            "chain": 4,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "*"
+          }
+        },
+        {
+          "ethCall": {
+            "note:": "Unknown function",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x01020304"
+          }
+        },
+        {
+          "solAccount": {
+            "chain": 1,
+            "account": "Jito4APyf642JPZPx3hGc6WWJ8zPKtRbRs4P815Awbb"
+          }
+        },`, 1)
+	perms := createTestPermissions(t, str)
+
+	var buf bytes.Buffer
+	require.NoError(t, perms.Describe(&buf, "MY_SECRET_KEY"))
+	assert.Equal(t, `User: Test User
+Unsigned requests are allowed
+Allowed chains: 1 (solana), 2 (ethereum)
+
+Chain 1 (solana)
+  TYPE        CONTRACT / ACCOUNT                           SELECTOR  SIGNATURE
+  solAccount  Jito4APyf642JPZPx3hGc6WWJ8zPKtRbRs4P815Awbb  -         -
+
+Chain 2 (ethereum)
+  TYPE     CONTRACT / ACCOUNT                          SELECTOR    SIGNATURE
+  ethCall  0xb4fbf271143f4fbf7b91a5ded31805e42b2208d6  0x01020304  -
+  ethCall  0xb4fbf271143f4fbf7b91a5ded31805e42b2208d6  0x06fdde03  name()
+
+Chain 4 (bsc)
+  TYPE     CONTRACT / ACCOUNT                          SELECTOR  SIGNATURE
+  ethCall  0xb4fbf271143f4fbf7b91a5ded31805e42b2208d6  *         any call
+`, buf.String())
+
+	err := perms.Describe(&buf, "unknown_key")
+	assert.True(t, errors.Is(err, ErrInvalidAPIKey))
+}
+
+func TestPermissionsDescribeLabels(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedCalls": [
+        {
+          "label": "Jito stake pool",
+          "solAccount": {
+            "chain": 1,
+            "account": "Jito4APyf642JPZPx3hGc6WWJ8zPKtRbRs4P815Awbb"
+          }
+        },`, 1)
+	str = strings.Replace(str, `"ethCall": {`, `"label": "WETH",
+          "ethCall": {`, 1)
+	perms := createTestPermissions(t, str)
+
+	var buf bytes.Buffer
+	require.NoError(t, perms.Describe(&buf, "my_secret_key"))
+	assert.Contains(t, buf.String(), "  solAccount  Jito4APyf642JPZPx3hGc6WWJ8zPKtRbRs4P815Awbb  -         Jito stake pool\n")
+	assert.Contains(t, buf.String(), "  ethCall  0xb4fbf271143f4fbf7b91a5ded31805e42b2208d6  0x06fdde03  name() (WETH)\n")
+}
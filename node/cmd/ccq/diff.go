@@ -0,0 +1,231 @@
+package ccq
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/spf13/cobra"
+)
+
+var diffEnvStr *string
+
+func init() {
+	diffEnvStr = DiffCmd.Flags().String("env", "", "environment (devnet, testnet, mainnet)")
+	QueryServerCmd.AddCommand(DiffCmd)
+}
+
+var DiffCmd = &cobra.Command{
+	Use:   "diff [OLD_PERM_FILE] [NEW_PERM_FILE]",
+	Short: "Print the users, calls and user settings that changed between two permissions files",
+	Run:   runDiff,
+	Args:  cobra.ExactArgs(2),
+}
+
+type (
+	// PermissionsDiff describes the changes in capabilities between two sets of permissions. Users are identified by name.
+	PermissionsDiff struct {
+		AddedUsers   []string
+		RemovedUsers []string
+		ChangedUsers []UserDiff // Users that exist in both sets whose allowed calls or settings changed.
+	}
+
+	// UserDiff lists the call keys that were added or removed for a user, and the settings that changed, such as the rate limit.
+	UserDiff struct {
+		UserName        string
+		AddedCalls      []string
+		RemovedCalls    []string
+		ChangedSettings []SettingChange
+	}
+
+	// SettingChange is a user setting that has a different value in the new permissions. The values are rendered as they are printed.
+	SettingChange struct {
+		Name     string
+		OldValue string
+		NewValue string
+	}
+)
+
+func runDiff(cmd *cobra.Command, args []string) {
+	env, err := common.ParseEnvironment(*diffEnvStr)
+	if err != nil || (env != common.UnsafeDevNet && env != common.TestNet && env != common.MainNet) {
+		if *diffEnvStr == "" {
+			fmt.Println("Please specify --env")
+		} else {
+			fmt.Println("Invalid value for --env, should be devnet, testnet or mainnet")
+		}
+		os.Exit(1)
+	}
+
+	oldPerms, err := NewPermissions(args[0], env, DefaultMaxConfigSize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	newPerms, err := NewPermissions(args[1], env, DefaultMaxConfigSize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Print(Diff(oldPerms, newPerms))
+}
+
+// Diff returns the users and allowed calls that are in one set of permissions but not the other, along with the settings that changed for
+// users that are in both, such as "allowAnything", the rate limit, the expiry time, the signers and the allowed chains. Neither input is
+// modified.
+func Diff(oldPerms, newPerms *Permissions) PermissionsDiff {
+	oldUsers := oldPerms.Keys()
+	newUsers := newPerms.Keys()
+	oldEntries := usersByName(oldPerms)
+	newEntries := usersByName(newPerms)
+
+	var diff PermissionsDiff
+	for _, userName := range slices.Sorted(maps.Keys(newUsers)) {
+		oldCalls, exists := oldUsers[userName]
+		if !exists {
+			diff.AddedUsers = append(diff.AddedUsers, userName)
+			continue
+		}
+
+		// The keys are sorted, so they can be searched.
+		newCalls := newUsers[userName]
+		userDiff := UserDiff{UserName: userName}
+		for _, callKey := range newCalls {
+			if _, found := slices.BinarySearch(oldCalls, callKey); !found {
+				userDiff.AddedCalls = append(userDiff.AddedCalls, callKey)
+			}
+		}
+		for _, callKey := range oldCalls {
+			if _, found := slices.BinarySearch(newCalls, callKey); !found {
+				userDiff.RemovedCalls = append(userDiff.RemovedCalls, callKey)
+			}
+		}
+		oldSettings := userSettings(oldEntries[userName])
+		for idx, newSetting := range userSettings(newEntries[userName]) {
+			if oldSettings[idx].value != newSetting.value {
+				userDiff.ChangedSettings = append(userDiff.ChangedSettings, SettingChange{Name: newSetting.name, OldValue: oldSettings[idx].value, NewValue: newSetting.value})
+			}
+		}
+		if len(userDiff.AddedCalls) != 0 || len(userDiff.RemovedCalls) != 0 || len(userDiff.ChangedSettings) != 0 {
+			diff.ChangedUsers = append(diff.ChangedUsers, userDiff)
+		}
+	}
+
+	for _, userName := range slices.Sorted(maps.Keys(oldUsers)) {
+		if _, exists := newUsers[userName]; !exists {
+			diff.RemovedUsers = append(diff.RemovedUsers, userName)
+		}
+	}
+
+	return diff
+}
+
+// userSetting is the name of a user setting and its value, rendered for Diff.
+type userSetting struct {
+	name  string
+	value string
+}
+
+// userSettings returns the settings of a user that affect what it may do, other than the allowed calls, which Diff compares separately.
+// They are always in the same order, so the settings of two users line up.
+func userSettings(pe *permissionEntry) []userSetting {
+	orNone := func(values []string) string {
+		if len(values) == 0 {
+			return "none"
+		}
+		slices.Sort(values)
+		return strings.Join(values, ", ")
+	}
+
+	rateLimit := "none"
+	if pe.rateLimiter != nil {
+		rateLimit = fmt.Sprintf("%g per second, burst %d", float64(pe.rateLimiter.Limit()), pe.rateLimiter.Burst())
+	}
+	expiresAt := "never"
+	if !pe.expiresAt.IsZero() {
+		expiresAt = pe.expiresAt.UTC().Format(time.RFC3339)
+	}
+	signers := make([]string, 0, len(pe.signerAddresses)+1)
+	if pe.signerAddress != nil {
+		signers = append(signers, pe.signerAddress.Hex())
+	}
+	for addr := range pe.signerAddresses {
+		signers = append(signers, addr.Hex())
+	}
+	chains := make([]string, 0, len(pe.allowedChains))
+	for chainId := range pe.allowedChains {
+		chains = append(chains, chainId.String())
+	}
+	cidrs := make([]string, 0, len(pe.allowedCIDRs))
+	for _, ipNet := range pe.allowedCIDRs {
+		cidrs = append(cidrs, ipNet.String())
+	}
+
+	return []userSetting{
+		{"allowAnything", strconv.FormatBool(pe.allowAnything)},
+		{"unrestricted", strconv.FormatBool(pe.unrestricted)},
+		{"allowUnsigned", strconv.FormatBool(pe.allowUnsigned)},
+		{"rateLimit", rateLimit},
+		{"expiresAt", expiresAt},
+		{"signers", orNone(signers)},
+		{"signerThreshold", strconv.Itoa(pe.signerThreshold)},
+		{"allowedChains", orNone(chains)},
+		{"allowedCIDRs", orNone(cidrs)},
+		{"maxCallsPerRequest", strconv.Itoa(pe.maxCalls)},
+		{"maxChainsPerRequest", strconv.Itoa(pe.maxChains)},
+		{"maxConcurrent", strconv.Itoa(pe.maxConcurrent)},
+		{"maxBlockDepth", strconv.FormatUint(pe.maxBlockDepth, 10)},
+		{"maxResponseBytes", strconv.Itoa(pe.maxResponseBytes)},
+		{"deniedCalls", orNone(slices.Collect(pe.deniedCalls.keys()))},
+	}
+}
+
+// usersByName returns the permission entries keyed by user name. Each user appears once, even if they have multiple API keys.
+func usersByName(perms *Permissions) map[string]*permissionEntry {
+	ret := make(map[string]*permissionEntry, len(perms.permMap))
+	for _, pe := range perms.permMap {
+		ret[pe.userName] = pe
+	}
+	return ret
+}
+
+// IsEmpty returns true if there are no differences.
+func (diff PermissionsDiff) IsEmpty() bool {
+	return len(diff.AddedUsers) == 0 && len(diff.RemovedUsers) == 0 && len(diff.ChangedUsers) == 0
+}
+
+// String renders the differences one per line, with "+" for additions and "-" for removals. The calls and settings of a changed user are
+// indented below it.
+func (diff PermissionsDiff) String() string {
+	if diff.IsEmpty() {
+		return "no changes\n"
+	}
+
+	var sb strings.Builder
+	for _, userName := range diff.AddedUsers {
+		fmt.Fprintf(&sb, "+ user \"%s\"\n", userName)
+	}
+	for _, userName := range diff.RemovedUsers {
+		fmt.Fprintf(&sb, "- user \"%s\"\n", userName)
+	}
+	for _, userDiff := range diff.ChangedUsers {
+		fmt.Fprintf(&sb, "~ user \"%s\"\n", userDiff.UserName)
+		for _, callKey := range userDiff.AddedCalls {
+			fmt.Fprintf(&sb, "    + %s\n", callKey)
+		}
+		for _, callKey := range userDiff.RemovedCalls {
+			fmt.Fprintf(&sb, "    - %s\n", callKey)
+		}
+		for _, setting := range userDiff.ChangedSettings {
+			fmt.Fprintf(&sb, "    ~ %s: %s -> %s\n", setting.Name, setting.OldValue, setting.NewValue)
+		}
+	}
+	return sb.String()
+}
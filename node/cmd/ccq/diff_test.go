@@ -0,0 +1,90 @@
+package ccq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const diffTestExtraCall = `"allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Total supply of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x18160ddd"
+          }
+        },`
+
+func TestDiffUnchanged(t *testing.T) {
+	oldPerms := createTestPermissions(t, validateRequestTestConfig)
+	newPerms := createTestPermissions(t, validateRequestTestConfig)
+
+	diff := Diff(oldPerms, newPerms)
+	assert.True(t, diff.IsEmpty())
+	assert.Equal(t, "no changes\n", diff.String())
+}
+
+func TestDiffAddedUser(t *testing.T) {
+	oldPerms := createTestPermissions(t, validateRequestTestConfig)
+	otherUser := createTestPermissions(t, strings.NewReplacer(`"Test User"`, `"Test User2"`, `"my_secret_key"`, `"my_secret_key_2"`).Replace(validateRequestTestConfig))
+	newPerms, err := oldPerms.Merge(otherUser)
+	require.NoError(t, err)
+
+	diff := Diff(oldPerms, newPerms)
+	assert.Equal(t, []string{"Test User2"}, diff.AddedUsers)
+	assert.Empty(t, diff.RemovedUsers)
+	assert.Empty(t, diff.ChangedUsers)
+	assert.Equal(t, "+ user \"Test User2\"\n", diff.String())
+
+	// Going the other way, the user is removed.
+	diff = Diff(newPerms, oldPerms)
+	assert.Empty(t, diff.AddedUsers)
+	assert.Equal(t, []string{"Test User2"}, diff.RemovedUsers)
+	assert.Equal(t, "- user \"Test User2\"\n", diff.String())
+}
+
+func TestDiffRemovedCall(t *testing.T) {
+	oldPerms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, diffTestExtraCall, 1))
+	newPerms := createTestPermissions(t, validateRequestTestConfig)
+
+	diff := Diff(oldPerms, newPerms)
+	assert.Empty(t, diff.AddedUsers)
+	assert.Empty(t, diff.RemovedUsers)
+	require.Equal(t, 1, len(diff.ChangedUsers))
+	assert.Equal(t, "Test User", diff.ChangedUsers[0].UserName)
+	assert.Empty(t, diff.ChangedUsers[0].AddedCalls)
+	assert.Equal(t, []string{"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd"}, diff.ChangedUsers[0].RemovedCalls)
+	assert.Equal(t, "~ user \"Test User\"\n    - ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd\n", diff.String())
+}
+
+func TestDiffChangedSettings(t *testing.T) {
+	oldPerms := createTestPermissions(t, validateRequestTestConfig)
+	newPerms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "maxCallsPerRequest": 5,
+      "rateLimit": 2.5,
+      "burstSize": 3,
+      "expiresAt": "2030-01-01T00:00:00Z",
+      "allowedChains": [2],`, 1))
+
+	diff := Diff(oldPerms, newPerms)
+	assert.Empty(t, diff.AddedUsers)
+	assert.Empty(t, diff.RemovedUsers)
+	require.Equal(t, 1, len(diff.ChangedUsers))
+	assert.Empty(t, diff.ChangedUsers[0].AddedCalls)
+	assert.Empty(t, diff.ChangedUsers[0].RemovedCalls)
+	assert.Equal(t, []SettingChange{
+		{Name: "rateLimit", OldValue: "none", NewValue: "2.5 per second, burst 3"},
+		{Name: "expiresAt", OldValue: "never", NewValue: "2030-01-01T00:00:00Z"},
+		{Name: "allowedChains", OldValue: "none", NewValue: "ethereum"},
+		{Name: "maxCallsPerRequest", OldValue: "0", NewValue: "5"},
+	}, diff.ChangedUsers[0].ChangedSettings)
+	assert.Equal(t, `~ user "Test User"
+    ~ rateLimit: none -> 2.5 per second, burst 3
+    ~ expiresAt: never -> 2030-01-01T00:00:00Z
+    ~ allowedChains: none -> ethereum
+    ~ maxCallsPerRequest: 0 -> 5
+`, diff.String())
+}
@@ -0,0 +1,130 @@
+package ccq
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidAPIKey is returned when the API key is not in the permissions file.
+	ErrInvalidAPIKey = errors.New("invalid api key")
+
+	// ErrAPIKeyExpired is returned when the API key is in the permissions file but its expiry time has passed.
+	ErrAPIKeyExpired = errors.New("api key has expired")
+
+	// ErrSourceNotAllowed is returned when a request comes from a source address that is not allowed for the user.
+	ErrSourceNotAllowed = errors.New("source address not allowed")
+
+	// ErrChainNotAllowed is returned when a request queries a chain that is not in the user's allowed chains.
+	ErrChainNotAllowed = errors.New("chain not allowed")
+
+	// ErrNoPermissionsForChain is returned when a request queries a chain on which the user does not have any allowed calls.
+	ErrNoPermissionsForChain = errors.New("no permissions for chain")
+
+	// ErrSignerThresholdNotMet is returned when a request is not signed by as many of the user's authorized signers as the threshold requires.
+	ErrSignerThresholdNotMet = errors.New("signer threshold not met")
+
+	// ErrBlockNotAllowed is returned when a request queries a block that is not allowed by the user's block restrictions or maximum block depth.
+	ErrBlockNotAllowed = errors.New("block not allowed")
+
+	// ErrHeadBlockUnavailable is returned when the head block of a chain is needed to check a user's maximum block depth but cannot be read.
+	ErrHeadBlockUnavailable = errors.New("head block not available")
+
+	// ErrPermissionsUnavailable is returned when the permissions backend fails to look up an API key, so the request can be neither allowed nor denied.
+	ErrPermissionsUnavailable = errors.New("permissions not available")
+
+	// ErrCallNotAuthorized is matched by a CallNotAuthorizedError.
+	ErrCallNotAuthorized = errors.New("call not authorized")
+
+	// ErrCallRateLimitExceeded is returned when a request contains a call that has exceeded its per-call rate limit.
+	ErrCallRateLimitExceeded = errors.New("call rate limit exceeded")
+
+	// ErrTooManyConcurrent is returned when an API key already has as many requests in flight as the user is allowed.
+	ErrTooManyConcurrent = errors.New("too many concurrent requests")
+
+	// ErrRequestReplayed is returned when replay protection is enabled and an identical request was recently seen from the same API key.
+	ErrRequestReplayed = errors.New("request has already been seen")
+
+	// ErrTooManyCalls is returned when a request contains more calls than the user is allowed in a single request.
+	ErrTooManyCalls = errors.New("too many calls in request")
+
+	// ErrTooManyChains is returned when a request contains more per chain queries than the user is allowed in a single request.
+	ErrTooManyChains = errors.New("too many per chain queries in request")
+
+	// ErrResponseTooLarge is returned when a response is larger than the user is allowed to receive.
+	ErrResponseTooLarge = errors.New("response too large")
+
+	// ErrGuardianSetNotFound is returned when the core contract does not have a guardian set with the requested index.
+	ErrGuardianSetNotFound = errors.New("guardian set not found")
+
+	// ErrGuardianSetExpired is returned when the requested guardian set has expired.
+	ErrGuardianSetExpired = errors.New("guardian set expired")
+
+	// ErrGuardianSetIndexTooOld is returned when a request refers to a guardian set that is older than the lookback allows.
+	ErrGuardianSetIndexTooOld = errors.New("guardian set index is too old")
+
+	// ErrGuardianSetIndexUnknown is returned when a request refers to a guardian set that is newer than the current one.
+	ErrGuardianSetIndexUnknown = errors.New("guardian set index is not known")
+
+	// ErrGuardianSetMismatch is returned by FetchGuardianSetMulti when the endpoints do not agree on the current guardian set.
+	ErrGuardianSetMismatch = errors.New("guardian set mismatch")
+
+	// ErrRPCNotAllowed is returned when an RPC URL is not in the allowlist of the RPCPolicy.
+	ErrRPCNotAllowed = errors.New("rpc url not allowed")
+
+	// ErrInsecureRPC is returned when an RPC URL does not use https or wss and the RPCPolicy requires it.
+	ErrInsecureRPC = errors.New("rpc url is not https or wss")
+
+	// ErrConfigTooLarge is returned when a permissions config is larger than the size limit it is parsed with.
+	ErrConfigTooLarge = errors.New("permissions config is too large")
+
+	// ErrUnsupportedQueryType is returned when a request contains a query type that the proxy does not support.
+	ErrUnsupportedQueryType = errors.New("unsupported query type")
+
+	// ErrEmptyPerChainQuery is returned when a request contains a per chain query that is nil or does not hold a query.
+	ErrEmptyPerChainQuery = errors.New("empty per chain query")
+
+	// ErrMaintenanceMode is returned for every request while "maintenanceMode" is set in the permissions.
+	ErrMaintenanceMode = errors.New("service in maintenance")
+
+	// ErrMalformedRequest is matched by errors caused by a request that could not be parsed or failed validation.
+	ErrMalformedRequest = errors.New("malformed request")
+)
+
+// CallNotAuthorizedError is returned when a request contains a call that the user is not authorized to make.
+type CallNotAuthorizedError struct {
+	// CallKey is the permission key of the call that was denied.
+	CallKey string
+
+	// Reason is an optional explanation for why the call was denied, in the case where the call key itself is allowed.
+	Reason string
+}
+
+func (e *CallNotAuthorizedError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf(`call "%s" not authorized: %s`, e.CallKey, e.Reason)
+	}
+	return fmt.Sprintf(`call "%s" not authorized`, e.CallKey)
+}
+
+// Is allows errors.Is(err, ErrCallNotAuthorized) to match a CallNotAuthorizedError.
+func (e *CallNotAuthorizedError) Is(target error) bool {
+	return target == ErrCallNotAuthorized
+}
+
+// malformedRequestError wraps an error so that it matches ErrMalformedRequest without changing the message.
+type malformedRequestError struct {
+	err error
+}
+
+func newMalformedRequestError(err error) error {
+	return &malformedRequestError{err: err}
+}
+
+func (e *malformedRequestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *malformedRequestError) Unwrap() []error {
+	return []error{ErrMalformedRequest, e.err}
+}
@@ -0,0 +1,124 @@
+package ccq
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	gossipv1 "github.com/certusone/wormhole/node/pkg/proto/gossip/v1"
+	"github.com/certusone/wormhole/node/pkg/query"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/gagliardetto/solana-go"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+)
+
+// fuzzRequestConfig covers each of the call types and the options that change how a request is checked.
+const fuzzRequestConfig = `
+{
+  "permissions": [
+    {
+      "userName": "Unsigned User",
+      "apiKey": "unsigned_key",
+      "allowUnsigned": true,
+      "maxCallsPerRequest": 10,
+      "blockRestrictions": [{ "chain": 2, "minBlockNumber": 100 }],
+      "allowedCalls": [
+        { "ethCall": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "balanceOf(address)" } },
+        { "ethCall": { "chain": 2, "contractAddress": "*", "call": "0x06fdde03" } },
+        { "ethCallByTimestamp": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "*" } },
+        { "ethCallWithFinality": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "0x18160ddd", "allowedFinality": ["safe"] } },
+        { "solAccount": { "chain": 1, "account": "BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna" } },
+        { "solPDA": { "chain": 1, "programAddress": "Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o", "maxSeeds": 2 } }
+      ],
+      "deniedCalls": [
+        { "ethCall": { "chain": 2, "contractAddress": "0000000000000000000000000000000000000001", "call": "0x06fdde03" } }
+      ]
+    },
+    {
+      "userName": "Signed User",
+      "apiKey": "signed_key",
+      "signerAddress": "0x1234567890123456789012345678901234567890",
+      "allowedCalls": [
+        { "ethCall": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "0x06fdde03" } }
+      ]
+    }
+  ]
+}`
+
+// FuzzParsePermissions checks that no config can make the parser panic. Run it with "go test -run '^$' -fuzz FuzzParsePermissions".
+func FuzzParsePermissions(f *testing.F) {
+	for _, seed := range []string{validateRequestTestConfig, fuzzRequestConfig, selfTestConfig, "", "{}", `{"permissions": [{}]}`} {
+		f.Add([]byte(seed))
+	}
+	f.Add([]byte(strings.Replace(validateRequestTestConfig, `"permissions"`, `"strict": true, "callGroups": [{"name": "g"}], "chainWeights": [{"chain": 2, "weight": 1}], "permissions"`, 1)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		perms, err := ParsePermissions(data, common.UnsafeDevNet)
+		if err != nil {
+			return
+		}
+
+		// Anything that parses should be usable.
+		_ = perms.Warnings()
+		_ = Lint(perms, LintSeverityWarning)
+	})
+}
+
+// FuzzValidateRequest checks that no request bytes can make the validation panic or allocate without bound. The pre-flight checks are run
+// on anything that unmarshals, since they walk the same request. Run it with "go test -run '^$' -fuzz FuzzValidateRequest".
+func FuzzValidateRequest(f *testing.F) {
+	perms, err := ParsePermissions([]byte(fuzzRequestConfig), common.UnsafeDevNet)
+	require.NoError(f, err)
+	signerKey, err := ethCrypto.GenerateKey()
+	require.NoError(f, err)
+
+	seeds := []*query.QueryRequest{
+		createMixedQueryRequest(f),
+		createEthCallQueryRequest(f, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x70a08231000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6"),
+		{
+			Nonce: 1,
+			PerChainQueries: []*query.PerChainQueryRequest{
+				{
+					ChainId: vaa.ChainIDSolana,
+					Query: &query.SolanaPdaQueryRequest{
+						Commitment: "finalized",
+						PDAs:       []query.SolanaPDAEntry{{ProgramAddress: solana.MustPublicKeyFromBase58("Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o"), Seeds: [][]byte{{1}}}},
+					},
+				},
+			},
+		},
+	}
+	for _, qr := range seeds {
+		queryRequestBytes, err := qr.Marshal()
+		require.NoError(f, err)
+		f.Add(queryRequestBytes, []byte{}, false, false)
+		f.Add(queryRequestBytes, []byte{}, false, true)
+		f.Add(queryRequestBytes, make([]byte, 65), true, false)
+	}
+
+	audit := func(AuditEvent) {}
+	f.Fuzz(func(t *testing.T, queryRequestBytes []byte, signature []byte, signed bool, reportAll bool) {
+		apiKey := "unsigned_key"
+		if signed {
+			apiKey = "signed_key"
+		}
+		validate := validateRequest
+		if reportAll {
+			validate = validateRequestAll
+		}
+
+		sqr := &gossipv1.SignedQueryRequest{QueryRequest: queryRequestBytes, Signature: signature}
+		_, _, _ = validate(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, signerKey, audit, nil, apiKey, sqr)
+
+		// The pre-flight checks see the same requests, without the signature checks in front of them.
+		var qr query.QueryRequest
+		if err := qr.Unmarshal(queryRequestBytes); err != nil {
+			return
+		}
+		_, _ = perms.Authorize(apiKey, &qr)
+		_, _ = perms.EstimateCost(&qr)
+	})
+}
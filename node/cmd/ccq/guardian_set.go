@@ -0,0 +1,125 @@
+package ccq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"go.uber.org/zap"
+)
+
+// GuardianSetCache caches the current guardian set. If a refresh interval is specified, it periodically refreshes it in the background.
+type GuardianSetCache struct {
+	logger          *zap.Logger
+	refreshInterval time.Duration
+	fetch           func(ctx context.Context) (*common.GuardianSet, error)
+
+	// lock protects the data items below.
+	lock      sync.Mutex
+	gs        *common.GuardianSet
+	fetchedAt time.Time
+}
+
+// NewGuardianSetCache creates a cache that reads the current guardian set from the specified core contract. A refresh interval of zero disables background refreshes.
+// The fetch timeout covers all of the attempts allowed by the retry policy. The RPC URL is checked against the RPC policy on every fetch.
+func NewGuardianSetCache(logger *zap.Logger, rpcUrl string, coreAddr string, refreshInterval time.Duration, fetchTimeout time.Duration, retryPolicy RetryPolicy, rpcPolicy RPCPolicy) *GuardianSetCache {
+	return &GuardianSetCache{
+		logger:          logger.With(zap.String("component", "guardian_set_cache")),
+		refreshInterval: refreshInterval,
+		fetch: func(ctx context.Context) (*common.GuardianSet, error) {
+			return FetchCurrentGuardianSetWithRetries(ctx, rpcUrl, coreAddr, fetchTimeout, retryPolicy, rpcPolicy)
+		},
+	}
+}
+
+// Start starts a go routine to periodically refresh the guardian set. It does nothing if the refresh interval is zero.
+func (c *GuardianSetCache) Start(ctx context.Context, errC chan error) {
+	if c.refreshInterval == 0 {
+		return
+	}
+
+	common.RunWithScissors(ctx, errC, "guardian_set_refresh", func(ctx context.Context) error {
+		ticker := time.NewTicker(c.refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				if err := c.refresh(ctx); err != nil {
+					c.logger.Warn("failed to refresh the guardian set, will continue using the old one", zap.Error(err))
+				}
+			}
+		}
+	})
+}
+
+// Get returns the cached guardian set. It only blocks on a fetch if the cache is empty.
+func (c *GuardianSetCache) Get(ctx context.Context) (*common.GuardianSet, error) {
+	c.lock.Lock()
+	gs := c.gs
+	c.lock.Unlock()
+	if gs != nil {
+		return gs, nil
+	}
+
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.gs, nil
+}
+
+// ReadinessCheck returns nil if a guardian set was obtained recently, which shows that the core contract is reachable. If the cached set is
+// missing, or has not been refreshed in two refresh intervals, it attempts to fetch it.
+func (c *GuardianSetCache) ReadinessCheck(ctx context.Context) error {
+	c.lock.Lock()
+	fresh := c.gs != nil && (c.refreshInterval == 0 || time.Since(c.fetchedAt) <= 2*c.refreshInterval)
+	c.lock.Unlock()
+	if fresh {
+		return nil
+	}
+
+	if err := c.refresh(ctx); err != nil {
+		return fmt.Errorf("failed to obtain the guardian set: %w", err)
+	}
+	return nil
+}
+
+// checkGuardianSetIndex returns an error unless the index is the current guardian set or one of the lookback sets before it. An index after
+// the current one is rejected as well, since the proxy cannot check signatures from a set that it has not seen yet.
+func checkGuardianSetIndex(index uint32, current uint32, lookback uint32) error {
+	if index > current {
+		return fmt.Errorf("%w: guardian set %d is newer than the current guardian set %d", ErrGuardianSetIndexUnknown, index, current)
+	}
+	if current-index > lookback {
+		return fmt.Errorf("%w: guardian set %d is more than %d before the current guardian set %d", ErrGuardianSetIndexTooOld, index, lookback, current)
+	}
+	return nil
+}
+
+// refresh fetches the current guardian set and updates the cache. On failure, the cache is left unchanged.
+func (c *GuardianSetCache) refresh(ctx context.Context) error {
+	gs, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if gs == nil || len(gs.Keys) == 0 {
+		return errors.New("fetched guardian set is empty")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.gs != nil && c.gs.Index != gs.Index {
+		c.logger.Info("guardian set has changed", zap.Uint32("oldIndex", c.gs.Index), zap.Uint32("newIndex", gs.Index))
+	}
+	c.gs = gs
+	c.fetchedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,487 @@
+package ccq
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	ethAbi "github.com/certusone/wormhole/node/pkg/watchers/evm/connectors/ethabi"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	eth_common "github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+)
+
+// mockGuardianSetFetcher returns the configured guardian set, or an error if one is set.
+type mockGuardianSetFetcher struct {
+	lock     sync.Mutex
+	gs       *common.GuardianSet
+	err      error
+	numCalls int
+}
+
+func (m *mockGuardianSetFetcher) fetch(ctx context.Context) (*common.GuardianSet, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.numCalls++
+	if m.err != nil {
+		return nil, m.err
+	}
+	return m.gs, nil
+}
+
+func (m *mockGuardianSetFetcher) set(gs *common.GuardianSet, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.gs = gs
+	m.err = err
+}
+
+func (m *mockGuardianSetFetcher) getNumCalls() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.numCalls
+}
+
+func newTestGuardianSet(index uint32) *common.GuardianSet {
+	return &common.GuardianSet{
+		Keys:  []eth_common.Address{eth_common.HexToAddress("0xbeFA429d57cD18b7F8A4d91A2da9AB4AF05d0FBe")},
+		Index: index,
+	}
+}
+
+func newTestGuardianSetCache(m *mockGuardianSetFetcher, refreshInterval time.Duration) *GuardianSetCache {
+	return &GuardianSetCache{
+		logger:          zap.NewNop(),
+		refreshInterval: refreshInterval,
+		fetch:           m.fetch,
+	}
+}
+
+func TestGuardianSetCacheOnlyFetchesWhenEmpty(t *testing.T) {
+	m := &mockGuardianSetFetcher{gs: newTestGuardianSet(3)}
+	c := newTestGuardianSetCache(m, 0)
+
+	gs, err := c.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), gs.Index)
+
+	gs, err = c.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), gs.Index)
+	assert.Equal(t, 1, m.getNumCalls())
+}
+
+func TestGuardianSetCacheReturnsErrorWhenEmpty(t *testing.T) {
+	m := &mockGuardianSetFetcher{err: errors.New("rpc is down")}
+	c := newTestGuardianSetCache(m, 0)
+
+	_, err := c.Get(context.Background())
+	require.ErrorContains(t, err, "rpc is down")
+}
+
+func TestCheckGuardianSetIndex(t *testing.T) {
+	require.NoError(t, checkGuardianSetIndex(5, 5, 1))
+	require.NoError(t, checkGuardianSetIndex(4, 5, 1))
+	require.NoError(t, checkGuardianSetIndex(0, 1, 1))
+	require.ErrorIs(t, checkGuardianSetIndex(3, 5, 1), ErrGuardianSetIndexTooOld)
+	require.ErrorIs(t, checkGuardianSetIndex(4, 5, 0), ErrGuardianSetIndexTooOld)
+	require.NoError(t, checkGuardianSetIndex(0, 2, 10))
+
+	err := checkGuardianSetIndex(6, 5, 1)
+	require.ErrorIs(t, err, ErrGuardianSetIndexUnknown)
+	assert.EqualError(t, err, "guardian set index is not known: guardian set 6 is newer than the current guardian set 5")
+	assert.EqualError(t, checkGuardianSetIndex(2, 5, 2), "guardian set index is too old: guardian set 2 is more than 2 before the current guardian set 5")
+}
+
+func TestGuardianSetCacheBackgroundRefresh(t *testing.T) {
+	m := &mockGuardianSetFetcher{gs: newTestGuardianSet(3)}
+	c := newTestGuardianSetCache(m, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errC := make(chan error)
+	c.Start(ctx, errC)
+
+	gs, err := c.Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), gs.Index)
+
+	// A failed refresh should keep serving the stale set.
+	m.set(nil, errors.New("rpc is down"))
+	numCalls := m.getNumCalls()
+	require.Eventually(t, func() bool { return m.getNumCalls() > numCalls }, time.Second, time.Millisecond)
+	gs, err = c.Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), gs.Index)
+
+	// A successful refresh should pick up the new set.
+	m.set(newTestGuardianSet(4), nil)
+	require.Eventually(t, func() bool {
+		gs, err := c.Get(ctx)
+		return err == nil && gs.Index == 4
+	}, time.Second, time.Millisecond)
+}
+
+// newMockCoreContractServer creates an http server that responds to eth_call requests for the current guardian set. It also returns
+// the previous index as an expired set with the same keys, and an empty set for any other index. The delay is applied to every request.
+func newMockCoreContractServer(t *testing.T, gs *common.GuardianSet, delay time.Duration) *httptest.Server {
+	t.Helper()
+	coreAbi, err := abi.JSON(strings.NewReader(ethAbi.AbiABI))
+	require.NoError(t, err)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var callArgs struct {
+			Input string `json:"input"`
+			Data  string `json:"data"`
+		}
+		if req.Method != "eth_call" || len(req.Params) == 0 || json.Unmarshal(req.Params[0], &callArgs) != nil {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		input := callArgs.Input
+		if input == "" {
+			input = callArgs.Data
+		}
+		data, err := hex.DecodeString(strings.TrimPrefix(input, "0x"))
+		if err != nil || len(data) < 4 {
+			http.Error(w, "invalid call data", http.StatusBadRequest)
+			return
+		}
+
+		method, err := coreAbi.MethodById(data[:4])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var result []byte
+		switch method.Name {
+		case "getCurrentGuardianSetIndex":
+			result, err = method.Outputs.Pack(gs.Index)
+		case "getGuardianSet":
+			var args []interface{}
+			args, err = method.Inputs.Unpack(data[4:])
+			if err == nil && args[0].(uint32) == gs.Index {
+				result, err = method.Outputs.Pack(ethAbi.StructsGuardianSet{Keys: gs.Keys})
+			} else if err == nil && args[0].(uint32)+1 == gs.Index {
+				result, err = method.Outputs.Pack(ethAbi.StructsGuardianSet{Keys: gs.Keys, ExpirationTime: 1700000000})
+			} else if err == nil {
+				result, err = method.Outputs.Pack(ethAbi.StructsGuardianSet{})
+			}
+		default:
+			err = fmt.Errorf("unexpected method %s", method.Name)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"result":  "0x" + hex.EncodeToString(result),
+		})
+	}))
+}
+
+func TestGuardianSetCacheReadinessCheck(t *testing.T) {
+	m := &mockGuardianSetFetcher{err: errors.New("rpc is down")}
+	c := newTestGuardianSetCache(m, time.Hour)
+
+	err := c.ReadinessCheck(context.Background())
+	require.ErrorContains(t, err, "failed to obtain the guardian set: rpc is down")
+
+	m.set(newTestGuardianSet(3), nil)
+	require.NoError(t, c.ReadinessCheck(context.Background()))
+	numCalls := m.getNumCalls()
+
+	// A recently fetched set does not require another fetch.
+	require.NoError(t, c.ReadinessCheck(context.Background()))
+	assert.Equal(t, numCalls, m.getNumCalls())
+
+	// Once the set is stale, the check fails if it cannot be refreshed.
+	c.lock.Lock()
+	c.fetchedAt = time.Now().Add(-3 * time.Hour)
+	c.lock.Unlock()
+	m.set(nil, errors.New("rpc is down"))
+	require.Error(t, c.ReadinessCheck(context.Background()))
+}
+
+func TestStatusServerReady(t *testing.T) {
+	var readinessErr error
+	s := NewStatusServer("", zap.NewNop(), common.UnsafeDevNet, func(ctx context.Context) error { return readinessErr })
+
+	rec := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	readinessErr = errors.New("failed to obtain the guardian set")
+	rec = httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	readinessErr = nil
+	s.disableHealth()
+	rec = httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestFetchCurrentGuardianSet(t *testing.T) {
+	expected := newTestGuardianSet(4)
+	server := newMockCoreContractServer(t, expected, 0)
+	defer server.Close()
+
+	gs, err := FetchCurrentGuardianSet(server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B")
+	require.NoError(t, err)
+	assert.Equal(t, expected.Index, gs.Index)
+	assert.Equal(t, expected.Keys, gs.Keys)
+}
+
+func TestFetchCurrentGuardianSetWithTimeout(t *testing.T) {
+	server := newMockCoreContractServer(t, newTestGuardianSet(4), 100*time.Millisecond)
+	defer server.Close()
+
+	_, err := FetchCurrentGuardianSetWithTimeout(context.Background(), server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 10*time.Millisecond)
+	require.ErrorContains(t, err, "context deadline exceeded")
+
+	gs, err := FetchCurrentGuardianSetWithTimeout(context.Background(), server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), gs.Index)
+}
+
+func TestFetchGuardianSet(t *testing.T) {
+	expected := newTestGuardianSet(4)
+	server := newMockCoreContractServer(t, expected, 0)
+	defer server.Close()
+
+	gs, expiresAt, err := FetchGuardianSet(server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 4)
+	require.NoError(t, err)
+	assert.Equal(t, expected.Index, gs.Index)
+	assert.Equal(t, expected.Keys, gs.Keys)
+	assert.True(t, expiresAt.IsZero())
+	require.NoError(t, checkGuardianSetExpiry(gs.Index, expiresAt, time.Now()))
+
+	// An expired set is still returned, so that historical sets can be read, and the caller decides whether to use it.
+	gs, expiresAt, err = FetchGuardianSet(server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 3)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), gs.Index)
+	assert.Equal(t, time.Unix(1700000000, 0), expiresAt)
+	err = checkGuardianSetExpiry(gs.Index, expiresAt, time.Now())
+	assert.True(t, errors.Is(err, ErrGuardianSetExpired))
+	assert.EqualError(t, err, "guardian set expired: guardian set 3 expired at 2023-11-14T22:13:20Z")
+	require.NoError(t, checkGuardianSetExpiry(gs.Index, expiresAt, expiresAt.Add(-time.Second)))
+
+	_, _, err = FetchGuardianSet(server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 7)
+	assert.True(t, errors.Is(err, ErrGuardianSetNotFound))
+}
+
+func TestRPCAllowlist(t *testing.T) {
+	server := newMockCoreContractServer(t, newTestGuardianSet(4), 0)
+	defer server.Close()
+	fetch := func(rpcPolicy RPCPolicy) (*common.GuardianSet, error) {
+		return FetchCurrentGuardianSetWithRetries(context.Background(), server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 5*time.Second, DefaultGuardianSetRetryPolicy, rpcPolicy)
+	}
+
+	// The mock server listens on a random port of the loopback address.
+	rpcPolicy, err := NewRPCPolicy([]string{"eth.example.com", "http://127.0.0.1"}, false)
+	require.NoError(t, err)
+	gs, err := fetch(rpcPolicy)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), gs.Index)
+
+	// The scheme must match if it is specified.
+	rpcPolicy, err = NewRPCPolicy([]string{"https://127.0.0.1"}, false)
+	require.NoError(t, err)
+	_, err = fetch(rpcPolicy)
+	require.ErrorIs(t, err, ErrRPCNotAllowed)
+
+	rpcPolicy, err = NewRPCPolicy([]string{"eth.example.com:8545"}, false)
+	require.NoError(t, err)
+	_, err = fetch(rpcPolicy)
+	require.ErrorIs(t, err, ErrRPCNotAllowed)
+	assert.NoError(t, rpcPolicy.Check("https://ETH.example.com:8545/v3/some_api_key"))
+	assert.ErrorIs(t, rpcPolicy.Check("https://eth.example.com:443/v3/some_api_key"), ErrRPCNotAllowed)
+	assert.ErrorIs(t, rpcPolicy.Check("/var/run/geth.ipc"), ErrRPCNotAllowed)
+
+	// The error does not include the path, which may contain an API key.
+	err = rpcPolicy.Check("https://evil.example.com/v3/some_api_key")
+	require.EqualError(t, err, "rpc url not allowed: https://evil.example.com")
+
+	// The policy applies to the guardian set cache and the head block provider too.
+	cache := NewGuardianSetCache(zap.NewNop(), server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 0, 5*time.Second, DefaultGuardianSetRetryPolicy, rpcPolicy)
+	_, err = cache.fetch(context.Background())
+	require.ErrorIs(t, err, ErrRPCNotAllowed)
+	_, err = NewRPCHeadBlockProvider(map[vaa.ChainID]string{vaa.ChainIDEthereum: server.URL}, rpcPolicy)
+	require.ErrorIs(t, err, ErrRPCNotAllowed)
+
+	_, err = NewRPCPolicy([]string{"https://"}, false)
+	require.ErrorContains(t, err, `invalid rpc allowlist entry "https://"`)
+
+	// An empty allowlist, or the zero policy, allows anything.
+	rpcPolicy, err = NewRPCPolicy([]string{""}, false)
+	require.NoError(t, err)
+	assert.NoError(t, rpcPolicy.Check("/var/run/geth.ipc"))
+	assert.NoError(t, RPCPolicy{}.Check("/var/run/geth.ipc"))
+}
+
+func TestRequireSecureRPC(t *testing.T) {
+	server := newMockCoreContractServer(t, newTestGuardianSet(4), 0)
+	defer server.Close()
+	fetch := func(rpcPolicy RPCPolicy) (*common.GuardianSet, error) {
+		return FetchCurrentGuardianSetWithRetries(context.Background(), server.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 5*time.Second, DefaultGuardianSetRetryPolicy, rpcPolicy)
+	}
+
+	// Plain http is allowed by default, for local development.
+	_, err := fetch(RPCPolicy{})
+	require.NoError(t, err)
+
+	// The mock server only speaks http, so it is rejected before dialing.
+	rpcPolicy, err := NewRPCPolicy(nil, true)
+	require.NoError(t, err)
+	_, err = fetch(rpcPolicy)
+	require.ErrorIs(t, err, ErrInsecureRPC)
+	assert.EqualError(t, err, `rpc url is not https or wss: scheme is "http"`)
+
+	for _, rpcUrl := range []string{"https://eth.example.com/v3/some_api_key", "wss://eth.example.com", "HTTPS://eth.example.com"} {
+		assert.NoError(t, rpcPolicy.Check(rpcUrl), rpcUrl)
+	}
+	for _, rpcUrl := range []string{"http://localhost:8545", "ws://eth.example.com", "/var/run/geth.ipc", "eth.example.com"} {
+		assert.ErrorIs(t, rpcPolicy.Check(rpcUrl), ErrInsecureRPC, rpcUrl)
+	}
+
+	// The requirement is checked along with the allowlist.
+	rpcPolicy, err = NewRPCPolicy([]string{"127.0.0.1"}, true)
+	require.NoError(t, err)
+	_, err = fetch(rpcPolicy)
+	require.ErrorIs(t, err, ErrInsecureRPC)
+	assert.ErrorIs(t, rpcPolicy.Check("https://eth.example.com"), ErrRPCNotAllowed)
+}
+
+// newFlakyServer creates an http server that fails the first numFailures requests, and forwards the rest to the target server.
+func newFlakyServer(t *testing.T, target *httptest.Server, numFailures int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	targetUrl, err := url.Parse(target.URL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(targetUrl)
+	numRequests := &atomic.Int32{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(numRequests.Add(1)) <= numFailures {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})), numRequests
+}
+
+func TestFetchCurrentGuardianSetWithRetries(t *testing.T) {
+	server := newMockCoreContractServer(t, newTestGuardianSet(4), 0)
+	defer server.Close()
+	policy := RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	// Two failures on the first call are absorbed by the retries, and the second call succeeds straight away.
+	flaky, numRequests := newFlakyServer(t, server, 2)
+	defer flaky.Close()
+	gs, err := FetchCurrentGuardianSetWithRetries(context.Background(), flaky.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 5*time.Second, policy, RPCPolicy{})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), gs.Index)
+	assert.Equal(t, int32(4), numRequests.Load())
+
+	// If every attempt fails, the error includes the number of attempts and the last error.
+	flaky, numRequests = newFlakyServer(t, server, 100)
+	defer flaky.Close()
+	_, err = FetchCurrentGuardianSetWithRetries(context.Background(), flaky.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 5*time.Second, policy, RPCPolicy{})
+	require.ErrorContains(t, err, "error requesting current guardian set index: failed after 3 attempts: 503 Service Unavailable")
+	assert.Equal(t, int32(3), numRequests.Load())
+
+	// The retries stop at the deadline.
+	policy = RetryPolicy{MaxAttempts: 100, InitialDelay: 20 * time.Millisecond, MaxDelay: 20 * time.Millisecond}
+	start := time.Now()
+	_, err = FetchCurrentGuardianSetWithRetries(context.Background(), flaky.URL, "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B", 100*time.Millisecond, policy, RPCPolicy{})
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestWithRetriesBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, InitialDelay: 10 * time.Millisecond, MaxDelay: 25 * time.Millisecond}
+	var attempts []time.Time
+	_, err := withRetries(context.Background(), policy, func() (int, error) {
+		attempts = append(attempts, time.Now())
+		return 0, errors.New("rpc is down")
+	})
+	require.EqualError(t, err, "failed after 4 attempts: rpc is down")
+	require.Len(t, attempts, 4)
+
+	// The delays are 10ms, 20ms and then capped at 25ms.
+	assert.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), 10*time.Millisecond)
+	assert.GreaterOrEqual(t, attempts[2].Sub(attempts[1]), 20*time.Millisecond)
+	assert.GreaterOrEqual(t, attempts[3].Sub(attempts[2]), 25*time.Millisecond)
+
+	// With no retries, the error is returned as is.
+	_, err = withRetries(context.Background(), RetryPolicy{}, func() (int, error) { return 0, errors.New("rpc is down") })
+	require.EqualError(t, err, "rpc is down")
+}
+
+func TestFetchGuardianSetMulti(t *testing.T) {
+	const coreAddr = "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B"
+	server1 := newMockCoreContractServer(t, newTestGuardianSet(4), 0)
+	defer server1.Close()
+	server2 := newMockCoreContractServer(t, newTestGuardianSet(4), 0)
+	defer server2.Close()
+
+	gs, err := FetchGuardianSetMulti([]GuardianSetEndpoint{{server1.URL, coreAddr}, {server2.URL, coreAddr}})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(4), gs.Index)
+
+	// A lagging endpoint is reported.
+	lagging := newMockCoreContractServer(t, newTestGuardianSet(3), 0)
+	defer lagging.Close()
+	_, err = FetchGuardianSetMulti([]GuardianSetEndpoint{{server1.URL, coreAddr}, {lagging.URL, coreAddr}})
+	require.ErrorIs(t, err, ErrGuardianSetMismatch)
+	assert.ErrorContains(t, err, fmt.Sprintf("%s (%s) returned guardian set 3, but %s (%s) returned guardian set 4", lagging.URL, coreAddr, server1.URL, coreAddr))
+
+	// So is one with different keys for the same index.
+	otherKeys := newTestGuardianSet(4)
+	otherKeys.Keys = []eth_common.Address{eth_common.HexToAddress("0x58CC3AE5C097b213cE3c81979e1B9f9570746AA5")}
+	compromised := newMockCoreContractServer(t, otherKeys, 0)
+	defer compromised.Close()
+	_, err = FetchGuardianSetMulti([]GuardianSetEndpoint{{server1.URL, coreAddr}, {server2.URL, coreAddr}, {compromised.URL, coreAddr}})
+	require.ErrorIs(t, err, ErrGuardianSetMismatch)
+	assert.ErrorContains(t, err, fmt.Sprintf("%s (%s) returned different keys for guardian set 4", compromised.URL, coreAddr))
+
+	_, err = FetchGuardianSetMulti(nil)
+	require.Error(t, err)
+}
+
+func TestGuardianSetEndpointString(t *testing.T) {
+	endpoint := GuardianSetEndpoint{RpcUrl: "https://mainnet.infura.io/v3/some_api_key", CoreAddr: "0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B"}
+	assert.Equal(t, "https://mainnet.infura.io (0x98f3c9e6E3fAce36bAAd05FE09d375Ef1464288B)", endpoint.String())
+}
@@ -1,11 +1,16 @@
 package ccq
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -15,6 +20,8 @@ import (
 	"github.com/certusone/wormhole/node/pkg/query"
 	"github.com/gorilla/mux"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/oklog/ulid"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
@@ -22,8 +29,13 @@ import (
 const MAX_BODY_SIZE = 5 * 1024 * 1024
 
 type queryRequest struct {
-	Bytes     string `json:"bytes"`
-	Signature string `json:"signature"`
+	Bytes        string   `json:"bytes"`
+	Signature    string   `json:"signature"`
+	Cosignatures []string `json:"cosignatures,omitempty"` // Additional signatures, for users that require more than one signer.
+
+	// GuardianSetIndex is the guardian set that the client will verify the response against. If it is set, the request is rejected unless it
+	// is the current guardian set or within the lookback, since the client would not accept the signatures.
+	GuardianSetIndex *uint32 `json:"guardianSetIndex,omitempty"`
 }
 
 type queryResponse struct {
@@ -35,10 +47,27 @@ type httpServer struct {
 	topic            *pubsub.Topic
 	logger           *zap.Logger
 	env              common.Environment
-	permissions      *Permissions
+	permissions      *PermissionsStore
 	signerKey        *ecdsa.PrivateKey
 	pendingResponses *PendingResponses
 	loggingMap       *LoggingMap
+	audit            AuditHook
+	headBlocks       HeadBlockProvider // Nil if no head block RPCs are configured, so "maxBlockDepth" cannot be checked.
+	responseCache    *ResponseCache    // Nil if response caching is disabled.
+	replayGuard      *ReplayGuard      // Nil if replay protection is disabled.
+
+	// shadowPermissions is a candidate config that requests are also evaluated against, without enforcing it. Nil if shadow mode is disabled.
+	// shadowSlots limits how many of those comparisons run at once.
+	shadowPermissions *PermissionsStore
+	shadowSlots       chan struct{}
+
+	// trustForwardedFor means the client IP should be taken from the X-Forwarded-For header, as set by a load balancer.
+	trustForwardedFor bool
+
+	// guardianSets is used to check the guardian set index in a request, which is allowed to be up to guardianSetLookback sets before the
+	// current one. If it is nil, the index is not checked.
+	guardianSets        *GuardianSetCache
+	guardianSetLookback uint32
 }
 
 func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
@@ -48,12 +77,18 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers for the preflight request
 	if r.Method == http.MethodOptions {
 		w.Header().Set("Access-Control-Allow-Methods", "PUT, POST")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Api-Key")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Api-Key, X-Report-All-Errors, X-Request-Id")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	// Every log line for the request includes the trace ID, so that a request can be followed from validation through to the response. It is
+	// returned to the client, which may also supply its own.
+	traceId := requestTraceId(r)
+	w.Header().Set("X-Request-Id", traceId)
+	logger := s.logger.With(zap.String("traceId", traceId))
+
 	start := time.Now()
 	allQueryRequestsReceived.Inc()
 
@@ -63,43 +98,63 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 	var q queryRequest
 	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_BODY_SIZE)).Decode(&q)
 	if err != nil {
-		s.logger.Error("failed to decode body", zap.Error(err))
+		logger.Error("failed to decode body", zap.Error(err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		invalidQueryRequestReceived.WithLabelValues("failed_to_decode_body").Inc()
 		return
 	}
 
-	// There should be one and only one API key in the header.
-	apiKeys, exists := r.Header["X-Api-Key"]
-	if !exists || len(apiKeys) != 1 {
-		s.logger.Error("received a request with the wrong number of api keys", zap.Stringer("url", r.URL), zap.Int("numApiKeys", len(apiKeys)))
-		http.Error(w, "api key is missing", http.StatusUnauthorized)
+	// Use the same version of the permissions for the whole request, even if they get reloaded.
+	permissions := s.permissions.Load()
+
+	// There should be one and only one API key in the header, unless there is an anonymous user, in which case it may be left out.
+	apiKey, status, err := apiKeyFromRequest(r)
+	if err != nil {
+		logger.Error("received a request with the wrong number of api keys", zap.Stringer("url", r.URL), zap.Int("numApiKeys", len(r.Header["X-Api-Key"])))
+		http.Error(w, err.Error(), status)
 		invalidQueryRequestReceived.WithLabelValues("missing_api_key").Inc()
 		return
 	}
-	apiKey := strings.ToLower(apiKeys[0])
 
-	// Make sure the user is authorized before we go any farther.
-	permEntry, exists := s.permissions.GetUserEntry(apiKey)
-	if !exists {
-		s.logger.Error("invalid api key", zap.String("apiKey", apiKey))
-		http.Error(w, "invalid api key", http.StatusForbidden)
-		invalidQueryRequestReceived.WithLabelValues("invalid_api_key").Inc()
+	// Make sure the user is authorized before we go any farther. The user is only looked up once, and the entry is used for the rest of
+	// the request, including the validation.
+	status, permEntry, err := lookupUser(logger, permissions, apiKey)
+	if err != nil {
+		status, err = missingApiKey(r, status, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if slices.Contains(permEntry.apiKeys, anonymousApiKey) {
+		// Anonymous requests share the concurrency limit, response cache and replay protection, however many different keys are presented.
+		apiKey = anonymousApiKey
+	}
+
+	if status, err := validateSource(logger, permEntry, clientIPFromRequest(r, s.trustForwardedFor)); err != nil {
+		http.Error(w, err.Error(), status)
+		invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
 		return
 	}
 
 	if permEntry.rateLimiter != nil && !permEntry.rateLimiter.Allow() {
-		s.logger.Debug("denying request due to rate limit", zap.String("userId", permEntry.userName))
+		logger.Debug("denying request due to rate limit", zap.String("userName", permEntry.userName))
 		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
 		rateLimitExceededByUser.WithLabelValues(permEntry.userName).Inc()
 		return
 	}
 
+	// The slot is held until the response is sent, so it is released by the defer on every path out of here.
+	releaseSlot, status, err := acquireRequestSlot(logger, permEntry, apiKey)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer releaseSlot()
+
 	totalRequestsByUser.WithLabelValues(permEntry.userName).Inc()
 
 	queryRequestBytes, err := hex.DecodeString(q.Bytes)
 	if err != nil {
-		s.logger.Error("failed to decode request bytes", zap.String("userId", permEntry.userName), zap.Error(err))
+		logger.Error("failed to decode request bytes", zap.String("userName", permEntry.userName), zap.Error(err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		invalidQueryRequestReceived.WithLabelValues("failed_to_decode_request").Inc()
 		invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
@@ -108,21 +163,56 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	signature, err := hex.DecodeString(q.Signature)
 	if err != nil {
-		s.logger.Error("failed to decode signature bytes", zap.String("userId", permEntry.userName), zap.Error(err))
+		logger.Error("failed to decode signature bytes", zap.String("userName", permEntry.userName), zap.Error(err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		invalidQueryRequestReceived.WithLabelValues("failed_to_decode_signature").Inc()
 		invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
 		return
 	}
 
+	cosignatures := make([][]byte, 0, len(q.Cosignatures))
+	for _, cosig := range q.Cosignatures {
+		cosignature, err := hex.DecodeString(cosig)
+		if err != nil {
+			logger.Error("failed to decode cosignature bytes", zap.String("userName", permEntry.userName), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			invalidQueryRequestReceived.WithLabelValues("failed_to_decode_signature").Inc()
+			invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
+			return
+		}
+		cosignatures = append(cosignatures, cosignature)
+	}
+
+	if q.GuardianSetIndex != nil && s.guardianSets != nil {
+		if status, err := s.validateGuardianSetIndex(r.Context(), logger, *q.GuardianSetIndex); err != nil {
+			logger.Error("invalid guardian set index", zap.String("userName", permEntry.userName), zap.Uint32("guardianSetIndex", *q.GuardianSetIndex), zap.Error(err))
+			http.Error(w, err.Error(), status)
+			invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
+			return
+		}
+	}
+
 	signedQueryRequest := &gossipv1.SignedQueryRequest{
 		QueryRequest: queryRequestBytes,
 		Signature:    signature,
 	}
 
-	status, queryReq, err := validateRequest(s.logger, s.env, s.permissions, s.signerKey, apiKey, signedQueryRequest)
+	if s.shadowPermissions != nil {
+		s.startShadowComparison(logger, permissions, permEntry.userName, apiKey, queryRequestBytes)
+	}
+
+	// By default, validation stops at the first failure. A client can ask for all of the unauthorized calls to be reported while debugging.
+	reportAll := r.Header.Get("X-Report-All-Errors") == "true"
+	var audit AuditHook
+	if s.audit != nil {
+		audit = func(event AuditEvent) {
+			event.TraceId = traceId
+			s.audit(event)
+		}
+	}
+	status, queryReq, err := validateRequestForEntry(r.Context(), logger, s.env, permEntry, s.signerKey, audit, s.headBlocks, signedQueryRequest, reportAll, cosignatures)
 	if err != nil {
-		s.logger.Error("failed to validate request", zap.String("userId", permEntry.userName), zap.String("requestId", hex.EncodeToString(signedQueryRequest.Signature)), zap.Int("status", status), zap.Error(err))
+		logger.Error("failed to validate request", zap.String("userName", permEntry.userName), zap.String("requestId", hex.EncodeToString(signedQueryRequest.Signature)), zap.Int("status", status), zap.Error(err))
 		http.Error(w, err.Error(), status)
 		// Error specific metric has already been pegged.
 		invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
@@ -130,7 +220,57 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	requestId := hex.EncodeToString(signedQueryRequest.Signature)
-	s.logger.Info("received request from client", zap.String("userId", permEntry.userName), zap.String("requestId", requestId))
+	logger.Info("received request from client", zap.String("userName", permEntry.userName), zap.String("requestId", requestId))
+
+	// If response caching is enabled, an identical request from the same API key that is in flight or recently completed gets the same
+	// response. The request has still been validated above, and the cache only reuses a response made under the same permissions entry,
+	// so a reload or a change to the user is not undone by an older response.
+	var cacheEntry *CachedResponse
+	if s.responseCache != nil {
+		entry, owner := s.responseCache.Start(apiKey, permEntry, queryRequestBytes)
+		if owner {
+			cacheEntry = entry
+			defer s.responseCache.Abort(cacheEntry)
+		} else {
+			resp, truncated, ok := entry.Wait(r.Context())
+			if r.Context().Err() != nil {
+				return
+			}
+			if ok {
+				logger.Info("publishing cached response to client", zap.String("userName", permEntry.userName), zap.String("requestId", requestId))
+				responseCacheHits.Inc()
+				if err := writeQueryResponse(w, resp, truncated); err != nil {
+					logger.Error("failed to encode cached response", zap.String("userName", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
+					failedQueriesByUser.WithLabelValues(permEntry.userName).Inc()
+					return
+				}
+				successfulQueriesByUser.WithLabelValues(permEntry.userName).Inc()
+				return
+			}
+			// The original request failed, so this one is handled from scratch, without caching.
+		}
+	}
+
+	// Replay protection is checked after the response cache, so a retry that can be served from the cache still succeeds. Only requests
+	// that would be sent to the guardians again are rejected.
+	responded := false
+	if s.replayGuard != nil {
+		seenAt := time.Now()
+		if !s.replayGuard.Check(apiKey, queryRequestBytes, seenAt) {
+			logger.Info("replayed request", zap.String("userName", permEntry.userName), zap.String("requestId", requestId))
+			http.Error(w, ErrRequestReplayed.Error(), http.StatusBadRequest)
+			invalidQueryRequestReceived.WithLabelValues("replayed_request").Inc()
+			invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
+			return
+		}
+		// A request that does not get a response may be retried, so it is forgotten on every failure. This runs before the response cache
+		// entry is aborted, so that anyone waiting on the entry can go on to send the request themselves.
+		defer func() {
+			if !responded {
+				s.replayGuard.Forget(apiKey, queryRequestBytes, seenAt)
+			}
+		}()
+	}
 
 	m := gossipv1.GossipMessage{
 		Message: &gossipv1.GossipMessage_SignedQueryRequest{
@@ -140,7 +280,7 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	b, err := proto.Marshal(&m)
 	if err != nil {
-		s.logger.Error("failed to marshal gossip message", zap.String("userId", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
+		logger.Error("failed to marshal gossip message", zap.String("userName", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		invalidQueryRequestReceived.WithLabelValues("failed_to_marshal_gossip_msg").Inc()
 		invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
@@ -150,7 +290,7 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 	pendingResponse := NewPendingResponse(signedQueryRequest, permEntry.userName, queryReq)
 	added := s.pendingResponses.Add(pendingResponse)
 	if !added {
-		s.logger.Info("duplicate request", zap.String("userId", permEntry.userName), zap.String("requestId", requestId))
+		logger.Info("duplicate request", zap.String("userName", permEntry.userName), zap.String("requestId", requestId))
 		http.Error(w, "Duplicate request", http.StatusBadRequest)
 		invalidQueryRequestReceived.WithLabelValues("duplicate_request").Inc()
 		invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
@@ -161,10 +301,14 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 		s.loggingMap.AddRequest(requestId)
 	}
 
-	s.logger.Info("posting request to gossip", zap.String("userId", permEntry.userName), zap.String("requestId", requestId))
-	err = s.topic.Publish(r.Context(), b)
+	// The user's timeout only covers getting the responses from the guardians, not the validation above.
+	ctx, cancel := context.WithTimeout(r.Context(), permEntry.requestTimeout())
+	defer cancel()
+
+	logger.Info("posting request to gossip", zap.String("userName", permEntry.userName), zap.String("requestId", requestId))
+	err = s.topic.Publish(ctx, b)
 	if err != nil {
-		s.logger.Error("failed to publish gossip message", zap.String("userId", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
+		logger.Error("failed to publish gossip message", zap.String("userName", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		invalidQueryRequestReceived.WithLabelValues("failed_to_publish_gossip_msg").Inc()
 		invalidRequestsByUser.WithLabelValues(permEntry.userName).Inc()
@@ -174,10 +318,17 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	// Wait for the response or timeout
 	select {
-	case <-time.After(query.RequestTimeout + 5*time.Second):
+	case <-ctx.Done():
+		if r.Context().Err() != nil {
+			// The client has gone away, so there is no one to respond to.
+			logger.Info("client canceled request", zap.String("userName", permEntry.userName), zap.String("requestId", requestId))
+			failedQueriesByUser.WithLabelValues(permEntry.userName).Inc()
+			observeQueryResult(queryReq, permEntry.userName, queryResultCanceled, start)
+			break
+		}
 		maxMatchingResponses, outstandingResponses, quorum := pendingResponse.getStats()
-		s.logger.Info("publishing time out to client",
-			zap.String("userId", permEntry.userName),
+		logger.Info("publishing time out to client",
+			zap.String("userName", permEntry.userName),
 			zap.String("requestId", requestId),
 			zap.Int("maxMatchingResponses", maxMatchingResponses),
 			zap.Int("outstandingResponses", outstandingResponses),
@@ -186,43 +337,63 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Timed out waiting for response", http.StatusGatewayTimeout)
 		queryTimeoutsByUser.WithLabelValues(permEntry.userName).Inc()
 		failedQueriesByUser.WithLabelValues(permEntry.userName).Inc()
+		observeQueryResult(queryReq, permEntry.userName, queryResultTimedOut, start)
 	case res := <-pendingResponse.ch:
-		s.logger.Info("publishing response to client", zap.String("userId", permEntry.userName), zap.String("requestId", requestId))
+		// The response is counted as received even if it cannot be relayed, since that is not the fault of the guardians.
+		observeQueryResult(queryReq, permEntry.userName, queryResultResponse, start)
+		logger.Info("publishing response to client", zap.String("userName", permEntry.userName), zap.String("requestId", requestId))
 		resBytes, err := res.Response.Marshal()
 		if err != nil {
-			s.logger.Error("failed to marshal response", zap.String("userId", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
+			logger.Error("failed to marshal response", zap.String("userName", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			invalidQueryRequestReceived.WithLabelValues("failed_to_marshal_response").Inc()
 			failedQueriesByUser.WithLabelValues(permEntry.userName).Inc()
 			break
 		}
+		resBytes, truncated, status, err := checkResponseSize(logger, permEntry, resBytes)
+		if err != nil {
+			logger.Info("rejecting response", zap.String("userName", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
+			http.Error(w, err.Error(), status)
+			failedQueriesByUser.WithLabelValues(permEntry.userName).Inc()
+			break
+		}
 		// Signature indices must be ascending for on-chain verification
 		sort.Slice(res.Signatures, func(i, j int) bool {
 			return res.Signatures[i].Index < res.Signatures[j].Index
 		})
-		signatures := make([]string, 0, len(res.Signatures))
-		for _, s := range res.Signatures {
+		resSignatures := res.Signatures
+		if truncated {
+			// The signatures cover the full response, so they would not verify against the truncated one.
+			resSignatures = nil
+		}
+		signatures := make([]string, 0, len(resSignatures))
+		for _, s := range resSignatures {
 			// ECDSA signature + a byte for the index of the guardian in the guardian set
 			signature := fmt.Sprintf("%s%02x", s.Signature, uint8(s.Index))
 			signatures = append(signatures, signature)
 		}
-		w.Header().Add("Content-Type", "application/json")
-		err = json.NewEncoder(w).Encode(&queryResponse{
+		resp := &queryResponse{
 			Signatures: signatures,
 			Bytes:      hex.EncodeToString(resBytes),
-		})
+		}
+		err = writeQueryResponse(w, resp, truncated)
 		if err != nil {
-			s.logger.Error("failed to encode response", zap.String("userId", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
+			logger.Error("failed to encode response", zap.String("userName", permEntry.userName), zap.String("requestId", requestId), zap.Error(err))
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			invalidQueryRequestReceived.WithLabelValues("failed_to_encode_response").Inc()
 			failedQueriesByUser.WithLabelValues(permEntry.userName).Inc()
 			break
 		}
+		if cacheEntry != nil {
+			s.responseCache.Complete(cacheEntry, resp, truncated)
+		}
+		responded = true
 		successfulQueriesByUser.WithLabelValues(permEntry.userName).Inc()
 	case errEntry := <-pendingResponse.errCh:
-		s.logger.Info("publishing error response to client", zap.String("userId", permEntry.userName), zap.String("requestId", requestId), zap.Int("status", errEntry.status), zap.Error(errEntry.err))
+		logger.Info("publishing error response to client", zap.String("userName", permEntry.userName), zap.String("requestId", requestId), zap.Int("status", errEntry.status), zap.Error(errEntry.err))
 		http.Error(w, errEntry.err.Error(), errEntry.status)
 		// Metrics have already been pegged.
+		observeQueryResult(queryReq, permEntry.userName, queryResultGuardianError, start)
 		break
 	}
 
@@ -231,18 +402,118 @@ func (s *httpServer) handleQuery(w http.ResponseWriter, r *http.Request) {
 	s.pendingResponses.Remove(pendingResponse)
 }
 
-func NewHTTPServer(addr string, t *pubsub.Topic, permissions *Permissions, signerKey *ecdsa.PrivateKey, p *PendingResponses, logger *zap.Logger, env common.Environment, loggingMap *LoggingMap) *http.Server {
+// traceIdRegex matches the trace IDs that a client may supply. They are limited to characters that are safe to log and return in a header.
+var traceIdRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// requestTraceId returns the trace ID for a request. This is the X-Request-Id header if the client set a valid one, otherwise a new ULID,
+// which is cheap to generate and sorts by time.
+func requestTraceId(r *http.Request) string {
+	if traceId := r.Header.Get("X-Request-Id"); traceIdRegex.MatchString(traceId) {
+		return traceId
+	}
+	return ulid.MustNew(ulid.Timestamp(time.Now()), rand.Reader).String()
+}
+
+// errApiKeyMissing is returned for a request without exactly one API key, unless there is an anonymous user to fall back on.
+var errApiKeyMissing = errors.New("api key is missing")
+
+// apiKeyFromRequest returns the API key from the request header in lower case. A request without the header gets the anonymous API key,
+// which is only accepted if there is an anonymous user, as checked by missingApiKey. A request with more than one API key is rejected.
+func apiKeyFromRequest(r *http.Request) (string, int, error) {
+	apiKeys, exists := r.Header["X-Api-Key"]
+	if !exists {
+		return anonymousApiKey, http.StatusOK, nil
+	}
+	if len(apiKeys) != 1 {
+		return "", http.StatusUnauthorized, errApiKeyMissing
+	}
+	return strings.ToLower(apiKeys[0]), http.StatusOK, nil
+}
+
+// missingApiKey replaces the error from looking up the user for a request without an API key, if there is no anonymous user for it to
+// fall back on, so that the client is told the key is missing rather than invalid.
+func missingApiKey(r *http.Request, status int, err error) (int, error) {
+	if _, exists := r.Header["X-Api-Key"]; !exists && errors.Is(err, ErrInvalidAPIKey) {
+		return http.StatusUnauthorized, errApiKeyMissing
+	}
+	return status, err
+}
+
+// The results of a query sent to the guardians, as used in the result label of queryResultsByChain.
+const (
+	queryResultResponse      = "response"
+	queryResultTimedOut      = "timed_out"
+	queryResultGuardianError = "guardian_error"
+	queryResultCanceled      = "canceled"
+)
+
+// observeQueryResult pegs the result of a query sent to the guardians for each chain in the request. A chain queried more than once in the
+// same request is only counted once. The latency is only observed for responses, so that timeouts do not skew it.
+func observeQueryResult(queryReq *query.QueryRequest, userName string, result string, start time.Time) {
+	elapsed := float64(time.Since(start).Milliseconds())
+	chains := make(map[vaa.ChainID]struct{}, len(queryReq.PerChainQueries))
+	for _, pcq := range queryReq.PerChainQueries {
+		if _, exists := chains[pcq.ChainId]; exists {
+			continue
+		}
+		chains[pcq.ChainId] = struct{}{}
+		queryResultsByChain.WithLabelValues(pcq.ChainId.String(), userName, result).Inc()
+		if result == queryResultResponse {
+			queryTimeByChain.WithLabelValues(pcq.ChainId.String()).Observe(elapsed)
+		}
+	}
+}
+
+// writeQueryResponse writes a successful response to the client.
+func writeQueryResponse(w http.ResponseWriter, resp *queryResponse, truncated bool) error {
+	if truncated {
+		w.Header().Add("X-Response-Truncated", "true")
+	}
+	w.Header().Add("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// validateGuardianSetIndex checks the guardian set index in a request against the current guardian set. In the case of an error, it returns
+// the HTTP status.
+func (s *httpServer) validateGuardianSetIndex(ctx context.Context, logger *zap.Logger, index uint32) (int, error) {
+	gs, err := s.guardianSets.Get(ctx)
+	if err != nil {
+		logger.Error("failed to obtain the guardian set", zap.Error(err))
+		invalidQueryRequestReceived.WithLabelValues("guardian_set_unavailable").Inc()
+		return http.StatusServiceUnavailable, errors.New("failed to obtain the guardian set")
+	}
+	if err := checkGuardianSetIndex(index, gs.Index, s.guardianSetLookback); err != nil {
+		invalidQueryRequestReceived.WithLabelValues("invalid_guardian_set_index").Inc()
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
+
+func NewHTTPServer(addr string, t *pubsub.Topic, permissions *PermissionsStore, signerKey *ecdsa.PrivateKey, p *PendingResponses, logger *zap.Logger, env common.Environment, loggingMap *LoggingMap, audit AuditHook, headBlocks HeadBlockProvider, responseCache *ResponseCache, replayGuard *ReplayGuard, shadowPermissions *PermissionsStore, trustForwardedFor bool, guardianSets *GuardianSetCache, guardianSetLookback uint32) *http.Server {
 	s := &httpServer{
-		topic:            t,
-		permissions:      permissions,
-		signerKey:        signerKey,
-		pendingResponses: p,
-		logger:           logger,
-		env:              env,
-		loggingMap:       loggingMap,
+		topic:             t,
+		permissions:       permissions,
+		signerKey:         signerKey,
+		pendingResponses:  p,
+		logger:            logger,
+		env:               env,
+		loggingMap:        loggingMap,
+		audit:             audit,
+		headBlocks:        headBlocks,
+		responseCache:     responseCache,
+		replayGuard:       replayGuard,
+		shadowPermissions: shadowPermissions,
+		trustForwardedFor: trustForwardedFor,
+
+		guardianSets:        guardianSets,
+		guardianSetLookback: guardianSetLookback,
+	}
+	if shadowPermissions != nil {
+		s.shadowSlots = make(chan struct{}, maxShadowComparisons)
 	}
 	r := mux.NewRouter()
 	r.HandleFunc("/v1/query", s.handleQuery).Methods("PUT", "POST", "OPTIONS")
+	r.HandleFunc("/v1/check", s.handleCheck).Methods("POST", "OPTIONS")
 	return &http.Server{
 		Addr:              addr,
 		Handler:           r,
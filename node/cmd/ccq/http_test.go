@@ -0,0 +1,173 @@
+package ccq
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestObserveQueryResult(t *testing.T) {
+	// Ethereum is queried twice, but the request should only be counted once for it.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	qr.PerChainQueries = append(qr.PerChainQueries,
+		createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd").PerChainQueries[0],
+		createEthCallQueryRequest(t, vaa.ChainIDBSC, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03").PerChainQueries[0],
+	)
+
+	counter := func(chainId vaa.ChainID, result string) float64 {
+		val, err := getCounterValue(queryResultsByChain.WithLabelValues(chainId.String(), "Metrics User", result))
+		require.NoError(t, err)
+		return val
+	}
+	samples := func(chainId vaa.ChainID) uint64 {
+		count, err := getHistogramSampleCount(queryTimeByChain.WithLabelValues(chainId.String()).(prometheus.Histogram))
+		require.NoError(t, err)
+		return count
+	}
+
+	ethResponses, bscResponses, ethTimeouts := counter(vaa.ChainIDEthereum, queryResultResponse), counter(vaa.ChainIDBSC, queryResultResponse), counter(vaa.ChainIDEthereum, queryResultTimedOut)
+	ethSamples := samples(vaa.ChainIDEthereum)
+
+	observeQueryResult(qr, "Metrics User", queryResultResponse, time.Now())
+	assert.Equal(t, ethResponses+1, counter(vaa.ChainIDEthereum, queryResultResponse))
+	assert.Equal(t, bscResponses+1, counter(vaa.ChainIDBSC, queryResultResponse))
+	assert.Equal(t, ethSamples+1, samples(vaa.ChainIDEthereum))
+
+	// The latency of a timeout is not observed.
+	observeQueryResult(&query.QueryRequest{PerChainQueries: qr.PerChainQueries[:1]}, "Metrics User", queryResultTimedOut, time.Now())
+	assert.Equal(t, ethTimeouts+1, counter(vaa.ChainIDEthereum, queryResultTimedOut))
+	assert.Equal(t, ethSamples+1, samples(vaa.ChainIDEthereum))
+}
+
+func TestRequestTraceId(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/v1/query", nil)
+	generated := requestTraceId(r)
+	assert.Len(t, generated, 26)
+	assert.NotEqual(t, generated, requestTraceId(r))
+
+	// A trace ID from the client is used as is, unless it is not safe to log.
+	r.Header.Set("X-Request-Id", "client-trace:1234")
+	assert.Equal(t, "client-trace:1234", requestTraceId(r))
+	r.Header.Set("X-Request-Id", "bad\ntrace")
+	assert.Len(t, requestTraceId(r), 26)
+	r.Header.Set("X-Request-Id", strings.Repeat("a", 65))
+	assert.Len(t, requestTraceId(r), 26)
+}
+
+func TestHandleQueryLogsTraceId(t *testing.T) {
+	observedCore, logs := observer.New(zapcore.InfoLevel)
+	s := &httpServer{
+		logger:      zap.New(observedCore),
+		permissions: NewPermissionsStore(createTestPermissions(t, validateRequestTestConfig), nil),
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/query", strings.NewReader("{}"))
+	r.Header.Set("X-Api-Key", "unknown_key")
+	r.Header.Set("X-Request-Id", "client-trace")
+	w := httptest.NewRecorder()
+	s.handleQuery(w, r)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "client-trace", w.Header().Get("X-Request-Id"))
+	entries := logs.FilterMessage("invalid api key").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "client-trace", entries[0].ContextMap()["traceId"])
+}
+
+func TestHandleQueryGuardianSetIndex(t *testing.T) {
+	m := &mockGuardianSetFetcher{gs: newTestGuardianSet(5)}
+	s := &httpServer{
+		logger:              zap.NewNop(),
+		env:                 common.UnsafeDevNet,
+		permissions:         NewPermissionsStore(createTestPermissions(t, validateRequestTestConfig), nil),
+		guardianSets:        newTestGuardianSetCache(m, 0),
+		guardianSetLookback: 1,
+	}
+	queryRequestBytes, err := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03").Marshal()
+	require.NoError(t, err)
+
+	post := func(guardianSetIndex string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"bytes": "%s"%s}`, hex.EncodeToString(queryRequestBytes), guardianSetIndex)
+		r := httptest.NewRequest(http.MethodPost, "/v1/query", strings.NewReader(body))
+		r.Header.Set("X-Api-Key", "my_secret_key")
+		w := httptest.NewRecorder()
+		s.handleQuery(w, r)
+		return w
+	}
+
+	// The server has no signer key, so a request that gets past the guardian set check is rejected for not being signed.
+	for _, guardianSetIndex := range []string{"", `, "guardianSetIndex": 5`, `, "guardianSetIndex": 4`} {
+		w := post(guardianSetIndex)
+		assert.Equal(t, http.StatusBadRequest, w.Code, guardianSetIndex)
+		assert.Contains(t, w.Body.String(), "request not signed", guardianSetIndex)
+	}
+
+	w := post(`, "guardianSetIndex": 3`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "guardian set index is too old")
+
+	w = post(`, "guardianSetIndex": 6`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "guardian set index is not known")
+
+	// If the guardian set cannot be read, the index cannot be checked.
+	s.guardianSets = newTestGuardianSetCache(&mockGuardianSetFetcher{err: errors.New("rpc is down")}, 0)
+	w = post(`, "guardianSetIndex": 5`)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "failed to obtain the guardian set")
+}
+
+func TestHandleQueryForgetsFailedRequests(t *testing.T) {
+	signerKey, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	replayGuard, err := NewReplayGuard(10, time.Minute)
+	require.NoError(t, err)
+	s := &httpServer{
+		logger:           zap.NewNop(),
+		env:              common.UnsafeDevNet,
+		permissions:      NewPermissionsStore(createTestPermissions(t, validateRequestTestConfig), nil),
+		signerKey:        signerKey,
+		pendingResponses: NewPendingResponses(zap.NewNop()),
+		replayGuard:      replayGuard,
+	}
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	queryRequestBytes, err := qr.Marshal()
+	require.NoError(t, err)
+
+	// The proxy signs the request the same way every time, so an identical pending request makes it fail before it is sent.
+	sqr, err := SignQueryRequest(common.UnsafeDevNet, qr, signerKey)
+	require.NoError(t, err)
+	require.True(t, s.pendingResponses.Add(NewPendingResponse(sqr, "Test User", qr)))
+
+	post := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/query", strings.NewReader(fmt.Sprintf(`{"bytes": "%s"}`, hex.EncodeToString(queryRequestBytes))))
+		r.Header.Set("X-Api-Key", "my_secret_key")
+		w := httptest.NewRecorder()
+		s.handleQuery(w, r)
+		return w
+	}
+
+	// Since the request failed, the retry is not treated as a replay.
+	for range 2 {
+		w := post()
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "Duplicate request")
+	}
+	assert.True(t, replayGuard.Check("my_secret_key", queryRequestBytes, time.Now()))
+}
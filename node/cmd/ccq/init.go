@@ -0,0 +1,64 @@
+package ccq
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	QueryServerCmd.AddCommand(InitCmd)
+}
+
+var InitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Print a starter permissions file, with comments explaining each setting",
+	Run:   runInit,
+	Args:  cobra.NoArgs,
+}
+
+func runInit(cmd *cobra.Command, args []string) {
+	fmt.Print(starterConfig)
+}
+
+// starterConfig is the permissions file printed by init. It has a single user with a single call, and uses the comments that the parser
+// allows to explain each setting. It must parse without errors or warnings, which is checked by the tests.
+const starterConfig = `// A starter permissions file for the query proxy. Comments and trailing commas are allowed.
+// See docs/query_proxy.md for all of the settings.
+{
+  // Whether users with "allowAnything" are accepted. Setting it to true is rejected in mainnet.
+  "allowAnythingSupported": false,
+
+  // The number of requests per second that each user may make, and how many may be made in a burst before the rate applies. This is not
+  // a limit on concurrent requests, which is set per user with "maxConcurrent". Users may override these.
+  "defaultRateLimit": 0.5,
+  "defaultBurstSize": 1,
+
+  "permissions": [
+    {
+      "userName": "Example User",
+
+      // Replace this with a newly generated key, such as a random UUID, and only share it with this user.
+      "apiKey": "insert_generated_api_key_here",
+
+      // Unsigned requests are signed by the proxy using the --signerKey. To require the user to sign their own requests instead,
+      // remove this and set "signerAddress" to the address of their key.
+      "allowUnsigned": true,
+
+      // The user may only make these calls.
+      "allowedCalls": [
+        {
+          "label": "Name of WETH on Ethereum",
+          "ethCall": {
+            // The Wormhole chain ID, where 2 is Ethereum.
+            "chain": 2,
+            "contractAddress": "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2",
+            // The function signature, or its four byte selector, such as "0x06fdde03".
+            "call": "name()",
+          },
+        },
+      ],
+    },
+  ],
+}
+`
@@ -0,0 +1,31 @@
+package ccq
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStarterConfig(t *testing.T) {
+	for _, env := range []common.Environment{common.MainNet, common.TestNet, common.UnsafeDevNet} {
+		perms, err := ParsePermissions([]byte(starterConfig), env)
+		require.NoError(t, err, env)
+		assert.Empty(t, perms.Warnings(), env)
+		assert.Empty(t, Lint(perms, LintSeverityWarning), env)
+	}
+
+	// Every field in the file must be one the config actually has, since a misspelt one would silently be ignored.
+	standardized, err := standardizeJSON([]byte(starterConfig))
+	require.NoError(t, err)
+	decoder := json.NewDecoder(bytes.NewReader(standardized))
+	decoder.DisallowUnknownFields()
+	var config Config
+	require.NoError(t, decoder.Decode(&config))
+	require.Len(t, config.Permissions, 1)
+	require.Len(t, config.Permissions[0].AllowedCalls, 1)
+	assert.NotNil(t, config.Permissions[0].AllowedCalls[0].EthCall)
+}
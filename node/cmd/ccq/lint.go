@@ -0,0 +1,125 @@
+package ccq
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/spf13/cobra"
+)
+
+var (
+	lintEnvStr   *string
+	lintSeverity *string
+)
+
+func init() {
+	lintEnvStr = LintCmd.Flags().String("env", "", "environment (devnet, testnet, mainnet)")
+	lintSeverity = LintCmd.Flags().String("severity", string(LintSeverityWarning), "how to report broad permissions (warning, error)")
+	QueryServerCmd.AddCommand(LintCmd)
+}
+
+var LintCmd = &cobra.Command{
+	Use:   "lint [PERM_FILE]",
+	Short: "Report users in a permissions file whose wild cards or flags allow more than a single call",
+	Run:   runLint,
+	Args:  cobra.ExactArgs(1),
+}
+
+// LintSeverity determines whether lint findings are reported as warnings or errors.
+type LintSeverity string
+
+const (
+	LintSeverityWarning LintSeverity = "warning"
+	LintSeverityError   LintSeverity = "error"
+)
+
+// LintFinding describes a permission that is broader than a single call.
+type LintFinding struct {
+	Severity LintSeverity
+	UserName string
+	CallKey  string // The broad allowed call. Empty if the finding applies to the user as a whole.
+	Message  string
+}
+
+func runLint(cmd *cobra.Command, args []string) {
+	env, err := common.ParseEnvironment(*lintEnvStr)
+	if err != nil || (env != common.UnsafeDevNet && env != common.TestNet && env != common.MainNet) {
+		if *lintEnvStr == "" {
+			fmt.Println("Please specify --env")
+		} else {
+			fmt.Println("Invalid value for --env, should be devnet, testnet or mainnet")
+		}
+		os.Exit(1)
+	}
+
+	severity := LintSeverity(*lintSeverity)
+	if severity != LintSeverityWarning && severity != LintSeverityError {
+		fmt.Println("Invalid value for --severity, should be warning or error")
+		os.Exit(1)
+	}
+
+	perms, err := NewPermissions(args[0], env, DefaultMaxConfigSize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	findings := Lint(perms, severity)
+	for _, finding := range findings {
+		fmt.Println(finding)
+	}
+	if len(findings) != 0 && severity == LintSeverityError {
+		os.Exit(1)
+	}
+	fmt.Printf("found %d broad permissions in \"%s\"\n", len(findings), args[0])
+}
+
+// Lint returns a finding for every user that may make any call, and for every allowed call that uses a wild card contract address or call.
+// The findings are sorted by user name and then call key, and all have the specified severity.
+func Lint(perms *Permissions, severity LintSeverity) []LintFinding {
+	users := usersByName(perms)
+	keys := perms.Keys()
+
+	var findings []LintFinding
+	for _, userName := range slices.Sorted(maps.Keys(users)) {
+		pe := users[userName]
+		if pe.allowAnything {
+			flag := "allowAnything"
+			if pe.unrestricted {
+				flag = "unrestricted"
+			}
+			findings = append(findings, LintFinding{Severity: severity, UserName: userName, Message: fmt.Sprintf(`"%s" allows any call on any chain`, flag)})
+		}
+
+		for _, callKey := range keys[userName] {
+			// Eth call keys are "<callType>:<chain>:<contract>:<call>", and only those support wild cards.
+			fields := strings.Split(callKey, ":")
+			if len(fields) != 4 {
+				continue
+			}
+			var message string
+			switch {
+			case fields[2] == "*":
+				message = fmt.Sprintf("allows call %s on any contract on chain %s", fields[3], fields[1])
+			case fields[3] == "*":
+				message = fmt.Sprintf("allows any call on contract %s on chain %s", fields[2], fields[1])
+			default:
+				continue
+			}
+			findings = append(findings, LintFinding{Severity: severity, UserName: userName, CallKey: callKey, Message: message})
+		}
+	}
+	return findings
+}
+
+// String renders the finding on a single line, naming the user and the broad key, if any.
+func (f LintFinding) String() string {
+	if f.CallKey == "" {
+		return fmt.Sprintf(`%s: user "%s": %s`, f.Severity, f.UserName, f.Message)
+	}
+	return fmt.Sprintf(`%s: user "%s": "%s" %s`, f.Severity, f.UserName, f.CallKey, f.Message)
+}
@@ -0,0 +1,55 @@
+package ccq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLintNoFindings(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	assert.Empty(t, Lint(perms, LintSeverityWarning))
+}
+
+func TestLintWildCards(t *testing.T) {
+	perms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "*",
+            "call": "0x18160ddd"
+          }
+        },
+        {
+          "ethCallByTimestamp": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "*"
+          }
+        },`, 1))
+
+	findings := Lint(perms, LintSeverityError)
+	assert.Equal(t, []LintFinding{
+		{
+			Severity: LintSeverityError,
+			UserName: "Test User",
+			CallKey:  "ethCall:2:*:18160ddd",
+			Message:  "allows call 18160ddd on any contract on chain 2",
+		},
+		{
+			Severity: LintSeverityError,
+			UserName: "Test User",
+			CallKey:  "ethCallByTimestamp:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:*",
+			Message:  "allows any call on contract 000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6 on chain 2",
+		},
+	}, findings)
+	assert.Equal(t, `error: user "Test User": "ethCall:2:*:18160ddd" allows call 18160ddd on any contract on chain 2`, findings[0].String())
+}
+
+func TestLintAllowAnything(t *testing.T) {
+	perms := createTestPermissions(t, strings.NewReplacer(`"permissions"`, `"allowAnythingSupported": true, "permissions"`, `"allowUnsigned": true,`, `"allowUnsigned": true, "allowAnything": true,`, `"allowedCalls"`, `"ignoredCalls"`).Replace(validateRequestTestConfig))
+	findings := Lint(perms, LintSeverityWarning)
+	assert.Len(t, findings, 1)
+	assert.Equal(t, `warning: user "Test User": "allowAnything" allows any call on any chain`, findings[0].String())
+}
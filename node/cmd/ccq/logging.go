@@ -0,0 +1,43 @@
+package ccq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	ipfslog "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap"
+)
+
+// The log formats accepted by NewLogger.
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
+
+// NewLogger sets the level of all loggers in the process, including the libp2p ones, and returns the query server logger. The format is
+// either "console", which leaves the output as configured by the GOLOG environment variables, or "json", which writes JSON to stderr.
+func NewLogger(format string, level string) (*zap.Logger, error) {
+	lvl, err := ipfslog.LevelFromString(level)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid log level "%s"`, level)
+	}
+
+	switch format {
+	case LogFormatConsole:
+	case LogFormatJSON:
+		ipfslog.SetupLogging(ipfslog.Config{Format: ipfslog.JSONOutput, Level: lvl, Stderr: true})
+	default:
+		return nil, fmt.Errorf(`invalid log format "%s", should be "%s" or "%s"`, format, LogFormatConsole, LogFormatJSON)
+	}
+
+	ipfslog.SetAllLoggers(lvl)
+	return ipfslog.Logger("query-server").Desugar(), nil
+}
+
+// apiKeyHash returns a short hash of an API key, so that requests using an unknown key can be correlated in the logs without logging the
+// key itself. Requests using a known key should be logged using the user name instead.
+func apiKeyHash(apiKey string) string {
+	hash := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,109 @@
+package ccq
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestNewLoggerRejectsInvalidSettings(t *testing.T) {
+	_, err := NewLogger("xml", "info")
+	require.EqualError(t, err, `invalid log format "xml", should be "console" or "json"`)
+
+	_, err = NewLogger(LogFormatConsole, "chatty")
+	require.EqualError(t, err, `invalid log level "chatty"`)
+
+	logger, err := NewLogger(LogFormatConsole, "info")
+	require.NoError(t, err)
+	assert.NotNil(t, logger)
+}
+
+func TestApiKeyHash(t *testing.T) {
+	assert.Equal(t, apiKeyHash("my_secret_key"), apiKeyHash("my_secret_key"))
+	assert.NotEqual(t, apiKeyHash("my_secret_key"), apiKeyHash("my_secret_key_2"))
+	assert.Len(t, apiKeyHash("my_secret_key"), 16)
+	assert.NotContains(t, apiKeyHash("my_secret_key"), "my_secret_key")
+}
+
+func TestValidateRequestLogsUseStructuredFields(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	observedCore, observedLogs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(observedCore)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	_, _, err = validateRequest(context.Background(), logger, common.UnsafeDevNet, perms, nil, nil, nil, "my_unknown_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrInvalidAPIKey)
+	_, _, err = validateRequest(context.Background(), logger, common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrCallNotAuthorized)
+
+	// An unknown key is only identified by its hash.
+	entries := observedLogs.FilterMessage("invalid api key").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, apiKeyHash("my_unknown_key"), entries[0].ContextMap()["apiKeyHash"])
+
+	// A known key is identified by the user name.
+	entries = observedLogs.FilterMessage("requested call not authorized").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "Test User", entries[0].ContextMap()["userName"])
+	assert.Equal(t, "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd", entries[0].ContextMap()["callKey"])
+
+	for _, entry := range observedLogs.All() {
+		for name, value := range entry.ContextMap() {
+			assert.NotContains(t, fmt.Sprint(value), "my_unknown_key", "field %s of %q", name, entry.Message)
+			assert.NotContains(t, fmt.Sprint(value), "my_secret_key", "field %s of %q", name, entry.Message)
+		}
+	}
+}
+
+func TestDeniedCallLogLevel(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	observedCore, observedLogs := observer.New(zapcore.InfoLevel)
+	logger := zap.New(observedCore)
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+
+	// By default, denials are logged at debug, so they do not show up at info.
+	_, _, err = validateRequest(context.Background(), logger, common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrCallNotAuthorized)
+	assert.Zero(t, observedLogs.FilterMessage("requested call not authorized").Len())
+
+	// The level is kept by loggers derived from the configured one.
+	warnLogger, err := WithDeniedCallLogLevel(logger, "warn")
+	require.NoError(t, err)
+	_, _, err = validateRequest(context.Background(), warnLogger.With(zap.String("requestId", "1")), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrCallNotAuthorized)
+	entries := observedLogs.FilterMessage("requested call not authorized").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.WarnLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "Test User", fields["userName"])
+	assert.Equal(t, "ethCall", fields["callType"])
+	assert.Equal(t, "2", fields["chain"])
+	assert.Equal(t, "000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6", fields["contract"])
+	assert.Equal(t, "18160ddd", fields["selector"])
+
+	assert.Equal(t, "1", fields["requestId"])
+
+	// Other loggers are not affected.
+	_, _, err = validateRequest(context.Background(), logger, common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrCallNotAuthorized)
+	assert.Equal(t, 1, observedLogs.FilterMessage("requested call not authorized").Len())
+
+	_, err = WithDeniedCallLogLevel(logger, "error")
+	assert.EqualError(t, err, `invalid denied call log level "error", must be "debug", "info" or "warn"`)
+	_, err = WithDeniedCallLogLevel(logger, "loud")
+	assert.Error(t, err)
+}
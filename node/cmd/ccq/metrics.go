@@ -1,6 +1,7 @@
 package ccq
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -51,6 +52,12 @@ var (
 			Help: "Total number of queries rejected due to rate limiting per user name",
 		}, []string{"user_name"})
 
+	tooManyConcurrentByUser = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ccq_server_too_many_concurrent_by_user",
+			Help: "Total number of queries rejected due to the concurrency limit per user name",
+		}, []string{"user_name"})
+
 	failedQueriesByUser = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ccq_server_failed_queries_by_user",
@@ -75,6 +82,18 @@ var (
 			Help: "Total number of invalid requests by user name",
 		}, []string{"user_name"})
 
+	validationResultsByUser = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ccq_server_validation_results_by_user",
+			Help: "Total number of requests allowed or denied by validation by user name",
+		}, []string{"user_name", "result"})
+
+	deniedCallsByUser = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ccq_server_denied_calls_by_user_and_call_type",
+			Help: "Total number of calls denied due to permissions by user name and call type",
+		}, []string{"user_name", "call_type"})
+
 	queryResponsesReceived = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "ccq_server_total_query_responses_received_by_peer_id",
@@ -100,6 +119,38 @@ var (
 			Buckets: []float64{10.0, 100.0, 250.0, 500.0, 1000.0, 5000.0, 10000.0, 30000.0},
 		})
 
+	shadowDiscrepanciesByUser = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ccq_server_shadow_discrepancies_by_user",
+			Help: "Total number of calls that the shadow permissions would decide differently about, by user name and shadow decision",
+		}, []string{"user_name", "shadow_decision"})
+
+	shadowComparisonsSkipped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ccq_server_shadow_comparisons_skipped",
+			Help: "Total number of requests that were not compared against the shadow permissions because too many comparisons were running",
+		})
+
+	queryResultsByChain = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ccq_server_query_results_by_chain_and_user",
+			Help: "Total number of queries sent to the guardians by chain, user name and result (response, timed_out, guardian_error, canceled)",
+		}, []string{"chain_name", "user_name", "result"})
+
+	queryTimeByChain = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ccq_server_query_time_by_chain_in_ms",
+			Help:    "Time from request to response received from the guardians in ms, by chain",
+			Buckets: []float64{10.0, 100.0, 250.0, 500.0, 1000.0, 5000.0, 10000.0, 30000.0},
+		}, []string{"chain_name"})
+
+	requestValidationTime = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ccq_server_request_validation_time_in_us",
+			Help:    "Time to validate a request in microseconds",
+			Buckets: []float64{10.0, 50.0, 100.0, 250.0, 500.0, 1000.0, 5000.0, 10000.0},
+		})
+
 	permissionFileReloadsSuccess = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "ccq_server_perm_file_reload_success",
@@ -112,6 +163,24 @@ var (
 			Help: "Total number of times the permissions file failed to reload",
 		})
 
+	responsesTooLargeByUser = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ccq_server_responses_too_large_by_user",
+			Help: "Total number of responses over the size limit by user name and action taken",
+		}, []string{"user_name", "action"})
+
+	responseCacheHits = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ccq_server_response_cache_hits",
+			Help: "Total number of queries served from the response cache",
+		})
+
+	auditEventsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "ccq_server_audit_events_dropped",
+			Help: "Total number of audit events dropped because the audit log could not keep up",
+		})
+
 	successfulReconnects = promauto.NewCounter(
 		prometheus.CounterOpts{
 			Name: "ccq_server_total_number_of_successful_reconnects",
@@ -131,6 +200,49 @@ var (
 		}, []string{"chain_name"})
 )
 
+// The gauges set by updateConfigMetrics. They are not created by promauto, so that they can be registered with a different registry.
+var (
+	configuredUsersOpts = prometheus.GaugeOpts{
+		Name: "ccq_server_configured_users",
+		Help: "Number of users in the permissions config",
+	}
+	configuredCallsOpts = prometheus.GaugeOpts{
+		Name: "ccq_server_configured_calls",
+		Help: "Number of allowed calls in the permissions config, summed over all of the users",
+	}
+)
+
+// updateConfigMetrics sets the gauges for the number of users and allowed calls in the permissions, so that dashboards show the size of the
+// config and any drift in it. It is called whenever the permissions are loaded or reloaded. The gauges are registered with the registry on
+// first use, and reused after that. Like promauto, it panics if a different metric is already registered under the same name.
+func updateConfigMetrics(reg prometheus.Registerer, perms *Permissions) {
+	users := registerGauge(reg, configuredUsersOpts)
+	calls := registerGauge(reg, configuredCallsOpts)
+
+	byName := usersByName(perms)
+	numCalls := 0
+	for _, pe := range byName {
+		numCalls += pe.allowedCalls.len()
+	}
+	users.Set(float64(len(byName)))
+	calls.Set(float64(numCalls))
+}
+
+// registerGauge registers a gauge, or returns the one that is already registered with the same options.
+func registerGauge(reg prometheus.Registerer, opts prometheus.GaugeOpts) prometheus.Gauge {
+	gauge := prometheus.NewGauge(opts)
+	if err := reg.Register(gauge); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(prometheus.Gauge); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return gauge
+}
+
 // getGaugeValue returns the current value of a metric.
 func getGaugeValue(gauge prometheus.Gauge) (float64, error) {
 	metric := &dto.Metric{}
@@ -139,3 +251,21 @@ func getGaugeValue(gauge prometheus.Gauge) (float64, error) {
 	}
 	return metric.GetGauge().GetValue(), nil
 }
+
+// getCounterValue returns the current value of a counter.
+func getCounterValue(counter prometheus.Counter) (float64, error) {
+	metric := &dto.Metric{}
+	if err := counter.Write(metric); err != nil {
+		return 0, fmt.Errorf("failed to read metric value: %w", err)
+	}
+	return metric.GetCounter().GetValue(), nil
+}
+
+// getHistogramSampleCount returns the number of observations made by a histogram.
+func getHistogramSampleCount(histogram prometheus.Histogram) (uint64, error) {
+	metric := &dto.Metric{}
+	if err := histogram.Write(metric); err != nil {
+		return 0, fmt.Errorf("failed to read metric value: %w", err)
+	}
+	return metric.GetHistogram().GetSampleCount(), nil
+}
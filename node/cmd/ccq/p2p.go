@@ -45,8 +45,7 @@ func runP2P(
 	port uint,
 	networkID string,
 	bootstrapPeers string,
-	ethRpcUrl string,
-	ethCoreAddr string,
+	gsCache *GuardianSetCache,
 	pendingResponses *PendingResponses,
 	logger *zap.Logger,
 	monitorPeers bool,
@@ -145,11 +144,9 @@ func runP2P(
 	}
 
 	// Fetch the initial current guardian set
-	guardianSet, err := FetchCurrentGuardianSet(ethRpcUrl, ethCoreAddr)
-	if err != nil {
+	if _, err := gsCache.Get(ctx); err != nil {
 		logger.Fatal("Failed to fetch current guardian set", zap.Error(err))
 	}
-	quorum := vaa.CalculateQuorum(len(guardianSet.Keys))
 
 	// Listen to the p2p network for query responses
 	go func() {
@@ -218,6 +215,13 @@ func runP2P(
 					continue
 				}
 				signerAddress := ethCommon.BytesToAddress(ethCrypto.Keccak256(signerBytes[1:])[12:])
+				guardianSet, err := gsCache.Get(ctx)
+				if err != nil {
+					logger.Error("failed to get the current guardian set", zap.Error(err))
+					inboundP2pError.WithLabelValues("failed_to_get_guardian_set").Inc()
+					continue
+				}
+				quorum := vaa.CalculateQuorum(len(guardianSet.Keys))
 				keyIdx, hasKeyIdx := guardianSet.KeyIndex(signerAddress)
 
 				if hasKeyIdx {
@@ -251,7 +255,7 @@ func runP2P(
 						case pendingResponse.ch <- s:
 							logger.Info("quorum reached, forwarded query response",
 								zap.String("peerId", peerId),
-								zap.String("userId", pendingResponse.userName),
+								zap.String("userName", pendingResponse.userName),
 								zap.Any("requestId", requestSignature),
 								zap.Int("numSigners", numSigners),
 								zap.Int("quorum", quorum),
@@ -279,7 +283,7 @@ func runP2P(
 							case pendingResponse.errCh <- &ErrorEntry{err: errors.New("quorum not met"), status: http.StatusBadRequest}:
 								logger.Info("query failed, quorum not met",
 									zap.String("peerId", peerId),
-									zap.String("userId", pendingResponse.userName),
+									zap.String("userName", pendingResponse.userName),
 									zap.Any("requestId", requestSignature),
 									zap.Int("numSigners", numSigners),
 									zap.Int("maxMatchingResponses", maxMatchingResponses),
@@ -293,7 +297,7 @@ func runP2P(
 						} else {
 							logger.Info("waiting for more query responses",
 								zap.String("peerId", peerId),
-								zap.String("userId", pendingResponse.userName),
+								zap.String("userName", pendingResponse.userName),
 								zap.Any("requestId", requestSignature),
 								zap.Int("numSigners", numSigners),
 								zap.Int("maxMatchingResponses", maxMatchingResponses),
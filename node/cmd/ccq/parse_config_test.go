@@ -1,9 +1,20 @@
 package ccq
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/certusone/wormhole/node/pkg/common"
 	"github.com/certusone/wormhole/node/pkg/query"
@@ -11,11 +22,15 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/wormhole-foundation/wormhole/sdk/vaa"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/time/rate"
+
+	"github.com/gagliardetto/solana-go"
 )
 
 func TestParseConfigFileDoesntExist(t *testing.T) {
-	_, err := parseConfigFile("missingFile.json", common.MainNet)
+	_, _, err := parseConfigFile("missingFile.json", common.MainNet, DefaultMaxConfigSize)
 	require.Error(t, err)
 	assert.Equal(t, `failed to open permissions file "missingFile.json": open missingFile.json: no such file or directory`, err.Error())
 }
@@ -56,7 +71,7 @@ func TestParseConfigBadJson(t *testing.T) {
 
 	_, err := parseConfig([]byte(str), common.MainNet)
 	require.Error(t, err)
-	assert.Equal(t, `failed to unmarshal json: unexpected end of JSON input`, err.Error())
+	assert.Equal(t, `failed to unmarshal json at line 32: unexpected end of JSON input`, err.Error())
 }
 
 func TestParseConfigDuplicateUser(t *testing.T) {
@@ -100,6 +115,18 @@ func TestParseConfigDuplicateUser(t *testing.T) {
 	assert.Equal(t, `UserName "Test User" is a duplicate`, err.Error())
 }
 
+func TestParseConfigMissingApiKey(t *testing.T) {
+	_, err := parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key",`, ``, 1)), common.MainNet)
+	require.EqualError(t, err, `UserName "Test User" does not have an "apiKey" or "apiKeys"`)
+
+	_, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key",`, `"apiKeys": ["my_secret_key", ""],`, 1)), common.MainNet)
+	require.EqualError(t, err, `UserName "Test User" has an empty API key`)
+
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	_, err = perms.UpsertUser(User{UserName: "New User", AllowUnsigned: true, AllowedCalls: []AllowedCall{{EthCall: &EthCall{Chain: 2, ContractAddress: "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", Call: "0x06fdde03"}}}})
+	require.EqualError(t, err, `UserName "New User" does not have an "apiKey" or "apiKeys"`)
+}
+
 func TestParseConfigDuplicateApiKey(t *testing.T) {
 	str := `
 	{
@@ -138,7 +165,114 @@ func TestParseConfigDuplicateApiKey(t *testing.T) {
 
 	_, err := parseConfig([]byte(str), common.MainNet)
 	require.Error(t, err)
-	assert.Equal(t, `API key "my_secret_key" is a duplicate`, err.Error())
+	assert.Equal(t, `API key with hash `+apiKeyHash("my_secret_key")+` for user "Test User 2" is a duplicate of a key for user "Test User 1"`, err.Error())
+}
+
+func TestParseConfigMultipleApiKeys(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_old_key",
+      "apiKeys": ["My_New_Key"],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(perms))
+
+	// Both keys should map to the same entry and authorize the same call.
+	oldPerms, exists := perms["my_old_key"]
+	require.True(t, exists)
+	newPerms, exists := perms["my_new_key"]
+	require.True(t, exists)
+	assert.Same(t, oldPerms, newPerms)
+	assert.Equal(t, []string{"my_old_key", "my_new_key"}, newPerms.apiKeys)
+
+	callData := createCallData(t, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, err = validateCallData(zap.NewNop(), oldPerms, "ethCall", vaa.ChainIDEthereum, callData, "", false, nil)
+	require.NoError(t, err)
+	_, err = validateCallData(zap.NewNop(), newPerms, "ethCall", vaa.ChainIDEthereum, callData, "", false, nil)
+	require.NoError(t, err)
+}
+
+func TestParseConfigDuplicateApiKeyInList(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User 1",
+      "apiKeys": ["key_one", "key_two"],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Test User 2",
+      "apiKeys": ["key_three", "KEY_TWO"],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `API key with hash `+apiKeyHash("key_two")+` for user "Test User 2" is a duplicate of a key for user "Test User 1"`, err.Error())
+
+	// The same key listed twice for one user is also a duplicate.
+	str = `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "key_one",
+      "apiKeys": ["key_one"],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err = parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `API key with hash `+apiKeyHash("key_one")+` for user "Test User" is a duplicate of a key for user "Test User"`, err.Error())
 }
 
 func TestParseConfigUnsupportedCallType(t *testing.T) {
@@ -165,6 +299,11 @@ func TestParseConfigUnsupportedCallType(t *testing.T) {
 	_, err := parseConfig([]byte(str), common.MainNet)
 	require.Error(t, err)
 	assert.Equal(t, `unsupported call type for user "Test User", must be "ethCall", "ethCallByTimestamp", "ethCallWithFinality", "solAccount" or "solPDA"`, err.Error())
+
+	// Log queries are not supported by the query package yet, so there is no call type for them.
+	_, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedCalls": [
+        { "logQuery": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6" } },`, 1)), common.MainNet)
+	assert.EqualError(t, err, `unsupported call type for user "Test User", must be "ethCall", "ethCallByTimestamp", "ethCallWithFinality", "solAccount" or "solPDA"`)
 }
 
 func TestParseConfigInvalidContractAddress(t *testing.T) {
@@ -216,7 +355,7 @@ func TestParseConfigInvalidEthCall(t *testing.T) {
 
 	_, err := parseConfig([]byte(str), common.MainNet)
 	require.Error(t, err)
-	assert.Equal(t, `invalid eth call "HelloWorld" for user "Test User"`, err.Error())
+	assert.Equal(t, `invalid eth call "HelloWorld" for user "Test User": contains 'H', which is not a hex digit`, err.Error())
 }
 
 func TestParseConfigInvalidEthCallLength(t *testing.T) {
@@ -337,21 +476,21 @@ func TestParseConfigSuccess(t *testing.T) {
 	perm, exists := perms["my_secret_key"]
 	require.True(t, exists)
 
-	assert.Equal(t, 5, len(perm.allowedCalls))
+	assert.Equal(t, 5, perm.allowedCalls.len())
 
-	_, exists = perm.allowedCalls["ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03"]
+	_, exists = perm.allowedCalls.get("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03")
 	assert.True(t, exists)
 
-	_, exists = perm.allowedCalls["ethCallByTimestamp:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d7:06fdde03"]
+	_, exists = perm.allowedCalls.get("ethCallByTimestamp:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d7:06fdde03")
 	assert.True(t, exists)
 
-	_, exists = perm.allowedCalls["ethCallWithFinality:2:000000000000000000000000ddb64fe46a91d46ee29420539fc25fd07c5fea3e:313ce567"]
+	_, exists = perm.allowedCalls.get("ethCallWithFinality:2:000000000000000000000000ddb64fe46a91d46ee29420539fc25fd07c5fea3e:313ce567")
 	assert.True(t, exists)
 
-	_, exists = perm.allowedCalls["solAccount:1:BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna"]
+	_, exists = perm.allowedCalls.get("solAccount:1:BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna")
 	assert.True(t, exists)
 
-	_, exists = perm.allowedCalls["solPDA:1:Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o"]
+	_, exists = perm.allowedCalls.get("solPDA:1:Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o")
 	assert.True(t, exists)
 }
 
@@ -571,7 +710,7 @@ func TestParseConfigContractWildcard(t *testing.T) {
 
 	permsForUser, ok := perms["my_secret_key"]
 	require.True(t, ok)
-	assert.Equal(t, 2, len(permsForUser.allowedCalls))
+	assert.Equal(t, 2, permsForUser.allowedCalls.len())
 
 	logger := zap.NewNop()
 
@@ -602,12 +741,12 @@ func TestParseConfigContractWildcard(t *testing.T) {
 			errText:         "",
 		},
 		{
-			label:           "Wild card, wrong call type",
+			label:           "Wild card, by timestamp is covered by eth call",
 			callType:        "ethCallByTimestamp",
 			chainID:         vaa.ChainIDEthereum,
 			contractAddress: "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
 			data:            "0x06fdde03",
-			errText:         "not authorized",
+			errText:         "",
 		},
 		{
 			label:           "Wild card, wrong chain",
@@ -661,7 +800,106 @@ func TestParseConfigContractWildcard(t *testing.T) {
 
 	for _, tst := range testCases {
 		t.Run(tst.label, func(t *testing.T) {
-			status, err := validateCallData(logger, permsForUser, tst.callType, tst.chainID, createCallData(t, tst.contractAddress, tst.data))
+			status, err := validateCallData(logger, permsForUser, tst.callType, tst.chainID, createCallData(t, tst.contractAddress, tst.data), "", false, nil)
+			if tst.errText == "" {
+				require.NoError(t, err)
+				assert.Equal(t, 200, status)
+			} else {
+				require.ErrorContains(t, err, tst.errText)
+			}
+		})
+	}
+}
+
+func TestParseConfigSelectorWildcard(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Anything on WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "*"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(perms))
+
+	permsForUser, ok := perms["my_secret_key"]
+	require.True(t, ok)
+	assert.Equal(t, 1, permsForUser.allowedCalls.len())
+
+	_, exists := permsForUser.allowedCalls.get("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:*")
+	assert.True(t, exists)
+
+	logger := zap.NewNop()
+
+	type testCase struct {
+		label           string
+		callType        string
+		chainID         vaa.ChainID
+		contractAddress string
+		data            string
+		errText         string // empty string means success
+	}
+
+	var testCases = []testCase{
+		{
+			label:           "Wild card, success",
+			callType:        "ethCall",
+			chainID:         vaa.ChainIDEthereum,
+			contractAddress: "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+			data:            "0x06fdde03",
+			errText:         "",
+		},
+		{
+			label:           "Wild card, success, different call",
+			callType:        "ethCall",
+			chainID:         vaa.ChainIDEthereum,
+			contractAddress: "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+			data:            "0x18160ddd",
+			errText:         "",
+		},
+		{
+			label:           "Wild card, wrong address",
+			callType:        "ethCall",
+			chainID:         vaa.ChainIDEthereum,
+			contractAddress: "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d7",
+			data:            "0x06fdde03",
+			errText:         "not authorized",
+		},
+		{
+			label:           "Wild card, wrong chain",
+			callType:        "ethCall",
+			chainID:         vaa.ChainIDBase,
+			contractAddress: "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+			data:            "0x06fdde03",
+			errText:         "not authorized",
+		},
+		{
+			label:           "Wild card, by timestamp is covered by eth call",
+			callType:        "ethCallByTimestamp",
+			chainID:         vaa.ChainIDEthereum,
+			contractAddress: "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+			data:            "0x06fdde03",
+			errText:         "",
+		},
+	}
+
+	for _, tst := range testCases {
+		t.Run(tst.label, func(t *testing.T) {
+			status, err := validateCallData(logger, permsForUser, tst.callType, tst.chainID, createCallData(t, tst.contractAddress, tst.data), "", false, nil)
 			if tst.errText == "" {
 				require.NoError(t, err)
 				assert.Equal(t, 200, status)
@@ -672,6 +910,63 @@ func TestParseConfigContractWildcard(t *testing.T) {
 	}
 }
 
+func TestParseConfigDuplicateSelectorWildcard(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "*"
+          }
+        },
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "*"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:*" is a duplicate allowed call for user "Test User"`, err.Error())
+}
+
+func TestParseConfigSelectorWildcardWithContractWildcard(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "*",
+            "call": "*"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `eth call "*" for user "Test User" may not be used with a wild card contract address`, err.Error())
+}
+
 func createCallData(t *testing.T, toStr string, dataStr string) []*query.EthCallData {
 	t.Helper()
 	to, err := vaa.StringToAddress(strings.TrimPrefix(toStr, "0x"))
@@ -960,3 +1255,2099 @@ func TestParseConfigWithRateLimiterButPerUserBurstSizeSetToZero(t *testing.T) {
 	_, err := parseConfig([]byte(str), common.MainNet)
 	assert.Equal(t, "if rate limiting is enabled, the burst size may not be zero", err.Error())
 }
+
+func TestParseConfigRateLimiterEnforcesBurstPerUser(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test user with rate limits",
+      "apiKey": "my_secret_key_with_rate_limits",
+      "rateLimit": 0.001,
+      "burstSize": 2,
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Test user without rate limits",
+      "apiKey": "my_secret_key_without_rate_limits",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+
+	// The bucket allows the burst and then denies until it refills.
+	perm, exists := perms["my_secret_key_with_rate_limits"]
+	require.True(t, exists)
+	require.NotNil(t, perm.rateLimiter)
+	assert.True(t, perm.rateLimiter.Allow())
+	assert.True(t, perm.rateLimiter.Allow())
+	assert.False(t, perm.rateLimiter.Allow())
+
+	// A user without a rate limit is never limited.
+	perm, exists = perms["my_secret_key_without_rate_limits"]
+	require.True(t, exists)
+	assert.Nil(t, perm.rateLimiter)
+}
+
+func TestParseConfigSolanaAccounts(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "solAccount": {
+            "note:": "Example NFT and Core Bridge on Devnet",
+            "chain": 1,
+            "accounts": [
+              "BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna",
+              "Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o"
+            ]
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(perms))
+
+	permsForUser, exists := perms["my_secret_key"]
+	require.True(t, exists)
+	assert.Equal(t, 2, permsForUser.allowedCalls.len())
+
+	_, exists = permsForUser.allowedCalls.get("solAccount:1:BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna")
+	assert.True(t, exists)
+
+	_, exists = permsForUser.allowedCalls.get("solAccount:1:Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o")
+	assert.True(t, exists)
+
+	logger := zap.NewNop()
+
+	q := &query.SolanaAccountQueryRequest{
+		Commitment: "finalized",
+		Accounts: [][query.SolanaPublicKeyLength]byte{
+			solana.MustPublicKeyFromBase58("BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna"),
+			solana.MustPublicKeyFromBase58("Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o"),
+		},
+	}
+	status, err := validateSolanaAccountQuery(logger, permsForUser, "solAccount", vaa.ChainIDSolana, q, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	q.Accounts = append(q.Accounts, solana.SystemProgramID)
+	status, err = validateSolanaAccountQuery(logger, permsForUser, "solAccount", vaa.ChainIDSolana, q, false, nil)
+	require.ErrorContains(t, err, `call "solAccount:1:11111111111111111111111111111111" not authorized`)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestParseConfigSolanaAccountInvalidBase58(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "solAccount": {
+            "chain": 1,
+            "accounts": ["HelloWorld0"]
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.ErrorContains(t, err, `solana account string "HelloWorld0" for user "Test User" is not valid base58`)
+}
+
+func TestParseConfigSolanaAccountMissing(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "solAccount": {
+            "chain": 1
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `solana account for user "Test User" must specify "account" or "accounts"`, err.Error())
+}
+
+func TestParseConfigSolanaPda(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "solPDA": {
+            "note:": "Core Bridge on Devnet",
+            "chain": 1,
+            "programAddress": "Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o",
+            "maxSeeds": 2
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(perms))
+
+	permsForUser, exists := perms["my_secret_key"]
+	require.True(t, exists)
+	opts, exists := permsForUser.allowedCalls.get("solPDA:1:Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o")
+	require.True(t, exists)
+	assert.Equal(t, 2, opts.maxSeeds)
+
+	logger := zap.NewNop()
+
+	type testCase struct {
+		label          string
+		programAddress string
+		seeds          [][]byte
+		errText        string // empty string means success
+	}
+
+	var testCases = []testCase{
+		{
+			label:          "Success",
+			programAddress: "Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o",
+			seeds:          [][]byte{[]byte("GuardianSet"), {0, 0, 0, 0}},
+			errText:        "",
+		},
+		{
+			label:          "Unauthorized program",
+			programAddress: "BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna",
+			seeds:          [][]byte{[]byte("GuardianSet")},
+			errText:        `call "solPDA:1:BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna" not authorized`,
+		},
+		{
+			label:          "Too many seeds",
+			programAddress: "Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o",
+			seeds:          [][]byte{[]byte("GuardianSet"), {0, 0, 0, 0}, {1}},
+			errText:        "has 3 seeds, which exceeds the maximum of 2",
+		},
+	}
+
+	for _, tst := range testCases {
+		t.Run(tst.label, func(t *testing.T) {
+			q := &query.SolanaPdaQueryRequest{
+				Commitment: "finalized",
+				PDAs: []query.SolanaPDAEntry{
+					{
+						ProgramAddress: solana.MustPublicKeyFromBase58(tst.programAddress),
+						Seeds:          tst.seeds,
+					},
+				},
+			}
+			status, err := validateSolanaPdaQuery(logger, permsForUser, "solPDA", vaa.ChainIDSolana, q, false, nil)
+			if tst.errText == "" {
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusOK, status)
+			} else {
+				require.ErrorContains(t, err, tst.errText)
+				assert.Equal(t, http.StatusForbidden, status)
+			}
+		})
+	}
+}
+
+func TestParseConfigSolanaPdaInvalidMaxSeeds(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "solPDA": {
+            "chain": 1,
+            "programAddress": "Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o",
+            "maxSeeds": 17
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid max seeds 17 for solana program address "Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o" for user "Test User", must be between zero and 16`, err.Error())
+}
+
+func TestPermissionsReload(t *testing.T) {
+	origStr := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	updatedStr := strings.Replace(origStr, "my_secret_key", "my_new_secret_key", 1)
+
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(origStr), 0600))
+
+	perms, err := NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	store := NewPermissionsStore(perms, nil)
+
+	_, exists := store.Load().GetUserEntry("my_secret_key")
+	assert.True(t, exists)
+
+	// A valid update should be picked up.
+	logger := zap.NewNop()
+	require.NoError(t, os.WriteFile(fileName, []byte(updatedStr), 0600))
+	store.Reload(logger)
+
+	_, exists = store.Load().GetUserEntry("my_secret_key")
+	assert.False(t, exists)
+	_, exists = store.Load().GetUserEntry("my_new_secret_key")
+	assert.True(t, exists)
+
+	// An invalid update should be rejected, leaving the old config in place.
+	require.NoError(t, os.WriteFile(fileName, []byte("Hello, World!"), 0600))
+	store.Reload(logger)
+
+	_, exists = store.Load().GetUserEntry("my_new_secret_key")
+	assert.True(t, exists)
+}
+
+func TestPermissionsReloadUsesEnvironment(t *testing.T) {
+	origStr := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	// This is not valid in mainnet.
+	updatedStr := `
+	{
+  "allowAnythingSupported": true,
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_new_secret_key",
+      "allowAnything": true
+    }
+  ]
+}`
+
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(origStr), 0600))
+
+	perms, err := NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	store := NewPermissionsStore(perms, nil)
+
+	require.NoError(t, os.WriteFile(fileName, []byte(updatedStr), 0600))
+	store.Reload(zap.NewNop())
+
+	_, exists := store.Load().GetUserEntry("my_secret_key")
+	assert.True(t, exists)
+	_, exists = store.Load().GetUserEntry("my_new_secret_key")
+	assert.False(t, exists)
+}
+
+func TestEthCallAuthorizesEthCallByTimestamp(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        },
+        {
+          "ethCallByTimestamp": {
+            "note:": "Total supply of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x18160ddd"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	permsForUser, exists := perms["my_secret_key"]
+	require.True(t, exists)
+
+	logger := zap.NewNop()
+
+	// A single eth call entry authorizes both an eth_call and an eth_call_by_timestamp.
+	callData := createCallData(t, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, err = validateCallData(logger, permsForUser, "ethCall", vaa.ChainIDEthereum, callData, "", false, nil)
+	require.NoError(t, err)
+	_, err = validateCallData(logger, permsForUser, "ethCallByTimestamp", vaa.ChainIDEthereum, callData, "", false, nil)
+	require.NoError(t, err)
+
+	// But an eth call by timestamp entry does not authorize an eth_call.
+	callData = createCallData(t, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	_, err = validateCallData(logger, permsForUser, "ethCallByTimestamp", vaa.ChainIDEthereum, callData, "", false, nil)
+	require.NoError(t, err)
+	_, err = validateCallData(logger, permsForUser, "ethCall", vaa.ChainIDEthereum, callData, "", false, nil)
+	require.ErrorContains(t, err, "not authorized")
+}
+
+func TestEthCallWithFinalityAllowedFinality(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        },
+        {
+          "ethCall": {
+            "note:": "Total supply of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x18160ddd",
+            "allowedFinality": ["finalized"]
+          }
+        },
+        {
+          "ethCallWithFinality": {
+            "note:": "Decimals of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x313ce567",
+            "allowedFinality": ["safe"]
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	permsForUser, exists := perms["my_secret_key"]
+	require.True(t, exists)
+
+	logger := zap.NewNop()
+
+	type testCase struct {
+		label    string
+		data     string
+		finality string
+		errText  string // empty string means success
+	}
+
+	var testCases = []testCase{
+		{
+			label:    "Eth call with no restriction, finalized",
+			data:     "0x06fdde03",
+			finality: "finalized",
+			errText:  "",
+		},
+		{
+			label:    "Eth call with no restriction, safe",
+			data:     "0x06fdde03",
+			finality: "safe",
+			errText:  "",
+		},
+		{
+			label:    "Eth call restricted to finalized, finalized",
+			data:     "0x18160ddd",
+			finality: "finalized",
+			errText:  "",
+		},
+		{
+			label:    "Eth call restricted to finalized, safe",
+			data:     "0x18160ddd",
+			finality: "safe",
+			errText:  `call "ethCallWithFinality:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd" not authorized: finality "safe" not allowed`,
+		},
+		{
+			label:    "Eth call with finality restricted to safe, safe",
+			data:     "0x313ce567",
+			finality: "safe",
+			errText:  "",
+		},
+		{
+			label:    "Eth call with finality restricted to safe, finalized",
+			data:     "0x313ce567",
+			finality: "finalized",
+			errText:  "not authorized",
+		},
+	}
+
+	for _, tst := range testCases {
+		t.Run(tst.label, func(t *testing.T) {
+			status, err := validateCallData(logger, permsForUser, "ethCallWithFinality", vaa.ChainIDEthereum, createCallData(t, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", tst.data), tst.finality, false, nil)
+			if tst.errText == "" {
+				require.NoError(t, err)
+				assert.Equal(t, http.StatusOK, status)
+			} else {
+				require.ErrorContains(t, err, tst.errText)
+			}
+		})
+	}
+}
+
+func TestParseConfigInvalidAllowedFinality(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03",
+            "allowedFinality": ["latest"]
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid finality "latest" for user "Test User", must be "finalized" or "safe"`, err.Error())
+}
+
+func TestParseConfigInvalidSignerAddress(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "signerAddress": "HelloWorld",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid signer address "HelloWorld" for user "Test User"`, err.Error())
+}
+
+func TestParseConfigExpiresAt(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "expiresAt": "2024-06-30T12:00:00Z",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	permsForUser, exists := perms["my_secret_key"]
+	require.True(t, exists)
+	assert.True(t, time.Date(2024, 6, 30, 12, 0, 0, 0, time.UTC).Equal(permsForUser.expiresAt))
+}
+
+func TestParseConfigInvalidExpiresAt(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "expiresAt": "June 30th",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.ErrorContains(t, err, `invalid expiresAt "June 30th" for user "Test User"`)
+}
+
+func TestParsePermissions(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := ParsePermissions([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	permsForUser, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+	assert.Equal(t, "Test User", permsForUser.userName)
+
+	// Errors are returned without any file name context.
+	_, err = ParsePermissions([]byte(`{"permissions": [`), common.MainNet)
+	require.ErrorContains(t, err, "failed to unmarshal json")
+	assert.NotContains(t, err.Error(), "permissions file")
+}
+
+func TestParseConfigReportsAllErrors(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User 1",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Invalid contract address",
+            "chain": 2,
+            "contractAddress": "HelloWorld",
+            "call": "0x06fdde03"
+          }
+        },
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        },
+        {
+          "ethCall": {
+            "note:": "Duplicate name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Test User 2",
+      "apiKey": "my_other_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Another invalid contract address",
+            "chain": 2,
+            "contractAddress": "GoodbyeWorld",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid contract address "HelloWorld" for user "Test User 1"
+"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03" is a duplicate allowed call for user "Test User 1"
+invalid contract address "GoodbyeWorld" for user "Test User 2"`, err.Error())
+}
+
+func TestParseConfigJsonErrorLine(t *testing.T) {
+	str := `{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": 42
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.ErrorContains(t, err, "failed to unmarshal json at line 5")
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(str), 0600))
+	require.NoError(t, ValidateConfigFile(fileName, common.MainNet, DefaultMaxConfigSize))
+
+	require.NoError(t, os.WriteFile(fileName, []byte(strings.Replace(str, "0x06fdde03", "0x06fd", 1)), 0600))
+	err := ValidateConfigFile(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, fileName)
+	require.ErrorContains(t, err, `eth call "0x06fd" for user "Test User" has an invalid length, must be 4 bytes`)
+}
+
+func TestParseConfigAllowedCIDRs(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCIDRs": ["10.0.0.0/8", "2001:db8::/32"],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	permsForUser, exists := perms["my_secret_key"]
+	require.True(t, exists)
+	assert.Equal(t, 2, len(permsForUser.allowedCIDRs))
+	assert.True(t, permsForUser.sourceAllowed(net.ParseIP("10.1.2.3")))
+	assert.True(t, permsForUser.sourceAllowed(net.ParseIP("2001:db8::1")))
+	assert.False(t, permsForUser.sourceAllowed(net.ParseIP("192.168.1.1")))
+	assert.False(t, permsForUser.sourceAllowed(nil))
+
+	// An empty list allows any source.
+	permsForUser.allowedCIDRs = nil
+	assert.True(t, permsForUser.sourceAllowed(net.ParseIP("192.168.1.1")))
+}
+
+func TestParseConfigInvalidCIDR(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCIDRs": ["10.0.0.0/33"],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid CIDR "10.0.0.0/33" for user "Test User"`, err.Error())
+}
+
+func TestParseConfigFunctionSignature(t *testing.T) {
+	tests := []struct {
+		signature string
+		selector  string
+	}{
+		{"name()", "06fdde03"},
+		{"totalSupply()", "18160ddd"},
+		{"balanceOf(address)", "70a08231"},
+		{"transfer(address,uint256)", "a9059cbb"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.signature, func(t *testing.T) {
+			sigPerms, err := parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "`+tc.signature+`"`, 1)), common.MainNet)
+			require.NoError(t, err)
+			selectorPerms, err := parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "0x`+tc.selector+`"`, 1)), common.MainNet)
+			require.NoError(t, err)
+
+			expectedKey := "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:" + tc.selector
+			assert.ElementsMatch(t, slices.Collect(selectorPerms["my_secret_key"].allowedCalls.keys()), slices.Collect(sigPerms["my_secret_key"].allowedCalls.keys()))
+			_, exists := sigPerms["my_secret_key"].allowedCalls.get(expectedKey)
+			assert.True(t, exists)
+		})
+	}
+}
+
+func TestParseConfigInvalidFunctionSignature(t *testing.T) {
+	_, err := parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "balanceOf(address owner)"`, 1)), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid eth call function signature "balanceOf(address owner)" for user "Test User"`, err.Error())
+}
+
+func TestParseConfigMaxCallsPerRequest(t *testing.T) {
+	str := `
+	{
+  "defaultMaxCallsPerRequest": 10,
+  "permissions": [
+    {
+      "userName": "Test User 1",
+      "apiKey": "my_secret_key_1",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Test User 2",
+      "apiKey": "my_secret_key_2",
+      "maxCallsPerRequest": 0,
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 10, perms["my_secret_key_1"].maxCalls)
+	assert.Equal(t, 0, perms["my_secret_key_2"].maxCalls)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"maxCallsPerRequest": 0`, `"maxCallsPerRequest": -1`, 1)), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid max calls per request -1 for user "Test User 2", may not be negative`, err.Error())
+}
+
+func TestParseConfigMaxChainsPerRequest(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"permissions": [`, `"defaultMaxChainsPerRequest": 3,
+  "permissions": [`, 1)
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 3, perms["my_secret_key"].maxChains)
+
+	perms, err = parseConfig([]byte(strings.Replace(str, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "maxChainsPerRequest": 0,`, 1)), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 0, perms["my_secret_key"].maxChains)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "maxChainsPerRequest": -1,`, 1)), common.MainNet)
+	assert.EqualError(t, err, `invalid max chains per request -1 for user "Test User", may not be negative`)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"defaultMaxChainsPerRequest": 3`, `"defaultMaxChainsPerRequest": -1`, 1)), common.MainNet)
+	assert.EqualError(t, err, "the default max chains per request may not be negative")
+}
+
+func TestParseConfigAllowedChains(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "allowedChains": [2, 4],`, 1)
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, map[vaa.ChainID]struct{}{vaa.ChainIDEthereum: {}, vaa.ChainIDBSC: {}}, perms["my_secret_key"].allowedChains)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `[2, 4]`, `[2, 70000]`, 1)), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid allowed chain 70000 for user "Test User"`, err.Error())
+}
+
+func TestPermissionsMerge(t *testing.T) {
+	baseStr := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User 1",
+      "apiKey": "my_secret_key_1",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Test User 2",
+      "apiKey": "my_secret_key_2",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	overlayStr := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User 1",
+      "apiKeys": ["my_secret_key_1", "my_new_secret_key_1"],
+      "logResponses": true,
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Total supply of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x18160ddd"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Test User 3",
+      "apiKey": "my_secret_key_3",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	base, err := ParsePermissions([]byte(baseStr), common.MainNet)
+	require.NoError(t, err)
+	overlay, err := ParsePermissions([]byte(overlayStr), common.MainNet)
+	require.NoError(t, err)
+
+	merged, err := base.Merge(overlay)
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(merged.permMap))
+
+	// The user in both has the union of the calls, and the settings from the overlay, under both keys.
+	user1, exists := merged.GetUserEntry("my_secret_key_1")
+	require.True(t, exists)
+	newUser1, exists := merged.GetUserEntry("my_new_secret_key_1")
+	require.True(t, exists)
+	assert.Same(t, user1, newUser1)
+	assert.True(t, user1.logResponses)
+	assert.Equal(t, 2, user1.allowedCalls.len())
+	_, exists = user1.allowedCalls.get("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03")
+	assert.True(t, exists)
+	_, exists = user1.allowedCalls.get("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd")
+	assert.True(t, exists)
+
+	// The users only in one or the other are carried over.
+	user2, exists := merged.GetUserEntry("my_secret_key_2")
+	require.True(t, exists)
+	assert.Equal(t, "Test User 2", user2.userName)
+	user3, exists := merged.GetUserEntry("my_secret_key_3")
+	require.True(t, exists)
+	assert.Equal(t, "Test User 3", user3.userName)
+
+	// The inputs should not be modified.
+	baseUser1, exists := base.GetUserEntry("my_secret_key_1")
+	require.True(t, exists)
+	assert.Equal(t, 1, baseUser1.allowedCalls.len())
+	assert.False(t, baseUser1.logResponses)
+}
+
+func TestPermissionsMergeConflictingUserName(t *testing.T) {
+	base, err := ParsePermissions([]byte(validateRequestTestConfig), common.MainNet)
+	require.NoError(t, err)
+	overlay, err := ParsePermissions([]byte(strings.Replace(validateRequestTestConfig, "Test User", "Other User", 1)), common.MainNet)
+	require.NoError(t, err)
+
+	_, err = base.Merge(overlay)
+	require.Error(t, err)
+	assert.Equal(t, `API key with hash `+apiKeyHash("my_secret_key")+` is used by user "Test User" and user "Other User"`, err.Error())
+}
+
+func TestPermissionsMergeDuplicateUserName(t *testing.T) {
+	base, err := ParsePermissions([]byte(validateRequestTestConfig), common.MainNet)
+	require.NoError(t, err)
+	overlay, err := ParsePermissions([]byte(strings.Replace(validateRequestTestConfig, "my_secret_key", "other_secret_key", 1)), common.MainNet)
+	require.NoError(t, err)
+
+	_, err = base.Merge(overlay)
+	require.EqualError(t, err, `user "Test User" exists in both sets of permissions, but with different API keys`)
+}
+
+func TestPermissionsKeys(t *testing.T) {
+	perms := createTestPermissions(t, `
+{
+  "allowAnythingSupported": true,
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKeys": ["my_secret_key", "my_other_key"],
+      "allowedCalls": [
+        { "solAccount": { "chain": 1, "account": "BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna" } },
+        { "ethCall": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "totalSupply()" } },
+        { "ethCall": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "0x06fdde03" } }
+      ]
+    },
+    {
+      "userName": "Anything User",
+      "apiKey": "anything_key",
+      "allowAnything": true
+    }
+  ]
+}`)
+
+	// Each user appears once, even with more than one API key, and the keys are sorted.
+	assert.Equal(t, map[string][]string{
+		"Test User": {
+			"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03",
+			"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd",
+			"solAccount:1:BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna",
+		},
+		"Anything User": {},
+	}, perms.Keys())
+}
+
+func TestPermissionsUpsertUser(t *testing.T) {
+	base, err := ParsePermissions([]byte(strings.Replace(validateRequestTestConfig, `"permissions": [`, `"defaultRateLimit": 0.5,
+  "permissions": [`, 1)), common.MainNet)
+	require.NoError(t, err)
+	contract, err := vaa.StringToAddress("B4FBF271143F4FBf7B91A5ded31805e42b2208d6")
+	require.NoError(t, err)
+
+	// Add a new user, which gets the defaults from the config.
+	newUser := User{
+		UserName:     "New User",
+		ApiKey:       "New_Key",
+		AllowedCalls: []AllowedCall{{EthCall: &EthCall{Chain: 2, ContractAddress: "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", Call: "totalSupply()"}}},
+	}
+	added, err := base.UpsertUser(newUser)
+	require.NoError(t, err)
+	pe, exists := added.GetUserEntry("new_key")
+	require.True(t, exists)
+	assert.Equal(t, rate.Limit(0.5), pe.rateLimiter.Limit())
+	assert.True(t, added.IsAllowed("new_key", vaa.ChainIDEthereum, contract, [4]byte{0x18, 0x16, 0x0d, 0xdd}))
+	assert.True(t, added.IsAllowed("my_secret_key", vaa.ChainIDEthereum, contract, [4]byte{0x06, 0xfd, 0xde, 0x03}))
+
+	// The original is not modified.
+	_, exists = base.GetUserEntry("new_key")
+	assert.False(t, exists)
+
+	// Replacing the user by name drops its old key.
+	newUser.ApiKey = "rotated_key"
+	replaced, err := added.UpsertUser(newUser)
+	require.NoError(t, err)
+	_, exists = replaced.GetUserEntry("new_key")
+	assert.False(t, exists)
+	_, exists = replaced.GetUserEntry("rotated_key")
+	assert.True(t, exists)
+
+	// The same validation applies as when parsing the config.
+	newUser.ApiKey = "MY_SECRET_KEY"
+	newUser.SignerAddress = "not an address"
+	_, err = replaced.UpsertUser(newUser)
+	assert.EqualError(t, err, `API key with hash `+apiKeyHash("my_secret_key")+` for user "New User" is a duplicate of a key for user "Test User"`+"\n"+
+		`invalid signer address "not an address" for user "New User"`)
+
+	// Removing a user by any of its keys removes all of them.
+	removed, err := replaced.RemoveUser("my_secret_key")
+	require.NoError(t, err)
+	_, exists = removed.GetUserEntry("my_secret_key")
+	assert.False(t, exists)
+	_, exists = removed.GetUserEntry("rotated_key")
+	assert.True(t, exists)
+
+	_, err = removed.RemoveUser("my_secret_key")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+}
+
+func TestEthCallWildCardPrecedence(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCallWithFinality": {
+            "chain": 2,
+            "contractAddress": "*",
+            "call": "0x06fdde03",
+            "allowedFinality": ["safe"]
+          }
+        },
+        {
+          "ethCallWithFinality": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "*",
+            "allowedFinality": ["finalized", "safe"]
+          }
+        },
+        {
+          "ethCallWithFinality": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03",
+            "allowedFinality": ["finalized"]
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	permsForUser, exists := perms["my_secret_key"]
+	require.True(t, exists)
+	logger := zap.NewNop()
+
+	// The exact entry wins over both wild cards.
+	callData := createCallData(t, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, err = validateCallData(logger, permsForUser, "ethCallWithFinality", vaa.ChainIDEthereum, callData, "finalized", false, nil)
+	require.NoError(t, err)
+	_, err = validateCallData(logger, permsForUser, "ethCallWithFinality", vaa.ChainIDEthereum, callData, "safe", false, nil)
+	require.ErrorContains(t, err, `finality "safe" not allowed`)
+
+	// Another contract is only covered by the wild card contract address entry.
+	callData = createCallData(t, "0x0000000000000000000000000000000000000001", "0x06fdde03")
+	_, err = validateCallData(logger, permsForUser, "ethCallWithFinality", vaa.ChainIDEthereum, callData, "safe", false, nil)
+	require.NoError(t, err)
+	_, err = validateCallData(logger, permsForUser, "ethCallWithFinality", vaa.ChainIDEthereum, callData, "finalized", false, nil)
+	require.ErrorContains(t, err, `finality "finalized" not allowed`)
+
+	// Other calls on the contract are covered by the wild card call entry.
+	callData = createCallData(t, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	_, err = validateCallData(logger, permsForUser, "ethCallWithFinality", vaa.ChainIDEthereum, callData, "finalized", false, nil)
+	require.NoError(t, err)
+}
+
+func TestPermissionsIsAllowed(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        },
+        {
+          "ethCall": {
+            "note:": "Total supply of anything on Goerli",
+            "chain": 2,
+            "contractAddress": "*",
+            "call": "0x18160ddd"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms, err := ParsePermissions([]byte(str), common.MainNet)
+	require.NoError(t, err)
+
+	weth, err := vaa.StringToAddress("B4FBF271143F4FBf7B91A5ded31805e42b2208d6")
+	require.NoError(t, err)
+	other, err := vaa.StringToAddress("0000000000000000000000000000000000000001")
+	require.NoError(t, err)
+	name := [ETH_CALL_SIG_LENGTH]byte{0x06, 0xfd, 0xde, 0x03}
+	totalSupply := [ETH_CALL_SIG_LENGTH]byte{0x18, 0x16, 0x0d, 0xdd}
+
+	tests := []struct {
+		label    string
+		apiKey   string
+		chainId  vaa.ChainID
+		contract vaa.Address
+		selector [ETH_CALL_SIG_LENGTH]byte
+		allowed  bool
+	}{
+		{"exact match", "my_secret_key", vaa.ChainIDEthereum, weth, name, true},
+		{"api key is case insensitive", "MY_SECRET_KEY", vaa.ChainIDEthereum, weth, name, true},
+		{"wild card contract", "my_secret_key", vaa.ChainIDEthereum, other, totalSupply, true},
+		{"wrong contract", "my_secret_key", vaa.ChainIDEthereum, other, name, false},
+		{"wrong chain", "my_secret_key", vaa.ChainIDBSC, weth, name, false},
+		{"unknown api key", "bad_key", vaa.ChainIDEthereum, weth, name, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.label, func(t *testing.T) {
+			assert.Equal(t, tc.allowed, perms.IsAllowed(tc.apiKey, tc.chainId, tc.contract, tc.selector))
+		})
+	}
+}
+
+func TestParseConfigFromEnv(t *testing.T) {
+	t.Setenv("CCQ_TEST_PERMISSIONS", validateRequestTestConfig)
+	perms, err := parseConfigFromEnv("CCQ_TEST_PERMISSIONS", common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	_, exists := perms.GetUserEntry("my_secret_key")
+	assert.True(t, exists)
+
+	// Unset or empty means no permissions.
+	perms, err = parseConfigFromEnv("CCQ_TEST_PERMISSIONS_UNSET", common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(perms.permMap))
+
+	t.Setenv("CCQ_TEST_PERMISSIONS", `{"permissions": [`)
+	_, err = parseConfigFromEnv("CCQ_TEST_PERMISSIONS", common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, `failed to parse permissions from environment variable "CCQ_TEST_PERMISSIONS"`)
+}
+
+func TestParseConfigBlockRestrictions(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "blockRestrictions": [
+        { "chain": 2, "minBlockNumber": 42000000 },
+        { "chain": 4, "allowBlockHashes": true }
+      ],`, 1)
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, map[vaa.ChainID]blockRestriction{
+		vaa.ChainIDEthereum: {minBlockNumber: 42000000},
+		vaa.ChainIDBSC:      {allowBlockHashes: true},
+	}, perms["my_secret_key"].blockRestrictions)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"chain": 4`, `"chain": 2`, 1)), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `chain 2 has a duplicate block restriction for user "Test User"`, err.Error())
+}
+
+func TestFunctionSelector(t *testing.T) {
+	tests := []struct {
+		signature string
+		selector  string
+		canonical string
+	}{
+		{"name()", "06fdde03", "name()"},
+		{"  transfer(address, uint256) ", "a9059cbb", "transfer(address,uint256)"},
+		{"balanceOf(address) returns (uint256)", "70a08231", "balanceOf(address)"},
+		{"balanceOf(address)(uint256)", "70a08231", "balanceOf(address)"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.signature, func(t *testing.T) {
+			selector, canonical, err := functionSelector(tc.signature)
+			require.NoError(t, err)
+			assert.Equal(t, tc.selector, selector)
+			assert.Equal(t, tc.canonical, canonical)
+		})
+	}
+
+	_, _, err := functionSelector("balanceOf(address owner)")
+	require.ErrorContains(t, err, `invalid function signature "balanceOf(address owner)"`)
+	_, _, err = functionSelector("balanceOf(address")
+	require.Error(t, err)
+}
+
+func TestParseConfigUnknownChain(t *testing.T) {
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(str), 0600))
+	require.NoError(t, ValidateConfigFile(fileName, common.MainNet, DefaultMaxConfigSize))
+
+	str = strings.Replace(str, `"chain": 2`, `"chain": 65000`, 1)
+	require.NoError(t, os.WriteFile(fileName, []byte(str), 0600))
+	err := ValidateConfigFile(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, fileName)
+	require.ErrorContains(t, err, `unknown chain 65000 for user "Test User", set "allowUnknownChains" if this is intentional`)
+
+	// The check may be disabled for chains not yet known to the SDK.
+	str = strings.Replace(str, `"permissions"`, `"allowUnknownChains": true,
+  "permissions"`, 1)
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	_, exists := perms["my_secret_key"].allowedCalls.get("ethCall:65000:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03")
+	assert.True(t, exists)
+}
+
+func TestParseConfigInvalidPerCallRateLimit(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"ethCall": {`, `"rateLimit": -1,
+          "ethCall": {`, 1)
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid rate limit -1 on an allowed call for user "Test User", the rate limit and burst size must be positive`, err.Error())
+}
+
+func TestParseConfigInvalidMaxConcurrent(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "maxConcurrent": -1,`, 1)
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `invalid max concurrent requests -1 for user "Test User", may not be negative`, err.Error())
+}
+
+func TestParseConfigUnrestrictedWithAllowedCalls(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "unrestricted": true,`, 1)
+	str = strings.Replace(str, `"permissions"`, `"unrestrictedEnvironments": ["mainnet"], "permissions"`, 1)
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.Error(t, err)
+	assert.Equal(t, `UserName "Test User" has "allowedCalls" specified with "unrestricted", which is not allowed`, err.Error())
+}
+
+func TestParseConfigUnrestrictedEnvironments(t *testing.T) {
+	user := `{ "userName": "Monitor", "apiKey": "my_secret_key", "unrestricted": true }`
+
+	// Without the top level opt-in, "unrestricted" is rejected in every environment.
+	for _, env := range []common.Environment{common.MainNet, common.TestNet, common.UnsafeDevNet} {
+		_, err := parseConfig([]byte(`{ "permissions": [`+user+`] }`), env)
+		assert.EqualError(t, err, `UserName "Monitor" has "unrestricted" specified when the environment is not in "unrestrictedEnvironments"`, env)
+	}
+
+	// The opt-in only applies to the environments that it lists.
+	str := `{ "unrestrictedEnvironments": ["testnet"], "permissions": [` + user + `] }`
+	perms, err := parseConfig([]byte(str), common.TestNet)
+	require.NoError(t, err)
+	assert.True(t, perms["my_secret_key"].unrestricted)
+	_, err = parseConfig([]byte(str), common.MainNet)
+	assert.ErrorContains(t, err, `"unrestricted" specified when the environment is not in "unrestrictedEnvironments"`)
+
+	_, err = parseConfig([]byte(`{ "unrestrictedEnvironments": ["mainnet"], "permissions": [`+user+`] }`), common.MainNet)
+	require.NoError(t, err)
+
+	_, err = parseConfig([]byte(`{ "unrestrictedEnvironments": ["moonnet"], "permissions": [] }`), common.MainNet)
+	assert.EqualError(t, err, `invalid environment "moonnet" in "unrestrictedEnvironments"`)
+}
+
+func TestParseConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	teamA := filepath.Join(dir, "team_a.json")
+	teamB := filepath.Join(dir, "team_b.json")
+	require.NoError(t, os.WriteFile(teamA, []byte(validateRequestTestConfig), 0600))
+	require.NoError(t, os.WriteFile(teamB, []byte(strings.NewReplacer(`"Test User"`, `"Test User2"`, `"my_secret_key"`, `"my_secret_key_2"`).Replace(validateRequestTestConfig)), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("not json"), 0600))
+
+	perms, err := parseConfigDir(zap.NewNop(), dir, common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(perms.permMap))
+	assert.Equal(t, "Test User", perms.permMap["my_secret_key"].userName)
+	assert.Equal(t, "Test User2", perms.permMap["my_secret_key_2"].userName)
+
+	// The same API key may not be used in two files.
+	teamC := filepath.Join(dir, "team_c.json")
+	require.NoError(t, os.WriteFile(teamC, []byte(strings.Replace(validateRequestTestConfig, `"Test User"`, `"Test User3"`, 1)), 0600))
+	_, err = parseConfigDir(zap.NewNop(), dir, common.MainNet, DefaultMaxConfigSize)
+	require.Error(t, err)
+	assert.Equal(t, fmt.Sprintf(`API key with hash %s for user "Test User3" is in both "%s" and "%s"`, apiKeyHash("my_secret_key"), teamA, teamC), err.Error())
+}
+
+func TestParseConfigCommentsAndTrailingCommas(t *testing.T) {
+	str := `
+// Permissions for the integration tests.
+{
+  "permissions": [
+    {
+      "userName": "Test // User", /* Comment markers in strings are kept. */
+      "apiKey": "my_secret_key",
+      "allowedChains": [2, 4,],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli \"/* still a string */\"",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03", // name()
+          },
+        },
+      ],
+    },
+  ],
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(perms))
+	assert.Equal(t, "Test // User", perms["my_secret_key"].userName)
+	assert.Equal(t, 2, len(perms["my_secret_key"].allowedChains))
+	_, exists := perms["my_secret_key"].allowedCalls.get("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03")
+	assert.True(t, exists)
+
+	// Genuinely malformed files are still rejected.
+	_, err = parseConfig([]byte(strings.Replace(str, `[2, 4,]`, `[2, 4,,]`, 1)), common.MainNet)
+	assert.ErrorContains(t, err, "failed to unmarshal json at line 8")
+
+	_, err = parseConfig([]byte(str+"\n/* Unterminated"), common.MainNet)
+	assert.EqualError(t, err, "unterminated comment at line 22")
+
+	_, err = parseConfig([]byte(`{ "permissions": [ , ] }`), common.MainNet)
+	assert.Error(t, err)
+}
+
+func TestParseConfigMaxResponseBytes(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "maxResponseBytes": 4096,
+      "truncateResponses": true,`, 1)
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 4096, perms["my_secret_key"].maxResponseBytes)
+	assert.True(t, perms["my_secret_key"].truncateResponses)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `4096`, `-1`, 1)), common.MainNet)
+	assert.EqualError(t, err, `invalid max response bytes -1 for user "Test User", may not be negative`)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"maxResponseBytes": 4096,`, ``, 1)), common.MainNet)
+	assert.EqualError(t, err, `UserName "Test User" has "truncateResponses" specified without "maxResponseBytes"`)
+}
+
+func TestParseConfigGzipped(t *testing.T) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write([]byte(validateRequestTestConfig))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	fileName := filepath.Join(t.TempDir(), "perms.json.gz")
+	require.NoError(t, os.WriteFile(fileName, buf.Bytes(), 0600))
+	gzipped, err := NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+
+	plain, err := ParsePermissions([]byte(validateRequestTestConfig), common.MainNet)
+	require.NoError(t, err)
+
+	var gzippedDesc, plainDesc bytes.Buffer
+	require.NoError(t, gzipped.Describe(&gzippedDesc, "my_secret_key"))
+	require.NoError(t, plain.Describe(&plainDesc, "my_secret_key"))
+	assert.Equal(t, plainDesc.String(), gzippedDesc.String())
+	assert.Equal(t, slices.Sorted(maps.Keys(plain.permMap)), slices.Sorted(maps.Keys(gzipped.permMap)))
+
+	// A corrupt gzip file is reported rather than parsed as json.
+	require.NoError(t, os.WriteFile(fileName, buf.Bytes()[:20], 0600))
+	_, err = NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, "failed to decompress gzipped config")
+	require.ErrorContains(t, err, fileName)
+}
+
+func TestParseConfigBase64Call(t *testing.T) {
+	plain, err := parseConfig([]byte(validateRequestTestConfig), common.MainNet)
+	require.NoError(t, err)
+
+	str := strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "base64:Bv3eAw=="`, 1)
+	b64, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, slices.Sorted(plain["my_secret_key"].allowedCalls.keys()), slices.Sorted(b64["my_secret_key"].allowedCalls.keys()))
+
+	// Decode failures are reported with the user and file names.
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	str = strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "base64:not base64!"`, 1)
+	require.NoError(t, os.WriteFile(fileName, []byte(str), 0600))
+	_, _, err = parseConfigFile(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, `invalid eth call "base64:not base64!" for user "Test User"`)
+	require.ErrorContains(t, err, fileName)
+
+	// The decoded value must still be a four byte selector.
+	str = strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "base64:Bv3e"`, 1)
+	_, err = parseConfig([]byte(str), common.MainNet)
+	require.EqualError(t, err, `eth call "base64:Bv3e" for user "Test User" has an invalid length, must be 4 bytes`)
+}
+
+func TestParseConfigEmptyPermissions(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(`{"permissions": []}`), 0600))
+	perms, err := NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	assert.True(t, perms.IsEmpty())
+
+	observedCore, observedLogs := observer.New(zapcore.WarnLevel)
+	perms.logWarnings(zap.New(observedCore))
+	entries := observedLogs.All()
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, fileName, entries[0].ContextMap()["fileName"])
+
+	// It is an error if the file says it should not be empty.
+	require.NoError(t, os.WriteFile(fileName, []byte(`{"requireNonEmpty": true, "permissions": []}`), 0600))
+	_, err = NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, `the config does not contain any users and "requireNonEmpty" is set`)
+	require.ErrorContains(t, err, fileName)
+
+	// There is no warning when there are users.
+	perms = createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"permissions"`, `"requireNonEmpty": true, "permissions"`, 1))
+	assert.False(t, perms.IsEmpty())
+	perms.logWarnings(zap.New(observedCore))
+	assert.Equal(t, 1, observedLogs.Len())
+}
+
+func TestParseConfigFileFormats(t *testing.T) {
+	// The last used times are set to the load time, so clear them before comparing.
+	load := func(fileName string) PermissionsMap {
+		perms, err := NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+		require.NoError(t, err)
+		for _, pe := range perms.permMap {
+			for callKey, opts := range pe.allowedCalls.all() {
+				opts.lastUsed = nil
+				pe.allowedCalls.set(callKey, opts)
+			}
+		}
+		return perms.permMap
+	}
+
+	expected := load("testdata/permissions.json")
+	require.Equal(t, 3, len(expected))
+	assert.Equal(t, expected, load("testdata/permissions.yaml"))
+	assert.Equal(t, expected, load("testdata/permissions.toml"))
+
+	// An unknown extension is treated as json.
+	fileName := filepath.Join(t.TempDir(), "permissions.conf")
+	jsonBytes, err := os.ReadFile("testdata/permissions.json")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fileName, jsonBytes, 0600))
+	assert.Equal(t, expected, load(fileName))
+
+	// Errors name the file and the format.
+	fileName = filepath.Join(t.TempDir(), "permissions.yml")
+	require.NoError(t, os.WriteFile(fileName, []byte("permissions: [\n"), 0600))
+	_, err = NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, fileName)
+	require.ErrorContains(t, err, "failed to unmarshal yaml")
+
+	// An unquoted hex value would be read as a number, so it is rejected.
+	require.NoError(t, os.WriteFile(fileName, []byte("permissions:\n  - userName: Test User\n    signerAddress: 0x00000000000000000000000000000000000000ab\n"), 0600))
+	_, err = NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, `line 3: the value "0x00000000000000000000000000000000000000ab" must be quoted`)
+
+	// Type errors name the field, without an offset into the converted json.
+	require.NoError(t, os.WriteFile(fileName, []byte("permissions:\n  - userName: Test User\n    maxCallsPerRequest: lots\n"), 0600))
+	_, err = NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.ErrorContains(t, err, `failed to unmarshal yaml: the value of "permissions.0.maxCallsPerRequest" may not be a string`)
+	assert.NotContains(t, err.Error(), "line")
+}
+
+func TestParseConfigZeroContractAddress(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6"`, `"contractAddress": "0x0000000000000000000000000000000000000000"`, 1)
+	perms := createTestPermissions(t, str)
+	assert.Equal(t, []string{`allowed call for user "Test User" has a zero contract address "0x0000000000000000000000000000000000000000"`}, perms.Warnings())
+
+	observedCore, observedLogs := observer.New(zapcore.WarnLevel)
+	perms.logWarnings(zap.New(observedCore))
+	entries := observedLogs.All()
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, perms.Warnings()[0], entries[0].ContextMap()["warning"])
+
+	// It is an error in strict mode.
+	_, err := parseConfig([]byte(strings.Replace(str, `"permissions"`, `"strict": true, "permissions"`, 1)), common.MainNet)
+	require.EqualError(t, err, `allowed call for user "Test User" has a zero contract address "0x0000000000000000000000000000000000000000"`)
+
+	// Other addresses are fine.
+	assert.Empty(t, createTestPermissions(t, validateRequestTestConfig).Warnings())
+}
+
+func TestParseConfigAddressChecksum(t *testing.T) {
+	// The last letter is upper case, which does not match the checksum.
+	str := strings.Replace(validateRequestTestConfig, `"contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6"`, `"contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208D6"`, 1)
+	assert.Equal(t, []string{`allowed call for user "Test User" has contract address "B4FBF271143F4FBf7B91A5ded31805e42b2208D6" with an invalid checksum`}, createTestPermissions(t, str).Warnings())
+
+	// It is an error in strict mode.
+	_, err := parseConfig([]byte(strings.Replace(str, `"permissions"`, `"strict": true, "permissions"`, 1)), common.MainNet)
+	require.EqualError(t, err, `allowed call for user "Test User" has contract address "B4FBF271143F4FBf7B91A5ded31805e42b2208D6" with an invalid checksum`)
+
+	// Signer addresses are checked too.
+	str = strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"signerAddress": "0xb4FBF271143F4FBf7B91A5ded31805e42b2208d6",`, 1)
+	assert.Equal(t, []string{`signer address "0xb4FBF271143F4FBf7B91A5ded31805e42b2208d6" for user "Test User" has an invalid checksum`}, createTestPermissions(t, str).Warnings())
+
+	// Addresses in a single case have no checksum, and EIP-55 does not apply to padded addresses, so they are not checked.
+	for _, addr := range []string{"b4fbf271143f4fbf7b91a5ded31805e42b2208d6", "0xB4FBF271143F4FBF7B91A5DED31805E42B2208D6", "000000000000000000000000B4FBF271143F4FBf7B91A5ded31805e42b2208d6"} {
+		str := strings.Replace(validateRequestTestConfig, `"B4FBF271143F4FBf7B91A5ded31805e42b2208d6"`, `"`+addr+`"`, 1)
+		assert.Empty(t, createTestPermissions(t, str).Warnings(), addr)
+	}
+}
+
+func TestParseConfigNegativeRateLimit(t *testing.T) {
+	_, err := parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"permissions"`, `"defaultRateLimit": -1, "permissions"`, 1)), common.MainNet)
+	require.EqualError(t, err, "the default rate limit may not be negative")
+
+	_, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "rateLimit": -0.5,`, 1)), common.MainNet)
+	require.EqualError(t, err, `invalid rate limit -0.5 for user "Test User", may not be negative`)
+
+	// An unset default means no limit, and a user can still set their own.
+	permMap, err := parseConfig([]byte(validateRequestTestConfig), common.MainNet)
+	require.NoError(t, err)
+	assert.Nil(t, permMap["my_secret_key"].rateLimiter)
+
+	permMap, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "rateLimit": 2,`, 1)), common.MainNet)
+	require.NoError(t, err)
+	require.NotNil(t, permMap["my_secret_key"].rateLimiter)
+	assert.Equal(t, rate.Limit(2), permMap["my_secret_key"].rateLimiter.Limit())
+}
+
+func TestParseConfigTimeout(t *testing.T) {
+	// The default is to wait as long as the guardians might take.
+	permMap, err := parseConfig([]byte(validateRequestTestConfig), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, maxRequestTimeout, permMap["my_secret_key"].requestTimeout())
+
+	// The global default applies to users that do not set their own.
+	permMap, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"permissions"`, `"defaultTimeout": "10s", "permissions"`, 1)), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, permMap["my_secret_key"].requestTimeout())
+
+	permMap, err = parseConfig([]byte(strings.Replace(strings.Replace(validateRequestTestConfig, `"permissions"`, `"defaultTimeout": "10s", "permissions"`, 1),
+		`"allowUnsigned": true,`, `"allowUnsigned": true,
+      "timeout": "45s",`, 1)), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 45*time.Second, permMap["my_secret_key"].requestTimeout())
+
+	_, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"permissions"`, `"defaultTimeout": "soon", "permissions"`, 1)), common.MainNet)
+	require.ErrorContains(t, err, `invalid defaultTimeout "soon"`)
+
+	_, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "timeout": "2m",`, 1)), common.MainNet)
+	require.EqualError(t, err, `invalid timeout "2m" for user "Test User": must be positive and at most 1m5s`)
+
+	_, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true,
+      "timeout": "-1s",`, 1)), common.MainNet)
+	require.EqualError(t, err, `invalid timeout "-1s" for user "Test User": must be positive and at most 1m5s`)
+}
+
+func TestParseConfigDuplicateApiKeyDifferentCase(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"permissions": [`, `"permissions": [
+    {
+      "userName": "Other User",
+      "apiKey": "My_Secret_Key",
+      "allowUnsigned": true,
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    },`, 1)
+
+	_, err := parseConfig([]byte(str), common.MainNet)
+	require.EqualError(t, err, `API key with hash `+apiKeyHash("my_secret_key")+` for user "Test User" is a duplicate of a key for user "Other User"`)
+}
+
+func TestApiKeyErrorsDoNotContainApiKeys(t *testing.T) {
+	const apiKey = "My_Secret_Key"
+	config := strings.Replace(validateRequestTestConfig, "my_secret_key", apiKey, 1)
+	otherUser := strings.Replace(config, "Test User", "Other User", 1)
+	base, err := ParsePermissions([]byte(config), common.MainNet)
+	require.NoError(t, err)
+	overlay, err := ParsePermissions([]byte(otherUser), common.MainNet)
+	require.NoError(t, err)
+
+	var errs []error
+	_, err = parseConfig([]byte(strings.Replace(config, `"apiKey": "My_Secret_Key",`, `"apiKeys": ["My_Secret_Key", "my_secret_key"],`, 1)), common.MainNet)
+	errs = append(errs, err)
+	_, err = parseConfig([]byte(strings.Replace(config, `"permissions": [`, `"permissions": [
+    { "userName": "Other User", "apiKey": "MY_SECRET_KEY", "allowUnsigned": true, "allowedCalls": [{ "ethCall": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "0x06fdde03" } }] },`, 1)), common.MainNet)
+	errs = append(errs, err)
+	_, err = base.Merge(overlay)
+	errs = append(errs, err)
+	_, err = base.UpsertUser(User{UserName: "New User", ApiKey: apiKey, AllowUnsigned: true, AllowedCalls: []AllowedCall{{EthCall: &EthCall{Chain: 2, ContractAddress: "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", Call: "0x06fdde03"}}}})
+	errs = append(errs, err)
+	errs = append(errs, base.Describe(io.Discard, "unknown_"+apiKey))
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.json"), []byte(config), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.json"), []byte(otherUser), 0600))
+	_, err = parseConfigDir(zap.NewNop(), dir, common.MainNet, DefaultMaxConfigSize)
+	errs = append(errs, err)
+
+	for _, err := range errs {
+		require.Error(t, err)
+		assert.NotContains(t, strings.ToLower(err.Error()), strings.ToLower(apiKey))
+		assert.Contains(t, err.Error(), "hash")
+	}
+}
+
+func TestAllowedSelectors(t *testing.T) {
+	perms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedCalls": [
+        {
+          "ethCallWithFinality": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x18160ddd"
+          }
+        },
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "*",
+            "call": "0x313ce567"
+          }
+        },
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "0x0000000000000000000000000000000000000001",
+            "call": "*"
+          }
+        },`, 1))
+
+	weth, err := vaa.StringToAddress("B4FBF271143F4FBf7B91A5ded31805e42b2208d6")
+	require.NoError(t, err)
+	selectors, wildCard := perms.AllowedSelectors("my_secret_key", 2, weth)
+	assert.Equal(t, [][4]byte{{0x06, 0xfd, 0xde, 0x03}, {0x18, 0x16, 0x0d, 0xdd}, {0x31, 0x3c, 0xe5, 0x67}}, selectors)
+	assert.False(t, wildCard)
+
+	// A wild card call entry is flagged, and the wild card contract entry still applies.
+	other, err := vaa.StringToAddress("0000000000000000000000000000000000000001")
+	require.NoError(t, err)
+	selectors, wildCard = perms.AllowedSelectors("my_secret_key", 2, other)
+	assert.Equal(t, [][4]byte{{0x31, 0x3c, 0xe5, 0x67}}, selectors)
+	assert.True(t, wildCard)
+
+	// Nothing is allowed on a different chain.
+	selectors, wildCard = perms.AllowedSelectors("my_secret_key", 4, weth)
+	assert.Nil(t, selectors)
+	assert.False(t, wildCard)
+
+	selectors, wildCard = perms.AllowedSelectors("my_unknown_key", 2, weth)
+	assert.Nil(t, selectors)
+	assert.False(t, wildCard)
+}
+
+func TestAllowedSelectorsChecksKey(t *testing.T) {
+	weth, err := vaa.StringToAddress("B4FBF271143F4FBf7B91A5ded31805e42b2208d6")
+	require.NoError(t, err)
+
+	// API keys are not case sensitive, the same as on a request.
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	selectors, _ := perms.AllowedSelectors("My_Secret_Key", 2, weth)
+	assert.Equal(t, [][4]byte{{0x06, 0xfd, 0xde, 0x03}}, selectors)
+
+	// An expired key has no permissions.
+	perms = createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true, "expiresAt": "2000-01-01T00:00:00Z",`, 1))
+	selectors, wildCard := perms.AllowedSelectors("my_secret_key", 2, weth)
+	assert.Nil(t, selectors)
+	assert.False(t, wildCard)
+
+	// Neither does a chain that is not in "allowedChains".
+	perms = createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, `"allowUnsigned": true, "allowedChains": [4],`, 1))
+	selectors, wildCard = perms.AllowedSelectors("my_secret_key", 2, weth)
+	assert.Nil(t, selectors)
+	assert.False(t, wildCard)
+}
+
+func TestAllowedSelectorsUnknownContract(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	other, err := vaa.StringToAddress("0000000000000000000000000000000000000001")
+	require.NoError(t, err)
+	selectors, wildCard := perms.AllowedSelectors("my_secret_key", 2, other)
+	assert.Nil(t, selectors)
+	assert.False(t, wildCard)
+}
+
+func TestParseConfigExpandsEnvVars(t *testing.T) {
+	t.Setenv("CCQ_TEST_API_KEY", "key_from_env")
+	t.Setenv("CCQ_TEST_USER_NAME", `Quoted "User"`)
+	str := strings.Replace(validateRequestTestConfig, `"my_secret_key"`, `"${CCQ_TEST_API_KEY}"`, 1)
+	str = strings.Replace(str, `"Test User"`, `"${CCQ_TEST_USER_NAME}"`, 1)
+	permMap, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	require.Contains(t, permMap, "key_from_env")
+	assert.Equal(t, `Quoted "User"`, permMap["key_from_env"].userName)
+
+	// Only the "${NAME}" form is expanded, and references in comments are ignored.
+	str = strings.Replace(validateRequestTestConfig, `"my_secret_key",`, `"$CCQ_TEST_API_KEY", // or ${CCQ_TEST_UNSET}`, 1)
+	permMap, err = parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Contains(t, permMap, "$ccq_test_api_key")
+
+	// Every unset variable is reported.
+	str = strings.Replace(validateRequestTestConfig, `"my_secret_key"`, `"${CCQ_TEST_UNSET}"`, 1)
+	str = strings.Replace(str, `"Test User"`, `"${CCQ_TEST_ALSO_UNSET}"`, 1)
+	_, err = parseConfig([]byte(str), common.MainNet)
+	require.EqualError(t, err, "environment variable \"CCQ_TEST_ALSO_UNSET\" is not set\nenvironment variable \"CCQ_TEST_UNSET\" is not set")
+}
+
+func TestParseConfigMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	maxSize := int64(len(validateRequestTestConfig))
+
+	// A file over the default limit is rejected, even though it is otherwise valid.
+	fileName := filepath.Join(dir, "perms.json")
+	oversized := validateRequestTestConfig + strings.Repeat(" ", DefaultMaxConfigSize)
+	require.NoError(t, os.WriteFile(fileName, []byte(oversized), 0600))
+	_, err := NewPermissions(fileName, common.MainNet, 0)
+	require.ErrorIs(t, err, ErrConfigTooLarge)
+	require.ErrorContains(t, err, fmt.Sprintf(`failed to read permissions file "%s": permissions config is too large, the maximum is %d bytes`, fileName, DefaultMaxConfigSize))
+
+	// A file of exactly the maximum size is allowed.
+	require.NoError(t, os.WriteFile(fileName, []byte(validateRequestTestConfig), 0600))
+	perms, err := NewPermissions(fileName, common.MainNet, maxSize)
+	require.NoError(t, err)
+
+	// The limit is kept for reloads, so a file that grows past it is not swapped in.
+	require.NoError(t, os.WriteFile(fileName, []byte(validateRequestTestConfig+" "), 0600))
+	store := NewPermissionsStore(perms, nil)
+	store.Reload(zap.NewNop())
+	assert.Same(t, perms, store.Load())
+	assert.ErrorIs(t, ValidateConfigFile(fileName, common.MainNet, maxSize), ErrConfigTooLarge)
+	assert.NoError(t, ValidateConfigFile(fileName, common.MainNet, maxSize+1))
+
+	// The limit also applies to a gzipped file once it has been decompressed, which could be much larger than the file itself.
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err = writer.Write([]byte(validateRequestTestConfig + " "))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.Less(t, buf.Len(), len(validateRequestTestConfig))
+
+	gzFileName := filepath.Join(dir, "perms.json.gz")
+	require.NoError(t, os.WriteFile(gzFileName, buf.Bytes(), 0600))
+	_, err = NewPermissions(gzFileName, common.MainNet, maxSize)
+	require.ErrorIs(t, err, ErrConfigTooLarge)
+	require.ErrorContains(t, err, "failed to decompress gzipped config")
+}
+
+func TestParseConfigSignerThreshold(t *testing.T) {
+	const addr1 = "0x1111111111111111111111111111111111111111"
+	const addr2 = "0x2222222222222222222222222222222222222222"
+	withSigners := func(signers string) []byte {
+		return []byte(strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`, signers, 1))
+	}
+
+	perms, err := parseConfig(withSigners(`"signerAddresses": ["`+addr1+`", "`+addr2+`"], "signerThreshold": 2,`), common.MainNet)
+	require.NoError(t, err)
+	assert.Len(t, perms["my_secret_key"].signerAddresses, 2)
+	assert.Equal(t, 2, perms["my_secret_key"].signerThreshold)
+
+	// The threshold defaults to one.
+	perms, err = parseConfig(withSigners(`"signerAddresses": ["`+addr1+`", "`+addr2+`"],`), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, 1, perms["my_secret_key"].signerThreshold)
+
+	_, err = parseConfig(withSigners(`"signerAddresses": ["`+addr1+`", "`+addr2+`"], "signerThreshold": 3,`), common.MainNet)
+	assert.EqualError(t, err, `invalid signer threshold 3 for user "Test User", must be between 1 and the number of signer addresses`)
+
+	_, err = parseConfig(withSigners(`"signerAddresses": ["`+addr1+`", "`+strings.ToUpper(addr1[2:])+`"], "signerThreshold": 2,`), common.MainNet)
+	assert.EqualError(t, err, `duplicate signer address "`+strings.ToUpper(addr1[2:])+`" for user "Test User"`)
+
+	_, err = parseConfig(withSigners(`"signerAddresses": ["HelloWorld"],`), common.MainNet)
+	assert.EqualError(t, err, `invalid signer address "HelloWorld" for user "Test User"`)
+
+	_, err = parseConfig(withSigners(`"signerThreshold": 1,`), common.MainNet)
+	assert.EqualError(t, err, `UserName "Test User" has "signerThreshold" specified without "signerAddresses"`)
+
+	_, err = parseConfig(withSigners(`"signerAddress": "`+addr1+`", "signerAddresses": ["`+addr2+`"],`), common.MainNet)
+	assert.EqualError(t, err, `UserName "Test User" has both "signerAddress" and "signerAddresses" specified, which is not allowed`)
+
+	// The proxy would sign an unsigned request itself, so it would not be checked against the signers.
+	for _, signers := range []string{
+		`"signerAddress": "` + addr1 + `",`,
+		`"signerAddresses": ["` + addr1 + `"],`,
+		`"signerAddresses": ["` + addr1 + `", "` + addr2 + `"], "signerThreshold": 2,`,
+	} {
+		_, err = parseConfig(withSigners(`"allowUnsigned": true, `+signers), common.MainNet)
+		assert.EqualError(t, err, `UserName "Test User" has "allowUnsigned" specified with "signerAddress" or "signerAddresses", which is not allowed`)
+	}
+}
+
+func TestParseConfigEthCallHexForms(t *testing.T) {
+	plain, err := parseConfig([]byte(validateRequestTestConfig), common.MainNet)
+	require.NoError(t, err)
+
+	// With or without a prefix, and with pasted white space, the selector gives the same key.
+	for _, call := range []string{"06fdde03", "0X06FDDE03", " 0x06fdde03 "} {
+		str := strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "`+call+`"`, 1)
+		perms, err := parseConfig([]byte(str), common.MainNet)
+		require.NoError(t, err, call)
+		assert.Equal(t, slices.Sorted(plain["my_secret_key"].allowedCalls.keys()), slices.Sorted(perms["my_secret_key"].allowedCalls.keys()), call)
+	}
+
+	str := strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "0x06fdde0"`, 1)
+	_, err = parseConfig([]byte(str), common.MainNet)
+	assert.EqualError(t, err, `invalid eth call "0x06fdde0" for user "Test User": has an odd number of hex digits (7), each byte must be two digits`)
+
+	str = strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "0x06fdde0g"`, 1)
+	_, err = parseConfig([]byte(str), common.MainNet)
+	assert.EqualError(t, err, `invalid eth call "0x06fdde0g" for user "Test User": contains 'g', which is not a hex digit`)
+}
+
+func TestParseConfigCallGroups(t *testing.T) {
+	str := `
+{
+  "callGroups": [
+    {
+      "name": "weth",
+      "allowedCalls": [
+        { "label": "WETH name", "ethCall": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "0x06fdde03" } },
+        { "ethCall": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "0x18160ddd" } }
+      ]
+    }
+  ],
+  "permissions": [
+    {
+      "userName": "Group User",
+      "apiKey": "group_key",
+      "callGroups": ["weth"]
+    },
+    {
+      "userName": "Mixed User",
+      "apiKey": "mixed_key",
+      "callGroups": ["weth"],
+      "allowedCalls": [
+        { "ethCall": { "chain": 2, "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "call": "0x313ce567" } }
+      ]
+    }
+  ]
+}`
+
+	perms, err := parseConfig([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03",
+		"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd",
+	}, slices.Sorted(perms["group_key"].allowedCalls.keys()))
+	assert.Equal(t, 3, perms["mixed_key"].allowedCalls.len())
+	mixedOpts, _ := perms["mixed_key"].allowedCalls.get("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03")
+	assert.Equal(t, "WETH name", mixedOpts.label)
+
+	// Each user gets its own options, so per-call state such as the last use time is not shared.
+	groupOpts, _ := perms["group_key"].allowedCalls.get("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03")
+	assert.NotSame(t, groupOpts.lastUsed, mixedOpts.lastUsed)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"callGroups": ["weth"],
+      "allowedCalls"`, `"callGroups": ["weth", "usdc"],
+      "allowedCalls"`, 1)), common.MainNet)
+	assert.EqualError(t, err, `UserName "Mixed User" references undefined call group "usdc"`)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"callGroups": [`, `"callGroups": [{ "name": "weth" },`, 1)), common.MainNet)
+	assert.EqualError(t, err, `call group "weth" is a duplicate`)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"name": "weth",`, ``, 1)), common.MainNet)
+	assert.EqualError(t, err, "a call group does not have a name")
+
+	// A call in a group is a duplicate if the user also lists it.
+	_, err = parseConfig([]byte(strings.Replace(str, `"call": "0x313ce567"`, `"call": "0x18160ddd"`, 1)), common.MainNet)
+	assert.EqualError(t, err, `"ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd" is a duplicate allowed call for user "Mixed User"`)
+}
+
+func TestParseConfigAnonymousUser(t *testing.T) {
+	perms, err := parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key"`, `"apiKey": "*"`, 1)), common.MainNet)
+	require.NoError(t, err)
+	assert.Contains(t, perms, anonymousApiKey)
+
+	_, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key"`, `"apiKeys": ["*", "my_secret_key"]`, 1)), common.MainNet)
+	assert.EqualError(t, err, `UserName "Test User" has the anonymous API key "*" along with other API keys, which is not allowed`)
+
+	_, err = parseConfig([]byte(strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key",`, `"apiKey": "*", "unrestricted": true,`, 1)), common.MainNet)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `UserName "Test User" has the anonymous API key "*", so it may not use "allowAnything" or "unrestricted"`)
+}
+
+func TestParseConfigAddressAliases(t *testing.T) {
+	str := `
+{
+  "addresses": [
+    { "name": "weth", "address": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6" },
+    { "name": "weth", "chain": 10002, "address": "0x1234567890123456789012345678901234567890" }
+  ],
+  "callGroups": [
+    { "name": "group", "allowedCalls": [{ "ethCall": { "chain": 10002, "contractAddress": "@weth", "call": "0x06fdde03" } }] }
+  ],
+  "permissions": [
+    {
+      "userName": "Alias User",
+      "apiKey": "alias_key",
+      "callGroups": ["group"],
+      "allowedCalls": [
+        { "ethCall": { "chain": 2, "contractAddress": "@weth", "call": "0x06fdde03" } }
+      ],
+      "deniedCalls": [
+        { "ethCall": { "chain": 2, "contractAddress": "@weth", "call": "0x18160ddd" } }
+      ]
+    }
+  ]
+}`
+	perms, err := parseConfig([]byte(str), common.UnsafeDevNet)
+	require.NoError(t, err)
+	pe := perms["alias_key"]
+	assert.True(t, pe.allowedCalls.has("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03"))
+	assert.True(t, pe.deniedCalls.has("ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd"))
+
+	// The alias for the chain takes precedence over the one for any chain.
+	assert.True(t, pe.allowedCalls.has("ethCall:10002:0000000000000000000000001234567890123456789012345678901234567890:06fdde03"))
+
+	_, err = parseConfig([]byte(strings.Replace(str, `{ "chain": 2, "contractAddress": "@weth", "call": "0x06fdde03" }`, `{ "chain": 2, "contractAddress": "@wbtc", "call": "0x06fdde03" }`, 1)), common.UnsafeDevNet)
+	assert.EqualError(t, err, `unknown address alias "wbtc" on chain 2 for user "Alias User"`)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"chain": 10002, "address"`, `"address"`, 1)), common.UnsafeDevNet)
+	assert.EqualError(t, err, `address alias "weth" is a duplicate for chain 0`)
+
+	_, err = parseConfig([]byte(strings.Replace(str, `"address": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6"`, `"address": "HelloWorld"`, 1)), common.UnsafeDevNet)
+	assert.ErrorContains(t, err, `invalid address "HelloWorld" for address alias "weth"`)
+}
@@ -108,11 +108,11 @@ func (p *PendingResponses) updateMetricsAlreadyLocked(reqRemoved *PendingRespons
 		currentNumConcurrentQueriesByChain.WithLabelValues(chainId.String()).Set(count)
 		currVal, err := getGaugeValue(maxConcurrentQueriesByChain.WithLabelValues(chainId.String()))
 		if err != nil {
-			p.logger.Error("failed to read current value of max concurrent queries metric", zap.String("chainId", chainId.String()), zap.Error(err))
+			p.logger.Error("failed to read current value of max concurrent queries metric", zap.Stringer("chainId", chainId), zap.Error(err))
 			continue
 		}
 		if count > currVal {
-			p.logger.Info("updating max concurrent queries metric", zap.String("chain", chainId.String()), zap.Float64("oldMax", currVal), zap.Float64("newMax", count))
+			p.logger.Info("updating max concurrent queries metric", zap.Stringer("chainId", chainId), zap.Float64("oldMax", currVal), zap.Float64("newMax", count))
 			maxConcurrentQueriesByChain.WithLabelValues(chainId.String()).Set(count)
 		}
 	}
@@ -1,46 +1,131 @@
 package ccq
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/certusone/wormhole/node/pkg/common"
 	"github.com/certusone/wormhole/node/pkg/query"
 	"github.com/wormhole-foundation/wormhole/sdk/vaa"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/time/rate"
 
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
 	"github.com/gagliardetto/solana-go"
+	"github.com/pelletier/go-toml/v2"
 	"gopkg.in/godo.v2/watcher/fswatch"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// functionSignatureRegex matches a canonical solidity function signature, such as "balanceOf(address)". It does not allow white space.
+	functionSignatureRegex = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*\([a-zA-Z0-9_,()\[\]]*\)$`)
+
+	// signatureSeparatorRegex matches white space around the separators in a function signature.
+	signatureSeparatorRegex = regexp.MustCompile(`\s*([,()\[\]])\s*`)
+
+	// envVarRegex matches a "${NAME}" reference to an environment variable in a config value.
+	envVarRegex = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
 )
 
 type (
 	Config struct {
-		AllowAnythingSupported bool    `json:"AllowAnythingSupported"`
-		DefaultRateLimit       float64 `json:"DefaultRateLimit"`
-		DefaultBurstSize       int     `json:"DefaultBurstSize"`
-		Permissions            []User  `json:"Permissions"`
+		AllowAnythingSupported     bool           `json:"allowAnythingSupported"`
+		AllowUnknownChains         bool           `json:"allowUnknownChains"`
+		DefaultRateLimit           float64        `json:"defaultRateLimit"`
+		DefaultBurstSize           int            `json:"defaultBurstSize"`
+		DefaultMaxCallsPerRequest  int            `json:"defaultMaxCallsPerRequest"`
+		DefaultMaxChainsPerRequest int            `json:"defaultMaxChainsPerRequest"`
+		DefaultTimeout             string         `json:"defaultTimeout"`
+		MaintenanceMode            bool           `json:"maintenanceMode"`
+		RequireNonEmpty            bool           `json:"requireNonEmpty"`
+		Strict                     bool           `json:"strict"`
+		UnrestrictedEnvironments   []string       `json:"unrestrictedEnvironments"`
+		Addresses                  []AddressAlias `json:"addresses"`
+		CallGroups                 []CallGroup    `json:"callGroups"`
+		ChainWeights               []ChainWeight  `json:"chainWeights"`
+		Permissions                []User         `json:"permissions"`
+	}
+
+	// AddressAlias names a contract address, so that calls can use "@name" as the contract address rather than repeating it. If Chain is set,
+	// the alias only applies to calls on that chain, and takes precedence over an alias with the same name and no chain.
+	AddressAlias struct {
+		Name    string `json:"name"`
+		Chain   int    `json:"chain"`
+		Address string `json:"address"`
+	}
+
+	// ChainWeight sets how much each call on a chain counts towards the weighted cost of a request. See EstimateCost.
+	ChainWeight struct {
+		Chain  int     `json:"chain"`
+		Weight float64 `json:"weight"`
+	}
+
+	// CallGroup is a named bundle of allowed calls that users can reference, so that users with the same access do not each need to list it.
+	CallGroup struct {
+		Name         string        `json:"name"`
+		AllowedCalls []AllowedCall `json:"allowedCalls"`
 	}
 
 	User struct {
-		UserName      string        `json:"userName"`
-		ApiKey        string        `json:"apiKey"`
-		AllowUnsigned bool          `json:"allowUnsigned"`
-		AllowAnything bool          `json:"allowAnything"`
-		RateLimit     *float64      `json:"RateLimit"`
-		BurstSize     *int          `json:"BurstSize"`
-		LogResponses  bool          `json:"logResponses"`
-		AllowedCalls  []AllowedCall `json:"allowedCalls"`
+		UserName          string             `json:"userName"`
+		ApiKey            string             `json:"apiKey"`
+		ApiKeys           []string           `json:"apiKeys"`
+		AllowUnsigned     bool               `json:"allowUnsigned"`
+		AllowAnything     bool               `json:"allowAnything"`
+		Unrestricted      bool               `json:"unrestricted"`
+		RateLimit         *float64           `json:"rateLimit"`
+		BurstSize         *int               `json:"burstSize"`
+		MaxCalls          *int               `json:"maxCallsPerRequest"`
+		MaxChains         *int               `json:"maxChainsPerRequest"`
+		LogResponses      bool               `json:"logResponses"`
+		SignerAddress     string             `json:"signerAddress"`
+		SignerAddresses   []string           `json:"signerAddresses"`
+		SignerThreshold   int                `json:"signerThreshold"`
+		ExpiresAt         string             `json:"expiresAt"`
+		AllowedCIDRs      []string           `json:"allowedCIDRs"`
+		AllowedChains     []int              `json:"allowedChains"`
+		BlockRestrictions []BlockRestriction `json:"blockRestrictions"`
+		MaxBlockDepth     uint64             `json:"maxBlockDepth"`
+		MaxConcurrent     int                `json:"maxConcurrent"`
+		MaxResponseBytes  int                `json:"maxResponseBytes"`
+		TruncateResponses bool               `json:"truncateResponses"`
+		Timeout           string             `json:"timeout"`
+		CallGroups        []string           `json:"callGroups"` // The names of call groups whose calls are added to the allowed calls.
+		AllowedCalls      []AllowedCall      `json:"allowedCalls"`
+		DeniedCalls       []AllowedCall      `json:"deniedCalls"`
+	}
+
+	// BlockRestriction limits the blocks that may be queried by eth calls on a chain.
+	BlockRestriction struct {
+		Chain            int    `json:"chain"`
+		MinBlockNumber   uint64 `json:"minBlockNumber"`
+		AllowBlockHashes bool   `json:"allowBlockHashes"`
 	}
 
 	AllowedCall struct {
+		Label               string               `json:"label"` // Optional description of the call, shown by describe.
+		RateLimit           *float64             `json:"rateLimit"`
 		EthCall             *EthCall             `json:"ethCall"`
 		EthCallByTimestamp  *EthCallByTimestamp  `json:"ethCallByTimestamp"`
 		EthCallWithFinality *EthCallWithFinality `json:"ethCallWithFinality"`
@@ -49,9 +134,10 @@ type (
 	}
 
 	EthCall struct {
-		Chain           int    `json:"chain"`
-		ContractAddress string `json:"contractAddress"`
-		Call            string `json:"call"`
+		Chain           int      `json:"chain"`
+		ContractAddress string   `json:"contractAddress"`
+		Call            string   `json:"call"`
+		AllowedFinality []string `json:"allowedFinality"`
 	}
 
 	EthCallByTimestamp struct {
@@ -61,63 +147,228 @@ type (
 	}
 
 	EthCallWithFinality struct {
-		Chain           int    `json:"chain"`
-		ContractAddress string `json:"contractAddress"`
-		Call            string `json:"call"`
+		Chain           int      `json:"chain"`
+		ContractAddress string   `json:"contractAddress"`
+		Call            string   `json:"call"`
+		AllowedFinality []string `json:"allowedFinality"`
 	}
 
 	SolanaAccount struct {
-		Chain   int    `json:"chain"`
-		Account string `json:"account"`
+		Chain    int      `json:"chain"`
+		Account  string   `json:"account"`
+		Accounts []string `json:"accounts"`
 	}
 
 	SolanaPda struct {
 		Chain          int    `json:"chain"`
 		ProgramAddress string `json:"programAddress"`
+		MaxSeeds       int    `json:"maxSeeds"`
 		// As a future enhancement, we may want to specify the allowed seeds.
 	}
 
 	PermissionsMap map[string]*permissionEntry
 
 	permissionEntry struct {
-		userName      string
-		apiKey        string
-		rateLimiter   *rate.Limiter
-		allowUnsigned bool
-		allowAnything bool
-		logResponses  bool
-		allowedCalls  allowedCallsForUser // Key is something like "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03"
+		userName          string
+		apiKeys           []string
+		rateLimiter       *rate.Limiter
+		allowUnsigned     bool
+		allowAnything     bool
+		unrestricted      bool // Like allowAnything, but allowed in any environment. Every request is logged at warn level.
+		logResponses      bool
+		signerAddress     *ethCommon.Address               // If set, signed requests must be signed by this address.
+		signerAddresses   map[ethCommon.Address]struct{}   // If not empty, signed requests must be signed by signerThreshold of these addresses.
+		signerThreshold   int                              // The number of distinct signerAddresses that must sign a request.
+		expiresAt         time.Time                        // If not zero, the API keys are rejected after this time.
+		allowedCIDRs      []*net.IPNet                     // If not empty, requests are only accepted from these source networks.
+		maxCalls          int                              // The maximum number of calls in a single request. Zero means no limit.
+		maxChains         int                              // The maximum number of per chain queries in a single request. Zero means no limit.
+		allowedChains     map[vaa.ChainID]struct{}         // If not empty, requests may only query these chains.
+		blockRestrictions map[vaa.ChainID]blockRestriction // Chains not in the map have no restrictions.
+		maxBlockDepth     uint64                           // How far behind the head block numbers may be on any chain. Zero means no limit.
+		maxConcurrent     int                              // The maximum number of requests in flight for each API key. Zero means no limit.
+		concurrency       map[string]*semaphore.Weighted   // Keyed by API key. Has an entry for every API key if maxConcurrent is set.
+		maxResponseBytes  int                              // The maximum size of a response. Zero means no limit.
+		truncateResponses bool                             // If set, responses over the maximum size are truncated rather than rejected.
+		timeout           time.Duration                    // How long to wait for the guardians to respond. Zero means maxRequestTimeout.
+		allowedCalls      allowedCallsForUser              // Key is something like "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03"
+		callChains        map[vaa.ChainID]struct{}         // The chains with at least one allowed call, built from allowedCalls.
+		deniedCalls       allowedCallsForUser              // Uses the same keys as allowedCalls. Takes precedence over allowedCalls and allowAnything. The options are not used.
+		warnings          []string                         // Likely mistakes in the config for this user that are not errors unless "strict" is set.
+	}
+
+	blockRestriction struct {
+		minBlockNumber   uint64 // Block numbers less than this may not be queried.
+		allowBlockHashes bool   // Since the age of a block hash cannot be determined, they are rejected unless this is set.
+	}
+
+	// allowedCallOptions contains any additional restrictions on an allowed call.
+	allowedCallOptions struct {
+		maxSeeds        int                 // Only applies to solPDA. Zero means no limit beyond what the protocol allows.
+		allowedFinality map[string]struct{} // Only applies to eth_call_with_finality requests. Empty means any finality is allowed.
+		rateLimiter     *rate.Limiter       // If set, calls matching this entry are rate limited in addition to the per-user limit.
+		argLayout       *argLayout          // Only set if the call was configured as a function signature, in which case the call data length is checked.
+		innerCallCheck  func([]byte) error  // If set, called with the full call data of a matching call. See validateCallData.
+		label           string              // The label from the config, if any.
+		lastUsed        *atomic.Int64       // Unix time in nanoseconds when a request last matched this entry, initially the time it was loaded.
 	}
 
-	allowedCallsForUser map[string]struct{}
+	// userDefaults contains the config level settings that are used when parsing each user.
+	userDefaults struct {
+		defaultRateLimit       float64
+		defaultBurstSize       int
+		defaultMaxCalls        int
+		defaultMaxChains       int
+		defaultTimeout         time.Duration
+		allowAnythingSupported bool
+		unrestrictedSupported  bool // Set if "unrestrictedEnvironments" includes the environment the config is parsed for.
+		allowUnknownChains     bool
+		strict                 bool
+		callGroups             map[string][]AllowedCall
+		addressAliases         map[string]map[vaa.ChainID]string // Keyed by name and then chain. Chain zero applies to any chain.
+		chainWeights           map[vaa.ChainID]float64           // Not used when parsing users, but kept with the other config level settings for EstimateCost.
+		maintenanceMode        bool                              // Not used when parsing users. If set, every request is rejected with ErrMaintenanceMode.
+	}
 
+	// Permissions is a parsed permissions config. It is never modified once it has been created, so it may be read concurrently without
+	// locking. Changes, such as a reload, produce a new object that is swapped into a PermissionsStore.
 	Permissions struct {
-		lock     sync.Mutex
 		env      common.Environment
 		permMap  PermissionsMap
+		defaults *userDefaults // Used to parse the users passed to UpsertUser. May be nil, in which case the built in defaults are used.
 		fileName string
-		watcher  *fswatch.Watcher
+		dirName  string // Set instead of fileName if the permissions were parsed from a directory by parseConfigDir.
+		maxSize  int64  // The limit on the size of the permissions file, used when it is reloaded.
 	}
 )
 
-// NewPermissions creates a Permissions object which contains the per-user permissions.
-func NewPermissions(fileName string, env common.Environment) (*Permissions, error) {
-	permMap, err := parseConfigFile(fileName, env)
+// NewPermissions creates a Permissions object which contains the per-user permissions. The file, and the config once decompressed, may be
+// at most maxSize bytes. The same limit applies when the file is reloaded. A maxSize of zero means DefaultMaxConfigSize.
+func NewPermissions(fileName string, env common.Environment, maxSize int64) (*Permissions, error) {
+	permMap, defaults, err := parseConfigFile(fileName, env, maxSize)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Permissions{
+		env:      env,
 		permMap:  permMap,
+		defaults: defaults,
 		fileName: fileName,
+		maxSize:  maxSize,
+	}, nil
+}
+
+// sourceAllowed returns true if requests for this user may come from the specified IP address.
+func (pe *permissionEntry) sourceAllowed(ip net.IP) bool {
+	if len(pe.allowedCIDRs) == 0 {
+		return true
+	}
+	for _, ipNet := range pe.allowedCIDRs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExpired returns true if the API keys for this user have expired as of the specified time.
+func (pe *permissionEntry) isExpired(now time.Time) bool {
+	return !pe.expiresAt.IsZero() && now.After(pe.expiresAt)
+}
+
+// chainAllowed returns true if this user may query the specified chain. It does not check the individual calls.
+func (pe *permissionEntry) chainAllowed(chainId vaa.ChainID) bool {
+	if len(pe.allowedChains) == 0 {
+		return true
+	}
+	_, exists := pe.allowedChains[chainId]
+	return exists
+}
+
+// hasCallsForChain returns true if this user has at least one allowed call on the specified chain, or may make any call.
+func (pe *permissionEntry) hasCallsForChain(chainId vaa.ChainID) bool {
+	if pe.allowAnything {
+		return true
+	}
+	_, exists := pe.callChains[chainId]
+	return exists
+}
+
+// chainsWithCalls returns the set of chains that appear in the keys of the allowed calls.
+func chainsWithCalls(calls allowedCallsForUser) map[vaa.ChainID]struct{} {
+	return calls.chains()
+}
+
+// requestTimeout returns how long a request from this user waits for the guardians to respond, after it has been validated.
+func (pe *permissionEntry) requestTimeout() time.Duration {
+	if pe.timeout == 0 {
+		return maxRequestTimeout
+	}
+	return pe.timeout
+}
+
+// markUsed records that a request matched this allowed call. It is safe to call concurrently.
+func (opts allowedCallOptions) markUsed(now time.Time) {
+	if opts.lastUsed != nil {
+		opts.lastUsed.Store(now.UnixNano())
+	}
+}
+
+// ParsePermissions creates a Permissions object from a permissions config that is held in memory rather than in a file.
+// Since there is no file associated with the returned object, starting a PermissionsStore watcher on it does nothing. If the config is gzip compressed, it
+// may be at most DefaultMaxConfigSize bytes once decompressed.
+func ParsePermissions(data []byte, env common.Environment) (*Permissions, error) {
+	return parsePermissions(data, env, DefaultMaxConfigSize)
+}
+
+// parsePermissions is like ParsePermissions, but with the specified limit on the size of the decompressed config.
+func parsePermissions(data []byte, env common.Environment, maxSize int64) (*Permissions, error) {
+	permMap, defaults, err := parseConfigWithDefaults(data, env, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Permissions{
+		env:      env,
+		permMap:  permMap,
+		defaults: defaults,
 	}, nil
 }
 
-// StartWatcher creates an fswatcher to watch for updates to the permissions file and reload it when it changes.
-func (perms *Permissions) StartWatcher(ctx context.Context, logger *zap.Logger, errC chan error) {
-	logger = logger.With(zap.String("component", "perms"))
-	perms.watcher = fswatch.NewWatcher(perms.fileName)
-	fsChan := perms.watcher.Start()
+// watchedFiles returns the paths to watch for changes to the permissions. For a directory, that is the directory itself, which changes when
+// a file is added, removed or replaced by a rename, and the config files that are in it now. It is empty if the permissions did not come
+// from a file or directory.
+func (perms *Permissions) watchedFiles() []string {
+	if perms.fileName != "" {
+		return []string{perms.fileName}
+	}
+	if perms.dirName == "" {
+		return nil
+	}
+	paths := []string{perms.dirName}
+	if dirEntries, err := os.ReadDir(perms.dirName); err == nil {
+		for _, dirEntry := range dirEntries {
+			if !dirEntry.IsDir() && configFormat(dirEntry.Name()) != "" {
+				paths = append(paths, filepath.Join(perms.dirName, dirEntry.Name()))
+			}
+		}
+	}
+	return paths
+}
+
+// source returns the file or directory that the permissions were parsed from, for logging.
+func (perms *Permissions) source() string {
+	if perms.dirName != "" {
+		return perms.dirName
+	}
+	return perms.fileName
+}
+
+// watchPermissionsFiles starts an fswatcher on the permissions files and calls the reload function whenever one of them changes.
+func watchPermissionsFiles(ctx context.Context, logger *zap.Logger, errC chan error, fileNames []string, reload func()) *fswatch.Watcher {
+	watcher := fswatch.NewWatcher(fileNames...)
+	fsChan := watcher.Start()
 
 	common.RunWithScissors(ctx, errC, "perm_file_watcher", func(ctx context.Context) error {
 		for {
@@ -125,234 +376,1569 @@ func (perms *Permissions) StartWatcher(ctx context.Context, logger *zap.Logger,
 			case <-ctx.Done():
 				return nil
 			case notif := <-fsChan:
-				if notif.Path != perms.fileName {
+				if !slices.Contains(fileNames, notif.Path) {
 					return fmt.Errorf("permissions watcher received an update for an unexpected file: %s", notif.Path)
 				}
 
 				logger.Info("the permissions file has been updated", zap.String("fileName", notif.Path), zap.Int("event", int(notif.Event)))
-				perms.Reload(logger)
+				reload()
 			}
 		}
 	})
+
+	return watcher
 }
 
-// Reload reloads the permissions file.
-func (perms *Permissions) Reload(logger *zap.Logger) {
-	permMap, err := parseConfigFile(perms.fileName, perms.env)
-	if err != nil {
-		logger.Error("failed to reload the permissions file, sticking with the old one", zap.String("fileName", perms.fileName), zap.Error(err))
-		permissionFileReloadsFailure.Inc()
-		return
+// anonymousApiKey is the API key of the user, if any, whose permissions apply to requests with an unknown API key or none at all.
+const anonymousApiKey = "*"
+
+// GetUserEntry returns the permissions entry for a given API key. It only finds the user that the key belongs to, and does not fall back to
+// the anonymous user, which only applies to requests.
+func (perms *Permissions) GetUserEntry(apiKey string) (*permissionEntry, bool) {
+	userEntry, exists := perms.permMap[apiKey]
+	return userEntry, exists
+}
+
+// PermissionsBackend is where request validation looks up the permissions for an API key. Permissions implements it using the permissions
+// file, but the permissions could equally be kept in a database.
+type PermissionsBackend interface {
+	// Lookup returns the permissions entry for a given API key, falling back to the anonymous user if the key is unknown. If there is no such user,
+	// it returns ErrInvalidAPIKey. Any other error means that the lookup failed, so the request is rejected as temporarily unavailable.
+	Lookup(apiKey string) (*permissionEntry, error)
+
+	// InMaintenance returns true if every request should be rejected with ErrMaintenanceMode.
+	InMaintenance() bool
+}
+
+// Lookup implements PermissionsBackend using GetUserEntry. It is only used on the request path, which is the only place that the anonymous
+// user applies.
+func (perms *Permissions) Lookup(apiKey string) (*permissionEntry, error) {
+	userEntry, exists := perms.GetUserEntry(apiKey)
+	if !exists {
+		userEntry, exists = perms.GetUserEntry(anonymousApiKey)
 	}
+	if !exists {
+		return nil, ErrInvalidAPIKey
+	}
+	return userEntry, nil
+}
 
-	logger.Info("successfully reloaded the permissions file, switching to it", zap.String("fileName", perms.fileName))
-	perms.lock.Lock()
-	perms.permMap = permMap
-	perms.lock.Unlock()
-	permissionFileReloadsSuccess.Inc()
+// HasAnonymousUser returns true if there is a user whose permissions apply to requests without a known API key.
+func (perms *Permissions) HasAnonymousUser() bool {
+	_, exists := perms.permMap[anonymousApiKey]
+	return exists
 }
 
-// StopWatcher stops the permissions file watcher.
-func (perms *Permissions) StopWatcher() {
-	if perms.watcher != nil {
-		perms.watcher.Stop()
+// IsEmpty returns true if there are no users, in which case every request is rejected.
+func (perms *Permissions) IsEmpty() bool {
+	return len(perms.permMap) == 0
+}
+
+// Warnings returns the likely mistakes found when parsing the config, sorted.
+func (perms *Permissions) Warnings() []string {
+	var warnings []string
+	seen := make(map[*permissionEntry]struct{})
+	for _, pe := range perms.permMap {
+		if _, exists := seen[pe]; !exists {
+			seen[pe] = struct{}{}
+			warnings = append(warnings, pe.warnings...)
+		}
 	}
+	slices.Sort(warnings)
+	return slices.Compact(warnings)
 }
 
-// GetUserEntry returns the permissions entry for a given API key. It uses the lock to protect against updates.
-func (perms *Permissions) GetUserEntry(apiKey string) (*permissionEntry, bool) {
-	perms.lock.Lock()
-	defer perms.lock.Unlock()
-	userEntry, exists := perms.permMap[apiKey]
-	return userEntry, exists
+// Keys returns the allowed calls of each user as permission keys, such as "ethCall:2:<contract>:06fdde03", keyed by user name. The keys for
+// each user are sorted, so the result is stable for diffing and snapshot tests. Every user is included, with an empty list if they have no
+// allowed calls, such as a user with "allowAnything". Denied calls are not included.
+func (perms *Permissions) Keys() map[string][]string {
+	users := usersByName(perms)
+	ret := make(map[string][]string, len(users))
+	for userName, pe := range users {
+		keys := slices.AppendSeq(make([]string, 0, pe.allowedCalls.len()), pe.allowedCalls.keys())
+		slices.Sort(keys)
+		ret[userName] = keys
+	}
+	return ret
+}
+
+// InMaintenance returns true if "maintenanceMode" is set in the config, in which case every request is rejected. Since it is part of the
+// config, it can be turned on and off by editing the permissions file while the server is running.
+func (perms *Permissions) InMaintenance() bool {
+	return perms.defaults != nil && perms.defaults.maintenanceMode
+}
+
+// logWarnings logs the warnings found when parsing the config. It also warns if there are no users, since every request would be rejected
+// as having an invalid API key, which looks like a bug to anyone who did not intend to lock down the server.
+func (perms *Permissions) logWarnings(logger *zap.Logger) {
+	if perms.InMaintenance() {
+		logger.Warn(`the permissions have "maintenanceMode" set, so all requests will be rejected`, zap.String("fileName", perms.source()))
+	}
+	if perms.IsEmpty() {
+		logger.Warn(`the permissions do not contain any users, so all requests will be rejected, set "requireNonEmpty" to treat this as an error`, zap.String("fileName", perms.source()))
+	}
+	for _, warning := range perms.Warnings() {
+		logger.Warn(`possible problem in the permissions, set "strict" to treat this as an error`, zap.String("fileName", perms.source()), zap.String("warning", warning))
+	}
 }
 
 const ETH_CALL_SIG_LENGTH = 4
 
-// parseConfigFile parses the permissions config file into a map keyed by API key.
-func parseConfigFile(fileName string, env common.Environment) (PermissionsMap, error) {
+// ValidateConfigFile parses the permissions file without using it. If there are any problems, they are all reported in the returned error, one per line.
+// The size limit is the same as for NewPermissions.
+func ValidateConfigFile(fileName string, env common.Environment, maxSize int64) error {
+	_, _, err := parseConfigFile(fileName, env, maxSize)
+	return err
+}
+
+// IsAllowed returns true if the API key is allowed to make an eth_call using the specified selector on the specified contract.
+// It uses the same lookup as request validation, so it can be used to check the permissions without building a request.
+func (perms *Permissions) IsAllowed(apiKey string, chainId vaa.ChainID, contractAddress vaa.Address, selector [ETH_CALL_SIG_LENGTH]byte) bool {
+	permsForUser, exists := perms.activeUserEntry(apiKey, chainId)
+	if !exists {
+		return false
+	}
+	k := newEthCallKey("ethCall", chainId, contractAddress, selector[:])
+	if _, denied := lookupEthCall(permsForUser.deniedCalls, k); denied {
+		return false
+	}
+	if permsForUser.allowAnything {
+		return true
+	}
+	_, allowed := lookupEthCall(permsForUser.allowedCalls, k)
+	return allowed
+}
+
+// activeUserEntry returns the permissions entry for an API key if the key may make calls on the chain. Like request validation, the key is
+// not case sensitive, and an expired key or a chain that is not in the user's "allowedChains" is treated as having no permissions.
+func (perms *Permissions) activeUserEntry(apiKey string, chainId vaa.ChainID) (*permissionEntry, bool) {
+	permsForUser, exists := perms.GetUserEntry(strings.ToLower(apiKey))
+	if !exists || permsForUser.isExpired(time.Now()) || !permsForUser.chainAllowed(chainId) {
+		return nil, false
+	}
+	return permsForUser, true
+}
+
+// UnusedSince returns the allowed calls that have not been matched by a request in the specified duration, so that stale entries can be
+// pruned from the config. Each one is formatted as the call key followed by the user name, and the list is sorted. Since usage is only
+// tracked in memory, an entry that has not been used since the permissions were loaded is only reported once the duration has passed.
+func (perms *Permissions) UnusedSince(d time.Duration) []string {
+	permMap := perms.permMap
+	cutoff := time.Now().Add(-d).UnixNano()
+	seen := make(map[*permissionEntry]struct{})
+	unused := []string{}
+	for _, pe := range permMap {
+		// All of the API keys for a user share the same entry.
+		if _, exists := seen[pe]; exists {
+			continue
+		}
+		seen[pe] = struct{}{}
+
+		for callKey, opts := range pe.allowedCalls.all() {
+			if opts.lastUsed != nil && opts.lastUsed.Load() < cutoff {
+				unused = append(unused, fmt.Sprintf(`%s for user "%s"`, callKey, pe.userName))
+			}
+		}
+	}
+
+	slices.Sort(unused)
+	return unused
+}
+
+// Merge combines these permissions with another set, such as a site specific overlay, and returns the result as a new Permissions object.
+// If an API key exists in both, it must belong to the same user, and the allowed calls are combined. A user that exists in both must have
+// at least one API key in common, since otherwise the sets would disagree about which keys it has. Any other settings for that user,
+// and the options on allowed calls that exist in both, are taken from the other set. Neither input is modified, and the result is not
+// associated with a file.
+func (perms *Permissions) Merge(other *Permissions) (*Permissions, error) {
+	base := perms.permMap
+	overlay := other.permMap
+
+	merged := make(PermissionsMap, len(base)+len(overlay))
+	for apiKey, pe := range base {
+		merged[apiKey] = pe
+	}
+
+	// Keyed by the entry in the other set. Since user names are unique within each set, each of these corresponds to a single base entry.
+	combined := make(map[*permissionEntry]*permissionEntry)
+	for apiKey, otherEntry := range overlay {
+		baseEntry, exists := base[apiKey]
+		if !exists {
+			merged[apiKey] = otherEntry
+			continue
+		}
+
+		if baseEntry.userName != otherEntry.userName {
+			return nil, fmt.Errorf(`API key with hash %s is used by user "%s" and user "%s"`, apiKeyHash(apiKey), baseEntry.userName, otherEntry.userName)
+		}
+
+		if _, exists := combined[otherEntry]; exists {
+			continue
+		}
+
+		pe := *otherEntry
+		pe.apiKeys = slices.Clone(baseEntry.apiKeys)
+		for _, key := range otherEntry.apiKeys {
+			if !slices.Contains(pe.apiKeys, key) {
+				pe.apiKeys = append(pe.apiKeys, key)
+			}
+		}
+		// The copy of the entry shares the maps of the other entry, so they are replaced rather than added to.
+		pe.allowedCalls = allowedCallsForUser{}
+		pe.allowedCalls.copyFrom(baseEntry.allowedCalls)
+		pe.allowedCalls.copyFrom(otherEntry.allowedCalls)
+		pe.callChains = chainsWithCalls(pe.allowedCalls)
+		// A call denied in either set stays denied.
+		pe.deniedCalls = allowedCallsForUser{}
+		pe.deniedCalls.copyFrom(baseEntry.deniedCalls)
+		pe.deniedCalls.copyFrom(otherEntry.deniedCalls)
+		pe.warnings = slices.Concat(baseEntry.warnings, otherEntry.warnings)
+		// The concurrency limit comes from the other set, so keys that are only in the base set need their own semaphores.
+		if pe.maxConcurrent > 0 {
+			pe.concurrency = newConcurrencyLimits(pe.apiKeys, pe.maxConcurrent, otherEntry.concurrency)
+		}
+		combined[otherEntry] = &pe
+	}
+
+	// A user in both sets whose keys do not overlap was not combined, so it would end up as two separate entries with the same name.
+	baseNames := make(map[string]struct{}, len(base))
+	for _, pe := range base {
+		baseNames[pe.userName] = struct{}{}
+	}
+	var duplicates []string
+	for _, otherEntry := range overlay {
+		if _, exists := baseNames[otherEntry.userName]; exists && combined[otherEntry] == nil && !slices.Contains(duplicates, otherEntry.userName) {
+			duplicates = append(duplicates, otherEntry.userName)
+		}
+	}
+	if len(duplicates) != 0 {
+		slices.Sort(duplicates)
+		return nil, fmt.Errorf(`user "%s" exists in both sets of permissions, but with different API keys`, duplicates[0])
+	}
+
+	// Make sure all of the keys for a combined user refer to the combined entry.
+	for _, pe := range combined {
+		for _, apiKey := range pe.apiKeys {
+			merged[apiKey] = pe
+		}
+	}
+
+	return &Permissions{
+		env:      perms.env,
+		permMap:  merged,
+		defaults: perms.defaults,
+	}, nil
+}
+
+// UpsertUser adds a user, or replaces the existing user with the same name, and returns the result as a new Permissions object that can be
+// swapped into a PermissionsStore. The user is validated the same way parseConfig does, using the defaults from the config that these
+// permissions were parsed from, and its API keys may not belong to any other user. These permissions are not modified. The change is
+// not written to the permissions file, so it is lost if the file is reloaded.
+func (perms *Permissions) UpsertUser(user User) (*Permissions, error) {
+	permMap := perms.permMap
+	defaults := perms.defaults
+	if defaults == nil {
+		defaults = &userDefaults{defaultBurstSize: 1}
+	}
+
+	var existing *permissionEntry
+	for _, pe := range permMap {
+		if pe.userName == user.UserName {
+			existing = pe
+			break
+		}
+	}
+
+	var errs []error
+	rawApiKeys := rawApiKeysForUser(user)
+	apiKeys := make([]string, 0, len(rawApiKeys))
+	for _, rawApiKey := range rawApiKeys {
+		apiKey := strings.ToLower(rawApiKey)
+		if slices.Contains(apiKeys, apiKey) {
+			errs = append(errs, fmt.Errorf(`API key with hash %s for user "%s" is a duplicate`, apiKeyHash(apiKey), user.UserName))
+		} else if pe, exists := permMap[apiKey]; exists && pe != existing {
+			errs = append(errs, fmt.Errorf(`API key with hash %s for user "%s" is a duplicate of a key for user "%s"`, apiKeyHash(apiKey), user.UserName, pe.userName))
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	pe, userErrs := defaults.parseUser(user, apiKeys)
+	errs = append(errs, userErrs...)
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// Requests that are in flight for a key that is kept should still count against its concurrency limit.
+	if existing != nil && pe.maxConcurrent > 0 && pe.maxConcurrent == existing.maxConcurrent {
+		pe.concurrency = newConcurrencyLimits(pe.apiKeys, pe.maxConcurrent, existing.concurrency)
+	}
+
+	updated := make(PermissionsMap, len(permMap)+len(pe.apiKeys))
+	for apiKey, entry := range permMap {
+		if entry != existing {
+			updated[apiKey] = entry
+		}
+	}
+	for _, apiKey := range pe.apiKeys {
+		updated[apiKey] = pe
+	}
+
+	return &Permissions{
+		env:      perms.env,
+		permMap:  updated,
+		defaults: perms.defaults,
+		fileName: perms.fileName,
+		dirName:  perms.dirName,
+		maxSize:  perms.maxSize,
+	}, nil
+}
+
+// RemoveUser removes the user that the API key belongs to, including all of its other keys, and returns the result as a new Permissions
+// object that can be swapped into a PermissionsStore. These permissions are not modified. Like UpsertUser, the change is lost if the
+// permissions file is reloaded.
+func (perms *Permissions) RemoveUser(apiKey string) (*Permissions, error) {
+	permMap := perms.permMap
+	removed, exists := permMap[strings.ToLower(apiKey)]
+	if !exists {
+		return nil, ErrInvalidAPIKey
+	}
+
+	updated := make(PermissionsMap, len(permMap))
+	for key, entry := range permMap {
+		if entry != removed {
+			updated[key] = entry
+		}
+	}
+
+	return &Permissions{
+		env:      perms.env,
+		permMap:  updated,
+		defaults: perms.defaults,
+		fileName: perms.fileName,
+		dirName:  perms.dirName,
+		maxSize:  perms.maxSize,
+	}, nil
+}
+
+// parseConfigFromEnv parses the permissions config from the specified environment variable. If the variable is unset or empty, it returns
+// an empty set of permissions. If the config is gzip compressed, it may be at most maxSize bytes once decompressed.
+func parseConfigFromEnv(varName string, env common.Environment, maxSize int64) (*Permissions, error) {
+	data := os.Getenv(varName)
+	if data == "" {
+		return &Permissions{
+			env:     env,
+			permMap: make(PermissionsMap),
+		}, nil
+	}
+
+	perms, err := parsePermissions([]byte(data), env, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to parse permissions from environment variable "%s": %w`, varName, err)
+	}
+
+	return perms, nil
+}
+
+// parseConfigDir parses every JSON, YAML and TOML file in the specified directory and merges them into a single set of permissions, which allows the
+// config to be split into multiple files, such as one per team. An API key may only appear in one file. Other files are skipped. The size
+// limit applies to each file. The returned permissions remember the directory, so that a PermissionsStore can watch and reload it.
+func parseConfigDir(logger *zap.Logger, dir string, env common.Environment, maxSize int64) (*Permissions, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to read permissions directory "%s": %w`, dir, err)
+	}
+
+	var errs []error
+	perms := &Permissions{
+		env:     env,
+		permMap: make(PermissionsMap),
+	}
+	fileNamesByApiKey := make(map[string]string)
+	for _, dirEntry := range dirEntries {
+		fileName := filepath.Join(dir, dirEntry.Name())
+		if dirEntry.IsDir() || configFormat(dirEntry.Name()) == "" {
+			logger.Debug("skipping unsupported file in permissions directory", zap.String("fileName", fileName))
+			continue
+		}
+
+		permMap, _, err := parseConfigFile(fileName, env, maxSize)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for apiKey := range permMap {
+			if otherFileName, exists := fileNamesByApiKey[apiKey]; exists {
+				errs = append(errs, fmt.Errorf(`API key with hash %s for user "%s" is in both "%s" and "%s"`, apiKeyHash(apiKey), permMap[apiKey].userName, otherFileName, fileName))
+				delete(permMap, apiKey)
+				continue
+			}
+			fileNamesByApiKey[apiKey] = fileName
+		}
+
+		perms, err = perms.Merge(&Permissions{env: env, permMap: permMap})
+		if err != nil {
+			return nil, fmt.Errorf(`failed to merge permissions file "%s": %w`, fileName, err)
+		}
+	}
+
+	if len(errs) != 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	perms.dirName = dir
+	perms.maxSize = maxSize
+	return perms, nil
+}
+
+// parseConfigFile parses the permissions config file into a map keyed by API key. It also returns the config level defaults. The file, and
+// the config once decompressed, may be at most maxSize bytes.
+func parseConfigFile(fileName string, env common.Environment, maxSize int64) (PermissionsMap, *userDefaults, error) {
 	jsonFile, err := os.Open(fileName)
 	if err != nil {
-		return nil, fmt.Errorf(`failed to open permissions file "%s": %w`, fileName, err)
+		return nil, nil, fmt.Errorf(`failed to open permissions file "%s": %w`, fileName, err)
 	}
 	defer jsonFile.Close()
 
-	byteValue, err := io.ReadAll(jsonFile)
+	byteValue, err := readConfig(jsonFile, maxSize)
 	if err != nil {
-		return nil, fmt.Errorf(`failed to read permissions file "%s": %w`, fileName, err)
+		return nil, nil, fmt.Errorf(`failed to read permissions file "%s": %w`, fileName, err)
 	}
 
-	retVal, err := parseConfig(byteValue, env)
+	format := configFormat(fileName)
+	byteValue, err = convertConfigToJSON(byteValue, format, maxSize)
 	if err != nil {
-		return nil, fmt.Errorf(`failed to parse permissions file "%s": %w`, fileName, err)
+		return nil, nil, fmt.Errorf(`failed to parse permissions file "%s": %w`, fileName, err)
 	}
 
-	return retVal, err
+	if format == "" {
+		format = "json"
+	}
+	retVal, defaults, err := parseConfigWithFormat(byteValue, env, maxSize, format)
+	if err != nil {
+		return nil, nil, fmt.Errorf(`failed to parse permissions file "%s": %w`, fileName, err)
+	}
+
+	return retVal, defaults, err
 }
 
-// parseConfig parses the permissions config from a buffer into a map keyed by API key.
-func parseConfig(byteValue []byte, env common.Environment) (PermissionsMap, error) {
-	config := Config{DefaultBurstSize: 1}
-	if err := json.Unmarshal(byteValue, &config); err != nil {
-		return nil, fmt.Errorf(`failed to unmarshal json: %w`, err)
+// configFormat returns the format of a permissions file based on its extension, ignoring any ".gz" suffix. It returns an empty string if the
+// extension is not one of the supported formats.
+func configFormat(fileName string) string {
+	switch strings.ToLower(filepath.Ext(strings.TrimSuffix(fileName, ".gz"))) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	default:
+		return ""
 	}
+}
 
-	// According to the docs, a burst size of zero does not allow any events. We don't want that!
-	if config.DefaultBurstSize == 0 {
-		return nil, errors.New("the default burst size may not be zero")
+// convertConfigToJSON converts a YAML or TOML config to JSON so that it can be handled by parseConfig. The field names are the same in all
+// formats. Anything else, including a file with an unknown extension, is assumed to be JSON already and is returned unchanged.
+func convertConfigToJSON(byteValue []byte, format string, maxSize int64) ([]byte, error) {
+	if format != "yaml" && format != "toml" {
+		return byteValue, nil
 	}
 
-	if config.AllowAnythingSupported && env == common.MainNet {
-		return nil, fmt.Errorf(`the "allowAnythingSupported" flag is not supported in mainnet`)
+	byteValue, err := decompressIfGzipped(byteValue, maxSize)
+	if err != nil {
+		return nil, err
 	}
 
-	ret := make(PermissionsMap)
-	userNames := map[string]struct{}{}
-	for _, user := range config.Permissions {
-		// Since we log user names in all our error messages, make sure they are unique.
-		if _, exists := userNames[user.UserName]; exists {
-			return nil, fmt.Errorf(`UserName "%s" is a duplicate`, user.UserName)
+	var config map[string]any
+	if format == "yaml" {
+		err = unmarshalYAML(byteValue, &config)
+	} else {
+		err = toml.Unmarshal(byteValue, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", format, err)
+	}
+
+	jsonBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s to json: %w", format, err)
+	}
+	return jsonBytes, nil
+}
+
+// unmarshalYAML is like yaml.Unmarshal, but rejects unquoted hex values. YAML reads a value like 0x000000000000000000000000000000000000abcd
+// as an integer, which would silently turn an address into a number, so addresses and other hex values must be quoted.
+func unmarshalYAML(byteValue []byte, out any) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(byteValue, &doc); err != nil {
+		return err
+	}
+	if err := checkYAMLHexValues(&doc); err != nil {
+		return err
+	}
+	return doc.Decode(out)
+}
+
+// checkYAMLHexValues returns an error for the first unquoted hex value in the YAML document.
+func checkYAMLHexValues(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!int" && node.Style == 0 {
+		value := strings.TrimLeft(node.Value, "+-")
+		if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+			return fmt.Errorf(`line %d: the value "%s" must be quoted, otherwise it is read as a number rather than a hex string`, node.Line, node.Value)
 		}
-		userNames[user.UserName] = struct{}{}
+	}
+	for _, child := range node.Content {
+		if err := checkYAMLHexValues(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		apiKey := strings.ToLower(user.ApiKey)
-		if _, exists := ret[apiKey]; exists {
-			return nil, fmt.Errorf(`API key "%s" is a duplicate`, apiKey)
-		}
-
-		if user.AllowAnything {
-			if !config.AllowAnythingSupported {
-				return nil, fmt.Errorf(`UserName "%s" has "allowAnything" specified when the feature is not enabled`, user.UserName)
-			}
-			if len(user.AllowedCalls) != 0 {
-				return nil, fmt.Errorf(`UserName "%s" has "allowedCalls" specified with "allowAnything", which is not allowed`, user.UserName)
-			}
-		}
-
-		var rateLimiter *rate.Limiter
-		rateLimit := config.DefaultRateLimit
-		if user.RateLimit != nil {
-			rateLimit = *user.RateLimit
-		}
-		if rateLimit != 0 {
-			burstSize := config.DefaultBurstSize
-			if user.BurstSize != nil {
-				burstSize = *user.BurstSize
-			}
-			if burstSize == 0 {
-				return nil, errors.New("if rate limiting is enabled, the burst size may not be zero")
-			}
-			rateLimiter = rate.NewLimiter(rate.Limit(rateLimit), burstSize)
-		}
-
-		// Build the list of allowed calls for this API key.
-		allowedCalls := make(allowedCallsForUser)
-		for _, ac := range user.AllowedCalls {
-			var chain int
-			var callType, contractAddressStr, callStr, callKey string
-			// var contractAddressStr string
-			if ac.EthCall != nil {
-				callType = "ethCall"
-				chain = ac.EthCall.Chain
-				contractAddressStr = ac.EthCall.ContractAddress
-				callStr = ac.EthCall.Call
-			} else if ac.EthCallByTimestamp != nil {
-				callType = "ethCallByTimestamp"
-				chain = ac.EthCallByTimestamp.Chain
-				contractAddressStr = ac.EthCallByTimestamp.ContractAddress
-				callStr = ac.EthCallByTimestamp.Call
-			} else if ac.EthCallWithFinality != nil {
-				callType = "ethCallWithFinality"
-				chain = ac.EthCallWithFinality.Chain
-				contractAddressStr = ac.EthCallWithFinality.ContractAddress
-				callStr = ac.EthCallWithFinality.Call
-			} else if ac.SolanaAccount != nil {
-				// We assume the account is base58, but if it starts with "0x" it should be 32 bytes of hex.
-				account := ac.SolanaAccount.Account
-				if strings.HasPrefix(account, "0x") {
-					buf, err := hex.DecodeString(account[2:])
-					if err != nil {
-						return nil, fmt.Errorf(`invalid solana account hex string "%s" for user "%s": %w`, account, user.UserName, err)
-					}
-					if len(buf) != query.SolanaPublicKeyLength {
-						return nil, fmt.Errorf(`invalid solana account hex string "%s" for user "%s, must be %d bytes`, account, user.UserName, query.SolanaPublicKeyLength)
-					}
-					account = solana.PublicKey(buf).String()
-				} else {
-					// Make sure it is valid base58.
-					_, err := solana.PublicKeyFromBase58(account)
-					if err != nil {
-						return nil, fmt.Errorf(`solana account string "%s" for user "%s" is not valid base58: %w`, account, user.UserName, err)
-					}
-				}
-				callKey = fmt.Sprintf("solAccount:%d:%s", ac.SolanaAccount.Chain, account)
-			} else if ac.SolanaPda != nil {
-				// We assume the account is base58, but if it starts with "0x" it should be 32 bytes of hex.
-				pa := ac.SolanaPda.ProgramAddress
-				if strings.HasPrefix(pa, "0x") {
-					buf, err := hex.DecodeString(pa[2:])
-					if err != nil {
-						return nil, fmt.Errorf(`invalid solana program address hex string "%s" for user "%s": %w`, pa, user.UserName, err)
-					}
-					if len(buf) != query.SolanaPublicKeyLength {
-						return nil, fmt.Errorf(`invalid solana program address hex string "%s" for user "%s, must be %d bytes`, pa, user.UserName, query.SolanaPublicKeyLength)
-					}
-					pa = solana.PublicKey(buf).String()
-				} else {
-					// Make sure it is valid base58.
-					_, err := solana.PublicKeyFromBase58(pa)
-					if err != nil {
-						return nil, fmt.Errorf(`solana program address string "%s" for user "%s" is not valid base58: %w`, pa, user.UserName, err)
-					}
-				}
-				callKey = fmt.Sprintf("solPDA:%d:%s", ac.SolanaPda.Chain, pa)
-			} else {
-				return nil, fmt.Errorf(`unsupported call type for user "%s", must be "ethCall", "ethCallByTimestamp", "ethCallWithFinality", "solAccount" or "solPDA"`, user.UserName)
-			}
-
-			if callKey == "" {
-				// Convert the contract address into a standard format like "000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6".
-				contractAddress := contractAddressStr
-				if contractAddressStr != "*" {
-					contractAddr, err := vaa.StringToAddress(contractAddressStr)
-					if err != nil {
-						return nil, fmt.Errorf(`invalid contract address "%s" for user "%s"`, contractAddressStr, user.UserName)
-					}
-					contractAddress = contractAddr.String()
-				}
+// parseConfig parses the permissions config from a buffer into a map keyed by API key. The config may be gzip compressed.
+func parseConfig(byteValue []byte, env common.Environment) (PermissionsMap, error) {
+	permMap, _, err := parseConfigWithDefaults(byteValue, env, DefaultMaxConfigSize)
+	return permMap, err
+}
 
-				// The call should be the ABI four byte hex hash of the function signature. Parse it into a standard form of "06fdde03".
-				call, err := hex.DecodeString(strings.TrimPrefix(callStr, "0x"))
-				if err != nil {
-					return nil, fmt.Errorf(`invalid eth call "%s" for user "%s"`, callStr, user.UserName)
-				}
-				if len(call) != ETH_CALL_SIG_LENGTH {
-					return nil, fmt.Errorf(`eth call "%s" for user "%s" has an invalid length, must be %d bytes`, callStr, user.UserName, ETH_CALL_SIG_LENGTH)
-				}
+// parseConfigWithDefaults is like parseConfig, but also returns the config level defaults, so that users can be parsed individually later.
+// If the config is gzip compressed, it may be at most maxSize bytes once decompressed.
+func parseConfigWithDefaults(byteValue []byte, env common.Environment, maxSize int64) (PermissionsMap, *userDefaults, error) {
+	return parseConfigWithFormat(byteValue, env, maxSize, "json")
+}
 
-				// The permission key is the chain, contract address and call formatted as a colon separated string.
-				callKey = fmt.Sprintf("%s:%d:%s:%s", callType, chain, contractAddress, hex.EncodeToString(call))
-			}
+// parseConfigWithFormat is like parseConfigWithDefaults, but the config was originally in the specified format and has been converted to
+// JSON by convertConfigToJSON. Line numbers in the converted JSON would not match the original file, so they are only reported for JSON.
+func parseConfigWithFormat(byteValue []byte, env common.Environment, maxSize int64, format string) (PermissionsMap, *userDefaults, error) {
+	byteValue, err := decompressIfGzipped(byteValue, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			if _, exists := allowedCalls[callKey]; exists {
-				return nil, fmt.Errorf(`"%s" is a duplicate allowed call for user "%s"`, callKey, user.UserName)
-			}
+	byteValue, err = standardizeJSON(byteValue)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			allowedCalls[callKey] = struct{}{}
-		}
+	byteValue, err = expandEnvVars(byteValue)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		pe := &permissionEntry{
-			userName:      user.UserName,
-			apiKey:        apiKey,
-			rateLimiter:   rateLimiter,
-			allowUnsigned: user.AllowUnsigned,
-			allowAnything: user.AllowAnything,
-			logResponses:  user.LogResponses,
-			allowedCalls:  allowedCalls,
+	config := Config{DefaultBurstSize: 1}
+	if err := json.Unmarshal(byteValue, &config); err != nil {
+		if format != "json" {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				return nil, nil, fmt.Errorf(`failed to unmarshal %s: the value of "%s" may not be a %s`, format, typeErr.Field, typeErr.Value)
+			}
+			return nil, nil, fmt.Errorf(`failed to unmarshal %s: %w`, format, err)
 		}
+		if line, ok := jsonErrorLine(byteValue, err); ok {
+			return nil, nil, fmt.Errorf(`failed to unmarshal json at line %d: %w`, line, err)
+		}
+		return nil, nil, fmt.Errorf(`failed to unmarshal json: %w`, err)
+	}
+
+	// According to the docs, a burst size of zero does not allow any events. We don't want that!
+	if config.DefaultBurstSize == 0 {
+		return nil, nil, errors.New("the default burst size may not be zero")
+	}
+
+	// A negative rate limit would silently reject every request, rather than meaning unlimited like zero does.
+	if config.DefaultRateLimit < 0 {
+		return nil, nil, errors.New("the default rate limit may not be negative")
+	}
 
-		ret[apiKey] = pe
+	if config.DefaultMaxCallsPerRequest < 0 {
+		return nil, nil, errors.New("the default max calls per request may not be negative")
 	}
 
-	return ret, nil
+	if config.DefaultMaxChainsPerRequest < 0 {
+		return nil, nil, errors.New("the default max chains per request may not be negative")
+	}
+
+	defaults := &userDefaults{
+		defaultRateLimit:       config.DefaultRateLimit,
+		defaultBurstSize:       config.DefaultBurstSize,
+		defaultMaxCalls:        config.DefaultMaxCallsPerRequest,
+		defaultMaxChains:       config.DefaultMaxChainsPerRequest,
+		allowAnythingSupported: config.AllowAnythingSupported,
+		allowUnknownChains:     config.AllowUnknownChains,
+		strict:                 config.Strict,
+		maintenanceMode:        config.MaintenanceMode,
+		callGroups:             make(map[string][]AllowedCall, len(config.CallGroups)),
+	}
+	if config.DefaultTimeout != "" {
+		var err error
+		defaults.defaultTimeout, err = parseRequestTimeout(config.DefaultTimeout)
+		if err != nil {
+			return nil, nil, fmt.Errorf(`invalid defaultTimeout "%s": %w`, config.DefaultTimeout, err)
+		}
+	}
+
+	if config.AllowAnythingSupported && env == common.MainNet {
+		return nil, nil, fmt.Errorf(`the "allowAnythingSupported" flag is not supported in mainnet`)
+	}
+
+	// Since "unrestricted" works in mainnet, where "allowAnything" is banned, each environment it may be used in must be listed explicitly.
+	for _, envStr := range config.UnrestrictedEnvironments {
+		unrestrictedEnv, err := common.ParseEnvironment(envStr)
+		if err != nil {
+			return nil, nil, fmt.Errorf(`invalid environment "%s" in "unrestrictedEnvironments"`, envStr)
+		}
+		if unrestrictedEnv == env {
+			defaults.unrestrictedSupported = true
+		}
+	}
+
+	if config.RequireNonEmpty && len(config.Permissions) == 0 {
+		return nil, nil, errors.New(`the config does not contain any users and "requireNonEmpty" is set`)
+	}
+
+	// Call groups are expanded into the allowed calls of each user that references them.
+	for _, group := range config.CallGroups {
+		if group.Name == "" {
+			return nil, nil, errors.New("a call group does not have a name")
+		}
+		if _, exists := defaults.callGroups[group.Name]; exists {
+			return nil, nil, fmt.Errorf(`call group "%s" is a duplicate`, group.Name)
+		}
+		defaults.callGroups[group.Name] = group.AllowedCalls
+	}
+
+	// Address aliases are resolved as each user is parsed, so they also apply to the call groups.
+	for _, alias := range config.Addresses {
+		if alias.Name == "" {
+			return nil, nil, errors.New("an address alias does not have a name")
+		}
+		if alias.Chain < 0 || alias.Chain > math.MaxUint16 {
+			return nil, nil, fmt.Errorf(`invalid chain %d for address alias "%s"`, alias.Chain, alias.Name)
+		}
+		if _, err := vaa.StringToAddress(alias.Address); err != nil {
+			return nil, nil, fmt.Errorf(`invalid address "%s" for address alias "%s": %w`, alias.Address, alias.Name, err)
+		}
+		if defaults.addressAliases == nil {
+			defaults.addressAliases = make(map[string]map[vaa.ChainID]string)
+		}
+		if defaults.addressAliases[alias.Name] == nil {
+			defaults.addressAliases[alias.Name] = make(map[vaa.ChainID]string)
+		}
+		if _, exists := defaults.addressAliases[alias.Name][vaa.ChainID(alias.Chain)]; exists {
+			return nil, nil, fmt.Errorf(`address alias "%s" is a duplicate for chain %d`, alias.Name, alias.Chain)
+		}
+		defaults.addressAliases[alias.Name][vaa.ChainID(alias.Chain)] = alias.Address
+	}
+
+	// Chains without a weight count as one per call.
+	for _, cw := range config.ChainWeights {
+		if cw.Chain <= 0 || cw.Chain > math.MaxUint16 {
+			return nil, nil, fmt.Errorf(`invalid chain weight chain %d`, cw.Chain)
+		}
+		if cw.Weight < 0 {
+			return nil, nil, fmt.Errorf(`invalid weight %v for chain %d, may not be negative`, cw.Weight, cw.Chain)
+		}
+		if defaults.chainWeights == nil {
+			defaults.chainWeights = make(map[vaa.ChainID]float64)
+		}
+		if _, exists := defaults.chainWeights[vaa.ChainID(cw.Chain)]; exists {
+			return nil, nil, fmt.Errorf(`chain %d has a duplicate chain weight`, cw.Chain)
+		}
+		defaults.chainWeights[vaa.ChainID(cw.Chain)] = cw.Weight
+	}
+
+	// Errors in the individual users are accumulated so that they can all be reported at once.
+	var errs []error
+	ret := make(PermissionsMap)
+	userNames := map[string]struct{}{}
+	// Keyed by the lower case API key. The value is the user it belongs to, so that a duplicate error can name both users.
+	seenApiKeys := map[string]string{}
+	for _, user := range config.Permissions {
+		// Since we log user names in all our error messages, make sure they are unique.
+		if _, exists := userNames[user.UserName]; exists {
+			errs = append(errs, fmt.Errorf(`UserName "%s" is a duplicate`, user.UserName))
+		}
+		userNames[user.UserName] = struct{}{}
+
+		rawApiKeys := rawApiKeysForUser(user)
+		apiKeys := make([]string, 0, len(rawApiKeys))
+		for _, rawApiKey := range rawApiKeys {
+			apiKey := strings.ToLower(rawApiKey)
+			if seenUserName, exists := seenApiKeys[apiKey]; exists {
+				errs = append(errs, fmt.Errorf(`API key with hash %s for user "%s" is a duplicate of a key for user "%s"`, apiKeyHash(apiKey), user.UserName, seenUserName))
+			} else {
+				seenApiKeys[apiKey] = user.UserName
+			}
+			apiKeys = append(apiKeys, apiKey)
+		}
+
+		pe, userErrs := defaults.parseUser(user, apiKeys)
+		errs = append(errs, userErrs...)
+		for _, apiKey := range apiKeys {
+			ret[apiKey] = pe
+		}
+	}
+
+	if len(errs) != 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+
+	return ret, defaults, nil
+}
+
+// rawApiKeysForUser returns the API keys of a user as written in the config. A user may have multiple API keys to allow key rotation.
+// The "apiKey" field is still supported for backward compatibility. The result is empty if the user has neither, which parseUser rejects.
+func rawApiKeysForUser(user User) []string {
+	rawApiKeys := user.ApiKeys
+	if user.ApiKey != "" {
+		rawApiKeys = append([]string{user.ApiKey}, rawApiKeys...)
+	}
+	return rawApiKeys
+}
+
+// parseUser parses a single user from the config, using the config level defaults. The API keys must already be in lower case. Errors are
+// returned rather than stopping at the first one, so that they can all be reported at once. Checks that span users, such as for duplicate
+// API keys, are left to the caller.
+func (d *userDefaults) parseUser(user User, apiKeys []string) (*permissionEntry, []error) {
+	var errs []error
+	// The calls in the referenced groups are treated as though they were listed in the user's "allowedCalls".
+	userAllowedCalls := user.AllowedCalls
+	for _, groupName := range user.CallGroups {
+		groupCalls, exists := d.callGroups[groupName]
+		if !exists {
+			errs = append(errs, fmt.Errorf(`UserName "%s" references undefined call group "%s"`, user.UserName, groupName))
+			continue
+		}
+		userAllowedCalls = append(slices.Clip(userAllowedCalls), groupCalls...)
+	}
+
+	if user.AllowAnything {
+		if !d.allowAnythingSupported {
+			errs = append(errs, fmt.Errorf(`UserName "%s" has "allowAnything" specified when the feature is not enabled`, user.UserName))
+		}
+		if len(userAllowedCalls) != 0 {
+			errs = append(errs, fmt.Errorf(`UserName "%s" has "allowedCalls" specified with "allowAnything", which is not allowed`, user.UserName))
+		}
+	}
+
+	if user.Unrestricted {
+		if !d.unrestrictedSupported {
+			errs = append(errs, fmt.Errorf(`UserName "%s" has "unrestricted" specified when the environment is not in "unrestrictedEnvironments"`, user.UserName))
+		}
+		if len(userAllowedCalls) != 0 {
+			errs = append(errs, fmt.Errorf(`UserName "%s" has "allowedCalls" specified with "unrestricted", which is not allowed`, user.UserName))
+		}
+	}
+
+	// Otherwise the user would be stored under the empty API key, which no request can match.
+	if len(apiKeys) == 0 {
+		errs = append(errs, fmt.Errorf(`UserName "%s" does not have an "apiKey" or "apiKeys"`, user.UserName))
+	} else if slices.Contains(apiKeys, "") {
+		errs = append(errs, fmt.Errorf(`UserName "%s" has an empty API key`, user.UserName))
+	}
+
+	// The anonymous user is meant for a public tier, so it may only make the calls it lists, and may not share an entry with real API keys.
+	if slices.Contains(apiKeys, anonymousApiKey) {
+		if len(apiKeys) != 1 {
+			errs = append(errs, fmt.Errorf(`UserName "%s" has the anonymous API key "%s" along with other API keys, which is not allowed`, user.UserName, anonymousApiKey))
+		}
+		if user.AllowAnything || user.Unrestricted {
+			errs = append(errs, fmt.Errorf(`UserName "%s" has the anonymous API key "%s", so it may not use "allowAnything" or "unrestricted"`, user.UserName, anonymousApiKey))
+		}
+	}
+
+	// Likely mistakes are recorded as warnings, unless "strict" is set, in which case they are errors. Returns false for an error.
+	var warnings []string
+	addWarning := func(warning string) bool {
+		if d.strict {
+			errs = append(errs, errors.New(warning))
+			return false
+		}
+		warnings = append(warnings, warning)
+		return true
+	}
+
+	var signerAddress *ethCommon.Address
+	if user.SignerAddress != "" {
+		if !ethCommon.IsHexAddress(user.SignerAddress) {
+			errs = append(errs, fmt.Errorf(`invalid signer address "%s" for user "%s"`, user.SignerAddress, user.UserName))
+		} else {
+			addr := ethCommon.HexToAddress(user.SignerAddress)
+			signerAddress = &addr
+		}
+	}
+	for _, rawAddr := range append([]string{user.SignerAddress}, user.SignerAddresses...) {
+		if invalidAddressChecksum(rawAddr) {
+			addWarning(fmt.Sprintf(`signer address "%s" for user "%s" has an invalid checksum`, rawAddr, user.UserName))
+		}
+	}
+
+	signerAddresses, signerThreshold, err := parseSignerAddresses(user)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	// The proxy signs an unsigned request with its own key, so allowing unsigned requests would get around the signer check.
+	if user.AllowUnsigned && (user.SignerAddress != "" || len(user.SignerAddresses) != 0) {
+		errs = append(errs, fmt.Errorf(`UserName "%s" has "allowUnsigned" specified with "signerAddress" or "signerAddresses", which is not allowed`, user.UserName))
+	}
+
+	var expiresAt time.Time
+	if user.ExpiresAt != "" {
+		var err error
+		expiresAt, err = time.Parse(time.RFC3339, user.ExpiresAt)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(`invalid expiresAt "%s" for user "%s", must be RFC3339: %w`, user.ExpiresAt, user.UserName, err))
+		}
+	}
+
+	timeout := d.defaultTimeout
+	if user.Timeout != "" {
+		var err error
+		timeout, err = parseRequestTimeout(user.Timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(`invalid timeout "%s" for user "%s": %w`, user.Timeout, user.UserName, err))
+		}
+	}
+
+	var allowedCIDRs []*net.IPNet
+	for _, cidr := range user.AllowedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf(`invalid CIDR "%s" for user "%s"`, cidr, user.UserName))
+			continue
+		}
+		allowedCIDRs = append(allowedCIDRs, ipNet)
+	}
+
+	var rateLimiter *rate.Limiter
+	rateLimit := d.defaultRateLimit
+	if user.RateLimit != nil {
+		rateLimit = *user.RateLimit
+		if rateLimit < 0 {
+			errs = append(errs, fmt.Errorf(`invalid rate limit %v for user "%s", may not be negative`, rateLimit, user.UserName))
+		}
+	}
+	burstSize := d.defaultBurstSize
+	if user.BurstSize != nil {
+		burstSize = *user.BurstSize
+	}
+	if rateLimit != 0 {
+		if burstSize == 0 {
+			errs = append(errs, errors.New("if rate limiting is enabled, the burst size may not be zero"))
+		}
+		rateLimiter = rate.NewLimiter(rate.Limit(rateLimit), burstSize)
+	}
+
+	maxCalls := d.defaultMaxCalls
+	if user.MaxCalls != nil {
+		maxCalls = *user.MaxCalls
+	}
+	if maxCalls < 0 {
+		errs = append(errs, fmt.Errorf(`invalid max calls per request %d for user "%s", may not be negative`, maxCalls, user.UserName))
+	}
+
+	maxChains := d.defaultMaxChains
+	if user.MaxChains != nil {
+		maxChains = *user.MaxChains
+	}
+	if maxChains < 0 {
+		errs = append(errs, fmt.Errorf(`invalid max chains per request %d for user "%s", may not be negative`, maxChains, user.UserName))
+	}
+
+	var concurrency map[string]*semaphore.Weighted
+	if user.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf(`invalid max concurrent requests %d for user "%s", may not be negative`, user.MaxConcurrent, user.UserName))
+	} else if user.MaxConcurrent > 0 {
+		concurrency = newConcurrencyLimits(apiKeys, user.MaxConcurrent, nil)
+	}
+
+	if user.MaxResponseBytes < 0 {
+		errs = append(errs, fmt.Errorf(`invalid max response bytes %d for user "%s", may not be negative`, user.MaxResponseBytes, user.UserName))
+	}
+	if user.TruncateResponses && user.MaxResponseBytes == 0 {
+		errs = append(errs, fmt.Errorf(`UserName "%s" has "truncateResponses" specified without "maxResponseBytes"`, user.UserName))
+	}
+
+	var allowedChains map[vaa.ChainID]struct{}
+	for _, chain := range user.AllowedChains {
+		if chain <= 0 || chain > math.MaxUint16 {
+			errs = append(errs, fmt.Errorf(`invalid allowed chain %d for user "%s"`, chain, user.UserName))
+			continue
+		}
+		if allowedChains == nil {
+			allowedChains = make(map[vaa.ChainID]struct{})
+		}
+		allowedChains[vaa.ChainID(chain)] = struct{}{}
+	}
+
+	var blockRestrictions map[vaa.ChainID]blockRestriction
+	for _, br := range user.BlockRestrictions {
+		if br.Chain <= 0 || br.Chain > math.MaxUint16 {
+			errs = append(errs, fmt.Errorf(`invalid block restriction chain %d for user "%s"`, br.Chain, user.UserName))
+			continue
+		}
+		if blockRestrictions == nil {
+			blockRestrictions = make(map[vaa.ChainID]blockRestriction)
+		}
+		if _, exists := blockRestrictions[vaa.ChainID(br.Chain)]; exists {
+			errs = append(errs, fmt.Errorf(`chain %d has a duplicate block restriction for user "%s"`, br.Chain, user.UserName))
+			continue
+		}
+		blockRestrictions[vaa.ChainID(br.Chain)] = blockRestriction{minBlockNumber: br.MinBlockNumber, allowBlockHashes: br.AllowBlockHashes}
+	}
+
+	// Build the list of allowed calls for this API key.
+	var allowedCalls allowedCallsForUser
+	loadTime := time.Now().UnixNano()
+	for _, ac := range userAllowedCalls {
+		ac, err := d.resolveAddressAlias(ac, user.UserName)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		callKeys, opts, err := parseAllowedCall(ac, user.UserName, d.allowUnknownChains)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		opts.label = ac.Label
+
+		// An all zero address parses fine, but it is almost certainly a placeholder that was left in by accident.
+		if rawAddr, isZero := zeroContractAddress(ac); isZero {
+			if !addWarning(fmt.Sprintf(`allowed call for user "%s" has a zero contract address "%s"`, user.UserName, rawAddr)) {
+				continue
+			}
+		}
+
+		// A mixed case address is assumed to be EIP-55 checksummed, so a bad checksum probably means a typo in the address.
+		if rawAddr := configContractAddress(ac); invalidAddressChecksum(rawAddr) {
+			if !addWarning(fmt.Sprintf(`allowed call for user "%s" has contract address "%s" with an invalid checksum`, user.UserName, rawAddr)) {
+				continue
+			}
+		}
+
+		if ac.RateLimit != nil && (*ac.RateLimit <= 0 || burstSize <= 0) {
+			errs = append(errs, fmt.Errorf(`invalid rate limit %v on an allowed call for user "%s", the rate limit and burst size must be positive`, *ac.RateLimit, user.UserName))
+			continue
+		}
+
+		for _, callKey := range callKeys {
+			if allowedCalls.has(callKey) {
+				errs = append(errs, fmt.Errorf(`"%s" is a duplicate allowed call for user "%s"`, callKey, user.UserName))
+			}
+
+			// Each permission key gets its own token bucket, using the same burst size as the per-user limit.
+			if ac.RateLimit != nil {
+				opts.rateLimiter = rate.NewLimiter(rate.Limit(*ac.RateLimit), burstSize)
+			}
+			opts.lastUsed = new(atomic.Int64)
+			opts.lastUsed.Store(loadTime)
+			allowedCalls.set(callKey, opts)
+		}
+	}
+
+	// The denied calls use the same format as the allowed calls, including wild cards.
+	var deniedCalls allowedCallsForUser
+	for _, dc := range user.DeniedCalls {
+		dc, err := d.resolveAddressAlias(dc, user.UserName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid denied call: %w", err))
+			continue
+		}
+		callKeys, _, err := parseAllowedCall(dc, user.UserName, d.allowUnknownChains)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid denied call: %w", err))
+			continue
+		}
+		if rawAddr := configContractAddress(dc); invalidAddressChecksum(rawAddr) {
+			if !addWarning(fmt.Sprintf(`denied call for user "%s" has contract address "%s" with an invalid checksum`, user.UserName, rawAddr)) {
+				continue
+			}
+		}
+
+		for _, callKey := range callKeys {
+			if deniedCalls.has(callKey) {
+				errs = append(errs, fmt.Errorf(`"%s" is a duplicate denied call for user "%s"`, callKey, user.UserName))
+			}
+			deniedCalls.set(callKey, allowedCallOptions{})
+		}
+	}
+
+	pe := &permissionEntry{
+		userName:          user.UserName,
+		apiKeys:           apiKeys,
+		rateLimiter:       rateLimiter,
+		allowUnsigned:     user.AllowUnsigned,
+		allowAnything:     user.AllowAnything || user.Unrestricted,
+		unrestricted:      user.Unrestricted,
+		logResponses:      user.LogResponses,
+		signerAddress:     signerAddress,
+		signerAddresses:   signerAddresses,
+		signerThreshold:   signerThreshold,
+		expiresAt:         expiresAt,
+		allowedCIDRs:      allowedCIDRs,
+		maxCalls:          maxCalls,
+		maxChains:         maxChains,
+		allowedChains:     allowedChains,
+		blockRestrictions: blockRestrictions,
+		maxBlockDepth:     user.MaxBlockDepth,
+		maxConcurrent:     user.MaxConcurrent,
+		concurrency:       concurrency,
+		maxResponseBytes:  user.MaxResponseBytes,
+		truncateResponses: user.TruncateResponses,
+		timeout:           timeout,
+		allowedCalls:      allowedCalls,
+		callChains:        chainsWithCalls(allowedCalls),
+		deniedCalls:       deniedCalls,
+		warnings:          warnings,
+	}
+
+	return pe, errs
+}
+
+// resolveAddressAlias returns the call with an "@name" contract address replaced by the address it is an alias for. The call is copied
+// rather than updated in place, since it may come from a call group that is shared with other users.
+func (d *userDefaults) resolveAddressAlias(ac AllowedCall, userName string) (AllowedCall, error) {
+	resolve := func(chain int, contractAddress string) (string, error) {
+		name, isAlias := strings.CutPrefix(contractAddress, "@")
+		if !isAlias {
+			return contractAddress, nil
+		}
+		if addr, exists := d.addressAliases[name][vaa.ChainID(chain)]; exists {
+			return addr, nil
+		}
+		if addr, exists := d.addressAliases[name][vaa.ChainIDUnset]; exists {
+			return addr, nil
+		}
+		return "", fmt.Errorf(`unknown address alias "%s" on chain %d for user "%s"`, name, chain, userName)
+	}
+
+	var err error
+	switch {
+	case ac.EthCall != nil:
+		ec := *ac.EthCall
+		ec.ContractAddress, err = resolve(ec.Chain, ec.ContractAddress)
+		ac.EthCall = &ec
+	case ac.EthCallByTimestamp != nil:
+		ec := *ac.EthCallByTimestamp
+		ec.ContractAddress, err = resolve(ec.Chain, ec.ContractAddress)
+		ac.EthCallByTimestamp = &ec
+	case ac.EthCallWithFinality != nil:
+		ec := *ac.EthCallWithFinality
+		ec.ContractAddress, err = resolve(ec.Chain, ec.ContractAddress)
+		ac.EthCallWithFinality = &ec
+	}
+	return ac, err
+}
+
+// reuseConcurrencyLimits gives the users in a reloaded config the semaphores of the current config, for each API key whose concurrency limit
+// has not changed, so that the requests in flight during a reload still count against the limit.
+func reuseConcurrencyLimits(permMap PermissionsMap, current PermissionsMap) {
+	seen := make(map[*permissionEntry]struct{})
+	for _, pe := range permMap {
+		if _, exists := seen[pe]; exists || pe.maxConcurrent == 0 {
+			continue
+		}
+		seen[pe] = struct{}{}
+		existing := make(map[string]*semaphore.Weighted)
+		for _, apiKey := range pe.apiKeys {
+			if old, exists := current[apiKey]; exists && old.maxConcurrent == pe.maxConcurrent && old.concurrency[apiKey] != nil {
+				existing[apiKey] = old.concurrency[apiKey]
+			}
+		}
+		pe.concurrency = newConcurrencyLimits(pe.apiKeys, pe.maxConcurrent, existing)
+	}
+}
+
+// newConcurrencyLimits returns a semaphore allowing maxConcurrent requests for each API key. Any semaphores in existing are reused.
+func newConcurrencyLimits(apiKeys []string, maxConcurrent int, existing map[string]*semaphore.Weighted) map[string]*semaphore.Weighted {
+	ret := make(map[string]*semaphore.Weighted, len(apiKeys))
+	for _, apiKey := range apiKeys {
+		if sem, exists := existing[apiKey]; exists {
+			ret[apiKey] = sem
+		} else {
+			ret[apiKey] = semaphore.NewWeighted(int64(maxConcurrent))
+		}
+	}
+	return ret
+}
+
+// decompressIfGzipped returns the decompressed data if it starts with the gzip magic bytes. Otherwise it returns the data unchanged. The
+// decompressed data may be at most maxSize bytes.
+func decompressIfGzipped(byteValue []byte, maxSize int64) ([]byte, error) {
+	if !bytes.HasPrefix(byteValue, []byte{0x1f, 0x8b}) {
+		return byteValue, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(byteValue))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress gzipped config: %w", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := readConfig(reader, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress gzipped config: %w", err)
+	}
+	return decompressed, nil
+}
+
+// DefaultMaxConfigSize is the default limit on the size of a permissions config, in bytes.
+const DefaultMaxConfigSize = 16 << 20
+
+// readConfig reads a permissions config, returning ErrConfigTooLarge without reading the rest of it if it is larger than maxSize bytes. The
+// limit guards against a bad mount or an adversarial file using up all of the memory on start up. Zero means DefaultMaxConfigSize.
+func readConfig(reader io.Reader, maxSize int64) ([]byte, error) {
+	limit := maxSize
+	if limit <= 0 {
+		limit = DefaultMaxConfigSize
+	}
+
+	// Reading one byte more than the limit tells a config that is exactly the maximum size from one that is too large.
+	byteValue, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(byteValue)) > limit {
+		return nil, fmt.Errorf("%w, the maximum is %d bytes", ErrConfigTooLarge, limit)
+	}
+	return byteValue, nil
+}
+
+// standardizeJSON converts JSON containing "//" and "/* */" comments and trailing commas into standard JSON. Everything that is removed is
+// replaced by spaces, keeping any line breaks, so the offsets in unmarshal errors still refer to the original file. Anything else that is
+// not valid JSON is left alone, so that it is reported by the unmarshal.
+func standardizeJSON(byteValue []byte) ([]byte, error) {
+	out := bytes.Clone(byteValue)
+	blank := func(start, end int) {
+		for idx := start; idx < end; idx++ {
+			if out[idx] != '\n' && out[idx] != '\r' {
+				out[idx] = ' '
+			}
+		}
+	}
+
+	lastComma := -1 // The offset of a comma that has not yet been followed by anything other than white space or comments.
+	var prev byte   // The last character that was not white space or part of a comment.
+	for idx := 0; idx < len(out); idx++ {
+		switch c := out[idx]; {
+		case c == '"':
+			// Skip over the string, including any escaped quotes.
+			for idx++; idx < len(out) && out[idx] != '"'; idx++ {
+				if out[idx] == '\\' {
+					idx++
+				}
+			}
+			lastComma = -1
+			prev = '"'
+		case c == '/' && idx+1 < len(out) && out[idx+1] == '/':
+			end := bytes.IndexByte(out[idx:], '\n')
+			if end < 0 {
+				end = len(out) - idx
+			}
+			blank(idx, idx+end)
+			idx += end
+		case c == '/' && idx+1 < len(out) && out[idx+1] == '*':
+			end := bytes.Index(out[idx+2:], []byte("*/"))
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at line %d", bytes.Count(out[:idx], []byte("\n"))+1)
+			}
+			blank(idx, idx+end+4)
+			idx += end + 3
+		case c == ',':
+			// Only a comma following a value may be a trailing comma, so that something like "[1,,]" is still an error.
+			if prev != ',' && prev != '[' && prev != '{' {
+				lastComma = idx
+			}
+			prev = c
+		case c == '}' || c == ']':
+			if lastComma >= 0 {
+				out[lastComma] = ' '
+			}
+			lastComma = -1
+			prev = c
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			lastComma = -1
+			prev = c
+		}
+	}
+
+	return out, nil
+}
+
+// expandEnvVars replaces each "${NAME}" reference in a config with the value of that environment variable, so that secrets such as API keys
+// do not need to be checked in. It runs after comments have been removed, so references in comments are ignored. The values are escaped as
+// JSON strings, so they may contain quotes. Anything else containing a dollar sign, such as "$NAME", is left alone, which is why this does
+// not use os.Expand. It is an error to reference a variable that is not set.
+func expandEnvVars(byteValue []byte) ([]byte, error) {
+	var errs error
+	out := envVarRegex.ReplaceAllFunc(byteValue, func(match []byte) []byte {
+		name := string(envVarRegex.FindSubmatch(match)[1])
+		value, exists := os.LookupEnv(name)
+		if !exists {
+			errs = errors.Join(errs, fmt.Errorf(`environment variable "%s" is not set`, name))
+			return match
+		}
+		quoted, _ := json.Marshal(value) // Marshaling a string cannot fail.
+		return quoted[1 : len(quoted)-1]
+	})
+	if errs != nil {
+		return nil, errs
+	}
+	return out, nil
+}
+
+// jsonErrorLine returns the line number in the json where the unmarshal error occurred, if it is known.
+func jsonErrorLine(byteValue []byte, err error) (int, bool) {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		offset = syntaxErr.Offset
+	} else if errors.As(err, &typeErr) {
+		offset = typeErr.Offset
+	} else {
+		return 0, false
+	}
+
+	if offset > int64(len(byteValue)) {
+		offset = int64(len(byteValue))
+	}
+	return bytes.Count(byteValue[:offset], []byte("\n")) + 1, true
+}
+
+// functionSelector returns the four byte selector for a function signature as a hex string, along with the canonical form of the signature.
+// It is forgiving of white space around separators and of a trailing return type, such as "balanceOf(address) returns (uint256)".
+func functionSelector(signature string) (string, string, error) {
+	sig := signatureSeparatorRegex.ReplaceAllString(strings.TrimSpace(signature), "$1")
+
+	// Drop anything after the closing parenthesis of the parameter list.
+	depth := 0
+	for idx, c := range sig {
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			depth--
+			if depth == 0 {
+				sig = sig[:idx+1]
+				break
+			}
+		}
+	}
+
+	if !functionSignatureRegex.MatchString(sig) {
+		return "", "", fmt.Errorf(`invalid function signature "%s"`, signature)
+	}
+	return hex.EncodeToString(ethCrypto.Keccak256([]byte(sig))[:ETH_CALL_SIG_LENGTH]), sig, nil
+}
+
+// parseAllowedCall parses a single allowed call from the config. It returns the permission keys for the call and the options that apply to them.
+// Unless allowUnknownChains is set, the chain must be one known to the SDK, since a typo would create an entry that can never match a query.
+func parseAllowedCall(ac AllowedCall, userName string, allowUnknownChains bool) ([]string, allowedCallOptions, error) {
+	var chain int
+	var callType, contractAddressStr, callStr string
+	var allowedFinality []string
+	var callKeys []string
+	var opts allowedCallOptions
+	if ac.EthCall != nil {
+		callType = "ethCall"
+		chain = ac.EthCall.Chain
+		contractAddressStr = ac.EthCall.ContractAddress
+		callStr = ac.EthCall.Call
+		allowedFinality = ac.EthCall.AllowedFinality
+	} else if ac.EthCallByTimestamp != nil {
+		callType = "ethCallByTimestamp"
+		chain = ac.EthCallByTimestamp.Chain
+		contractAddressStr = ac.EthCallByTimestamp.ContractAddress
+		callStr = ac.EthCallByTimestamp.Call
+	} else if ac.EthCallWithFinality != nil {
+		callType = "ethCallWithFinality"
+		chain = ac.EthCallWithFinality.Chain
+		contractAddressStr = ac.EthCallWithFinality.ContractAddress
+		callStr = ac.EthCallWithFinality.Call
+		allowedFinality = ac.EthCallWithFinality.AllowedFinality
+	} else if ac.SolanaAccount != nil {
+		chain = ac.SolanaAccount.Chain
+		// A single account may be specified using "account", and / or a list using "accounts".
+		accounts := ac.SolanaAccount.Accounts
+		if ac.SolanaAccount.Account != "" {
+			accounts = append([]string{ac.SolanaAccount.Account}, accounts...)
+		}
+		if len(accounts) == 0 {
+			return nil, opts, fmt.Errorf(`solana account for user "%s" must specify "account" or "accounts"`, userName)
+		}
+		for _, acct := range accounts {
+			account, err := parseSolanaPublicKey(acct, "account", userName)
+			if err != nil {
+				return nil, opts, err
+			}
+			callKeys = append(callKeys, fmt.Sprintf("solAccount:%d:%s", ac.SolanaAccount.Chain, account))
+		}
+	} else if ac.SolanaPda != nil {
+		chain = ac.SolanaPda.Chain
+		pa, err := parseSolanaPublicKey(ac.SolanaPda.ProgramAddress, "program address", userName)
+		if err != nil {
+			return nil, opts, err
+		}
+		if ac.SolanaPda.MaxSeeds < 0 || ac.SolanaPda.MaxSeeds > query.SolanaMaxSeeds {
+			return nil, opts, fmt.Errorf(`invalid max seeds %d for solana program address "%s" for user "%s", must be between zero and %d`, ac.SolanaPda.MaxSeeds, ac.SolanaPda.ProgramAddress, userName, query.SolanaMaxSeeds)
+		}
+		opts.maxSeeds = ac.SolanaPda.MaxSeeds
+		callKeys = append(callKeys, fmt.Sprintf("solPDA:%d:%s", ac.SolanaPda.Chain, pa))
+	} else {
+		return nil, opts, fmt.Errorf(`unsupported call type for user "%s", must be "ethCall", "ethCallByTimestamp", "ethCallWithFinality", "solAccount" or "solPDA"`, userName)
+	}
+
+	if !allowUnknownChains && !isKnownChain(chain) {
+		return nil, opts, fmt.Errorf(`unknown chain %d for user "%s", set "allowUnknownChains" if this is intentional`, chain, userName)
+	}
+
+	if len(callKeys) == 0 {
+		// Convert the contract address into a standard format like "000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6".
+		contractAddress := contractAddressStr
+		if contractAddressStr != "*" {
+			contractAddr, err := vaa.StringToAddress(contractAddressStr)
+			if err != nil {
+				return nil, opts, fmt.Errorf(`invalid contract address "%s" for user "%s"`, contractAddressStr, userName)
+			}
+			contractAddress = contractAddr.String()
+		}
+
+		// The call should be the ABI four byte hex hash of the function signature. Parse it into a standard form of "06fdde03".
+		// It may also be the function signature itself, such as "name()", in which case we compute the hash.
+		// A call of "*" means any call on the specified contract, so is stored as is.
+		call := callStr
+		if callStr == "*" {
+			if contractAddress == "*" {
+				return nil, opts, fmt.Errorf(`eth call "*" for user "%s" may not be used with a wild card contract address`, userName)
+			}
+		} else if strings.Contains(callStr, "(") {
+			selector, sig, err := functionSelector(callStr)
+			if err != nil {
+				return nil, opts, fmt.Errorf(`invalid eth call function signature "%s" for user "%s"`, callStr, userName)
+			}
+			opts.argLayout, err = parseArgLayout(sig)
+			if err != nil {
+				return nil, opts, fmt.Errorf(`invalid eth call function signature "%s" for user "%s": %w`, callStr, userName, err)
+			}
+			call = selector
+		} else {
+			buf, err := decodeCallBytes(callStr)
+			if err != nil {
+				return nil, opts, fmt.Errorf(`invalid eth call "%s" for user "%s": %w`, callStr, userName, err)
+			}
+			if len(buf) != ETH_CALL_SIG_LENGTH {
+				return nil, opts, fmt.Errorf(`eth call "%s" for user "%s" has an invalid length, must be %d bytes`, callStr, userName, ETH_CALL_SIG_LENGTH)
+			}
+			call = hex.EncodeToString(buf)
+		}
+
+		for _, finality := range allowedFinality {
+			if finality != "finalized" && finality != "safe" {
+				return nil, opts, fmt.Errorf(`invalid finality "%s" for user "%s", must be "finalized" or "safe"`, finality, userName)
+			}
+			if opts.allowedFinality == nil {
+				opts.allowedFinality = make(map[string]struct{})
+			}
+			opts.allowedFinality[finality] = struct{}{}
+		}
+
+		// The permission key is the chain, contract address and call formatted as a colon separated string.
+		callKeys = append(callKeys, fmt.Sprintf("%s:%d:%s:%s", callType, chain, contractAddress, call))
+	}
+
+	return callKeys, opts, nil
+}
+
+// decodeCallBytes decodes call data from the config. It is normally hex, with or without a "0x" or "0X" prefix, but may be base64 if it has a
+// "base64:" prefix. Surrounding white space is ignored, since selectors are often pasted in. The errors say what is wrong with the hex in
+// terms an operator can act on, rather than those of hex.DecodeString.
+func decodeCallBytes(str string) ([]byte, error) {
+	str = strings.TrimSpace(str)
+	if b64, found := strings.CutPrefix(str, "base64:"); found {
+		buf, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("not valid base64: %w", err)
+		}
+		return buf, nil
+	}
+
+	digits := str
+	if len(digits) >= 2 && (digits[:2] == "0x" || digits[:2] == "0X") {
+		digits = digits[2:]
+	}
+	buf, err := hex.DecodeString(digits)
+	var invalidByte hex.InvalidByteError
+	switch {
+	case errors.As(err, &invalidByte):
+		return nil, fmt.Errorf("contains %q, which is not a hex digit", rune(invalidByte))
+	case errors.Is(err, hex.ErrLength):
+		return nil, fmt.Errorf("has an odd number of hex digits (%d), each byte must be two digits", len(digits))
+	case err != nil:
+		return nil, err
+	}
+	return buf, nil
+}
+
+// configContractAddress returns the contract address of an allowed call as specified in the config, or an empty string if it does not have one.
+func configContractAddress(ac AllowedCall) string {
+	switch {
+	case ac.EthCall != nil:
+		return ac.EthCall.ContractAddress
+	case ac.EthCallByTimestamp != nil:
+		return ac.EthCallByTimestamp.ContractAddress
+	case ac.EthCallWithFinality != nil:
+		return ac.EthCallWithFinality.ContractAddress
+	default:
+		return ""
+	}
+}
+
+// zeroContractAddress returns the contract address as specified in the config, and true if it is an eth call whose address is all zeros.
+func zeroContractAddress(ac AllowedCall) (string, bool) {
+	rawAddr := configContractAddress(ac)
+	addr, err := vaa.StringToAddress(rawAddr)
+	return rawAddr, err == nil && addr == vaa.Address{}
+}
+
+// invalidAddressChecksum returns true if the string is a mixed case EVM address whose case does not match its EIP-55 checksum. Addresses
+// that are all lower or all upper case carry no checksum, so they are never reported, and neither is anything that is not an EVM address.
+func invalidAddressChecksum(rawAddr string) bool {
+	hexAddr := strings.TrimPrefix(rawAddr, "0x")
+	if !ethCommon.IsHexAddress(hexAddr) || hexAddr == strings.ToLower(hexAddr) || hexAddr == strings.ToUpper(hexAddr) {
+		return false
+	}
+	return ethCommon.HexToAddress(hexAddr).Hex()[2:] != hexAddr
+}
+
+// isKnownChain returns true if the chain is one of the chains known to the SDK.
+func isKnownChain(chain int) bool {
+	return chain > 0 && chain <= math.MaxUint16 && slices.Contains(vaa.GetAllNetworkIDs(), vaa.ChainID(chain))
+}
+
+// maxRequestTimeout is how long a request waits for the guardians by default. The guardians give up on a query after query.RequestTimeout,
+// so waiting any longer would not help. The extra time allows for the responses to be gossiped back.
+const maxRequestTimeout = query.RequestTimeout + 5*time.Second
+
+// parseRequestTimeout parses a timeout from the config, such as "30s", which must be positive and no more than maxRequestTimeout.
+func parseRequestTimeout(str string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 || timeout > maxRequestTimeout {
+		return 0, fmt.Errorf("must be positive and at most %s", maxRequestTimeout)
+	}
+	return timeout, nil
+}
+
+// parseSignerAddresses parses the set of authorized signers for a user, along with the number of them that must sign each request. The
+// threshold defaults to one, so that any of the signers may sign.
+func parseSignerAddresses(user User) (map[ethCommon.Address]struct{}, int, error) {
+	if len(user.SignerAddresses) == 0 {
+		if user.SignerThreshold != 0 {
+			return nil, 0, fmt.Errorf(`UserName "%s" has "signerThreshold" specified without "signerAddresses"`, user.UserName)
+		}
+		return nil, 0, nil
+	}
+	if user.SignerAddress != "" {
+		return nil, 0, fmt.Errorf(`UserName "%s" has both "signerAddress" and "signerAddresses" specified, which is not allowed`, user.UserName)
+	}
+
+	signerAddresses := make(map[ethCommon.Address]struct{}, len(user.SignerAddresses))
+	for _, str := range user.SignerAddresses {
+		if !ethCommon.IsHexAddress(str) {
+			return nil, 0, fmt.Errorf(`invalid signer address "%s" for user "%s"`, str, user.UserName)
+		}
+		addr := ethCommon.HexToAddress(str)
+		if _, exists := signerAddresses[addr]; exists {
+			return nil, 0, fmt.Errorf(`duplicate signer address "%s" for user "%s"`, str, user.UserName)
+		}
+		signerAddresses[addr] = struct{}{}
+	}
+
+	threshold := user.SignerThreshold
+	if threshold == 0 {
+		threshold = 1
+	}
+	if threshold < 0 || threshold > len(signerAddresses) {
+		return nil, 0, fmt.Errorf(`invalid signer threshold %d for user "%s", must be between 1 and the number of signer addresses`, user.SignerThreshold, user.UserName)
+	}
+
+	return signerAddresses, threshold, nil
+}
+
+// parseSolanaPublicKey parses a Solana public key from the config into base58. We assume the value is base58, but if it starts with "0x" it should be 32 bytes of hex.
+func parseSolanaPublicKey(str string, desc string, userName string) (string, error) {
+	if strings.HasPrefix(str, "0x") {
+		buf, err := hex.DecodeString(str[2:])
+		if err != nil {
+			return "", fmt.Errorf(`invalid solana %s hex string "%s" for user "%s": %w`, desc, str, userName, err)
+		}
+		if len(buf) != query.SolanaPublicKeyLength {
+			return "", fmt.Errorf(`invalid solana %s hex string "%s" for user "%s, must be %d bytes`, desc, str, userName, query.SolanaPublicKeyLength)
+		}
+		return solana.PublicKey(buf).String(), nil
+	}
+
+	// Make sure it is valid base58.
+	if _, err := solana.PublicKeyFromBase58(str); err != nil {
+		return "", fmt.Errorf(`solana %s string "%s" for user "%s" is not valid base58: %w`, desc, str, userName, err)
+	}
+
+	return str, nil
+}
+
+// AllowedSelectors returns the function selectors that the API key may call on a contract, using any of the eth call types, and whether
+// any call is allowed, because of a wild card call entry or allowAnything. Entries with a wild card contract address are included, and
+// selectors that are denied are left out. The selectors are sorted. It returns nil and false for an unknown or expired key, a chain the key
+// is not allowed to use, or a contract the key may not call. The key is checked the same way as by IsAllowed.
+func (perms *Permissions) AllowedSelectors(apiKey string, chain int, contract vaa.Address) ([][4]byte, bool) {
+	if chain <= 0 || chain > math.MaxUint16 {
+		return nil, false
+	}
+	pe, exists := perms.activeUserEntry(apiKey, vaa.ChainID(chain))
+	if !exists {
+		return nil, false
+	}
+
+	// The call keys are "<callType>:<chain>:<contract>:<call>", with both the contract and the call in lower case hex, or "*".
+	contractStr := contract.String()
+	matchingCalls := func(calls allowedCallsForUser) (map[string]struct{}, bool) {
+		selectors := make(map[string]struct{})
+		wildCard := false
+		for callKey := range calls.keys() {
+			fields := strings.Split(callKey, ":")
+			if len(fields) != 4 || fields[1] != strconv.Itoa(chain) || (fields[2] != contractStr && fields[2] != "*") {
+				continue
+			}
+			if fields[3] == "*" {
+				wildCard = true
+				continue
+			}
+			selectors[fields[3]] = struct{}{}
+		}
+		return selectors, wildCard
+	}
+
+	denied, deniedWildCard := matchingCalls(pe.deniedCalls)
+	if deniedWildCard {
+		return nil, false
+	}
+	allowed, wildCard := matchingCalls(pe.allowedCalls)
+	wildCard = wildCard || pe.allowAnything
+
+	var ret [][4]byte
+	for _, selectorStr := range slices.Sorted(maps.Keys(allowed)) {
+		if _, exists := denied[selectorStr]; exists {
+			continue
+		}
+		var selector [4]byte
+		if _, err := hex.Decode(selector[:], []byte(selectorStr)); err != nil {
+			continue
+		}
+		ret = append(ret, selector)
+	}
+	return ret, wildCard
 }
@@ -0,0 +1,63 @@
+package ccq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"go.uber.org/zap"
+)
+
+// permissionsSource is where the permissions are loaded from, as selected by the --permEnvVar, --permDir and --permFile flags. It is shared
+// by the server and the verify paths, so that verifying the permissions checks exactly what the server would load.
+type permissionsSource struct {
+	envVar  string
+	dir     string
+	file    string
+	maxSize int64
+}
+
+// check returns an error if the flags do not select a valid source.
+func (src permissionsSource) check() error {
+	if src.file == "" && src.envVar == "" && src.dir == "" {
+		return errors.New("Please specify --permFile, --permDir or --permEnvVar")
+	}
+	if src.dir != "" && (src.file != "" || src.envVar != "") {
+		return errors.New("--permDir may not be used with --permFile or --permEnvVar")
+	}
+	if src.maxSize <= 0 {
+		return errors.New("--maxPermFileSize must be positive")
+	}
+	return nil
+}
+
+// useEnvVar returns true if the permissions come from the environment variable, which takes precedence over the file if it is set, or if
+// there is no file.
+func (src permissionsSource) useEnvVar() bool {
+	return src.envVar != "" && (src.file == "" || os.Getenv(src.envVar) != "")
+}
+
+// load parses the permissions from the environment variable, the directory or the file, in that order of precedence.
+func (src permissionsSource) load(logger *zap.Logger, env common.Environment) (*Permissions, error) {
+	switch {
+	case src.useEnvVar():
+		return parseConfigFromEnv(src.envVar, env, src.maxSize)
+	case src.dir != "":
+		return parseConfigDir(logger, src.dir, env, src.maxSize)
+	default:
+		return NewPermissions(src.file, env, src.maxSize)
+	}
+}
+
+// String describes the source that load uses, for logs and messages.
+func (src permissionsSource) String() string {
+	switch {
+	case src.useEnvVar():
+		return fmt.Sprintf(`environment variable "%s"`, src.envVar)
+	case src.dir != "":
+		return fmt.Sprintf(`directory "%s"`, src.dir)
+	default:
+		return fmt.Sprintf(`file "%s"`, src.file)
+	}
+}
@@ -0,0 +1,57 @@
+package ccq
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPermissionsSource(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "perms.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(validateRequestTestConfig), 0600))
+	t.Setenv("CCQ_TEST_PERMS", strings.Replace(validateRequestTestConfig, "my_secret_key", "env_secret_key", 1))
+
+	// The environment variable on its own is enough, and takes precedence over the file when it is set.
+	for _, src := range []permissionsSource{
+		{envVar: "CCQ_TEST_PERMS", maxSize: DefaultMaxConfigSize},
+		{envVar: "CCQ_TEST_PERMS", file: fileName, maxSize: DefaultMaxConfigSize},
+	} {
+		require.NoError(t, src.check())
+		perms, err := src.load(zap.NewNop(), common.MainNet)
+		require.NoError(t, err)
+		_, exists := perms.GetUserEntry("env_secret_key")
+		assert.True(t, exists)
+		assert.Equal(t, `environment variable "CCQ_TEST_PERMS"`, src.String())
+	}
+
+	// An unset variable falls back to the file.
+	src := permissionsSource{envVar: "CCQ_TEST_UNSET", file: fileName, maxSize: DefaultMaxConfigSize}
+	perms, err := src.load(zap.NewNop(), common.MainNet)
+	require.NoError(t, err)
+	_, exists := perms.GetUserEntry("my_secret_key")
+	assert.True(t, exists)
+	assert.Equal(t, `file "`+fileName+`"`, src.String())
+
+	src = permissionsSource{dir: dir, maxSize: DefaultMaxConfigSize}
+	perms, err = src.load(zap.NewNop(), common.MainNet)
+	require.NoError(t, err)
+	assert.Equal(t, dir, perms.dirName)
+
+	// The size limit applies to the files.
+	for _, src := range []permissionsSource{{dir: dir}, {file: fileName}} {
+		src.maxSize = 10
+		_, err := src.load(zap.NewNop(), common.MainNet)
+		assert.Error(t, err, src.String())
+	}
+
+	assert.EqualError(t, permissionsSource{maxSize: DefaultMaxConfigSize}.check(), "Please specify --permFile, --permDir or --permEnvVar")
+	assert.EqualError(t, permissionsSource{dir: dir, file: fileName, maxSize: DefaultMaxConfigSize}.check(), "--permDir may not be used with --permFile or --permEnvVar")
+	assert.EqualError(t, permissionsSource{file: fileName}.check(), "--maxPermFileSize must be positive")
+}
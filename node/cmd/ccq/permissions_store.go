@@ -0,0 +1,84 @@
+package ccq
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"gopkg.in/godo.v2/watcher/fswatch"
+)
+
+// PermissionsStore holds the current permissions. When the permissions file changes, a new Permissions object is swapped in atomically,
+// so request validation can load the current permissions without locking and sees a consistent version for the whole request.
+type PermissionsStore struct {
+	perms   atomic.Pointer[Permissions]
+	watcher *fswatch.Watcher
+	reg     prometheus.Registerer // The registry for the config metrics, or nil if they should not be updated.
+}
+
+// NewPermissionsStore creates a store containing the specified permissions. The config metrics are updated in the registry whenever the
+// permissions are stored. Only the store of the permissions being enforced should have one, so the registry is nil for the shadow store.
+func NewPermissionsStore(perms *Permissions, reg prometheus.Registerer) *PermissionsStore {
+	store := &PermissionsStore{reg: reg}
+	store.Store(perms)
+	return store
+}
+
+// Load returns the current permissions.
+func (store *PermissionsStore) Load() *Permissions {
+	return store.perms.Load()
+}
+
+// Store replaces the current permissions, and updates the config metrics to match if the store has a registry.
+func (store *PermissionsStore) Store(perms *Permissions) {
+	store.perms.Store(perms)
+	if store.reg != nil {
+		updateConfigMetrics(store.reg, perms)
+	}
+}
+
+// StartWatcher watches the file or directory associated with the current permissions and swaps in the new version when it changes.
+// It does nothing if the permissions are not associated with a file or directory. For a directory, a file that is added after the watcher
+// starts is loaded, but later changes to it are only seen when the directory itself changes.
+func (store *PermissionsStore) StartWatcher(ctx context.Context, logger *zap.Logger, errC chan error) {
+	fileNames := store.Load().watchedFiles()
+	if len(fileNames) == 0 {
+		return
+	}
+
+	logger = logger.With(zap.String("component", "perms"))
+	store.watcher = watchPermissionsFiles(ctx, logger, errC, fileNames, func() { store.Reload(logger) })
+}
+
+// Reload rereads the file or directory associated with the current permissions. If it is valid, it replaces the current permissions. This is
+// the only way that permissions are reloaded, since a Permissions object is never modified once it has been created.
+func (store *PermissionsStore) Reload(logger *zap.Logger) {
+	current := store.Load()
+	var perms *Permissions
+	var err error
+	if current.dirName != "" {
+		perms, err = parseConfigDir(logger, current.dirName, current.env, current.maxSize)
+	} else {
+		perms, err = NewPermissions(current.fileName, current.env, current.maxSize)
+	}
+	if err != nil {
+		logger.Error("failed to reload the permissions file, sticking with the old one", zap.String("fileName", current.source()), zap.Error(err))
+		permissionFileReloadsFailure.Inc()
+		return
+	}
+
+	reuseConcurrencyLimits(perms.permMap, current.permMap)
+
+	logger.Info("successfully reloaded the permissions file, switching to it", zap.String("fileName", current.source()))
+	perms.logWarnings(logger)
+	store.Store(perms)
+	permissionFileReloadsSuccess.Inc()
+}
+
+// StopWatcher stops the permissions file watcher.
+func (store *PermissionsStore) StopWatcher() {
+	if store.watcher != nil {
+		store.watcher.Stop()
+	}
+}
@@ -0,0 +1,156 @@
+package ccq
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestPermissionsStoreReload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(validateRequestTestConfig), 0600))
+	perms, err := NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	store := NewPermissionsStore(perms, nil)
+
+	// A successful reload swaps in a new object.
+	require.NoError(t, os.WriteFile(fileName, []byte(strings.Replace(validateRequestTestConfig, "my_secret_key", "my_new_secret_key", 1)), 0600))
+	store.Reload(zap.NewNop())
+	newPerms := store.Load()
+	assert.NotSame(t, perms, newPerms)
+	_, exists := newPerms.GetUserEntry("my_new_secret_key")
+	assert.True(t, exists)
+	assert.Equal(t, common.MainNet, newPerms.env)
+
+	// The old object is not modified, so a request in progress still sees a consistent version.
+	_, exists = perms.GetUserEntry("my_secret_key")
+	assert.True(t, exists)
+
+	// A failed reload keeps the current version.
+	require.NoError(t, os.WriteFile(fileName, []byte(`{"permissions": [`), 0600))
+	store.Reload(zap.NewNop())
+	assert.Same(t, newPerms, store.Load())
+}
+
+func TestPermissionsStoreReloadDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "team_a.json"), []byte(validateRequestTestConfig), 0600))
+	perms, err := parseConfigDir(zap.NewNop(), dir, common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	assert.Equal(t, []string{dir, filepath.Join(dir, "team_a.json")}, perms.watchedFiles())
+	store := NewPermissionsStore(perms, nil)
+
+	// A file added to the directory is picked up by a reload.
+	teamB := strings.NewReplacer(`"Test User"`, `"Test User2"`, `"my_secret_key"`, `"my_secret_key_2"`).Replace(validateRequestTestConfig)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "team_b.json"), []byte(teamB), 0600))
+	store.Reload(zap.NewNop())
+	newPerms := store.Load()
+	assert.NotSame(t, perms, newPerms)
+	_, exists := newPerms.GetUserEntry("my_secret_key_2")
+	assert.True(t, exists)
+	assert.Equal(t, dir, newPerms.dirName)
+
+	// A failed reload keeps the current version.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "team_c.json"), []byte(validateRequestTestConfig), 0600))
+	store.Reload(zap.NewNop())
+	assert.Same(t, newPerms, store.Load())
+}
+
+func TestPermissionsStoreReloadKeepsConcurrencyLimits(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	config := strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key",`, `"apiKey": "my_secret_key", "maxConcurrent": 1,`, 1)
+	require.NoError(t, os.WriteFile(fileName, []byte(config), 0600))
+	perms, err := NewPermissions(fileName, common.MainNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	store := NewPermissionsStore(perms, nil)
+	pe, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+	release, _, err := acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	require.NoError(t, err)
+
+	// A request that is in flight during the reload still counts against the limit afterwards.
+	store.Reload(zap.NewNop())
+	pe, exists = store.Load().GetUserEntry("my_secret_key")
+	require.True(t, exists)
+	_, _, err = acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	require.ErrorIs(t, err, ErrTooManyConcurrent)
+	release()
+	release, _, err = acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	require.NoError(t, err)
+
+	// If the limit changes, the key gets a new semaphore with the new size.
+	require.NoError(t, os.WriteFile(fileName, []byte(strings.Replace(config, `"maxConcurrent": 1`, `"maxConcurrent": 2`, 1)), 0600))
+	store.Reload(zap.NewNop())
+	pe, exists = store.Load().GetUserEntry("my_secret_key")
+	require.True(t, exists)
+	_, _, err = acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	require.NoError(t, err)
+	release()
+}
+
+// TestPermissionsStoreConcurrentAccess is meant to be run with the race detector.
+func TestPermissionsStoreConcurrentAccess(t *testing.T) {
+	perms, err := ParsePermissions([]byte(validateRequestTestConfig), common.MainNet)
+	require.NoError(t, err)
+	store := NewPermissionsStore(perms, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				_, exists := store.Load().GetUserEntry("my_secret_key")
+				assert.True(t, exists)
+			}
+		}()
+	}
+
+	for j := 0; j < 100; j++ {
+		newPerms, err := ParsePermissions([]byte(validateRequestTestConfig), common.MainNet)
+		require.NoError(t, err)
+		store.Store(newPerms)
+	}
+
+	wg.Wait()
+}
+
+func TestUpdateConfigMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	gauge := func(opts prometheus.GaugeOpts) float64 {
+		val, err := getGaugeValue(registerGauge(reg, opts))
+		require.NoError(t, err)
+		return val
+	}
+
+	updateConfigMetrics(reg, createTestPermissions(t, fuzzRequestConfig))
+	assert.Equal(t, 2.0, gauge(configuredUsersOpts))
+	assert.Equal(t, 7.0, gauge(configuredCallsOpts))
+
+	// Updating them again, as on a reload, replaces the values.
+	updateConfigMetrics(reg, createTestPermissions(t, validateRequestTestConfig))
+	assert.Equal(t, 1.0, gauge(configuredUsersOpts))
+	assert.Equal(t, 1.0, gauge(configuredCallsOpts))
+
+	// The store keeps its registry up to date.
+	reg = prometheus.NewRegistry()
+	store := NewPermissionsStore(createTestPermissions(t, fuzzRequestConfig), reg)
+	assert.Equal(t, 2.0, gauge(configuredUsersOpts))
+	assert.Equal(t, 7.0, gauge(configuredCallsOpts))
+	store.Store(createTestPermissions(t, validateRequestTestConfig))
+	assert.Equal(t, 1.0, gauge(configuredCallsOpts))
+
+	// A shadow store does not have a registry, so loading and reloading the candidate config leaves the metrics alone.
+	shadowStore := NewPermissionsStore(createTestPermissions(t, fuzzRequestConfig), nil)
+	shadowStore.Store(createTestPermissions(t, fuzzRequestConfig))
+	assert.Equal(t, 1.0, gauge(configuredUsersOpts))
+	assert.Equal(t, 1.0, gauge(configuredCallsOpts))
+}
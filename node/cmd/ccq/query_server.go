@@ -6,10 +6,12 @@ package ccq
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,8 +21,8 @@ import (
 	promremotew "github.com/certusone/wormhole/node/pkg/telemetry/prom_remote_write"
 	"github.com/certusone/wormhole/node/pkg/version"
 	ethCrypto "github.com/ethereum/go-ethereum/crypto"
-	ipfslog "github.com/ipfs/go-log/v2"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -36,9 +38,18 @@ var (
 	nodeKeyPath            *string
 	signerKeyPath          *string
 	permFile               *string
+	permEnvVar             *string
+	permDir                *string
+	maxPermFileSize        *int64
+	shadowPermFile         *string
 	ethRPC                 *string
+	ethRPCAllowlist        *string
+	ethRPCRequireTLS       *bool
+	headBlockRPCs          *string
 	ethContract            *string
 	logLevel               *string
+	deniedCallLogLevel     *string
+	logFormat              *string
 	telemetryLokiURL       *string
 	telemetryNodeName      *string
 	statusAddr             *string
@@ -48,6 +59,16 @@ var (
 	monitorPeers           *bool
 	gossipAdvertiseAddress *string
 	verifyPermissions      *bool
+	gsRefreshInterval      *uint
+	gsFetchTimeout         *uint
+	gsFetchAttempts        *uint
+	gsIndexLookback        *uint
+	trustForwardedFor      *bool
+	auditLogFile           *string
+	responseCacheSize      *uint
+	responseCacheTTL       *uint
+	replayWindow           *uint
+	replayCacheSize        *uint
 )
 
 const DEV_NETWORK_ID = "/wormhole/dev"
@@ -61,9 +82,18 @@ func init() {
 	signerKeyPath = QueryServerCmd.Flags().String("signerKey", "", "Path to key used to sign unsigned queries")
 	listenAddr = QueryServerCmd.Flags().String("listenAddr", "[::]:6069", "Listen address for query server (disabled if blank)")
 	permFile = QueryServerCmd.Flags().String("permFile", "", "JSON file containing permissions configuration")
+	permEnvVar = QueryServerCmd.Flags().String("permEnvVar", "", "Environment variable containing permissions configuration JSON (takes precedence over permFile if set)")
+	permDir = QueryServerCmd.Flags().String("permDir", "", "Directory of permissions files that are merged together, such as one per team (instead of permFile)")
+	maxPermFileSize = QueryServerCmd.Flags().Int64("maxPermFileSize", DefaultMaxConfigSize, "Maximum size of the permissions file in bytes, including after decompression")
+	shadowPermFile = QueryServerCmd.Flags().String("shadowPermFile", "", "Candidate permissions file that requests are also evaluated against, logging any differences without enforcing it (optional)")
 	ethRPC = QueryServerCmd.Flags().String("ethRPC", "", "Ethereum RPC for fetching current guardian set")
+	ethRPCAllowlist = QueryServerCmd.Flags().String("ethRPCAllowlist", "", "Comma separated list of hosts or scheme://host entries that the Ethereum RPC must match (optional, allows any if blank)")
+	ethRPCRequireTLS = QueryServerCmd.Flags().Bool("ethRPCRequireTLS", false, "Reject an Ethereum RPC that does not use https or wss")
+	headBlockRPCs = QueryServerCmd.Flags().String("headBlockRPCs", "", "Comma separated list of chain=url entries used to read the head block for users with a maxBlockDepth (optional)")
 	ethContract = QueryServerCmd.Flags().String("ethContract", "", "Ethereum core bridge address for fetching current guardian set")
 	logLevel = QueryServerCmd.Flags().String("logLevel", "info", "Logging level (debug, info, warn, error, dpanic, panic, fatal)")
+	deniedCallLogLevel = QueryServerCmd.Flags().String("deniedCallLogLevel", "debug", "Logging level for calls that are not authorized or are denied (debug, info, warn)")
+	logFormat = QueryServerCmd.Flags().String("logFormat", LogFormatConsole, "Logging format (console, json)")
 	telemetryLokiURL = QueryServerCmd.Flags().String("telemetryLokiURL", "", "Loki cloud logging URL")
 	telemetryNodeName = QueryServerCmd.Flags().String("telemetryNodeName", "", "Node name used in telemetry")
 	statusAddr = QueryServerCmd.Flags().String("statusAddr", "[::]:6060", "Listen address for status server (disabled if blank)")
@@ -71,6 +101,16 @@ func init() {
 	monitorPeers = QueryServerCmd.Flags().Bool("monitorPeers", false, "Should monitor bootstrap peers and attempt to reconnect")
 	gossipAdvertiseAddress = QueryServerCmd.Flags().String("gossipAdvertiseAddress", "", "External IP to advertize on P2P (use if behind a NAT or running in k8s)")
 	verifyPermissions = QueryServerCmd.Flags().Bool("verifyPermissions", false, `parse and verify the permissions file and then exit with 0 if success, 1 if failure`)
+	gsRefreshInterval = QueryServerCmd.Flags().Uint("guardianSetRefreshInterval", 300, "Seconds between refreshes of the current guardian set (zero disables refreshing)")
+	gsFetchTimeout = QueryServerCmd.Flags().Uint("guardianSetFetchTimeout", 5, "Seconds to wait when reading the current guardian set")
+	gsIndexLookback = QueryServerCmd.Flags().Uint("guardianSetIndexLookback", 1, "Number of guardian sets before the current one that the guardianSetIndex of a request may refer to")
+	gsFetchAttempts = QueryServerCmd.Flags().Uint("guardianSetFetchAttempts", uint(DefaultGuardianSetRetryPolicy.MaxAttempts), "Number of attempts at each RPC call when reading the current guardian set, with exponential backoff between them")
+	trustForwardedFor = QueryServerCmd.Flags().Bool("trustForwardedFor", false, "Use the X-Forwarded-For header to determine the client IP (only use if behind a load balancer that sets it)")
+	auditLogFile = QueryServerCmd.Flags().String("auditLogFile", "", "File to which an audit record of every authorized call is appended as JSON lines (disabled if blank)")
+	responseCacheSize = QueryServerCmd.Flags().Uint("responseCacheSize", 0, "Number of recent responses to cache for identical retried requests from the same API key (zero disables caching)")
+	responseCacheTTL = QueryServerCmd.Flags().Uint("responseCacheTTL", 5, "Seconds that a cached response may be reused")
+	replayWindow = QueryServerCmd.Flags().Uint("replayWindow", 0, "Seconds during which an identical request from the same API key is rejected as a replay (zero disables replay protection)")
+	replayCacheSize = QueryServerCmd.Flags().Uint("replayCacheSize", 100000, "Number of recent requests to remember for replay protection")
 
 	// The default health check monitoring is every five seconds, with a five second timeout, and you have to miss two, for 20 seconds total.
 	shutdownDelay1 = QueryServerCmd.Flags().Uint("shutdownDelay1", 25, "Seconds to delay after disabling health check on shutdown")
@@ -96,9 +136,13 @@ func runQueryServer(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	permSource := permissionsSource{envVar: *permEnvVar, dir: *permDir, file: *permFile, maxSize: *maxPermFileSize}
 	if *verifyPermissions {
-		_, err := parseConfigFile(*permFile, env)
-		if err != nil {
+		if err := permSource.check(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if _, err := permSource.load(zap.NewNop(), env); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -108,15 +152,12 @@ func runQueryServer(cmd *cobra.Command, args []string) {
 	common.SetRestrictiveUmask()
 
 	// Setup logging
-	lvl, err := ipfslog.LevelFromString(*logLevel)
+	logger, err := NewLogger(*logFormat, *logLevel)
 	if err != nil {
-		fmt.Println("Invalid log level")
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	logger := ipfslog.Logger("query-server").Desugar()
-	ipfslog.SetAllLoggers(lvl)
-
 	if *p2pNetworkID == "" {
 		*p2pNetworkID = p2p.GetNetworkId(env)
 	} else if env != common.UnsafeDevNet {
@@ -165,23 +206,104 @@ func runQueryServer(cmd *cobra.Command, args []string) {
 	if *p2pBootstrap == "" {
 		logger.Fatal("Please specify --bootstrap")
 	}
-	if *permFile == "" {
-		logger.Fatal("Please specify --permFile")
+	if deniedCallLogger, err := WithDeniedCallLogLevel(logger, *deniedCallLogLevel); err != nil {
+		logger.Fatal("invalid --deniedCallLogLevel", zap.Error(err))
+	} else {
+		logger = deniedCallLogger
+	}
+	if err := permSource.check(); err != nil {
+		logger.Fatal(err.Error())
 	}
 	if *ethRPC == "" {
 		logger.Fatal("Please specify --ethRPC")
 	}
+	rpcPolicy, err := NewRPCPolicy(strings.Split(*ethRPCAllowlist, ","), *ethRPCRequireTLS)
+	if err != nil {
+		logger.Fatal("invalid --ethRPCAllowlist", zap.Error(err))
+	}
+	if err := rpcPolicy.Check(*ethRPC); errors.Is(err, ErrInsecureRPC) {
+		logger.Fatal("--ethRPC does not use https or wss, which is required by --ethRPCRequireTLS", zap.Error(err))
+	} else if err != nil {
+		logger.Fatal("--ethRPC is not in --ethRPCAllowlist", zap.Error(err))
+	}
+	var headBlocks HeadBlockProvider
+	if *headBlockRPCs != "" {
+		rpcUrls, err := parseHeadBlockRPCs(*headBlockRPCs)
+		if err != nil {
+			logger.Fatal("invalid --headBlockRPCs", zap.Error(err))
+		}
+		// The same RPC policy as --ethRPC applies to these URLs too.
+		headBlocks, err = NewRPCHeadBlockProvider(rpcUrls, rpcPolicy)
+		if err != nil {
+			logger.Fatal("invalid --headBlockRPCs", zap.Error(err))
+		}
+	}
 	if *ethContract == "" {
 		logger.Fatal("Please specify --ethContract")
 	}
+	if *gsFetchTimeout == 0 {
+		logger.Fatal("--guardianSetFetchTimeout may not be zero")
+	}
+	if *responseCacheSize != 0 && *responseCacheTTL == 0 {
+		logger.Fatal("--responseCacheTTL may not be zero if --responseCacheSize is set")
+	}
+	if *replayWindow != 0 && *replayCacheSize == 0 {
+		logger.Fatal("--replayCacheSize may not be zero if --replayWindow is set")
+	}
 
-	permissions, err := NewPermissions(*permFile, env)
+	permissions, err := permSource.load(logger, env)
 	if err != nil {
-		logger.Fatal("Failed to load permissions file", zap.String("permFile", *permFile), zap.Error(err))
+		logger.Fatal("Failed to load permissions", zap.Stringer("source", permSource), zap.Error(err))
 	}
+	logger.Info("loaded permissions", zap.Stringer("source", permSource))
+	permissions.logWarnings(logger.With(zap.Stringer("source", permSource)))
 
+	permStore := NewPermissionsStore(permissions, prometheus.DefaultRegisterer)
+
+	var shadowPermStore *PermissionsStore
+	if *shadowPermFile != "" {
+		shadowPermissions, err := NewPermissions(*shadowPermFile, env, *maxPermFileSize)
+		if err != nil {
+			logger.Fatal("Failed to load shadow permissions file", zap.String("shadowPermFile", *shadowPermFile), zap.Error(err))
+		}
+		logger.Info("evaluating requests against shadow permissions", zap.String("shadowPermFile", *shadowPermFile))
+		shadowPermissions.logWarnings(logger.With(zap.String("shadowPermFile", *shadowPermFile)))
+		// The candidate config is not counted in the config metrics, since they describe the config being enforced.
+		shadowPermStore = NewPermissionsStore(shadowPermissions, nil)
+	}
 	loggingMap := NewLoggingMap()
 
+	var auditLogger *AuditLogger
+	var auditHook AuditHook
+	if *auditLogFile != "" {
+		f, err := os.OpenFile(*auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			logger.Fatal("Failed to open audit log file", zap.String("auditLogFile", *auditLogFile), zap.Error(err))
+		}
+		defer f.Close()
+		auditLogger = NewAuditLogger(f, 10000)
+		auditHook = auditLogger.Log
+		logger.Info("writing audit log", zap.String("auditLogFile", *auditLogFile))
+	}
+
+	var responseCache *ResponseCache
+	if *responseCacheSize != 0 {
+		responseCache, err = NewResponseCache(int(*responseCacheSize), time.Duration(*responseCacheTTL)*time.Second)
+		if err != nil {
+			logger.Fatal("Failed to create response cache", zap.Error(err))
+		}
+		logger.Info("caching responses", zap.Uint("responseCacheSize", *responseCacheSize), zap.Uint("responseCacheTTL", *responseCacheTTL))
+	}
+
+	var replayGuard *ReplayGuard
+	if *replayWindow != 0 {
+		replayGuard, err = NewReplayGuard(int(*replayCacheSize), time.Duration(*replayWindow)*time.Second)
+		if err != nil {
+			logger.Fatal("Failed to create replay guard", zap.Error(err))
+		}
+		logger.Info("rejecting replayed requests", zap.Uint("replayWindow", *replayWindow), zap.Uint("replayCacheSize", *replayCacheSize))
+	}
+
 	// Load p2p private key
 	var priv crypto.PrivKey
 	priv, err = common.GetOrCreateNodeKey(logger, *nodeKeyPath)
@@ -202,16 +324,28 @@ func runQueryServer(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	errC := make(chan error)
+
+	if auditLogger != nil {
+		auditLogger.Start(ctx, logger, errC)
+	}
+
+	// Start the guardian set cache.
+	gsRetryPolicy := DefaultGuardianSetRetryPolicy
+	gsRetryPolicy.MaxAttempts = int(*gsFetchAttempts)
+	gsCache := NewGuardianSetCache(logger, *ethRPC, *ethContract, time.Duration(*gsRefreshInterval)*time.Second, time.Duration(*gsFetchTimeout)*time.Second, gsRetryPolicy, rpcPolicy)
+	gsCache.Start(ctx, errC)
+
 	// Run p2p
 	pendingResponses := NewPendingResponses(logger)
-	p2p, err := runP2P(ctx, priv, *p2pPort, networkID, *p2pBootstrap, *ethRPC, *ethContract, pendingResponses, logger, *monitorPeers, loggingMap, *gossipAdvertiseAddress)
+	p2p, err := runP2P(ctx, priv, *p2pPort, networkID, *p2pBootstrap, gsCache, pendingResponses, logger, *monitorPeers, loggingMap, *gossipAdvertiseAddress)
 	if err != nil {
 		logger.Fatal("Failed to start p2p", zap.Error(err))
 	}
 
 	// Start the HTTP server
 	go func() {
-		s := NewHTTPServer(*listenAddr, p2p.topic_req, permissions, signerKey, pendingResponses, logger, env, loggingMap)
+		s := NewHTTPServer(*listenAddr, p2p.topic_req, permStore, signerKey, pendingResponses, logger, env, loggingMap, auditHook, headBlocks, responseCache, replayGuard, shadowPermStore, *trustForwardedFor, gsCache, uint32(*gsIndexLookback))
 		logger.Sugar().Infof("Server listening on %s", *listenAddr)
 		err := s.ListenAndServe()
 		if err != nil && err != http.ErrServerClosed {
@@ -222,7 +356,7 @@ func runQueryServer(cmd *cobra.Command, args []string) {
 	// Start the status server
 	var statServer *statusServer
 	if *statusAddr != "" {
-		statServer = NewStatusServer(*statusAddr, logger, env)
+		statServer = NewStatusServer(*statusAddr, logger, env, gsCache.ReadinessCheck)
 		go func() {
 			logger.Sugar().Infof("Status server listening on %s", *statusAddr)
 			err := statServer.httpServer.ListenAndServe()
@@ -280,8 +414,10 @@ func runQueryServer(cmd *cobra.Command, args []string) {
 	}()
 
 	// Start watching for permissions file updates.
-	errC := make(chan error)
-	permissions.StartWatcher(ctx, logger, errC)
+	permStore.StartWatcher(ctx, logger, errC)
+	if shadowPermStore != nil {
+		shadowPermStore.StartWatcher(ctx, logger.With(zap.String("shadowPermFile", *shadowPermFile)), errC)
+	}
 
 	// Star logging cleanup process.
 	loggingMap.Start(ctx, logger, errC)
@@ -297,7 +433,16 @@ func runQueryServer(cmd *cobra.Command, args []string) {
 	}
 
 	// Stop the permissions file watcher.
-	permissions.StopWatcher()
+	permStore.StopWatcher()
+	if shadowPermStore != nil {
+		shadowPermStore.StopWatcher()
+	}
+
+	// Write out any audit events that are still queued before the audit log file is closed.
+	if auditLogger != nil {
+		cancel()
+		auditLogger.Wait()
+	}
 
 	// Shutdown p2p. Without this the same host won't properly discover peers until some timeout
 	p2p.sub.Cancel()
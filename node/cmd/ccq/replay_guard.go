@@ -0,0 +1,60 @@
+package ccq
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// ReplayGuard remembers the requests seen recently, so that a captured request cannot be replayed against the proxy. Query requests do not
+// carry a timestamp, and the nonce is chosen freely by the client, so the age of a request cannot be checked directly. Instead, a request is
+// rejected if an identical one was seen from the same API key within the window, which forces clients to vary the nonce between requests.
+// Memory is bounded by the size of the guard, so it must be large enough to hold all of the requests received during the window. Otherwise
+// the oldest entries are evicted early, and a request could be replayed once its entry is gone.
+type ReplayGuard struct {
+	lock   sync.Mutex
+	window time.Duration
+	seen   *lru.Cache // Maps the request key to the time the request was first seen.
+}
+
+// NewReplayGuard creates a guard that remembers up to size requests, each of which is rejected if it is seen again within the window.
+func NewReplayGuard(size int, window time.Duration) (*ReplayGuard, error) {
+	seen, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayGuard{window: window, seen: seen}, nil
+}
+
+// Check records a request from an API key, and returns false if an identical request was already seen within the window. The request is
+// keyed the same way as in the response cache, so it is only matched against earlier requests with the same API key.
+func (rg *ReplayGuard) Check(apiKey string, queryRequest []byte, now time.Time) bool {
+	key := responseCacheKey(apiKey, queryRequest)
+
+	rg.lock.Lock()
+	defer rg.lock.Unlock()
+
+	if value, exists := rg.seen.Get(key); exists {
+		if now.Sub(value.(time.Time)) < rg.window {
+			return false
+		}
+	}
+
+	rg.seen.Add(key, now)
+	return true
+}
+
+// Forget removes the request recorded by Check at the specified time, so that it can be retried. It is used when a request fails without
+// getting a response, such as a timeout or an error from the guardians, since a retry of it is not a replay. If the request has been
+// recorded again since then, the newer entry is kept.
+func (rg *ReplayGuard) Forget(apiKey string, queryRequest []byte, seenAt time.Time) {
+	key := responseCacheKey(apiKey, queryRequest)
+
+	rg.lock.Lock()
+	defer rg.lock.Unlock()
+
+	if value, exists := rg.seen.Peek(key); exists && value.(time.Time).Equal(seenAt) {
+		rg.seen.Remove(key)
+	}
+}
@@ -0,0 +1,89 @@
+package ccq
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayGuardRejectsRequestsWithinWindow(t *testing.T) {
+	rg, err := NewReplayGuard(10, time.Minute)
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.True(t, rg.Check("my_secret_key", []byte("request"), now))
+
+	// The same request is rejected within the window.
+	assert.False(t, rg.Check("my_secret_key", []byte("request"), now.Add(30*time.Second)))
+
+	// A different request, or the same request from a different API key, is allowed.
+	assert.True(t, rg.Check("my_secret_key", []byte("other request"), now))
+	assert.True(t, rg.Check("other_key", []byte("request"), now))
+
+	// Once the window has passed, the request is allowed again, and the window restarts.
+	assert.True(t, rg.Check("my_secret_key", []byte("request"), now.Add(time.Minute)))
+	assert.False(t, rg.Check("my_secret_key", []byte("request"), now.Add(90*time.Second)))
+}
+
+func TestReplayGuardForget(t *testing.T) {
+	rg, err := NewReplayGuard(10, time.Minute)
+	require.NoError(t, err)
+
+	// A request that failed is forgotten, so it can be retried.
+	now := time.Now()
+	assert.True(t, rg.Check("my_secret_key", []byte("request"), now))
+	rg.Forget("my_secret_key", []byte("request"), now)
+	assert.True(t, rg.Check("my_secret_key", []byte("request"), now.Add(time.Second)))
+
+	// Forgetting an older attempt keeps the entry for the newer one.
+	rg.Forget("my_secret_key", []byte("request"), now)
+	assert.False(t, rg.Check("my_secret_key", []byte("request"), now.Add(2*time.Second)))
+
+	// Forgetting a request that was never seen does nothing.
+	rg.Forget("other_key", []byte("request"), now)
+	assert.False(t, rg.Check("my_secret_key", []byte("request"), now.Add(3*time.Second)))
+}
+
+func TestReplayGuardIsBounded(t *testing.T) {
+	rg, err := NewReplayGuard(2, time.Minute)
+	require.NoError(t, err)
+
+	now := time.Now()
+	assert.True(t, rg.Check("my_secret_key", []byte("request1"), now))
+	assert.True(t, rg.Check("my_secret_key", []byte("request2"), now))
+	assert.True(t, rg.Check("my_secret_key", []byte("request3"), now))
+
+	// The oldest request has been evicted, so it is no longer detected.
+	assert.Equal(t, 2, rg.seen.Len())
+	assert.True(t, rg.Check("my_secret_key", []byte("request1"), now))
+	assert.False(t, rg.Check("my_secret_key", []byte("request3"), now))
+}
+
+func TestReplayGuardConcurrentRequests(t *testing.T) {
+	rg, err := NewReplayGuard(100, time.Minute)
+	require.NoError(t, err)
+
+	// Only one of many identical requests racing each other is allowed.
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rg.Check("my_secret_key", []byte("request"), time.Now()) {
+				lock.Lock()
+				allowed++
+				lock.Unlock()
+			}
+			// Distinct requests are all allowed.
+			assert.True(t, rg.Check("my_secret_key", []byte(fmt.Sprintf("request%d", i)), time.Now()))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, allowed)
+}
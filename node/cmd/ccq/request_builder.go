@@ -0,0 +1,75 @@
+package ccq
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	gossipv1 "github.com/certusone/wormhole/node/pkg/proto/gossip/v1"
+	"github.com/certusone/wormhole/node/pkg/query"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// BuildEthCallRequest builds a query request containing a single eth_call against the specified block, which may be a block number or hash
+// in hex. The selector may be followed by the ABI encoded arguments. The contract address must be an EVM address left padded to 32 bytes,
+// as returned by vaa.StringToAddress. Each request gets a random nonce, so that identical calls are not rejected as duplicates.
+func BuildEthCallRequest(chain vaa.ChainID, contract vaa.Address, selector []byte, block string) (*query.QueryRequest, error) {
+	const evmAddressLength = 20
+	for _, b := range contract[:len(contract)-evmAddressLength] {
+		if b != 0 {
+			return nil, fmt.Errorf(`contract address "%s" is not an EVM address`, contract)
+		}
+	}
+	if len(selector) < ETH_CALL_SIG_LENGTH {
+		return nil, fmt.Errorf("eth call data must be at least %d bytes", ETH_CALL_SIG_LENGTH)
+	}
+
+	qr := &query.QueryRequest{
+		Nonce: rand.Uint32(),
+		PerChainQueries: []*query.PerChainQueryRequest{
+			{
+				ChainId: chain,
+				Query: &query.EthCallQueryRequest{
+					BlockId: block,
+					CallData: []*query.EthCallData{
+						{
+							To:   contract[len(contract)-evmAddressLength:],
+							Data: selector,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := qr.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to validate request: %w", err)
+	}
+	return qr, nil
+}
+
+// SignQueryRequest marshals a query request and signs it for the specified environment, producing the signed request that is sent to the
+// proxy and checked by validateRequest. If the key is nil, the request is left unsigned, which is only accepted for users with "allowUnsigned".
+func SignQueryRequest(env common.Environment, qr *query.QueryRequest, key *ecdsa.PrivateKey) (*gossipv1.SignedQueryRequest, error) {
+	queryRequestBytes, err := qr.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	sqr := &gossipv1.SignedQueryRequest{
+		QueryRequest: queryRequestBytes,
+	}
+
+	if key != nil {
+		digest := query.QueryRequestDigest(env, queryRequestBytes)
+		sqr.Signature, err = ethCrypto.Sign(digest.Bytes(), key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+	}
+
+	return sqr, nil
+}
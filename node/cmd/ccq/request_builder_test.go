@@ -0,0 +1,71 @@
+package ccq
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+func ExampleBuildEthCallRequest() {
+	perms, err := ParsePermissions([]byte(validateRequestTestConfig), common.UnsafeDevNet)
+	if err != nil {
+		panic(err)
+	}
+
+	contract, err := vaa.StringToAddress("B4FBF271143F4FBf7B91A5ded31805e42b2208d6")
+	if err != nil {
+		panic(err)
+	}
+	qr, err := BuildEthCallRequest(vaa.ChainIDEthereum, contract, []byte{0x06, 0xfd, 0xde, 0x03}, "0x28d9630")
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := ethCrypto.GenerateKey()
+	if err != nil {
+		panic(err)
+	}
+	sqr, err := SignQueryRequest(common.UnsafeDevNet, qr, key)
+	if err != nil {
+		panic(err)
+	}
+
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", sqr)
+	fmt.Println(status, err)
+	// Output: 200 <nil>
+}
+
+func TestBuildEthCallRequest(t *testing.T) {
+	contract, err := vaa.StringToAddress("B4FBF271143F4FBf7B91A5ded31805e42b2208d6")
+	require.NoError(t, err)
+
+	qr, err := BuildEthCallRequest(vaa.ChainIDEthereum, contract, []byte{0x06, 0xfd, 0xde, 0x03}, "0x28d9630")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(qr.PerChainQueries))
+	ecq := qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest)
+	assert.Equal(t, "0x28d9630", ecq.BlockId)
+	assert.Equal(t, contract[12:], ecq.CallData[0].To)
+
+	// Unsigned requests have no signature.
+	sqr, err := SignQueryRequest(common.UnsafeDevNet, qr, nil)
+	require.NoError(t, err)
+	assert.Empty(t, sqr.Signature)
+
+	_, err = BuildEthCallRequest(vaa.ChainIDEthereum, contract, []byte{0x06, 0xfd}, "0x28d9630")
+	assert.EqualError(t, err, "eth call data must be at least 4 bytes")
+
+	_, err = BuildEthCallRequest(vaa.ChainIDEthereum, vaa.Address{1}, []byte{0x06, 0xfd, 0xde, 0x03}, "0x28d9630")
+	assert.ErrorContains(t, err, "is not an EVM address")
+
+	_, err = BuildEthCallRequest(vaa.ChainIDEthereum, contract, []byte{0x06, 0xfd, 0xde, 0x03}, "")
+	assert.ErrorContains(t, err, "failed to validate request")
+}
@@ -0,0 +1,114 @@
+package ccq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// ResponseCache remembers the responses to recent requests, so that a client retrying an identical request can be served the same response
+// without sending it to the guardians again. An identical request that arrives while the first one is still in flight waits for its result.
+// Entries are keyed by the API key as well as the request, so one user is never served another user's result. They are also tied to the
+// version of the user's permissions, so a response is not reused once the permissions have been reloaded or the user has been changed.
+type ResponseCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries *lru.Cache
+}
+
+// CachedResponse is an entry in the response cache. It is created by the request that is responsible for getting the response, and
+// completed by that request once the response has been sent to its client.
+type CachedResponse struct {
+	key          string
+	permsForUser *permissionEntry // The version of the user's permissions that the response was made under.
+	done         chan struct{}
+
+	// These are only valid once done is closed.
+	response  *queryResponse // Nil if the request failed, in which case the entry is not reused.
+	truncated bool
+	expiresAt time.Time
+}
+
+// NewResponseCache creates a cache of up to size responses, each of which is reused for the specified time to live.
+func NewResponseCache(size int, ttl time.Duration) (*ResponseCache, error) {
+	entries, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &ResponseCache{ttl: ttl, entries: entries}, nil
+}
+
+// responseCacheKey returns the cache key for a request from an API key.
+func responseCacheKey(apiKey string, queryRequest []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(apiKey))
+	hash.Write([]byte{0}) // API keys cannot contain a zero byte, so this keeps the key and the request separate.
+	hash.Write(queryRequest)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Start looks up a request from an API key. If an identical request made under the same permissions entry is in flight or completed within
+// the time to live, it returns that entry and false, and the caller should wait for it. Otherwise it returns a new entry and true, in which
+// case the caller is responsible for getting the response and must call Complete or Abort on the entry.
+func (rc *ResponseCache) Start(apiKey string, permsForUser *permissionEntry, queryRequest []byte) (*CachedResponse, bool) {
+	key := responseCacheKey(apiKey, queryRequest)
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if value, exists := rc.entries.Get(key); exists && value.(*CachedResponse).permsForUser == permsForUser {
+		entry := value.(*CachedResponse)
+		select {
+		case <-entry.done:
+			if time.Now().Before(entry.expiresAt) {
+				return entry, false
+			}
+		default:
+			return entry, false
+		}
+	}
+
+	entry := &CachedResponse{key: key, permsForUser: permsForUser, done: make(chan struct{})}
+	rc.entries.Add(key, entry)
+	return entry, true
+}
+
+// Complete records the response for an entry returned by Start, and wakes up any requests waiting for it.
+func (rc *ResponseCache) Complete(entry *CachedResponse, response *queryResponse, truncated bool) {
+	entry.response = response
+	entry.truncated = truncated
+	entry.expiresAt = time.Now().Add(rc.ttl)
+	close(entry.done)
+}
+
+// Abort removes an entry returned by Start when the request failed, and wakes up any requests waiting for it. It does nothing if the entry
+// has already been completed, so it can be deferred.
+func (rc *ResponseCache) Abort(entry *CachedResponse) {
+	select {
+	case <-entry.done:
+		return
+	default:
+	}
+
+	rc.lock.Lock()
+	if value, exists := rc.entries.Peek(entry.key); exists && value == entry {
+		rc.entries.Remove(entry.key)
+	}
+	rc.lock.Unlock()
+	close(entry.done)
+}
+
+// Wait waits for an entry to be completed, and returns the response and whether it was truncated. The last value is false if the request
+// that owns the entry failed, or the context is done first.
+func (entry *CachedResponse) Wait(ctx context.Context) (*queryResponse, bool, bool) {
+	select {
+	case <-ctx.Done():
+		return nil, false, false
+	case <-entry.done:
+		return entry.response, entry.truncated, entry.response != nil
+	}
+}
@@ -0,0 +1,128 @@
+package ccq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseCacheServesIdenticalRequests(t *testing.T) {
+	rc, err := NewResponseCache(10, time.Minute)
+	require.NoError(t, err)
+
+	entry, owner := rc.Start("my_secret_key", nil, []byte("request"))
+	require.True(t, owner)
+
+	// An identical request in flight waits for the first one.
+	waiter, owner := rc.Start("my_secret_key", nil, []byte("request"))
+	require.False(t, owner)
+	assert.Same(t, entry, waiter)
+
+	resultC := make(chan *queryResponse)
+	go func() {
+		resp, _, ok := waiter.Wait(context.Background())
+		assert.True(t, ok)
+		resultC <- resp
+	}()
+
+	resp := &queryResponse{Bytes: "0102", Signatures: []string{"sig"}}
+	rc.Complete(entry, resp, false)
+	rc.Abort(entry) // Does nothing once completed.
+	assert.Same(t, resp, <-resultC)
+
+	// A recent request gets the same response.
+	recent, owner := rc.Start("my_secret_key", nil, []byte("request"))
+	require.False(t, owner)
+	cached, truncated, ok := recent.Wait(context.Background())
+	require.True(t, ok)
+	assert.False(t, truncated)
+	assert.Same(t, resp, cached)
+}
+
+func TestResponseCacheIsolatesUsers(t *testing.T) {
+	rc, err := NewResponseCache(10, time.Minute)
+	require.NoError(t, err)
+
+	entry, owner := rc.Start("my_secret_key", nil, []byte("request"))
+	require.True(t, owner)
+	rc.Complete(entry, &queryResponse{Bytes: "0102"}, false)
+
+	// The same request from a different API key is not served from the cache.
+	_, owner = rc.Start("my_secret_key_2", nil, []byte("request"))
+	assert.True(t, owner)
+
+	// Nor is a different request from the same API key.
+	_, owner = rc.Start("my_secret_key", nil, []byte("other request"))
+	assert.True(t, owner)
+}
+
+func TestResponseCacheIsTiedToPermissions(t *testing.T) {
+	rc, err := NewResponseCache(10, time.Minute)
+	require.NoError(t, err)
+	oldPerms := &permissionEntry{userName: "Test User"}
+	newPerms := &permissionEntry{userName: "Test User"}
+
+	entry, owner := rc.Start("my_secret_key", oldPerms, []byte("request"))
+	require.True(t, owner)
+	rc.Complete(entry, &queryResponse{Bytes: "0102"}, false)
+	_, owner = rc.Start("my_secret_key", oldPerms, []byte("request"))
+	assert.False(t, owner)
+
+	// Once the permissions have been reloaded, the response made under the old ones is not reused.
+	entry, owner = rc.Start("my_secret_key", newPerms, []byte("request"))
+	require.True(t, owner)
+	rc.Complete(entry, &queryResponse{Bytes: "0304"}, false)
+	cached, owner := rc.Start("my_secret_key", newPerms, []byte("request"))
+	require.False(t, owner)
+	resp, _, ok := cached.Wait(context.Background())
+	require.True(t, ok)
+	assert.Equal(t, "0304", resp.Bytes)
+}
+
+func TestResponseCacheDoesNotReuseFailures(t *testing.T) {
+	rc, err := NewResponseCache(10, time.Minute)
+	require.NoError(t, err)
+
+	entry, owner := rc.Start("my_secret_key", nil, []byte("request"))
+	require.True(t, owner)
+	waiter, owner := rc.Start("my_secret_key", nil, []byte("request"))
+	require.False(t, owner)
+
+	rc.Abort(entry)
+	_, _, ok := waiter.Wait(context.Background())
+	assert.False(t, ok)
+
+	// The next identical request is handled from scratch.
+	_, owner = rc.Start("my_secret_key", nil, []byte("request"))
+	assert.True(t, owner)
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	rc, err := NewResponseCache(10, time.Millisecond)
+	require.NoError(t, err)
+
+	entry, owner := rc.Start("my_secret_key", nil, []byte("request"))
+	require.True(t, owner)
+	rc.Complete(entry, &queryResponse{Bytes: "0102"}, false)
+
+	time.Sleep(5 * time.Millisecond)
+	_, owner = rc.Start("my_secret_key", nil, []byte("request"))
+	assert.True(t, owner)
+}
+
+func TestResponseCacheWaitCanceled(t *testing.T) {
+	rc, err := NewResponseCache(10, time.Minute)
+	require.NoError(t, err)
+
+	_, owner := rc.Start("my_secret_key", nil, []byte("request"))
+	require.True(t, owner)
+	waiter, _ := rc.Start("my_secret_key", nil, []byte("request"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, ok := waiter.Wait(ctx)
+	assert.False(t, ok)
+}
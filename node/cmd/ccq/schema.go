@@ -0,0 +1,76 @@
+package ccq
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	QueryServerCmd.AddCommand(SchemaCmd)
+}
+
+var SchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON schema for the permissions file",
+	Run:   runSchema,
+	Args:  cobra.NoArgs,
+}
+
+func runSchema(cmd *cobra.Command, args []string) {
+	schema, err := PermissionsSchema()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(string(schema))
+}
+
+// PermissionsSchema returns a JSON schema describing the permissions file. It is generated from the config structs, so it is always in sync with them.
+func PermissionsSchema() ([]byte, error) {
+	schema := schemaForType(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "Wormhole queries proxy permissions file"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// schemaForType returns the JSON schema for a type used in the config.
+func schemaForType(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaForType(t.Elem())
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaForType(field.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaForType(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{}
+	}
+}
@@ -0,0 +1,42 @@
+package ccq
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionsSchema(t *testing.T) {
+	schemaBytes, err := PermissionsSchema()
+	require.NoError(t, err)
+
+	var schema struct {
+		Type       string `json:"type"`
+		Properties map[string]struct {
+			Type  string `json:"type"`
+			Items struct {
+				Type       string `json:"type"`
+				Properties map[string]struct {
+					Type  string          `json:"type"`
+					Items json.RawMessage `json:"items"`
+				} `json:"properties"`
+			} `json:"items"`
+		} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(schemaBytes, &schema))
+
+	assert.Equal(t, "object", schema.Type)
+	assert.Equal(t, "number", schema.Properties["defaultRateLimit"].Type)
+	assert.Equal(t, "boolean", schema.Properties["allowAnythingSupported"].Type)
+
+	perms := schema.Properties["permissions"]
+	require.Equal(t, "array", perms.Type)
+	require.Equal(t, "object", perms.Items.Type)
+	assert.Equal(t, "string", perms.Items.Properties["apiKey"].Type)
+	assert.Equal(t, "array", perms.Items.Properties["apiKeys"].Type)
+	assert.Equal(t, "integer", perms.Items.Properties["burstSize"].Type)
+	assert.Equal(t, "array", perms.Items.Properties["allowedCalls"].Type)
+	assert.Contains(t, string(perms.Items.Properties["allowedCalls"].Items), `"solPDA"`)
+}
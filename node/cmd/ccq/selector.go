@@ -0,0 +1,36 @@
+package ccq
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	QueryServerCmd.AddCommand(SelectorCmd)
+}
+
+var SelectorCmd = &cobra.Command{
+	Use:   "selector [SIGNATURE]...",
+	Short: `Print the four byte eth call selector for one or more function signatures, such as "transfer(address,uint256)"`,
+	Run:   runSelector,
+	Args:  cobra.MinimumNArgs(1),
+}
+
+func runSelector(cmd *cobra.Command, args []string) {
+	failed := false
+	for _, arg := range args {
+		selector, sig, err := functionSelector(arg)
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		fmt.Printf("0x%s %s\n", selector, sig)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,332 @@
+package ccq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/certusone/wormhole/node/pkg/query"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/gagliardetto/solana-go"
+	"github.com/spf13/cobra"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+)
+
+var (
+	selfTestEnvStr   *string
+	selfTestPermFile *string
+)
+
+func init() {
+	selfTestEnvStr = SelfTestCmd.Flags().String("env", "", "environment (devnet, testnet, mainnet)")
+	selfTestPermFile = SelfTestCmd.Flags().String("permFile", "", "JSON file containing permissions configuration")
+	QueryServerCmd.AddCommand(SelfTestCmd)
+}
+
+var SelfTestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Check that a request built from each user's permissions passes validation, and that an unauthorized one does not",
+	Run:   runSelfTest,
+	Args:  cobra.NoArgs,
+}
+
+// The outcomes of the self test for a user.
+const (
+	selfTestPassed  = "ok"
+	selfTestFailed  = "FAIL"
+	selfTestSkipped = "skip"
+)
+
+// SelfTestResult is the outcome of the self test for a single user.
+type SelfTestResult struct {
+	UserName    string
+	Result      string // One of "ok", "FAIL" or "skip".
+	AllowedCall string // The call key of the call that should have been allowed, if any.
+	DeniedCall  string // The call key of the call that should have been denied, if any.
+	Detail      string // Why the test failed or was skipped. May also be set if it passed, such as when there was no call to deny.
+}
+
+// runSelfTest implements the selftest subcommand.
+func runSelfTest(cmd *cobra.Command, args []string) {
+	env, err := common.ParseEnvironment(*selfTestEnvStr)
+	if err != nil || (env != common.UnsafeDevNet && env != common.TestNet && env != common.MainNet) {
+		if *selfTestEnvStr == "" {
+			fmt.Println("Please specify --env")
+		} else {
+			fmt.Println("Invalid value for --env, should be devnet, testnet or mainnet")
+		}
+		os.Exit(1)
+	}
+
+	if *selfTestPermFile == "" {
+		fmt.Println("Please specify --permFile")
+		os.Exit(1)
+	}
+
+	perms, err := NewPermissions(*selfTestPermFile, env, DefaultMaxConfigSize)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	results, err := RunSelfTest(perms)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if failed := WriteSelfTestResults(os.Stdout, results); failed != 0 {
+		os.Exit(1)
+	}
+}
+
+// RunSelfTest builds a request for each user from the first of their allowed calls, in call key order, and checks that it passes
+// validateRequest and Authorize. It then builds a request for a call the user is not allowed to make, and checks that both reject it.
+// This catches cases where the validation does not agree with the config. The signature checks are not covered, since the user's signing
+// keys are not available, so the requests are validated as if the user allowed unsigned requests. The results are sorted by user name.
+func RunSelfTest(perms *Permissions) ([]SelfTestResult, error) {
+	// The proxy signs unsigned requests, so it needs a key. It is not used for anything else.
+	signerKey, err := ethCrypto.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	entries := make(map[string]*permissionEntry)
+	for _, pe := range perms.permMap {
+		entries[pe.userName] = pe
+	}
+
+	results := make([]SelfTestResult, 0, len(entries))
+	for _, userName := range slices.Sorted(maps.Keys(entries)) {
+		results = append(results, selfTestUser(perms, entries[userName], signerKey))
+	}
+	return results, nil
+}
+
+// selfTestUser runs the self test for a single user.
+func selfTestUser(perms *Permissions, pe *permissionEntry, signerKey *ecdsa.PrivateKey) SelfTestResult {
+	result := SelfTestResult{UserName: pe.userName, Result: selfTestSkipped}
+	if pe.allowAnything || pe.unrestricted {
+		result.Detail = "allows any call"
+		return result
+	}
+	if pe.isExpired(time.Now()) {
+		result.Detail = "has expired"
+		return result
+	}
+
+	// Use the first call that a request can be built for. Calls with an inner call check need call data that satisfies it, which cannot be
+	// made up.
+	var allowedCall string
+	for _, callKey := range slices.Sorted(pe.allowedCalls.keys()) {
+		if opts, _ := pe.allowedCalls.get(callKey); opts.innerCallCheck == nil {
+			allowedCall = callKey
+			break
+		}
+	}
+	if allowedCall == "" {
+		result.Detail = "has no calls that a request can be built for"
+		return result
+	}
+
+	apiKey := pe.apiKeys[0]
+	relaxed := *pe
+	relaxed.allowUnsigned = true
+	relaxed.signerAddress = nil
+	relaxed.signerAddresses = nil
+	relaxed.signerThreshold = 0
+	validate := func(qr *query.QueryRequest) error {
+		sqr, err := SignQueryRequest(perms.env, qr, nil)
+		if err != nil {
+			return err
+		}
+		_, _, err = validateRequestForUser(context.Background(), zap.NewNop(), perms.env, &relaxed, signerKey, nil, sqr, false, nil)
+		return err
+	}
+	authorized := func(qr *query.QueryRequest) (bool, string) {
+		authResults, err := perms.Authorize(apiKey, qr)
+		if err != nil {
+			return false, err.Error()
+		}
+		return authResults[0].Allowed, authResults[0].Reason
+	}
+
+	result.AllowedCall = allowedCall
+	result.Result = selfTestFailed
+	qr, err := buildSelfTestRequest(pe, allowedCall)
+	if err != nil {
+		result.Detail = fmt.Sprintf("failed to build a request for the allowed call: %v", err)
+		return result
+	}
+	if err := validate(qr); err != nil {
+		result.Detail = fmt.Sprintf("allowed call was rejected: %v", err)
+		return result
+	}
+	if allowed, reason := authorized(qr); !allowed {
+		result.Detail = fmt.Sprintf("allowed call passed validation, but authorize rejected it: %s", reason)
+		return result
+	}
+
+	result.Result = selfTestPassed
+	deniedCall, qr := buildSelfTestDeniedRequest(pe, allowedCall)
+	if allowed, _ := authorized(qr); allowed {
+		result.Detail = "could not find a call to deny"
+		return result
+	}
+	result.DeniedCall = deniedCall
+	if err := validate(qr); !errors.Is(err, ErrCallNotAuthorized) {
+		result.Result = selfTestFailed
+		if err == nil {
+			result.Detail = "unauthorized call passed validation"
+		} else {
+			result.Detail = fmt.Sprintf("unauthorized call was rejected for the wrong reason: %v", err)
+		}
+	}
+	return result
+}
+
+// buildSelfTestRequest builds a request containing a single call matching a call key. Wild cards are replaced by arbitrary values, and the
+// block, finality and arguments are chosen to satisfy the restrictions on the call.
+func buildSelfTestRequest(pe *permissionEntry, callKey string) (*query.QueryRequest, error) {
+	fields := strings.Split(callKey, ":")
+	chain, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid call key "%s": %w`, callKey, err)
+	}
+	chainId := vaa.ChainID(chain)
+	opts, _ := pe.allowedCalls.get(callKey)
+
+	var chainQuery query.ChainSpecificQuery
+	switch fields[0] {
+	case "solAccount", "solPDA":
+		account, err := solana.PublicKeyFromBase58(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf(`invalid call key "%s": %w`, callKey, err)
+		}
+		if fields[0] == "solAccount" {
+			chainQuery = &query.SolanaAccountQueryRequest{Commitment: "finalized", Accounts: [][query.SolanaPublicKeyLength]byte{account}}
+		} else {
+			chainQuery = &query.SolanaPdaQueryRequest{Commitment: "finalized", PDAs: []query.SolanaPDAEntry{{ProgramAddress: account, Seeds: [][]byte{{1}}}}}
+		}
+	default:
+		const evmAddressLength = 20
+		var contract vaa.Address
+		contract[len(contract)-1] = 1
+		if fields[2] != "*" {
+			if contract, err = vaa.StringToAddress(fields[2]); err != nil {
+				return nil, fmt.Errorf(`invalid contract address in call key "%s": %w`, callKey, err)
+			}
+			if slices.ContainsFunc(contract[:len(contract)-evmAddressLength], func(b byte) bool { return b != 0 }) {
+				return nil, fmt.Errorf(`contract address "%s" is not an EVM address`, contract)
+			}
+		}
+		to := contract[len(contract)-evmAddressLength:]
+		data := make([]byte, ETH_CALL_SIG_LENGTH)
+		if fields[3] != "*" {
+			if data, err = hex.DecodeString(fields[3]); err != nil {
+				return nil, fmt.Errorf(`invalid call in call key "%s"`, callKey)
+			}
+		}
+		if opts.argLayout != nil {
+			data = append(data, make([]byte, opts.argLayout.headSize)...)
+		}
+		callData := []*query.EthCallData{{To: to, Data: data}}
+
+		// The oldest block that may be queried is fine, since the request is never executed.
+		blockId := "0x1"
+		if restriction, exists := pe.blockRestrictions[chainId]; exists && restriction.minBlockNumber > 1 {
+			blockId = fmt.Sprintf("0x%x", restriction.minBlockNumber)
+		}
+
+		switch fields[0] {
+		case "ethCall":
+			chainQuery = &query.EthCallQueryRequest{BlockId: blockId, CallData: callData}
+		case "ethCallByTimestamp":
+			chainQuery = &query.EthCallByTimestampQueryRequest{TargetTimestamp: uint64(time.Now().UnixMicro()), CallData: callData}
+		case "ethCallWithFinality":
+			finality := "finalized"
+			if len(opts.allowedFinality) != 0 {
+				finality = slices.Sorted(maps.Keys(opts.allowedFinality))[0]
+			}
+			chainQuery = &query.EthCallWithFinalityQueryRequest{BlockId: blockId, Finality: finality, CallData: callData}
+		default:
+			return nil, fmt.Errorf(`unsupported call type in call key "%s"`, callKey)
+		}
+	}
+
+	qr := &query.QueryRequest{
+		Nonce:           1,
+		PerChainQueries: []*query.PerChainQueryRequest{{ChainId: chainId, Query: chainQuery}},
+	}
+	if err := qr.Validate(); err != nil {
+		return nil, fmt.Errorf("failed to validate request: %w", err)
+	}
+	return qr, nil
+}
+
+// buildSelfTestDeniedRequest builds a request for a call that the user is probably not allowed to make, on the same chain as one of their
+// allowed calls. It returns the request and the call key of the call. The caller must check that the call really is not allowed, since it
+// may be covered by a wild card.
+func buildSelfTestDeniedRequest(pe *permissionEntry, allowedCall string) (string, *query.QueryRequest) {
+	fields := strings.Split(allowedCall, ":")
+	var callKey string
+	if len(fields) == 4 {
+		// Use an unlikely selector on the same contract.
+		fields[3] = "ffffffff"
+		callKey = strings.Join(fields, ":")
+	} else {
+		// Use an account that is all ones, which is not a valid public key.
+		var account solana.PublicKey
+		for idx := range account {
+			account[idx] = 0xff
+		}
+		callKey = fmt.Sprintf("%s:%s:%s", fields[0], fields[1], account)
+	}
+
+	qr, err := buildSelfTestRequest(pe, callKey)
+	if err != nil {
+		// This cannot happen, since the allowed call was built successfully.
+		panic(err)
+	}
+	return callKey, qr
+}
+
+// WriteSelfTestResults prints the self test results as a table, followed by a summary line. It returns the number of users that failed.
+func WriteSelfTestResults(w io.Writer, results []SelfTestResult) int {
+	failed := 0
+	passed := 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESULT\tUSER\tALLOWED CALL\tDENIED CALL\tDETAIL")
+	for _, result := range results {
+		switch result.Result {
+		case selfTestFailed:
+			failed++
+		case selfTestPassed:
+			passed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Result, result.UserName, dashIfEmpty(result.AllowedCall), dashIfEmpty(result.DeniedCall), dashIfEmpty(result.Detail))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d of %d users passed, %d failed, %d skipped\n", passed, len(results), failed, len(results)-passed-failed)
+	return failed
+}
+
+// dashIfEmpty returns the string, or "-" if it is empty, for display in a table.
+func dashIfEmpty(str string) string {
+	if str == "" {
+		return "-"
+	}
+	return str
+}
@@ -0,0 +1,146 @@
+package ccq
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const selfTestConfig = `
+{
+  "permissions": [
+    {
+      "userName": "Eth User",
+      "apiKey": "eth_key",
+      "signerAddress": "0x1234567890123456789012345678901234567890",
+      "blockRestrictions": [{ "chain": 2, "minBlockNumber": 100 }],
+      "allowedCalls": [
+        {
+          "ethCallWithFinality": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "balanceOf(address)",
+            "allowedFinality": ["safe"]
+          }
+        },
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Solana User",
+      "apiKey": "solana_key",
+      "allowUnsigned": true,
+      "allowedCalls": [
+        {
+          "solAccount": {
+            "chain": 1,
+            "account": "BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Wild Card User",
+      "apiKey": "wild_card_key",
+      "allowUnsigned": true,
+      "allowedCalls": [
+        {
+          "ethCallByTimestamp": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "*"
+          }
+        }
+      ]
+    },
+    {
+      "userName": "Expired User",
+      "apiKey": "expired_key",
+      "allowUnsigned": true,
+      "expiresAt": "2020-01-01T00:00:00Z",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+func TestRunSelfTest(t *testing.T) {
+	results, err := RunSelfTest(createTestPermissions(t, selfTestConfig))
+	require.NoError(t, err)
+	assert.Equal(t, []SelfTestResult{
+		{
+			UserName:    "Eth User",
+			Result:      selfTestPassed,
+			AllowedCall: "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03",
+			DeniedCall:  "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:ffffffff",
+		},
+		{
+			UserName: "Expired User",
+			Result:   selfTestSkipped,
+			Detail:   "has expired",
+		},
+		{
+			UserName:    "Solana User",
+			Result:      selfTestPassed,
+			AllowedCall: "solAccount:1:BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna",
+			DeniedCall:  "solAccount:1:JEKNVnkbo3jma5nREBBJCDoXFVeKkD56V3xKrvRmWxFG",
+		},
+		{
+			UserName:    "Wild Card User",
+			Result:      selfTestPassed,
+			AllowedCall: "ethCallByTimestamp:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:*",
+			Detail:      "could not find a call to deny",
+		},
+	}, results)
+}
+
+func TestBuildSelfTestRequestRespectsRestrictions(t *testing.T) {
+	perms := createTestPermissions(t, selfTestConfig)
+	pe, exists := perms.GetUserEntry("eth_key")
+	require.True(t, exists)
+
+	// The call with finality sorts after the plain eth call, so it is not used by the self test, but it should still validate.
+	var callKey string
+	for key := range pe.allowedCalls.keys() {
+		if key != "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03" {
+			callKey = key
+		}
+	}
+	qr, err := buildSelfTestRequest(pe, callKey)
+	require.NoError(t, err)
+	results, err := perms.Authorize("eth_key", qr)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.True(t, results[0].Allowed, results[0].Reason)
+}
+
+func TestWriteSelfTestResults(t *testing.T) {
+	var buf bytes.Buffer
+	failed := WriteSelfTestResults(&buf, []SelfTestResult{
+		{UserName: "Good User", Result: selfTestPassed, AllowedCall: "ethCall:2:*:06fdde03", DeniedCall: "ethCall:2:*:ffffffff"},
+		{UserName: "Bad User", Result: selfTestFailed, AllowedCall: "solPDA:1:abc", Detail: "allowed call was rejected: call not authorized"},
+		{UserName: "Other User", Result: selfTestSkipped, Detail: "allows any call"},
+	})
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, `RESULT  USER        ALLOWED CALL          DENIED CALL           DETAIL
+ok      Good User   ethCall:2:*:06fdde03  ethCall:2:*:ffffffff  -
+FAIL    Bad User    solPDA:1:abc          -                     allowed call was rejected: call not authorized
+skip    Other User  -                     -                     allows any call
+1 of 3 users passed, 1 failed, 1 skipped
+`, buf.String())
+}
@@ -0,0 +1,107 @@
+package ccq
+
+import (
+	"github.com/certusone/wormhole/node/pkg/query"
+	"go.uber.org/zap"
+)
+
+// shadowDiscrepancy is a call in a request that the live and shadow permissions make different decisions about.
+type shadowDiscrepancy struct {
+	callKey       string
+	liveAllowed   bool
+	liveReason    string
+	shadowAllowed bool
+	shadowReason  string
+}
+
+// shadowDiscrepancies compares the decisions that the live and shadow permissions make about each call in a request. Like Authorize,
+// which does the evaluation, it has no side effects, so it never affects the enforcement of the live permissions. A request that one
+// side rejects as a whole, such as for an unknown API key, is treated as denying every call. Only the checks that Authorize makes are compared.
+// Signatures, source addresses, rate and concurrency limits, block depth, response size and maintenance mode are not.
+func shadowDiscrepancies(live *Permissions, shadow *Permissions, apiKey string, qr *query.QueryRequest) []shadowDiscrepancy {
+	liveResults, liveErr := live.Authorize(apiKey, qr)
+	shadowResults, shadowErr := shadow.Authorize(apiKey, qr)
+	switch {
+	case liveErr != nil && shadowErr != nil:
+		return nil
+	case liveErr != nil:
+		liveResults = deniedResults(shadowResults, liveErr)
+	case shadowErr != nil:
+		shadowResults = deniedResults(liveResults, shadowErr)
+	}
+
+	// The results are in the order of the calls in the request, so they line up.
+	var discrepancies []shadowDiscrepancy
+	for idx, liveResult := range liveResults {
+		shadowResult := shadowResults[idx]
+		if liveResult.Allowed != shadowResult.Allowed {
+			discrepancies = append(discrepancies, shadowDiscrepancy{
+				callKey:       liveResult.CallKey,
+				liveAllowed:   liveResult.Allowed,
+				liveReason:    liveResult.Reason,
+				shadowAllowed: shadowResult.Allowed,
+				shadowReason:  shadowResult.Reason,
+			})
+		}
+	}
+	return discrepancies
+}
+
+// deniedResults returns a copy of the results with every call denied for the reason that the request as a whole was rejected.
+func deniedResults(results []CallAuthResult, err error) []CallAuthResult {
+	denied := make([]CallAuthResult, len(results))
+	for idx, result := range results {
+		denied[idx] = CallAuthResult{ChainId: result.ChainId, CallKey: result.CallKey, Reason: err.Error()}
+	}
+	return denied
+}
+
+// maxShadowComparisons is the most shadow comparisons that may run at once. A request that arrives while that many are running is not
+// compared, so shadow mode adds a bounded amount of work however busy the server is.
+const maxShadowComparisons = 16
+
+// startShadowComparison runs compareShadowPermissions in the background, unless maxShadowComparisons are already running, in which case
+// the request is skipped and counted.
+func (s *httpServer) startShadowComparison(logger *zap.Logger, live *Permissions, userName string, apiKey string, queryRequestBytes []byte) {
+	select {
+	case s.shadowSlots <- struct{}{}:
+	default:
+		shadowComparisonsSkipped.Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-s.shadowSlots }()
+		s.compareShadowPermissions(logger, live, userName, apiKey, queryRequestBytes)
+	}()
+}
+
+// compareShadowPermissions logs and counts every call in a request that the shadow permissions would decide differently about than the
+// live permissions used to validate it. It is called off the request path, so it parses the request itself. A request that cannot be parsed
+// is ignored, since the live validation rejects it anyway.
+func (s *httpServer) compareShadowPermissions(logger *zap.Logger, live *Permissions, userName string, apiKey string, queryRequestBytes []byte) {
+	var qr query.QueryRequest
+	if err := qr.Unmarshal(queryRequestBytes); err != nil {
+		return
+	}
+
+	for _, d := range shadowDiscrepancies(live, s.shadowPermissions.Load(), apiKey, &qr) {
+		logger.Warn("shadow permissions disagree with the live permissions",
+			zap.String("userName", userName),
+			zap.String("callKey", d.callKey),
+			zap.String("liveDecision", authDecision(d.liveAllowed)),
+			zap.String("liveReason", d.liveReason),
+			zap.String("shadowDecision", authDecision(d.shadowAllowed)),
+			zap.String("shadowReason", d.shadowReason),
+		)
+		shadowDiscrepanciesByUser.WithLabelValues(userName, authDecision(d.shadowAllowed)).Inc()
+	}
+}
+
+// authDecision returns the name of an authorization decision, as used in logs and metrics.
+func authDecision(allowed bool) string {
+	if allowed {
+		return "allowed"
+	}
+	return "denied"
+}
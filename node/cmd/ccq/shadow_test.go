@@ -0,0 +1,103 @@
+package ccq
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestShadowDiscrepancies(t *testing.T) {
+	live := createTestPermissions(t, validateRequestTestConfig)
+	qr := createMixedQueryRequest(t)
+
+	// Identical permissions never disagree.
+	assert.Empty(t, shadowDiscrepancies(live, createTestPermissions(t, validateRequestTestConfig), "my_secret_key", qr))
+
+	// A stricter candidate that drops "name()" and adds "totalSupply()" disagrees about both.
+	shadow := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "0x18160ddd"`, 1))
+	assert.Equal(t, []shadowDiscrepancy{
+		{
+			callKey:      "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03",
+			liveAllowed:  true,
+			shadowReason: "call not authorized",
+		},
+		{
+			callKey:       "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd",
+			liveReason:    "call not authorized",
+			shadowAllowed: true,
+		},
+	}, shadowDiscrepancies(live, shadow, "my_secret_key", qr))
+
+	// An API key that the candidate does not know about denies every call.
+	shadow = createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"my_secret_key"`, `"new_secret_key"`, 1))
+	assert.Equal(t, []shadowDiscrepancy{
+		{
+			callKey:      "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03",
+			liveAllowed:  true,
+			shadowReason: "invalid api key",
+		},
+	}, shadowDiscrepancies(live, shadow, "my_secret_key", qr))
+
+	// When neither knows the API key, they agree.
+	assert.Empty(t, shadowDiscrepancies(live, shadow, "unknown_key", qr))
+}
+
+func TestCompareShadowPermissions(t *testing.T) {
+	observedCore, logs := observer.New(zapcore.InfoLevel)
+	s := &httpServer{
+		shadowPermissions: NewPermissionsStore(createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "0x18160ddd"`, 1)), nil),
+	}
+	live := createTestPermissions(t, validateRequestTestConfig)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	queryRequestBytes, err := qr.Marshal()
+	require.NoError(t, err)
+
+	s.compareShadowPermissions(zap.New(observedCore), live, "Test User", "my_secret_key", queryRequestBytes)
+	entries := logs.FilterMessage("shadow permissions disagree with the live permissions").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "Test User", fields["userName"])
+	assert.Equal(t, "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:06fdde03", fields["callKey"])
+	assert.Equal(t, "allowed", fields["liveDecision"])
+	assert.Equal(t, "denied", fields["shadowDecision"])
+	assert.Equal(t, "call not authorized", fields["shadowReason"])
+
+	// A request that cannot be parsed is left to the live validation.
+	s.compareShadowPermissions(zap.New(observedCore), live, "Test User", "my_secret_key", []byte{0x01})
+	assert.Equal(t, 1, logs.Len())
+}
+
+func TestStartShadowComparisonIsBounded(t *testing.T) {
+	observedCore, logs := observer.New(zapcore.InfoLevel)
+	s := &httpServer{
+		shadowPermissions: NewPermissionsStore(createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "0x18160ddd"`, 1)), nil),
+		shadowSlots:       make(chan struct{}, 1),
+	}
+	live := createTestPermissions(t, validateRequestTestConfig)
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	queryRequestBytes, err := qr.Marshal()
+	require.NoError(t, err)
+
+	// While every slot is taken, requests are skipped rather than starting more go routines.
+	s.shadowSlots <- struct{}{}
+	before, err := getCounterValue(shadowComparisonsSkipped)
+	require.NoError(t, err)
+	s.startShadowComparison(zap.New(observedCore), live, "Test User", "my_secret_key", queryRequestBytes)
+	after, err := getCounterValue(shadowComparisonsSkipped)
+	require.NoError(t, err)
+	assert.Equal(t, before+1, after)
+	assert.Zero(t, logs.Len())
+
+	// Once a slot is free, the comparison runs, and it gives the slot back when it is done.
+	<-s.shadowSlots
+	s.startShadowComparison(zap.New(observedCore), live, "Test User", "my_secret_key", queryRequestBytes)
+	require.Eventually(t, func() bool { return logs.Len() == 1 && len(s.shadowSlots) == 0 }, time.Second, 10*time.Millisecond)
+}
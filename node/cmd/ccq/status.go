@@ -15,20 +15,23 @@ import (
 )
 
 type statusServer struct {
-	logger        *zap.Logger
-	env           common.Environment
-	httpServer    *http.Server
-	healthEnabled atomic.Bool
+	logger         *zap.Logger
+	env            common.Environment
+	httpServer     *http.Server
+	healthEnabled  atomic.Bool
+	readinessCheck func(ctx context.Context) error
 }
 
-func NewStatusServer(addr string, logger *zap.Logger, env common.Environment) *statusServer {
+func NewStatusServer(addr string, logger *zap.Logger, env common.Environment, readinessCheck func(ctx context.Context) error) *statusServer {
 	s := &statusServer{
-		logger: logger,
-		env:    env,
+		logger:         logger,
+		env:            env,
+		readinessCheck: readinessCheck,
 	}
 	s.healthEnabled.Store(true)
 	r := mux.NewRouter()
 	r.HandleFunc("/health", s.handleHealth).Methods("GET")
+	r.HandleFunc("/ready", s.handleReady).Methods("GET")
 	r.Handle("/metrics", promhttp.Handler())
 	s.httpServer = &http.Server{
 		Addr:              addr,
@@ -53,6 +56,22 @@ func (s *statusServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "ok")
 }
 
+// handleReady reports whether the proxy is ready to serve traffic, which requires that it can obtain the guardian set.
+func (s *statusServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.healthEnabled.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.readinessCheck(r.Context()); err != nil {
+		s.logger.Warn("readiness check failed", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	s.logger.Debug("readiness check")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "ok")
+}
+
 func RunPrometheusScraper(ctx context.Context, logger *zap.Logger, info promremotew.PromTelemetryInfo) error {
 	promLogger := logger.With(zap.String("component", "prometheus_scraper"))
 	errC := make(chan error)
@@ -6,7 +6,13 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/certusone/wormhole/node/pkg/common"
@@ -14,6 +20,8 @@ import (
 	"github.com/certusone/wormhole/node/pkg/query"
 	"github.com/wormhole-foundation/wormhole/sdk/vaa"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/time/rate"
 
 	ethAbi "github.com/certusone/wormhole/node/pkg/watchers/evm/connectors/ethabi"
 	ethBind "github.com/ethereum/go-ethereum/accounts/abi/bind"
@@ -25,43 +33,406 @@ import (
 	"github.com/gagliardetto/solana-go"
 )
 
+// DefaultGuardianSetFetchTimeout is the timeout used by FetchCurrentGuardianSet.
+const DefaultGuardianSetFetchTimeout = 5 * time.Second
+
+// RetryPolicy controls how the contract calls made when fetching a guardian set are retried. The delay doubles after each failed attempt,
+// up to the maximum. Retries never go past the deadline of the context, so the fetch timeout covers all of the attempts.
+type RetryPolicy struct {
+	MaxAttempts  int // The total number of attempts, including the first. Zero or one means there are no retries.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultGuardianSetRetryPolicy is the retry policy used when one is not specified.
+var DefaultGuardianSetRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialDelay: 250 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+// FetchCurrentGuardianSet reads the current guardian set from the core contract using the default timeout. It allows any RPC URL, so use
+// FetchCurrentGuardianSetWithRetries if the URL needs to be checked against an RPCPolicy.
 func FetchCurrentGuardianSet(rpcUrl, coreAddr string) (*common.GuardianSet, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	return FetchCurrentGuardianSetWithTimeout(context.Background(), rpcUrl, coreAddr, DefaultGuardianSetFetchTimeout)
+}
+
+// FetchCurrentGuardianSetWithTimeout reads the current guardian set from the core contract using the specified timeout and the default retry policy.
+// Like FetchCurrentGuardianSet, it allows any RPC URL.
+func FetchCurrentGuardianSetWithTimeout(parentCtx context.Context, rpcUrl, coreAddr string, timeout time.Duration) (*common.GuardianSet, error) {
+	return FetchCurrentGuardianSetWithRetries(parentCtx, rpcUrl, coreAddr, timeout, DefaultGuardianSetRetryPolicy, RPCPolicy{})
+}
+
+// FetchCurrentGuardianSetWithRetries reads the current guardian set from the core contract using the specified timeout and retry policy.
+// The RPC URL must be permitted by the RPC policy.
+func FetchCurrentGuardianSetWithRetries(parentCtx context.Context, rpcUrl, coreAddr string, timeout time.Duration, policy RetryPolicy, rpcPolicy RPCPolicy) (*common.GuardianSet, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+	caller, closeFunc, err := dialCoreContract(ctx, rpcPolicy, rpcUrl, coreAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFunc()
+	currentIndex, err := withRetries(ctx, policy, func() (uint32, error) {
+		return caller.GetCurrentGuardianSetIndex(&ethBind.CallOpts{Context: ctx})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error requesting current guardian set index: %w", err)
+	}
+	gs, expiresAt, err := fetchGuardianSet(ctx, caller, currentIndex, policy)
+	if err != nil {
+		return nil, err
+	}
+	// The current set should never have expired, but if it has, the guardians will not accept its signatures anyway.
+	if err := checkGuardianSetExpiry(currentIndex, expiresAt, time.Now()); err != nil {
+		return nil, err
+	}
+	return gs, nil
+}
+
+// FetchGuardianSet reads the guardian set with the specified index from the core contract using the default timeout. It also returns the time
+// the set expires, which is zero if it does not expire. A set that has expired is still returned, so that historical sets can be read. Use
+// checkGuardianSetExpiry to reject one.
+func FetchGuardianSet(rpcUrl, coreAddr string, index uint32) (*common.GuardianSet, time.Time, error) {
+	return FetchGuardianSetWithTimeout(context.Background(), rpcUrl, coreAddr, index, DefaultGuardianSetFetchTimeout, RPCPolicy{})
+}
+
+// FetchGuardianSetWithTimeout reads the guardian set with the specified index from the core contract using the specified timeout and the
+// default retry policy. Like FetchGuardianSet, it also returns the time the set expires. The RPC URL must be permitted by the RPC policy.
+func FetchGuardianSetWithTimeout(parentCtx context.Context, rpcUrl, coreAddr string, index uint32, timeout time.Duration, rpcPolicy RPCPolicy) (*common.GuardianSet, time.Time, error) {
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
 	defer cancel()
+	caller, closeFunc, err := dialCoreContract(ctx, rpcPolicy, rpcUrl, coreAddr)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer closeFunc()
+	return fetchGuardianSet(ctx, caller, index, DefaultGuardianSetRetryPolicy)
+}
+
+// GuardianSetEndpoint identifies a core contract, and the RPC used to read it, for FetchGuardianSetMulti.
+type GuardianSetEndpoint struct {
+	RpcUrl   string
+	CoreAddr string
+}
+
+// String identifies the endpoint in errors. Only the scheme and host of the RPC URL are included, since the rest often contains an API key.
+func (e GuardianSetEndpoint) String() string {
+	if u, err := url.Parse(e.RpcUrl); err == nil && u.Host != "" {
+		return fmt.Sprintf("%s://%s (%s)", u.Scheme, u.Host, e.CoreAddr)
+	}
+	return fmt.Sprintf("endpoint (%s)", e.CoreAddr)
+}
+
+// FetchGuardianSetMulti reads the current guardian set from each of the endpoints using the default timeout, and returns it if they all
+// agree. This guards against a single compromised or lagging RPC. When there is only one endpoint, use FetchCurrentGuardianSet instead.
+func FetchGuardianSetMulti(endpoints []GuardianSetEndpoint) (*common.GuardianSet, error) {
+	return FetchGuardianSetMultiWithTimeout(context.Background(), endpoints, DefaultGuardianSetFetchTimeout)
+}
+
+// FetchGuardianSetMultiWithTimeout is like FetchGuardianSetMulti, but uses the specified timeout. The endpoints are read concurrently, so
+// the timeout applies to each of them rather than to the total.
+func FetchGuardianSetMultiWithTimeout(parentCtx context.Context, endpoints []GuardianSetEndpoint, timeout time.Duration) (*common.GuardianSet, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no guardian set endpoints specified")
+	}
+
+	sets := make([]*common.GuardianSet, len(endpoints))
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for idx, endpoint := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sets[idx], errs[idx] = FetchCurrentGuardianSetWithTimeout(parentCtx, endpoint.RpcUrl, endpoint.CoreAddr, timeout)
+		}()
+	}
+	wg.Wait()
+
+	for idx, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the guardian set from %s: %w", endpoints[idx], err)
+		}
+	}
+
+	// Everything is compared against the first endpoint, so that is the one any disagreement is reported against.
+	for idx := 1; idx < len(sets); idx++ {
+		if sets[idx].Index != sets[0].Index {
+			return nil, fmt.Errorf("%w: %s returned guardian set %d, but %s returned guardian set %d", ErrGuardianSetMismatch, endpoints[idx], sets[idx].Index, endpoints[0], sets[0].Index)
+		}
+		if !slices.Equal(sets[idx].Keys, sets[0].Keys) {
+			return nil, fmt.Errorf("%w: %s returned different keys for guardian set %d than %s", ErrGuardianSetMismatch, endpoints[idx], sets[idx].Index, endpoints[0])
+		}
+	}
+
+	return sets[0], nil
+}
+
+// withRetries calls the function until it succeeds, the attempts allowed by the policy are used up, or the context is done. If it never
+// succeeds and there was more than one attempt, the error includes the number of attempts and wraps the last error.
+func withRetries[T any](ctx context.Context, policy RetryPolicy, call func() (T, error)) (T, error) {
+	delay := policy.InitialDelay
+	for attempt := 1; ; attempt++ {
+		result, err := call()
+		if err == nil {
+			return result, nil
+		}
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			return result, retriesError(attempt, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, retriesError(attempt, err)
+		case <-timer.C:
+		}
+		delay = min(2*delay, policy.MaxDelay)
+	}
+}
+
+// retriesError returns the error for the final failure in withRetries.
+func retriesError(attempts int, err error) error {
+	if attempts == 1 {
+		return err
+	}
+	return fmt.Errorf("failed after %d attempts: %w", attempts, err)
+}
+
+// rpcTarget is an entry in the RPC allowlist. An empty scheme matches any scheme, and an empty port matches any port.
+type rpcTarget struct {
+	scheme string
+	host   string
+	port   string
+}
+
+// RPCPolicy restricts the RPC URLs that the proxy may connect to. It is passed to everything that dials an RPC. The zero value allows any URL.
+type RPCPolicy struct {
+	allowlist     []rpcTarget // If empty, any target is allowed.
+	requireSecure bool        // If set, only https and wss URLs are allowed.
+}
+
+// NewRPCPolicy creates a policy that only allows the RPC URLs in the allowlist. Each entry is a host, optionally with a port, such as
+// "eth.example.com", or a URL with a scheme and host, such as "https://eth.example.com:8545". Empty entries are ignored, and an empty
+// allowlist allows any URL. If requireSecure is set, the URLs must also use https or wss. It is off for the zero policy, so that a local node
+// can be used over plain http during development.
+func NewRPCPolicy(allowlist []string, requireSecure bool) (RPCPolicy, error) {
+	targets := make([]rpcTarget, 0, len(allowlist))
+	for _, entry := range allowlist {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var target rpcTarget
+		hostPort := entry
+		if strings.Contains(entry, "://") {
+			u, err := url.Parse(entry)
+			if err != nil || u.Host == "" {
+				return RPCPolicy{}, fmt.Errorf(`invalid rpc allowlist entry "%s"`, entry)
+			}
+			target.scheme = strings.ToLower(u.Scheme)
+			hostPort = u.Host
+		}
+		if host, port, err := net.SplitHostPort(hostPort); err == nil {
+			target.host, target.port = host, port
+		} else {
+			target.host = hostPort
+		}
+		if target.host == "" || strings.ContainsAny(target.host, "/?#") {
+			return RPCPolicy{}, fmt.Errorf(`invalid rpc allowlist entry "%s"`, entry)
+		}
+		target.host = strings.ToLower(target.host)
+		targets = append(targets, target)
+	}
+	return RPCPolicy{allowlist: targets, requireSecure: requireSecure}, nil
+}
+
+// Check returns an error if the RPC URL is not permitted by the allowlist, or does not use https or wss when that is required. A URL without
+// a host, such as an IPC path, is only allowed if there is no allowlist and plaintext URLs are allowed.
+func (p RPCPolicy) Check(rpcUrl string) error {
+	if p.requireSecure {
+		u, err := url.Parse(rpcUrl)
+		if err != nil {
+			return fmt.Errorf("%w: failed to parse url", ErrInsecureRPC)
+		}
+		if scheme := strings.ToLower(u.Scheme); scheme != "https" && scheme != "wss" {
+			return fmt.Errorf(`%w: scheme is "%s"`, ErrInsecureRPC, u.Scheme)
+		}
+	}
+
+	if len(p.allowlist) == 0 {
+		return nil
+	}
+	u, err := url.Parse(rpcUrl)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("%w: url does not have a host", ErrRPCNotAllowed)
+	}
+	for _, target := range p.allowlist {
+		if target.scheme != "" && target.scheme != strings.ToLower(u.Scheme) {
+			continue
+		}
+		if target.host != strings.ToLower(u.Hostname()) {
+			continue
+		}
+		if target.port != "" && target.port != u.Port() {
+			continue
+		}
+		return nil
+	}
+	// Only the scheme and host are included, since RPC URLs often contain an API key.
+	return fmt.Errorf("%w: %s://%s", ErrRPCNotAllowed, u.Scheme, u.Host)
+}
+
+// dialCoreContract connects to the core contract. The returned function should be called to close the connection.
+// The RPC URL must be permitted by the RPC policy.
+func dialCoreContract(ctx context.Context, rpcPolicy RPCPolicy, rpcUrl, coreAddr string) (*ethAbi.AbiCaller, func(), error) {
+	if err := rpcPolicy.Check(rpcUrl); err != nil {
+		return nil, nil, err
+	}
 	ethContract := eth_common.HexToAddress(coreAddr)
 	rawClient, err := ethRpc.DialContext(ctx, rpcUrl)
 	if err != nil {
-		return nil, errors.New("failed to connect to ethereum")
+		return nil, nil, errors.New("failed to connect to ethereum")
 	}
 	client := ethClient.NewClient(rawClient)
 	caller, err := ethAbi.NewAbiCaller(ethContract, client)
 	if err != nil {
-		return nil, errors.New("failed to create caller")
+		rawClient.Close()
+		return nil, nil, errors.New("failed to create caller")
 	}
-	currentIndex, err := caller.GetCurrentGuardianSetIndex(&ethBind.CallOpts{Context: ctx})
+	return caller, rawClient.Close, nil
+}
+
+// fetchGuardianSet reads the guardian set with the specified index, along with the time it expires, which is zero if it does not expire. The
+// core contract returns an empty set for an index that does not exist, which is treated as an error. An expired set is still returned, since
+// every set before the current one has expired, so it is up to the caller to decide whether to use it, such as with checkGuardianSetExpiry.
+func fetchGuardianSet(ctx context.Context, caller *ethAbi.AbiCaller, index uint32, policy RetryPolicy) (*common.GuardianSet, time.Time, error) {
+	gs, err := withRetries(ctx, policy, func() (ethAbi.StructsGuardianSet, error) {
+		return caller.GetGuardianSet(&ethBind.CallOpts{Context: ctx}, index)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("error requesting current guardian set index: %w", err)
+		return nil, time.Time{}, fmt.Errorf("error requesting guardian set %d: %w", index, err)
 	}
-	gs, err := caller.GetGuardianSet(&ethBind.CallOpts{Context: ctx}, currentIndex)
-	if err != nil {
-		return nil, fmt.Errorf("error requesting current guardian set value: %w", err)
+	if len(gs.Keys) == 0 {
+		return nil, time.Time{}, fmt.Errorf("%w: guardian set %d is empty", ErrGuardianSetNotFound, index)
+	}
+	var expiresAt time.Time
+	if gs.ExpirationTime != 0 {
+		expiresAt = time.Unix(int64(gs.ExpirationTime), 0)
 	}
 	return &common.GuardianSet{
 		Keys:  gs.Keys,
-		Index: currentIndex,
-	}, nil
+		Index: index,
+	}, expiresAt, nil
+}
+
+// checkGuardianSetExpiry returns ErrGuardianSetExpired if the guardian set has expired, since signatures from it would be rejected on chain.
+// An expiry time of zero means the set does not expire.
+func checkGuardianSetExpiry(index uint32, expiresAt time.Time, now time.Time) error {
+	if !expiresAt.IsZero() && now.After(expiresAt) {
+		return fmt.Errorf("%w: guardian set %d expired at %s", ErrGuardianSetExpired, index, expiresAt.UTC().Format(time.RFC3339))
+	}
+	return nil
 }
 
 // validateRequest verifies that this API key is allowed to do all of the calls in this request. In the case of an error, it returns the HTTP status.
-func validateRequest(logger *zap.Logger, env common.Environment, perms *Permissions, signerKey *ecdsa.PrivateKey, apiKey string, qr *gossipv1.SignedQueryRequest) (int, *query.QueryRequest, error) {
-	permsForUser, exists := perms.GetUserEntry(apiKey)
-	if !exists {
-		logger.Debug("invalid api key", zap.String("apiKey", apiKey))
+// The errors returned can be checked using errors.Is and errors.As against the errors defined in errors.go. If the audit hook is set, it is
+// called for every call in an authorized request. Validation stops at the first failure, so this should be used on the hot path.
+// Any cosignatures are counted along with the request signature for users that require more than one signer. The head block provider is
+// used to check the "maxBlockDepth" of a user, and may be nil, in which case requests for a block number from such a user are rejected.
+func validateRequest(ctx context.Context, logger *zap.Logger, env common.Environment, perms PermissionsBackend, signerKey *ecdsa.PrivateKey, audit AuditHook, headBlocks HeadBlockProvider, apiKey string, qr *gossipv1.SignedQueryRequest, cosignatures ...[]byte) (int, *query.QueryRequest, error) {
+	return validateRequestForKey(ctx, logger, env, perms, signerKey, audit, headBlocks, apiKey, qr, false, cosignatures)
+}
+
+// validateRequestAll is like validateRequest, except that it carries on past calls that are not authorized, so that all of them can be
+// returned together, joined using errors.Join. This makes it easier for a client to fix its request. Any other failure still stops validation.
+func validateRequestAll(ctx context.Context, logger *zap.Logger, env common.Environment, perms PermissionsBackend, signerKey *ecdsa.PrivateKey, audit AuditHook, headBlocks HeadBlockProvider, apiKey string, qr *gossipv1.SignedQueryRequest, cosignatures ...[]byte) (int, *query.QueryRequest, error) {
+	return validateRequestForKey(ctx, logger, env, perms, signerKey, audit, headBlocks, apiKey, qr, true, cosignatures)
+}
+
+// validateRequestForKey implements validateRequest and validateRequestAll.
+func validateRequestForKey(ctx context.Context, logger *zap.Logger, env common.Environment, perms PermissionsBackend, signerKey *ecdsa.PrivateKey, audit AuditHook, headBlocks HeadBlockProvider, apiKey string, qr *gossipv1.SignedQueryRequest, reportAll bool, cosignatures [][]byte) (int, *query.QueryRequest, error) {
+	status, permsForUser, err := lookupUser(logger, perms, apiKey)
+	if err != nil {
+		return status, nil, err
+	}
+	return validateRequestForEntry(ctx, logger, env, permsForUser, signerKey, audit, headBlocks, qr, reportAll, cosignatures)
+}
+
+// lookupUser returns the permissions entry for an API key from the backend. On failure, it returns the HTTP status, and pegs the metric for
+// the failure. It should only be called once per request, since the backend may not be local. The HTTP handler calls it directly, so that
+// the same entry is used for the rate limits and concurrency as well as for the validation.
+func lookupUser(logger *zap.Logger, perms PermissionsBackend, apiKey string) (int, *permissionEntry, error) {
+	// This comes before everything else, so that traffic can be drained during an incident regardless of the rest of the config.
+	if perms.InMaintenance() {
+		logger.Debug("rejecting request in maintenance mode")
+		invalidQueryRequestReceived.WithLabelValues("maintenance_mode").Inc()
+		return http.StatusServiceUnavailable, nil, ErrMaintenanceMode
+	}
+
+	permsForUser, err := perms.Lookup(apiKey)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		logger.Error("invalid api key", zap.String("apiKeyHash", apiKeyHash(apiKey)))
 		invalidQueryRequestReceived.WithLabelValues("invalid_api_key").Inc()
-		return http.StatusForbidden, nil, errors.New("invalid api key")
+		return http.StatusForbidden, nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		logger.Error("failed to look up the permissions for api key", zap.String("apiKeyHash", apiKeyHash(apiKey)), zap.Error(err))
+		invalidQueryRequestReceived.WithLabelValues("permissions_unavailable").Inc()
+		return http.StatusServiceUnavailable, nil, ErrPermissionsUnavailable
+	}
+	return http.StatusOK, permsForUser, nil
+}
+
+// validateRequestForEntry validates a request for a user that has already been looked up using lookupUser, recording the result and
+// calling the audit hook. Like validateRequestAll, it carries on past calls that are not authorized if reportAll is set.
+func validateRequestForEntry(ctx context.Context, logger *zap.Logger, env common.Environment, permsForUser *permissionEntry, signerKey *ecdsa.PrivateKey, audit AuditHook, headBlocks HeadBlockProvider, qr *gossipv1.SignedQueryRequest, reportAll bool, cosignatures [][]byte) (int, *query.QueryRequest, error) {
+	start := time.Now()
+	status, queryRequest, err := validateRequestForUser(ctx, logger, env, permsForUser, signerKey, headBlocks, qr, reportAll, cosignatures)
+	requestValidationTime.Observe(float64(time.Since(start).Microseconds()))
+	if err != nil {
+		validationResultsByUser.WithLabelValues(permsForUser.userName, "denied").Inc()
+	} else {
+		validationResultsByUser.WithLabelValues(permsForUser.userName, "allowed").Inc()
+		if audit != nil {
+			for _, event := range auditEvents(permsForUser.userName, queryRequest, time.Now()) {
+				audit(event)
+			}
+		}
+	}
+	return status, queryRequest, err
+}
+
+// validateRequestForUser does the validation of a request once the user has been determined from the API key.
+func validateRequestForUser(ctx context.Context, logger *zap.Logger, env common.Environment, permsForUser *permissionEntry, signerKey *ecdsa.PrivateKey, headBlocks HeadBlockProvider, qr *gossipv1.SignedQueryRequest, reportAll bool, cosignatures [][]byte) (int, *query.QueryRequest, error) {
+	if permsForUser.isExpired(time.Now()) {
+		logger.Debug("api key has expired", zap.String("userName", permsForUser.userName), zap.Time("expiresAt", permsForUser.expiresAt))
+		invalidQueryRequestReceived.WithLabelValues("api_key_expired").Inc()
+		return http.StatusForbidden, nil, ErrAPIKeyExpired
+	}
+
+	if len(qr.Signature) != 0 && permsForUser.signerAddress != nil {
+		// Verify that the request was signed by the signer configured for this user.
+		digest := query.QueryRequestDigest(env, qr.QueryRequest)
+		signerAddress, err := recoverSignerAddress(digest.Bytes(), qr.Signature)
+		if err != nil {
+			logger.Debug("failed to recover signer address", zap.String("userName", permsForUser.userName), zap.Error(err))
+			invalidQueryRequestReceived.WithLabelValues("failed_to_recover_signer").Inc()
+			return http.StatusBadRequest, nil, newMalformedRequestError(fmt.Errorf("failed to verify signature: %w", err))
+		}
+		if signerAddress != *permsForUser.signerAddress {
+			logger.Debug("request not signed by the authorized signer",
+				zap.String("userName", permsForUser.userName),
+				zap.Stringer("signerAddress", signerAddress),
+				zap.Stringer("expectedSignerAddress", permsForUser.signerAddress),
+			)
+			invalidQueryRequestReceived.WithLabelValues("invalid_signer").Inc()
+			return http.StatusForbidden, nil, errors.New("request not signed by the authorized signer")
+		}
 	}
 
-	// TODO: Should we verify the signatures?
+	if len(qr.Signature) != 0 && len(permsForUser.signerAddresses) != 0 {
+		if status, err := validateSignerThreshold(logger, env, permsForUser, qr, cosignatures); err != nil {
+			return status, nil, err
+		}
+	}
 
 	if len(qr.Signature) == 0 {
 		if !permsForUser.allowUnsigned || signerKey == nil {
@@ -90,113 +461,688 @@ func validateRequest(logger *zap.Logger, env common.Environment, perms *Permissi
 	if err != nil {
 		logger.Debug("failed to unmarshal request", zap.String("userName", permsForUser.userName), zap.Error(err))
 		invalidQueryRequestReceived.WithLabelValues("failed_to_unmarshal_request").Inc()
-		return http.StatusBadRequest, nil, fmt.Errorf("failed to unmarshal request: %w", err)
+		return http.StatusBadRequest, nil, newMalformedRequestError(fmt.Errorf("failed to unmarshal request: %w", err))
 	}
 
 	// Make sure the overall query request is sane.
 	if err := queryRequest.Validate(); err != nil {
 		logger.Debug("failed to validate request", zap.String("userName", permsForUser.userName), zap.Error(err))
 		invalidQueryRequestReceived.WithLabelValues("failed_to_validate_request").Inc()
-		return http.StatusBadRequest, nil, fmt.Errorf("failed to validate request: %w", err)
+		return http.StatusBadRequest, nil, newMalformedRequestError(fmt.Errorf("failed to validate request: %w", err))
+	}
+
+	if permsForUser.unrestricted {
+		logger.Warn("unrestricted user is skipping the call checks", zap.String("userName", permsForUser.userName), zap.Int("numCalls", numCallsInRequest(&queryRequest)))
+	}
+
+	if permsForUser.maxCalls != 0 {
+		if numCalls := numCallsInRequest(&queryRequest); numCalls > permsForUser.maxCalls {
+			logger.Debug("request contains too many calls", zap.String("userName", permsForUser.userName), zap.Int("numCalls", numCalls), zap.Int("maxCalls", permsForUser.maxCalls))
+			invalidQueryRequestReceived.WithLabelValues("too_many_calls").Inc()
+			return http.StatusBadRequest, nil, fmt.Errorf("%w: request contains %d calls, which exceeds the maximum of %d", ErrTooManyCalls, numCalls, permsForUser.maxCalls)
+		}
+	}
+
+	if permsForUser.maxChains != 0 && len(queryRequest.PerChainQueries) > permsForUser.maxChains {
+		logger.Debug("request contains too many per chain queries", zap.String("userName", permsForUser.userName), zap.Int("numChainQueries", len(queryRequest.PerChainQueries)), zap.Int("maxChains", permsForUser.maxChains))
+		invalidQueryRequestReceived.WithLabelValues("too_many_chains").Inc()
+		return http.StatusBadRequest, nil, fmt.Errorf("%w: request contains %d per chain queries, which exceeds the maximum of %d", ErrTooManyChains, len(queryRequest.PerChainQueries), permsForUser.maxChains)
 	}
 
 	// Make sure they are allowed to make all of the calls that they are asking for.
+	failures := authFailures{reportAll: reportAll}
+	limits := &callRateLimits{}
 	for _, pcq := range queryRequest.PerChainQueries {
+		// Stop if the request has been canceled, such as by the client disconnecting.
+		if err := ctx.Err(); err != nil {
+			logger.Debug("request validation canceled", zap.String("userName", permsForUser.userName), zap.Error(err))
+			return http.StatusRequestTimeout, nil, err
+		}
+
+		// The request has already been validated, so this should not happen, but it must not reach the type switch below.
+		if isEmptyPerChainQuery(pcq) {
+			logger.Debug("empty per chain query", zap.String("userName", permsForUser.userName))
+			invalidQueryRequestReceived.WithLabelValues("empty_per_chain_query").Inc()
+			return http.StatusBadRequest, nil, ErrEmptyPerChainQuery
+		}
+
+		// If the user is restricted to certain chains, check that before looking at the individual calls.
+		if !permsForUser.chainAllowed(pcq.ChainId) {
+			logger.Debug("requested chain not allowed", zap.String("userName", permsForUser.userName), zap.Stringer("chainId", pcq.ChainId))
+			invalidQueryRequestReceived.WithLabelValues("chain_not_allowed").Inc()
+			if failures.add(http.StatusForbidden, fmt.Errorf("%w: %s", ErrChainNotAllowed, pcq.ChainId)) {
+				status, err := failures.result()
+				return status, nil, err
+			}
+			continue
+		}
+
+		// If the user has no calls at all on this chain, there is no point looking at the individual calls.
+		if !permsForUser.hasCallsForChain(pcq.ChainId) {
+			logger.Debug("user has no permissions for chain", zap.String("userName", permsForUser.userName), zap.Stringer("chainId", pcq.ChainId))
+			invalidQueryRequestReceived.WithLabelValues("no_permissions_for_chain").Inc()
+			if failures.add(http.StatusForbidden, fmt.Errorf("%w %d", ErrNoPermissionsForChain, pcq.ChainId)) {
+				status, err := failures.result()
+				return status, nil, err
+			}
+			continue
+		}
+
 		var status int
 		var err error
 		switch q := pcq.Query.(type) {
 		case *query.EthCallQueryRequest:
-			status, err = validateCallData(logger, permsForUser, "ethCall", pcq.ChainId, q.CallData)
+			status, err = validateBlockIds(ctx, logger, headBlocks, permsForUser, pcq.ChainId, q.BlockId)
+			if err == nil {
+				status, err = validateCallData(logger, permsForUser, "ethCall", pcq.ChainId, q.CallData, "", reportAll, limits)
+			}
 		case *query.EthCallByTimestampQueryRequest:
-			status, err = validateCallData(logger, permsForUser, "ethCallByTimestamp", pcq.ChainId, q.CallData)
+			status, err = validateBlockIds(ctx, logger, headBlocks, permsForUser, pcq.ChainId, q.TargetBlockIdHint, q.FollowingBlockIdHint)
+			if err == nil {
+				status, err = validateCallData(logger, permsForUser, "ethCallByTimestamp", pcq.ChainId, q.CallData, "", reportAll, limits)
+			}
 		case *query.EthCallWithFinalityQueryRequest:
-			status, err = validateCallData(logger, permsForUser, "ethCallWithFinality", pcq.ChainId, q.CallData)
+			status, err = validateBlockIds(ctx, logger, headBlocks, permsForUser, pcq.ChainId, q.BlockId)
+			if err == nil {
+				status, err = validateCallData(logger, permsForUser, "ethCallWithFinality", pcq.ChainId, q.CallData, q.Finality, reportAll, limits)
+			}
 		case *query.SolanaAccountQueryRequest:
-			status, err = validateSolanaAccountQuery(logger, permsForUser, "solAccount", pcq.ChainId, q)
+			status, err = validateSolanaAccountQuery(logger, permsForUser, "solAccount", pcq.ChainId, q, reportAll, limits)
 		case *query.SolanaPdaQueryRequest:
-			status, err = validateSolanaPdaQuery(logger, permsForUser, "solPDA", pcq.ChainId, q)
+			status, err = validateSolanaPdaQuery(logger, permsForUser, "solPDA", pcq.ChainId, q, reportAll, limits)
+		// The query package does not support log queries yet. When it does, they should get an allowed call type of their own and be
+		// checked here.
 		default:
 			logger.Debug("unsupported query type", zap.String("userName", permsForUser.userName), zap.Any("type", pcq.Query))
 			invalidQueryRequestReceived.WithLabelValues("unsupported_query_type").Inc()
-			return http.StatusBadRequest, nil, errors.New("unsupported query type")
+			return http.StatusBadRequest, nil, ErrUnsupportedQueryType
 		}
 
-		if err != nil {
+		if err != nil && failures.add(status, err) {
 			// Metric is pegged below.
+			status, err := failures.result()
 			return status, nil, err
 		}
 	}
 
-	logger.Debug("submitting query request", zap.String("userName", permsForUser.userName))
+	if status, err := failures.result(); err != nil {
+		return status, nil, err
+	}
+
+	// The per-call rate limits are only charged once every call has been authorized.
+	if status, err := limits.take(logger, permsForUser); err != nil {
+		return status, nil, err
+	}
+
+	// Checking the level first avoids allocating the fields on every request when debug logging is off.
+	if ce := logger.Check(zap.DebugLevel, "submitting query request"); ce != nil {
+		ce.Write(zap.String("userName", permsForUser.userName))
+	}
 	return http.StatusOK, &queryRequest, nil
 }
 
-// validateCallData performs verification on all of the call data objects in a query.
-func validateCallData(logger *zap.Logger, permsForUser *permissionEntry, callTag string, chainId vaa.ChainID, callData []*query.EthCallData) (int, error) {
+// checkResponseSize verifies that a marshaled response is within the user's size limit before it is relayed. If the user is configured to
+// truncate large responses, it returns the truncated bytes and true. In the case of an error, it returns the HTTP status.
+func checkResponseSize(logger *zap.Logger, permsForUser *permissionEntry, resBytes []byte) ([]byte, bool, int, error) {
+	if permsForUser.maxResponseBytes == 0 || len(resBytes) <= permsForUser.maxResponseBytes {
+		return resBytes, false, http.StatusOK, nil
+	}
+
+	if permsForUser.truncateResponses {
+		logger.Debug("truncating response", zap.String("userName", permsForUser.userName), zap.Int("size", len(resBytes)), zap.Int("maxResponseBytes", permsForUser.maxResponseBytes))
+		responsesTooLargeByUser.WithLabelValues(permsForUser.userName, "truncated").Inc()
+		return resBytes[:permsForUser.maxResponseBytes], true, http.StatusOK, nil
+	}
+
+	logger.Debug("response too large", zap.String("userName", permsForUser.userName), zap.Int("size", len(resBytes)), zap.Int("maxResponseBytes", permsForUser.maxResponseBytes))
+	responsesTooLargeByUser.WithLabelValues(permsForUser.userName, "rejected").Inc()
+	return nil, false, http.StatusForbidden, fmt.Errorf("%w: response is %d bytes, which exceeds the maximum of %d", ErrResponseTooLarge, len(resBytes), permsForUser.maxResponseBytes)
+}
+
+// validateSource verifies that the user is allowed to make requests from the specified client IP. In the case of an error, it returns the HTTP status.
+func validateSource(logger *zap.Logger, permsForUser *permissionEntry, clientIP net.IP) (int, error) {
+	if !permsForUser.sourceAllowed(clientIP) {
+		logger.Debug("request source not allowed", zap.String("userName", permsForUser.userName), zap.Stringer("clientIP", clientIP))
+		invalidQueryRequestReceived.WithLabelValues("source_not_allowed").Inc()
+		return http.StatusForbidden, ErrSourceNotAllowed
+	}
+	return http.StatusOK, nil
+}
+
+// clientIPFromRequest returns the IP address of the client making the request. If trustForwardedFor is set, the last address in
+// the X-Forwarded-For header is used, since that is the one added by our load balancer. It returns nil if the address cannot be determined.
+func clientIPFromRequest(r *http.Request, trustForwardedFor bool) net.IP {
+	if trustForwardedFor {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) != 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// numCallsInRequest returns the total number of calls in a request. For eth queries this is the number of call data entries,
+// and for Solana queries it is the number of accounts or PDAs.
+func numCallsInRequest(queryRequest *query.QueryRequest) int {
+	numCalls := 0
+	for _, pcq := range queryRequest.PerChainQueries {
+		if isEmptyPerChainQuery(pcq) {
+			continue
+		}
+		switch q := pcq.Query.(type) {
+		case *query.EthCallQueryRequest:
+			numCalls += len(q.CallData)
+		case *query.EthCallByTimestampQueryRequest:
+			numCalls += len(q.CallData)
+		case *query.EthCallWithFinalityQueryRequest:
+			numCalls += len(q.CallData)
+		case *query.SolanaAccountQueryRequest:
+			numCalls += len(q.Accounts)
+		case *query.SolanaPdaQueryRequest:
+			numCalls += len(q.PDAs)
+		}
+	}
+	return numCalls
+}
+
+// isEmptyPerChainQuery returns true if a per chain query is nil or does not hold a query, including a nil pointer to one of the query
+// types. A buggy client can send a partially populated request to the pre-flight checks, which must reject it rather than panic.
+func isEmptyPerChainQuery(pcq *query.PerChainQueryRequest) bool {
+	if pcq == nil {
+		return true
+	}
+	switch q := pcq.Query.(type) {
+	case nil:
+		return true
+	case *query.EthCallQueryRequest:
+		return q == nil
+	case *query.EthCallByTimestampQueryRequest:
+		return q == nil
+	case *query.EthCallWithFinalityQueryRequest:
+		return q == nil
+	case *query.SolanaAccountQueryRequest:
+		return q == nil
+	case *query.SolanaPdaQueryRequest:
+		return q == nil
+	}
+	return false
+}
+
+// recoverSignerAddress returns the address of the key used to sign the specified digest.
+func recoverSignerAddress(digest []byte, signature []byte) (eth_common.Address, error) {
+	pubKey, err := ethCrypto.SigToPub(digest, signature)
+	if err != nil {
+		return eth_common.Address{}, err
+	}
+	return ethCrypto.PubkeyToAddress(*pubKey), nil
+}
+
+// validateSignerThreshold verifies that a request has been signed by at least the threshold number of the user's authorized signers. The
+// request signature and the cosignatures are all counted, but a signer that signed more than once is only counted once. A signature from
+// anyone other than an authorized signer is rejected, just like with a single signer.
+func validateSignerThreshold(logger *zap.Logger, env common.Environment, permsForUser *permissionEntry, qr *gossipv1.SignedQueryRequest, cosignatures [][]byte) (int, error) {
+	digest := query.QueryRequestDigest(env, qr.QueryRequest)
+	signers := make(map[eth_common.Address]struct{}, 1+len(cosignatures))
+	for _, signature := range append([][]byte{qr.Signature}, cosignatures...) {
+		signerAddress, err := recoverSignerAddress(digest.Bytes(), signature)
+		if err != nil {
+			logger.Debug("failed to recover signer address", zap.String("userName", permsForUser.userName), zap.Error(err))
+			invalidQueryRequestReceived.WithLabelValues("failed_to_recover_signer").Inc()
+			return http.StatusBadRequest, newMalformedRequestError(fmt.Errorf("failed to verify signature: %w", err))
+		}
+		if _, exists := permsForUser.signerAddresses[signerAddress]; !exists {
+			logger.Debug("request signed by a signer that is not authorized", zap.String("userName", permsForUser.userName), zap.Stringer("signerAddress", signerAddress))
+			invalidQueryRequestReceived.WithLabelValues("invalid_signer").Inc()
+			return http.StatusForbidden, fmt.Errorf("request signed by %s, which is not an authorized signer", signerAddress)
+		}
+		signers[signerAddress] = struct{}{}
+	}
+
+	if len(signers) < permsForUser.signerThreshold {
+		logger.Debug("request does not have enough signers", zap.String("userName", permsForUser.userName), zap.Int("numSigners", len(signers)), zap.Int("signerThreshold", permsForUser.signerThreshold))
+		invalidQueryRequestReceived.WithLabelValues("signer_threshold_not_met").Inc()
+		return http.StatusForbidden, fmt.Errorf("%w: request is signed by %d of the %d required signers", ErrSignerThresholdNotMet, len(signers), permsForUser.signerThreshold)
+	}
+	return http.StatusOK, nil
+}
+
+// validateBlockIds verifies that the specified block IDs are allowed by the user's block restrictions for the chain, and are not further
+// behind the head of the chain than the user's maximum block depth. Empty block IDs are ignored.
+func validateBlockIds(ctx context.Context, logger *zap.Logger, headBlocks HeadBlockProvider, permsForUser *permissionEntry, chainId vaa.ChainID, blockIds ...string) (int, error) {
+	status, label, err := checkBlockIds(permsForUser, chainId, blockIds...)
+	if err == nil {
+		status, label, err = checkBlockDepth(ctx, headBlocks, permsForUser, chainId, blockIds...)
+	}
+	if err != nil {
+		// The block IDs are copied for the log, so that the variadic slice does not escape and get allocated on every call.
+		logger.Debug("requested block not allowed", zap.String("userName", permsForUser.userName), zap.Stringer("chainId", chainId), zap.Strings("blockIds", slices.Clone(blockIds)), zap.Error(err))
+		invalidQueryRequestReceived.WithLabelValues(label).Inc()
+	}
+	return status, err
+}
+
+// checkBlockIds implements validateBlockIds without any logging or metrics. On failure, it also returns the metric label for the failure.
+func checkBlockIds(permsForUser *permissionEntry, chainId vaa.ChainID, blockIds ...string) (int, string, error) {
+	restriction, exists := permsForUser.blockRestrictions[chainId]
+	if !exists {
+		return http.StatusOK, "", nil
+	}
+
+	for _, blockId := range blockIds {
+		if blockId == "" {
+			continue
+		}
+
+		// A block ID is either a block hash (32 bytes) or a block number, as a hex string starting with "0x".
+		blockIdHex := strings.TrimPrefix(blockId, "0x")
+		if len(blockIdHex) == 2*eth_common.HashLength {
+			if !restriction.allowBlockHashes {
+				return http.StatusForbidden, "block_not_allowed", fmt.Errorf("%w: block hash %s may not be queried on chain %s", ErrBlockNotAllowed, blockId, chainId)
+			}
+			continue
+		}
+
+		blockNum, err := strconv.ParseUint(blockIdHex, 16, 64)
+		if err != nil {
+			return http.StatusBadRequest, "invalid_block_id", newMalformedRequestError(fmt.Errorf(`invalid block id "%s": %w`, blockId, err))
+		}
+		if blockNum < restriction.minBlockNumber {
+			return http.StatusForbidden, "block_not_allowed", fmt.Errorf("%w: block %d is older than the minimum of %d on chain %s", ErrBlockNotAllowed, blockNum, restriction.minBlockNumber, chainId)
+		}
+	}
+
+	return http.StatusOK, "", nil
+}
+
+// validateCallData performs verification on all of the call data objects in a query. The finality should only be specified for eth_call_with_finality.
+//
+// Only the top level contract address and selector of each call are checked. A call to an aggregator such as Multicall3 is authorized by
+// allowing the aggregator's selector on the aggregator contract, and the calls it fans out to are not inspected. If that ever needs to
+// change, the innerCallCheck on the matching allowed call is the place to decode and check the inner calls. Nothing sets it yet.
+func validateCallData(logger *zap.Logger, permsForUser *permissionEntry, callTag string, chainId vaa.ChainID, callData []*query.EthCallData, finality string, reportAll bool, limits *callRateLimits) (int, error) {
+	failures := authFailures{reportAll: reportAll}
 	for _, cd := range callData {
 		contractAddress, err := vaa.BytesToAddress(cd.To)
 		if err != nil {
 			logger.Debug("failed to parse contract address", zap.String("userName", permsForUser.userName), zap.String("contract", hex.EncodeToString(cd.To)), zap.Error(err))
 			invalidQueryRequestReceived.WithLabelValues("invalid_contract_address").Inc()
-			return http.StatusBadRequest, fmt.Errorf("failed to parse contract address: %w", err)
+			return http.StatusBadRequest, newMalformedRequestError(fmt.Errorf("failed to parse contract address: %w", err))
 		}
 		if len(cd.Data) < ETH_CALL_SIG_LENGTH {
 			logger.Debug("eth call data must be at least four bytes", zap.String("userName", permsForUser.userName), zap.String("data", hex.EncodeToString(cd.Data)))
 			invalidQueryRequestReceived.WithLabelValues("bad_call_data").Inc()
-			return http.StatusBadRequest, errors.New("eth call data must be at least four bytes")
+			return http.StatusBadRequest, newMalformedRequestError(errors.New("eth call data must be at least four bytes"))
 		}
+		// The key is looked up directly, so the formatted permission key is only built when it is needed for an error or a log message.
+		k := newEthCallKey(callTag, chainId, contractAddress, cd.Data)
+
+		// The denied calls take precedence over everything else.
+		if _, denied := lookupEthCall(permsForUser.deniedCalls, k); denied {
+			if failures.add(deniedCallError(logger, permsForUser, callTag, k.String())) {
+				return failures.result()
+			}
+			continue
+		}
+
 		if !permsForUser.allowAnything {
-			call := hex.EncodeToString(cd.Data[0:ETH_CALL_SIG_LENGTH])
-			callKey := fmt.Sprintf("%s:%d:%s:%s", callTag, chainId, contractAddress, call)
-			if _, exists := permsForUser.allowedCalls[callKey]; !exists {
-				// The call data doesn't exist including the contract address. See if it's covered by a wildcard.
-				wildCardCallKey := fmt.Sprintf("%s:%d:*:%s", callTag, chainId, call)
-				if _, exists := permsForUser.allowedCalls[wildCardCallKey]; !exists {
-					logger.Debug("requested call not authorized", zap.String("userName", permsForUser.userName), zap.String("callKey", callKey))
-					invalidQueryRequestReceived.WithLabelValues("call_not_authorized").Inc()
-					return http.StatusBadRequest, fmt.Errorf(`call "%s" not authorized`, callKey)
+			opts, allowed := lookupEthCall(permsForUser.allowedCalls, k)
+			if !allowed {
+				callKey := k.String()
+				logDeniedCall(logger, "requested call not authorized", permsForUser, callKey)
+				invalidQueryRequestReceived.WithLabelValues("call_not_authorized").Inc()
+				deniedCallsByUser.WithLabelValues(permsForUser.userName, callTag).Inc()
+				if failures.add(http.StatusBadRequest, &CallNotAuthorizedError{CallKey: callKey}) {
+					return failures.result()
+				}
+				continue
+			}
+			if finality != "" && len(opts.allowedFinality) != 0 {
+				if _, exists := opts.allowedFinality[finality]; !exists {
+					callKey := k.String()
+					logDeniedCall(logger, "requested finality not authorized", permsForUser, callKey, zap.String("finality", finality))
+					invalidQueryRequestReceived.WithLabelValues("finality_not_authorized").Inc()
+					deniedCallsByUser.WithLabelValues(permsForUser.userName, callTag).Inc()
+					if failures.add(http.StatusBadRequest, &CallNotAuthorizedError{CallKey: callKey, Reason: fmt.Sprintf(`finality "%s" not allowed`, finality)}) {
+						return failures.result()
+					}
+					continue
 				}
 			}
+			if opts.argLayout != nil {
+				if err := opts.argLayout.check(len(cd.Data) - ETH_CALL_SIG_LENGTH); err != nil {
+					callKey := k.String()
+					logger.Debug("eth call data does not match the function signature", zap.String("userName", permsForUser.userName), zap.String("callKey", callKey), zap.Error(err))
+					invalidQueryRequestReceived.WithLabelValues("bad_call_data_length").Inc()
+					return http.StatusBadRequest, newMalformedRequestError(fmt.Errorf(`call "%s": %w`, callKey, err))
+				}
+			}
+			if opts.innerCallCheck != nil {
+				if err := opts.innerCallCheck(cd.Data); err != nil {
+					callKey := k.String()
+					logDeniedCall(logger, "inner call not authorized", permsForUser, callKey, zap.Error(err))
+					invalidQueryRequestReceived.WithLabelValues("inner_call_not_authorized").Inc()
+					deniedCallsByUser.WithLabelValues(permsForUser.userName, callTag).Inc()
+					if failures.add(http.StatusForbidden, &CallNotAuthorizedError{CallKey: callKey, Reason: err.Error()}) {
+						return failures.result()
+					}
+					continue
+				}
+			}
+			limits.add(k.String(), opts)
+			opts.markUsed(time.Now())
 		}
 
 		totalRequestedCallsByChain.WithLabelValues(chainId.String()).Inc()
 	}
 
+	return failures.result()
+}
+
+// authFailures collects the authorization failures in a request. Unless reportAll is set, validation stops at the first failure.
+type authFailures struct {
+	reportAll bool
+	status    int // The status of the first failure.
+	errs      []error
+}
+
+// add records a failure and returns true if validation should stop. Only calls and chains that are not authorized are collected. Any other failure
+// replaces what has been collected so far, since the request cannot go any further.
+func (af *authFailures) add(status int, err error) bool {
+	if !af.reportAll || !(errors.Is(err, ErrCallNotAuthorized) || errors.Is(err, ErrChainNotAllowed) || errors.Is(err, ErrNoPermissionsForChain)) {
+		af.status, af.errs = status, []error{err}
+		return true
+	}
+	if len(af.errs) == 0 {
+		af.status = status
+	}
+	af.errs = append(af.errs, err)
+	return false
+}
+
+// result returns the status and error to be returned for the failures, or http.StatusOK and nil if there were none.
+func (af *authFailures) result() (int, error) {
+	switch len(af.errs) {
+	case 0:
+		return http.StatusOK, nil
+	case 1:
+		return af.status, af.errs[0]
+	default:
+		return af.status, errors.Join(af.errs...)
+	}
+}
+
+// checkDeniedCall returns an error if the call key is in the user's denied calls. This takes precedence over the allowed calls.
+func checkDeniedCall(logger *zap.Logger, permsForUser *permissionEntry, callTag string, callKey string) (int, error) {
+	if permsForUser.deniedCalls.has(callKey) {
+		return deniedCallError(logger, permsForUser, callTag, callKey)
+	}
+	return http.StatusOK, nil
+}
+
+// deniedCallError logs and pegs the metrics for a call that matched the user's denied calls, and returns the error for it.
+func deniedCallError(logger *zap.Logger, permsForUser *permissionEntry, callTag string, callKey string) (int, error) {
+	logDeniedCall(logger, "requested call is denied", permsForUser, callKey)
+	invalidQueryRequestReceived.WithLabelValues("call_denied").Inc()
+	deniedCallsByUser.WithLabelValues(permsForUser.userName, callTag).Inc()
+	return http.StatusForbidden, &CallNotAuthorizedError{CallKey: callKey, Reason: "call is denied"}
+}
+
+// deniedCallLevelCore carries the level at which calls that are not authorized or are denied get logged, so that it is configured on the
+// logger rather than passed through request validation.
+type deniedCallLevelCore struct {
+	zapcore.Core
+	level zapcore.Level
+}
+
+// With implements zapcore.Core, keeping the level on loggers derived with With.
+func (c *deniedCallLevelCore) With(fields []zap.Field) zapcore.Core {
+	return &deniedCallLevelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+// WithDeniedCallLogLevel returns a logger that logs calls that are not authorized or are denied at the specified level, which may be
+// "debug", "info" or "warn". Logging them above debug gives visibility into authorization failures without the rest of the debug logging.
+// Loggers that have not been configured this way log them at debug.
+func WithDeniedCallLogLevel(logger *zap.Logger, level string) (*zap.Logger, error) {
+	l, err := zapcore.ParseLevel(level)
+	if err != nil || l < zapcore.DebugLevel || l > zapcore.WarnLevel {
+		return nil, fmt.Errorf(`invalid denied call log level "%s", must be "debug", "info" or "warn"`, level)
+	}
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		if c, ok := core.(*deniedCallLevelCore); ok {
+			core = c.Core
+		}
+		return &deniedCallLevelCore{Core: core, level: l}
+	})), nil
+}
+
+// deniedCallLevel returns the level at which the logger logs calls that are not authorized or are denied.
+func deniedCallLevel(logger *zap.Logger) zapcore.Level {
+	if c, ok := logger.Core().(*deniedCallLevelCore); ok {
+		return c.level
+	}
+	return zapcore.DebugLevel
+}
+
+// logDeniedCall logs a call that was not authorized or was denied, at the level configured by WithDeniedCallLogLevel. The call key is broken
+// out into the chain, contract and selector, so that denials can be searched on. For Solana, the contract is the account or program address,
+// and there is no selector. The API key is never logged.
+func logDeniedCall(logger *zap.Logger, msg string, permsForUser *permissionEntry, callKey string, fields ...zap.Field) {
+	ce := logger.Check(deniedCallLevel(logger), msg)
+	if ce == nil {
+		return
+	}
+	parts := strings.SplitN(callKey, ":", 4)
+	callFields := []zap.Field{zap.String("userName", permsForUser.userName), zap.String("callKey", callKey), zap.String("callType", parts[0])}
+	if len(parts) > 1 {
+		callFields = append(callFields, zap.String("chain", parts[1]))
+	}
+	if len(parts) > 2 {
+		callFields = append(callFields, zap.String("contract", parts[2]))
+	}
+	if len(parts) > 3 {
+		callFields = append(callFields, zap.String("selector", parts[3]))
+	}
+	ce.Write(append(callFields, fields...)...)
+}
+
+// acquireRequestSlot enforces the concurrency limit, if any, of the API key. On success, the returned function must be called to release the slot
+// when the request completes. It is safe to call more than once.
+func acquireRequestSlot(logger *zap.Logger, permsForUser *permissionEntry, apiKey string) (func(), int, error) {
+	sem, exists := permsForUser.concurrency[apiKey]
+	if !exists {
+		return func() {}, http.StatusOK, nil
+	}
+
+	if !sem.TryAcquire(1) {
+		logger.Debug("denying request due to concurrency limit", zap.String("userName", permsForUser.userName))
+		tooManyConcurrentByUser.WithLabelValues(permsForUser.userName).Inc()
+		return nil, http.StatusTooManyRequests, ErrTooManyConcurrent
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { sem.Release(1) }) }, http.StatusOK, nil
+}
+
+// callRateLimits collects the per-call rate limits of the calls in a request, which are in addition to the per-user limit. The tokens are only taken
+// once the whole request has been authorized, so a request that is rejected does not use up the limits of the calls that came before the failure.
+type callRateLimits struct {
+	callKeys []string
+	limiters []*rate.Limiter
+}
+
+// add records the rate limit, if any, of the permission entry matching a call. It does nothing if limits is nil, such as when a call is checked on its own.
+func (limits *callRateLimits) add(callKey string, opts allowedCallOptions) {
+	if limits == nil || opts.rateLimiter == nil {
+		return
+	}
+	limits.callKeys = append(limits.callKeys, callKey)
+	limits.limiters = append(limits.limiters, opts.rateLimiter)
+}
+
+// take takes a token for each of the calls. All of the limits are checked before any tokens are taken, so if one would be exceeded, the request is
+// rejected without using up the others. A limit shared by more than one call in the request needs a token for each of them.
+func (limits *callRateLimits) take(logger *zap.Logger, permsForUser *permissionEntry) (int, error) {
+	now := time.Now()
+	needed := make(map[*rate.Limiter]int, len(limits.limiters))
+	for _, limiter := range limits.limiters {
+		needed[limiter]++
+	}
+	for idx, limiter := range limits.limiters {
+		if limiter.TokensAt(now) < float64(needed[limiter]) {
+			return limits.exceeded(logger, permsForUser, idx)
+		}
+	}
+	for idx, limiter := range limits.limiters {
+		if n, exists := needed[limiter]; exists {
+			delete(needed, limiter)
+			// Another request may have taken the tokens since they were checked.
+			if !limiter.AllowN(now, n) {
+				return limits.exceeded(logger, permsForUser, idx)
+			}
+		}
+	}
 	return http.StatusOK, nil
 }
 
+// exceeded reports that the rate limit of the specified call has been exceeded.
+func (limits *callRateLimits) exceeded(logger *zap.Logger, permsForUser *permissionEntry, idx int) (int, error) {
+	logger.Debug("denying call due to per-call rate limit", zap.String("userName", permsForUser.userName), zap.String("callKey", limits.callKeys[idx]))
+	rateLimitExceededByUser.WithLabelValues(permsForUser.userName).Inc()
+	return http.StatusTooManyRequests, fmt.Errorf(`%w: call "%s"`, ErrCallRateLimitExceeded, limits.callKeys[idx])
+}
+
+// lookupEthCall returns true if the specified eth call matches an entry in the calls, which may be the user's allowed or denied calls, along with
+// the options for the matching entry. An eth_call_by_timestamp or eth_call_with_finality also matches the corresponding eth_call entry.
+func lookupEthCall(calls allowedCallsForUser, k ethCallKey) (allowedCallOptions, bool) {
+	opts, allowed := ethCallAllowed(calls, k)
+	if !allowed && (k.callType == ethCallTypeByTimestamp || k.callType == ethCallTypeWithFinality) {
+		k.callType = ethCallTypeEthCall
+		opts, allowed = ethCallAllowed(calls, k)
+	}
+	return opts, allowed
+}
+
+// ethCallAllowed returns true if the calls contain an entry for the specified call, either explicitly or by a wild card.
+// It also returns the options associated with the matching entry. The first match wins, checking the exact entry, then the
+// wild card contract address entry, then the wild card call entry.
+func ethCallAllowed(calls allowedCallsForUser, k ethCallKey) (allowedCallOptions, bool) {
+	if opts, exists := calls.getEthCall(k); exists {
+		return opts, true
+	}
+
+	// The call data doesn't exist including the contract address. See if it's covered by a wildcard.
+	if opts, exists := calls.getEthCall(ethCallKey{callType: k.callType, chain: k.chain, anyContract: true, selector: k.selector}); exists {
+		return opts, true
+	}
+
+	// See if all calls are allowed on this contract.
+	if opts, exists := calls.getEthCall(ethCallKey{callType: k.callType, chain: k.chain, contract: k.contract, anyCall: true}); exists {
+		return opts, true
+	}
+
+	return allowedCallOptions{}, false
+}
+
+// solanaCallKey returns the permission key for an account or program address in a Solana query, such as "solAccount:1:<base58 address>".
+// The keys for a query are built once and then checked against both the denied and the allowed calls, since the base58 encoding is costly.
+func solanaCallKey(callTag string, chainId vaa.ChainID, addr [query.SolanaPublicKeyLength]byte) string {
+	return callTag + ":" + strconv.FormatUint(uint64(chainId), 10) + ":" + solana.PublicKey(addr).String()
+}
+
 // validateSolanaAccountQuery performs verification on a Solana sol_account query.
-func validateSolanaAccountQuery(logger *zap.Logger, permsForUser *permissionEntry, callTag string, chainId vaa.ChainID, q *query.SolanaAccountQueryRequest) (int, error) {
+func validateSolanaAccountQuery(logger *zap.Logger, permsForUser *permissionEntry, callTag string, chainId vaa.ChainID, q *query.SolanaAccountQueryRequest, reportAll bool, limits *callRateLimits) (int, error) {
+	callKeys := make([]string, len(q.Accounts))
+	for i, acct := range q.Accounts {
+		callKeys[i] = solanaCallKey(callTag, chainId, acct)
+	}
+
+	failures := authFailures{reportAll: reportAll}
+	for _, callKey := range callKeys {
+		if status, err := checkDeniedCall(logger, permsForUser, callTag, callKey); err != nil && failures.add(status, err) {
+			return failures.result()
+		}
+	}
+
 	if !permsForUser.allowAnything {
-		for _, acct := range q.Accounts {
-			callKey := fmt.Sprintf("%s:%d:%s", callTag, chainId, solana.PublicKey(acct).String())
-			if _, exists := permsForUser.allowedCalls[callKey]; !exists {
-				logger.Debug("requested call not authorized", zap.String("userName", permsForUser.userName), zap.String("callKey", callKey))
+		for _, callKey := range callKeys {
+			if permsForUser.deniedCalls.has(callKey) {
+				// Already reported above.
+				continue
+			}
+			opts, exists := permsForUser.allowedCalls.get(callKey)
+			if !exists {
+				logDeniedCall(logger, "requested call not authorized", permsForUser, callKey)
 				invalidQueryRequestReceived.WithLabelValues("call_not_authorized").Inc()
-				return http.StatusForbidden, fmt.Errorf(`call "%s" not authorized`, callKey)
+				deniedCallsByUser.WithLabelValues(permsForUser.userName, callTag).Inc()
+				if failures.add(http.StatusForbidden, &CallNotAuthorizedError{CallKey: callKey}) {
+					return failures.result()
+				}
+				continue
 			}
 
+			limits.add(callKey, opts)
+			opts.markUsed(time.Now())
+
 			totalRequestedCallsByChain.WithLabelValues(chainId.String()).Inc()
 		}
 	}
 
-	return http.StatusOK, nil
+	return failures.result()
 }
 
-// validateSolanaPdaQuery performs verification on a Solana sol_account query.
-func validateSolanaPdaQuery(logger *zap.Logger, permsForUser *permissionEntry, callTag string, chainId vaa.ChainID, q *query.SolanaPdaQueryRequest) (int, error) {
+// validateSolanaPdaQuery performs verification on a Solana sol_pda query.
+func validateSolanaPdaQuery(logger *zap.Logger, permsForUser *permissionEntry, callTag string, chainId vaa.ChainID, q *query.SolanaPdaQueryRequest, reportAll bool, limits *callRateLimits) (int, error) {
+	callKeys := make([]string, len(q.PDAs))
+	for i, acct := range q.PDAs {
+		callKeys[i] = solanaCallKey(callTag, chainId, acct.ProgramAddress)
+	}
+
+	failures := authFailures{reportAll: reportAll}
+	for _, callKey := range callKeys {
+		if status, err := checkDeniedCall(logger, permsForUser, callTag, callKey); err != nil && failures.add(status, err) {
+			return failures.result()
+		}
+	}
+
 	if !permsForUser.allowAnything {
-		for _, acct := range q.PDAs {
-			callKey := fmt.Sprintf("%s:%d:%s", callTag, chainId, solana.PublicKey(acct.ProgramAddress).String())
-			if _, exists := permsForUser.allowedCalls[callKey]; !exists {
-				logger.Debug("requested call not authorized", zap.String("userName", permsForUser.userName), zap.String("callKey", callKey))
+		for i, acct := range q.PDAs {
+			callKey := callKeys[i]
+			if permsForUser.deniedCalls.has(callKey) {
+				// Already reported above.
+				continue
+			}
+			opts, exists := permsForUser.allowedCalls.get(callKey)
+			if !exists {
+				logDeniedCall(logger, "requested call not authorized", permsForUser, callKey)
 				invalidQueryRequestReceived.WithLabelValues("call_not_authorized").Inc()
-				return http.StatusForbidden, fmt.Errorf(`call "%s" not authorized`, callKey)
+				deniedCallsByUser.WithLabelValues(permsForUser.userName, callTag).Inc()
+				if failures.add(http.StatusForbidden, &CallNotAuthorizedError{CallKey: callKey}) {
+					return failures.result()
+				}
+				continue
 			}
 
+			if opts.maxSeeds != 0 && len(acct.Seeds) > opts.maxSeeds {
+				logDeniedCall(logger, "requested PDA has too many seeds", permsForUser, callKey, zap.Int("numSeeds", len(acct.Seeds)), zap.Int("maxSeeds", opts.maxSeeds))
+				invalidQueryRequestReceived.WithLabelValues("too_many_seeds").Inc()
+				deniedCallsByUser.WithLabelValues(permsForUser.userName, callTag).Inc()
+				if failures.add(http.StatusForbidden, &CallNotAuthorizedError{CallKey: callKey, Reason: fmt.Sprintf("has %d seeds, which exceeds the maximum of %d", len(acct.Seeds), opts.maxSeeds)}) {
+					return failures.result()
+				}
+				continue
+			}
+
+			limits.add(callKey, opts)
+			opts.markUsed(time.Now())
+
 			totalRequestedCallsByChain.WithLabelValues(chainId.String()).Inc()
 		}
 	}
 
-	return http.StatusOK, nil
+	return failures.result()
 }
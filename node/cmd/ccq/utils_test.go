@@ -0,0 +1,1227 @@
+package ccq
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	gossipv1 "github.com/certusone/wormhole/node/pkg/proto/gossip/v1"
+	"github.com/certusone/wormhole/node/pkg/query"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/gagliardetto/solana-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wormhole-foundation/wormhole/sdk/vaa"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const validateRequestTestConfig = `
+{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowUnsigned": true,
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+// createTestPermissions parses the config and creates a Permissions object from it.
+func createTestPermissions(t *testing.T, str string) *Permissions {
+	t.Helper()
+	perms, err := ParsePermissions([]byte(str), common.UnsafeDevNet)
+	require.NoError(t, err)
+	return perms
+}
+
+// createEthCallQueryRequest creates a query request containing a single eth_call.
+func createEthCallQueryRequest(t testing.TB, chainId vaa.ChainID, toStr string, dataStr string) *query.QueryRequest {
+	t.Helper()
+	return &query.QueryRequest{
+		Nonce: 1,
+		PerChainQueries: []*query.PerChainQueryRequest{
+			{
+				ChainId: chainId,
+				Query: &query.EthCallQueryRequest{
+					BlockId: "0x28d9630",
+					CallData: []*query.EthCallData{
+						{
+							To:   ethCommon.HexToAddress(toStr).Bytes(),
+							Data: ethCommon.FromHex(dataStr),
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// createSignedQueryRequest marshals the query request and signs it using the specified key. If the key is nil, the request is not signed.
+func createSignedQueryRequest(t testing.TB, key *ecdsa.PrivateKey, qr *query.QueryRequest) *gossipv1.SignedQueryRequest {
+	t.Helper()
+	sqr, err := SignQueryRequest(common.UnsafeDevNet, qr, key)
+	require.NoError(t, err)
+	return sqr
+}
+
+func TestValidateRequestSuccess(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	status, queryReq, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	require.NotNil(t, queryReq)
+	assert.True(t, qr.Equal(queryReq))
+}
+
+func TestValidateRequestSignsUnsignedRequest(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	signerKey, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	sqr := createSignedQueryRequest(t, nil, createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03"))
+
+	// Unsigned requests are rejected if we don't have a signing key.
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", sqr)
+	require.ErrorContains(t, err, "request not signed")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// But signed using our key if we do.
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, signerKey, nil, nil, "my_secret_key", sqr)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	signerAddress, err := recoverSignerAddress(query.QueryRequestDigest(common.UnsafeDevNet, sqr.QueryRequest).Bytes(), sqr.Signature)
+	require.NoError(t, err)
+	assert.Equal(t, ethCrypto.PubkeyToAddress(signerKey.PublicKey), signerAddress)
+}
+
+func TestValidateRequestInvalidApiKey(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "bad_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorContains(t, err, "invalid api key")
+	assert.True(t, errors.Is(err, ErrInvalidAPIKey))
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestValidateRequestExpiredApiKey(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	permsForUser, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+
+	permsForUser.expiresAt = time.Now().Add(time.Hour)
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	permsForUser.expiresAt = time.Now().Add(-time.Second)
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	assert.True(t, errors.Is(err, ErrAPIKeyExpired))
+	assert.False(t, errors.Is(err, ErrInvalidAPIKey))
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestValidateRequestCallNotAuthorized(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.True(t, errors.Is(err, ErrCallNotAuthorized))
+	assert.False(t, errors.Is(err, ErrMalformedRequest))
+
+	var callErr *CallNotAuthorizedError
+	require.True(t, errors.As(err, &callErr))
+	assert.Equal(t, "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd", callErr.CallKey)
+	assert.Equal(t, `call "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd" not authorized`, err.Error())
+}
+
+func TestValidateRequestCallDataWithArguments(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	args := strings.Repeat("00", 31) + "01"
+
+	// Only the selector is used to match the allowed call, so arguments after it do not stop it matching.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03"+args)
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	// The key of a call that is not authorized does not include the arguments either.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd"+args)
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	var callErr *CallNotAuthorizedError
+	require.True(t, errors.As(err, &callErr))
+	assert.Equal(t, "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd", callErr.CallKey)
+}
+
+func TestValidateRequestLogsUnauthorizedCall(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	observedCore, observedLogs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(observedCore)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	_, _, err = validateRequest(context.Background(), logger, common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.Error(t, err)
+
+	entries := observedLogs.FilterMessage("requested call not authorized").All()
+	require.Equal(t, 1, len(entries))
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "Test User", fields["userName"])
+	assert.Equal(t, "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd", fields["callKey"])
+}
+
+func TestValidateRequestMalformedRequest(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	sqr := createSignedQueryRequest(t, key, createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03"))
+	sqr.QueryRequest = sqr.QueryRequest[:len(sqr.QueryRequest)-1]
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", sqr)
+	require.ErrorContains(t, err, "failed to unmarshal request")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.True(t, errors.Is(err, ErrMalformedRequest))
+	assert.False(t, errors.Is(err, ErrCallNotAuthorized))
+
+	// Call data that is too short to contain a selector is also malformed.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fd")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrMalformedRequest))
+}
+
+func TestValidateRequestSignerAddress(t *testing.T) {
+	authorizedKey, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	otherKey, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "signerAddress": "` + ethCrypto.PubkeyToAddress(authorizedKey.PublicKey).Hex() + `",
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Name of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms := createTestPermissions(t, str)
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, authorizedKey, qr))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, otherKey, qr))
+	require.ErrorContains(t, err, "request not signed by the authorized signer")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	sqr := createSignedQueryRequest(t, authorizedKey, qr)
+	sqr.Signature = sqr.Signature[1:]
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", sqr)
+	require.ErrorContains(t, err, "failed to verify signature")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestValidateRequestSignerThreshold(t *testing.T) {
+	keys := make([]*ecdsa.PrivateKey, 3)
+	addrs := make([]string, 3)
+	for idx := range keys {
+		var err error
+		keys[idx], err = ethCrypto.GenerateKey()
+		require.NoError(t, err)
+		addrs[idx] = `"` + ethCrypto.PubkeyToAddress(keys[idx].PublicKey).Hex() + `"`
+	}
+	otherKey, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	perms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowUnsigned": true,`,
+		`"signerAddresses": [`+strings.Join(addrs, ", ")+`], "signerThreshold": 2,`, 1))
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	sign := func(key *ecdsa.PrivateKey) []byte {
+		return createSignedQueryRequest(t, key, qr).Signature
+	}
+
+	// Two of the three signers pass, whichever signs the request itself.
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, keys[0], qr), sign(keys[1]))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, keys[2], qr), sign(keys[0]), sign(keys[1]))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// A single signer is not enough, even if it signs more than once.
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, keys[0], qr))
+	require.ErrorIs(t, err, ErrSignerThresholdNotMet)
+	require.ErrorContains(t, err, "request is signed by 1 of the 2 required signers")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, keys[0], qr), sign(keys[0]))
+	require.ErrorIs(t, err, ErrSignerThresholdNotMet)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// A signature from anyone else is rejected, rather than ignored.
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, keys[0], qr), sign(keys[1]), sign(otherKey))
+	require.ErrorContains(t, err, "which is not an authorized signer")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, keys[0], qr), sign(keys[1])[1:])
+	require.ErrorIs(t, err, ErrMalformedRequest)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// The request must be signed, since unsigned requests are not allowed.
+	unsigned := createSignedQueryRequest(t, keys[0], qr)
+	unsigned.Signature = nil
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", unsigned, sign(keys[1]), sign(keys[2]))
+	require.ErrorContains(t, err, "request not signed")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestValidateSource(t *testing.T) {
+	permsForUser := &permissionEntry{userName: "Test User"}
+	_, ipNet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	permsForUser.allowedCIDRs = []*net.IPNet{ipNet}
+
+	status, err := validateSource(zap.NewNop(), permsForUser, net.ParseIP("10.1.2.3"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, err = validateSource(zap.NewNop(), permsForUser, net.ParseIP("192.168.1.1"))
+	assert.True(t, errors.Is(err, ErrSourceNotAllowed))
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestClientIPFromRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/v1/query", nil)
+	r.RemoteAddr = "192.168.1.1:1234"
+	r.Header.Add("X-Forwarded-For", "1.2.3.4, 10.1.2.3")
+
+	assert.Equal(t, "192.168.1.1", clientIPFromRequest(r, false).String())
+	assert.Equal(t, "10.1.2.3", clientIPFromRequest(r, true).String())
+
+	// If there is no header, fall back to the remote address.
+	r.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "192.168.1.1", clientIPFromRequest(r, true).String())
+}
+
+func TestValidateRequestMetrics(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, "Test User", "Metrics Test User", 1)
+	perms := createTestPermissions(t, str)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	// The metrics are global, so use a user name that is unique to this test.
+	allowed := validationResultsByUser.WithLabelValues("Metrics Test User", "allowed")
+	denied := validationResultsByUser.WithLabelValues("Metrics Test User", "denied")
+	deniedCalls := deniedCallsByUser.WithLabelValues("Metrics Test User", "ethCall")
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.Error(t, err)
+
+	for _, tc := range []struct {
+		counter  prometheus.Counter
+		expected float64
+	}{
+		{allowed, 1},
+		{denied, 1},
+		{deniedCalls, 1},
+	} {
+		val, err := getCounterValue(tc.counter)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, val)
+	}
+}
+
+func TestValidateRequestMixedCaseConfig(t *testing.T) {
+	// The config uses a checksummed contract address and an upper case selector, the request uses lower case.
+	str := strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"`, `"call": "0x06FDDE03"`, 1)
+	require.Contains(t, str, "B4FBF271143F4FBf7B91A5ded31805e42b2208d6")
+	perms := createTestPermissions(t, str)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xb4fbf271143f4fbf7b91a5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	// And the reverse.
+	perms = createTestPermissions(t, strings.Replace(validateRequestTestConfig, "B4FBF271143F4FBf7B91A5ded31805e42b2208d6", "b4fbf271143f4fbf7b91a5ded31805e42b2208d6", 1))
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06FDDE03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+}
+
+func TestValidateRequestMaxCallsPerRequest(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	permsForUser, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	ecq := qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest)
+	ecq.CallData = append(ecq.CallData, ecq.CallData[0])
+
+	permsForUser.maxCalls = 2
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	permsForUser.maxCalls = 1
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorContains(t, err, "request contains 2 calls, which exceeds the maximum of 1")
+	assert.True(t, errors.Is(err, ErrTooManyCalls))
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestValidateRequestMaxChainsPerRequest(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	permsForUser, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+
+	// Querying the same chain twice still counts as two per chain queries.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	qr.PerChainQueries = append(qr.PerChainQueries, qr.PerChainQueries[0])
+
+	permsForUser.maxChains = 2
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	permsForUser.maxChains = 1
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorContains(t, err, "request contains 2 per chain queries, which exceeds the maximum of 1")
+	assert.True(t, errors.Is(err, ErrTooManyChains))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	_, err = perms.Authorize("my_secret_key", qr)
+	assert.ErrorIs(t, err, ErrTooManyChains)
+}
+
+func TestValidateRequestMaintenanceMode(t *testing.T) {
+	maintenanceStr := strings.Replace(validateRequestTestConfig, `"permissions"`, `"maintenanceMode": true, "permissions"`, 1)
+	fileName := filepath.Join(t.TempDir(), "perms.json")
+	require.NoError(t, os.WriteFile(fileName, []byte(maintenanceStr), 0600))
+	perms, err := NewPermissions(fileName, common.UnsafeDevNet, DefaultMaxConfigSize)
+	require.NoError(t, err)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+
+	// Every request is rejected, even one with an unknown API key.
+	for _, apiKey := range []string{"my_secret_key", "my_unknown_key"} {
+		status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, apiKey, createSignedQueryRequest(t, key, qr))
+		require.ErrorIs(t, err, ErrMaintenanceMode)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+	}
+
+	// Turning it off only needs a reload.
+	store := NewPermissionsStore(perms, nil)
+	require.NoError(t, os.WriteFile(fileName, []byte(validateRequestTestConfig), 0600))
+	store.Reload(zap.NewNop())
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, store.Load(), nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+}
+
+// memoryPermissionsBackend is a PermissionsBackend that keeps the entries in a map, standing in for one backed by a database.
+type memoryPermissionsBackend struct {
+	entries     map[string]*permissionEntry
+	err         error
+	maintenance bool
+}
+
+func (b *memoryPermissionsBackend) Lookup(apiKey string) (*permissionEntry, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	pe, exists := b.entries[apiKey]
+	if !exists {
+		return nil, ErrInvalidAPIKey
+	}
+	return pe, nil
+}
+
+func (b *memoryPermissionsBackend) InMaintenance() bool {
+	return b.maintenance
+}
+
+func TestValidateRequestPermissionsBackend(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	pe, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+	backend := &memoryPermissionsBackend{entries: map[string]*permissionEntry{"my_other_key": pe}}
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, backend, nil, nil, nil, "my_other_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// The key is only looked up in the backend, not the permissions file.
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, backend, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrInvalidAPIKey)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// A failed lookup is neither allowed nor denied, and the cause is not returned to the client.
+	backend.err = errors.New("connection refused by db.internal:5432")
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, backend, nil, nil, nil, "my_other_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrPermissionsUnavailable)
+	assert.NotContains(t, err.Error(), "db.internal")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	backend.err = nil
+	backend.maintenance = true
+	status, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, backend, nil, nil, nil, "my_other_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrMaintenanceMode)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestPermissionsLookup(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	pe, err := perms.Lookup("my_secret_key")
+	require.NoError(t, err)
+	assert.Equal(t, "Test User", pe.userName)
+	_, err = perms.Lookup("bad_key")
+	require.ErrorIs(t, err, ErrInvalidAPIKey)
+}
+
+func TestValidateRequestAnonymousUser(t *testing.T) {
+	anonymousStr := strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key"`, `"apiKey": "*"`, 1)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	allowed := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	denied := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+
+	// Any API key gets the permissions of the anonymous user.
+	perms := createTestPermissions(t, anonymousStr)
+	assert.True(t, perms.HasAnonymousUser())
+
+	// Outside of request validation, lookups are exact, so an unknown key does not get the permissions of the anonymous user.
+	_, exists := perms.GetUserEntry("my_unknown_key")
+	assert.False(t, exists)
+	require.Error(t, perms.Describe(io.Discard, "my_unknown_key"))
+	for _, apiKey := range []string{anonymousApiKey, "my_unknown_key"} {
+		_, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, apiKey, createSignedQueryRequest(t, key, allowed))
+		require.NoError(t, err)
+		status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, apiKey, createSignedQueryRequest(t, key, denied))
+		require.ErrorIs(t, err, ErrCallNotAuthorized)
+		assert.Equal(t, http.StatusBadRequest, status)
+	}
+
+	// Without an anonymous user, an unknown API key is still rejected.
+	perms = createTestPermissions(t, validateRequestTestConfig)
+	assert.False(t, perms.HasAnonymousUser())
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_unknown_key", createSignedQueryRequest(t, key, allowed))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestApiKeyFromRequest(t *testing.T) {
+	newRequest := func(apiKeys ...string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/v1/query", nil)
+		for _, apiKey := range apiKeys {
+			r.Header.Add("X-Api-Key", apiKey)
+		}
+		return r
+	}
+
+	apiKey, _, err := apiKeyFromRequest(newRequest("My_Secret_Key"))
+	require.NoError(t, err)
+	assert.Equal(t, "my_secret_key", apiKey)
+	_, status, err := apiKeyFromRequest(newRequest("key1", "key2"))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// Without the header, the anonymous user is looked up, and if there is not one, the key is reported as missing rather than invalid.
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	apiKey, _, err = apiKeyFromRequest(newRequest())
+	require.NoError(t, err)
+	assert.Equal(t, anonymousApiKey, apiKey)
+	status, _, err = lookupUser(zap.NewNop(), perms, apiKey)
+	status, err = missingApiKey(newRequest(), status, err)
+	require.ErrorIs(t, err, errApiKeyMissing)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// An unknown key that is present is still invalid.
+	status, _, err = lookupUser(zap.NewNop(), perms, "bad_key")
+	status, err = missingApiKey(newRequest("bad_key"), status, err)
+	require.ErrorIs(t, err, ErrInvalidAPIKey)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// With an anonymous user, the header may be left out.
+	perms = createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key"`, `"apiKey": "*"`, 1))
+	_, pe, err := lookupUser(zap.NewNop(), perms, anonymousApiKey)
+	require.NoError(t, err)
+	assert.Equal(t, "Test User", pe.userName)
+}
+
+func TestValidateRequestAllowedChains(t *testing.T) {
+	// The user has a wild card call on two chains, but is only allowed to query one of them.
+	str := `
+	{
+  "permissions": [
+    {
+      "userName": "Test User",
+      "apiKey": "my_secret_key",
+      "allowedChains": [2],
+      "allowedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "*",
+            "call": "0x06fdde03"
+          }
+        },
+        {
+          "ethCall": {
+            "chain": 4,
+            "contractAddress": "*",
+            "call": "0x06fdde03"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+	perms := createTestPermissions(t, str)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	qr = createEthCallQueryRequest(t, vaa.ChainIDBSC, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorContains(t, err, "chain not allowed: bsc")
+	assert.True(t, errors.Is(err, ErrChainNotAllowed))
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestValidateBlockIds(t *testing.T) {
+	permsForUser := &permissionEntry{
+		userName: "Test User",
+		blockRestrictions: map[vaa.ChainID]blockRestriction{
+			vaa.ChainIDEthereum: {minBlockNumber: 0x28d9630},
+			vaa.ChainIDBSC:      {allowBlockHashes: true},
+		},
+	}
+	blockHash := "0x" + strings.Repeat("ab", 32)
+
+	tests := []struct {
+		label    string
+		chainId  vaa.ChainID
+		blockIds []string
+		errText  string
+	}{
+		{"block at the minimum", vaa.ChainIDEthereum, []string{"0x28d9630"}, ""},
+		{"block after the minimum", vaa.ChainIDEthereum, []string{"0x28d9631"}, ""},
+		{"block before the minimum", vaa.ChainIDEthereum, []string{"0x28d962f"}, "block not allowed: block 42833455 is older than the minimum of 42833456 on chain ethereum"},
+		{"empty block ids are ignored", vaa.ChainIDEthereum, []string{"", "0x28d9630"}, ""},
+		{"block hash not allowed", vaa.ChainIDEthereum, []string{blockHash}, "block not allowed: block hash " + blockHash + " may not be queried on chain ethereum"},
+		{"block hash allowed", vaa.ChainIDBSC, []string{blockHash}, ""},
+		{"invalid block number", vaa.ChainIDEthereum, []string{"0xhello"}, `invalid block id "0xhello"`},
+		{"chain without restrictions", vaa.ChainIDPolygon, []string{"0x1", blockHash}, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.label, func(t *testing.T) {
+			_, err := validateBlockIds(context.Background(), zap.NewNop(), nil, permsForUser, tc.chainId, tc.blockIds...)
+			if tc.errText == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.errText)
+			}
+		})
+	}
+}
+
+func TestValidateRequestBlockRestrictions(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+	permsForUser, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+
+	// The test request queries block 0x28d9630.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	permsForUser.blockRestrictions = map[vaa.ChainID]blockRestriction{vaa.ChainIDEthereum: {minBlockNumber: 0x28d9630}}
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	permsForUser.blockRestrictions = map[vaa.ChainID]blockRestriction{vaa.ChainIDEthereum: {minBlockNumber: 0x28d9631}}
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	assert.True(t, errors.Is(err, ErrBlockNotAllowed))
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestValidateRequestPerCallRateLimit(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowedCalls": [
+        {
+          "ethCall"`, `"allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Total supply of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x18160ddd"
+          }
+        },
+        {
+          "rateLimit": 0.001,
+          "ethCall"`, 1)
+	perms := createTestPermissions(t, str)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	// The first call uses up the burst, so the second one is rate limited.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	assert.True(t, errors.Is(err, ErrCallRateLimitExceeded))
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	// A call without a per-call limit is not affected.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	for i := 0; i < 3; i++ {
+		_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+		require.NoError(t, err)
+	}
+}
+
+func TestValidateRequestPerCallRateLimitOnlyChargedWhenAuthorized(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowedCalls": [
+        {
+          "ethCall"`, `"allowedCalls": [
+        {
+          "rateLimit": 0.001,
+          "ethCall"`, 1)
+	perms := createTestPermissions(t, str)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	// The rate limited call is followed by one that is not allowed, so the request is rejected without using up the burst.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	denied := qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest)
+	denied.CallData = append(denied.CallData, &query.EthCallData{To: ethCommon.HexToAddress("0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6").Bytes(), Data: ethCommon.FromHex("0x12345678")})
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.True(t, errors.Is(err, ErrCallNotAuthorized))
+
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	// Two calls under the same limit need two tokens. When there are not enough, the request is rejected and none are taken.
+	perms = createTestPermissions(t, strings.Replace(str, `"allowUnsigned": true,`, `"allowUnsigned": true, "burstSize": 2,`, 1))
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	twice := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	calls := twice.PerChainQueries[0].Query.(*query.EthCallQueryRequest)
+	calls.CallData = append(calls.CallData, calls.CallData[0])
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, twice))
+	assert.True(t, errors.Is(err, ErrCallRateLimitExceeded))
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+}
+
+func TestValidateRequestCallDataLengthWithSignature(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Balance on WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "balanceOf(address)"
+          }
+        },`, 1)
+	perms := createTestPermissions(t, str)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	arg := "000000000000000000000000" + "b4fbf271143f4fbf7b91a5ded31805e42b2208d6"
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x70a08231"+arg)
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	for _, data := range []string{"0x70a08231", "0x70a08231" + arg + arg, "0x70a08231" + arg[2:]} {
+		qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", data)
+		status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+		require.Error(t, err, data)
+		assert.True(t, errors.Is(err, ErrMalformedRequest))
+		assert.Contains(t, err.Error(), "call data arguments are")
+		assert.Equal(t, http.StatusBadRequest, status)
+	}
+
+	// Calls configured with a bare selector are not checked.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03"+arg[2:])
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+}
+
+func TestValidateRequestUnrestrictedUser(t *testing.T) {
+	str := `
+{
+  "unrestrictedEnvironments": ["mainnet"],
+  "permissions": [
+    {
+      "userName": "Monitor",
+      "apiKey": "my_secret_key",
+      "unrestricted": true,
+      "deniedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "transfer(address,uint256)"
+          }
+        }
+      ]
+    }
+  ]
+}`
+	perms, err := ParsePermissions([]byte(str), common.MainNet)
+	require.NoError(t, err)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	observedCore, observedLogs := observer.New(zapcore.WarnLevel)
+	logger := zap.New(observedCore)
+
+	// Any call is allowed, even in mainnet, and each request is logged.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0x0000000000000000000000000000000000000001", "0x12345678")
+	_, _, err = validateRequest(context.Background(), logger, common.MainNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+	require.Equal(t, 1, observedLogs.FilterMessage("unrestricted user is skipping the call checks").Len())
+	assert.Equal(t, "Monitor", observedLogs.All()[0].ContextMap()["userName"])
+
+	// The request must still be sane.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0x0000000000000000000000000000000000000001", "0x12")
+	status, _, err := validateRequest(context.Background(), logger, common.MainNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	assert.True(t, errors.Is(err, ErrMalformedRequest))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// The denied calls still apply.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0xa9059cbb")
+	status, _, err = validateRequest(context.Background(), logger, common.MainNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	assert.True(t, errors.Is(err, ErrCallNotAuthorized))
+	assert.Equal(t, http.StatusForbidden, status)
+}
+
+func TestValidateRequestAllReportsEveryUnauthorizedCall(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	ethQuery := qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest)
+	ethQuery.CallData = append(ethQuery.CallData,
+		&query.EthCallData{To: ethCommon.HexToAddress("0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6").Bytes(), Data: ethCommon.FromHex("0x18160ddd")},
+		&query.EthCallData{To: ethCommon.HexToAddress("0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6").Bytes(), Data: ethCommon.FromHex("0x313ce567")},
+	)
+	qr.PerChainQueries = append(qr.PerChainQueries, createEthCallQueryRequest(t, vaa.ChainIDBSC, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03").PerChainQueries[0])
+
+	// The fast fail version only reports the first one.
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.EqualError(t, err, `call "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd" not authorized`)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _, err = validateRequestAll(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.True(t, errors.Is(err, ErrCallNotAuthorized))
+	assert.Equal(t, `call "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd" not authorized
+call "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:313ce567" not authorized
+no permissions for chain 4`, err.Error())
+
+	// Other failures still stop validation.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x18160ddd")
+	qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest).CallData[0].Data = ethCommon.FromHex("0x12")
+	_, _, err = validateRequestAll(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	assert.True(t, errors.Is(err, ErrMalformedRequest))
+	assert.False(t, errors.Is(err, ErrCallNotAuthorized))
+
+	// An authorized request is still allowed.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequestAll(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+}
+
+func TestAcquireRequestSlot(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"apiKey": "my_secret_key",`, `"apiKeys": ["my_secret_key", "my_other_key"],
+      "maxConcurrent": 2,`, 1)
+	perms := createTestPermissions(t, str)
+	pe, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+
+	release1, _, err := acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	require.NoError(t, err)
+	release2, _, err := acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	require.NoError(t, err)
+
+	before, err := getCounterValue(tooManyConcurrentByUser.WithLabelValues("Test User"))
+	require.NoError(t, err)
+	_, status, err := acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	assert.True(t, errors.Is(err, ErrTooManyConcurrent))
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	after, err := getCounterValue(tooManyConcurrentByUser.WithLabelValues("Test User"))
+	require.NoError(t, err)
+	assert.Equal(t, before+1, after)
+
+	// Each API key has its own limit.
+	releaseOther, _, err := acquireRequestSlot(zap.NewNop(), pe, "my_other_key")
+	require.NoError(t, err)
+	releaseOther()
+
+	// Releasing more than once only frees one slot.
+	release1()
+	release1()
+	release3, _, err := acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	require.NoError(t, err)
+	_, _, err = acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+	assert.True(t, errors.Is(err, ErrTooManyConcurrent))
+
+	release2()
+	release3()
+}
+
+func TestAcquireRequestSlotNoLimit(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	pe, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+
+	for i := 0; i < 100; i++ {
+		_, _, err := acquireRequestSlot(zap.NewNop(), pe, "my_secret_key")
+		require.NoError(t, err)
+	}
+}
+
+func TestPermissionsUnusedSince(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Total supply of WETH on Goerli",
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "0x18160ddd"
+          }
+        },`, 1)
+	perms := createTestPermissions(t, str)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	// Entries are not reported until the duration has passed since they were loaded.
+	assert.Empty(t, perms.UnusedSince(time.Hour))
+
+	// Pretend the permissions were loaded a while ago.
+	permsForUser, exists := perms.GetUserEntry("my_secret_key")
+	require.True(t, exists)
+	for _, opts := range permsForUser.allowedCalls.all() {
+		opts.lastUsed.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	}
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	sqr := createSignedQueryRequest(t, key, qr)
+
+	// Validation may update the timestamps while they are being read.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", sqr)
+			assert.NoError(t, err)
+			perms.UnusedSince(time.Hour)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, []string{`ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:18160ddd for user "Test User"`}, perms.UnusedSince(time.Hour))
+	assert.Empty(t, perms.UnusedSince(3*time.Hour))
+}
+
+func TestValidateRequestCanceled(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	status, queryReq, err := validateRequest(ctx, zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, http.StatusRequestTimeout, status)
+	assert.Nil(t, queryReq)
+}
+
+func TestCheckResponseSize(t *testing.T) {
+	permsForUser := &permissionEntry{userName: "Test User"}
+	resBytes := []byte("0123456789")
+
+	// No limit.
+	out, truncated, status, err := checkResponseSize(zap.NewNop(), permsForUser, resBytes)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.False(t, truncated)
+	assert.Equal(t, resBytes, out)
+
+	// Within the limit.
+	permsForUser.maxResponseBytes = 10
+	out, truncated, _, err = checkResponseSize(zap.NewNop(), permsForUser, resBytes)
+	require.NoError(t, err)
+	assert.False(t, truncated)
+	assert.Equal(t, resBytes, out)
+
+	// Over the limit is rejected by default.
+	permsForUser.maxResponseBytes = 4
+	_, _, status, err = checkResponseSize(zap.NewNop(), permsForUser, resBytes)
+	assert.True(t, errors.Is(err, ErrResponseTooLarge))
+	assert.EqualError(t, err, "response too large: response is 10 bytes, which exceeds the maximum of 4")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// Or truncated if configured.
+	permsForUser.truncateResponses = true
+	out, truncated, status, err = checkResponseSize(zap.NewNop(), permsForUser, resBytes)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, truncated)
+	assert.Equal(t, []byte("0123"), out)
+}
+
+func TestValidateRequestDeniedCallOverridesWildCard(t *testing.T) {
+	str := strings.Replace(validateRequestTestConfig, `"call": "0x06fdde03"
+          }
+        }
+      ]`, `"call": "*"
+          }
+        }
+      ],
+      "deniedCalls": [
+        {
+          "ethCall": {
+            "chain": 2,
+            "contractAddress": "B4FBF271143F4FBf7B91A5ded31805e42b2208d6",
+            "call": "transfer(address,uint256)"
+          }
+        }
+      ]`, 1)
+	perms := createTestPermissions(t, str)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	// The wild card allows other calls on the contract.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+
+	// But not the denied one.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0xa9059cbb")
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	assert.True(t, errors.Is(err, ErrCallNotAuthorized))
+	assert.EqualError(t, err, `call "ethCall:2:000000000000000000000000b4fbf271143f4fbf7b91a5ded31805e42b2208d6:a9059cbb" not authorized: call is denied`)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// The denied call is also reflected in IsAllowed.
+	contract, err := vaa.StringToAddress("B4FBF271143F4FBf7B91A5ded31805e42b2208d6")
+	require.NoError(t, err)
+	assert.True(t, perms.IsAllowed("my_secret_key", vaa.ChainIDEthereum, contract, [4]byte{0x06, 0xfd, 0xde, 0x03}))
+	assert.False(t, perms.IsAllowed("my_secret_key", vaa.ChainIDEthereum, contract, [4]byte{0xa9, 0x05, 0x9c, 0xbb}))
+}
+
+func TestValidateRequestNoPermissionsForChain(t *testing.T) {
+	perms := createTestPermissions(t, validateRequestTestConfig)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	// The user only has calls on Ethereum, so a query on BSC is rejected without looking at the calls.
+	qr := createEthCallQueryRequest(t, vaa.ChainIDBSC, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.EqualError(t, err, "no permissions for chain 4")
+	assert.True(t, errors.Is(err, ErrNoPermissionsForChain))
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// A user that may make any call is not restricted by chain.
+	pe := &permissionEntry{userName: "Test User", allowAnything: true}
+	assert.True(t, pe.hasCallsForChain(vaa.ChainIDBSC))
+	assert.True(t, perms.permMap["my_secret_key"].hasCallsForChain(vaa.ChainIDEthereum))
+	assert.False(t, perms.permMap["my_secret_key"].hasCallsForChain(vaa.ChainIDBSC))
+}
+
+// multicall3Aggregate3 is the Multicall3 aggregate3((address,bool,bytes)[]) function, which makes each of the inner calls in turn.
+const multicall3Aggregate3 = "0x82ad56cb"
+
+// createMulticallData ABI encodes an aggregate3 call that fans out to the specified inner call on each of the targets.
+func createMulticallData(t *testing.T, innerCall []byte, targets ...string) []byte {
+	t.Helper()
+	callsType, err := abi.NewType("tuple[]", "", []abi.ArgumentMarshaling{
+		{Name: "target", Type: "address"},
+		{Name: "allowFailure", Type: "bool"},
+		{Name: "callData", Type: "bytes"},
+	})
+	require.NoError(t, err)
+
+	type call3 struct {
+		Target       ethCommon.Address
+		AllowFailure bool
+		CallData     []byte
+	}
+	calls := make([]call3, 0, len(targets))
+	for _, target := range targets {
+		calls = append(calls, call3{Target: ethCommon.HexToAddress(target), CallData: innerCall})
+	}
+	args, err := abi.Arguments{{Type: callsType}}.Pack(calls)
+	require.NoError(t, err)
+	return append(ethCommon.FromHex(multicall3Aggregate3), args...)
+}
+
+func TestValidateRequestMulticallOnlyChecksTopLevelCall(t *testing.T) {
+	perms := createTestPermissions(t, strings.Replace(validateRequestTestConfig, `"allowedCalls": [`, `"allowedCalls": [
+        {
+          "ethCall": {
+            "note:": "Multicall3",
+            "chain": 2,
+            "contractAddress": "0xcA11bde05977b3631167028862bE2a173976CA11",
+            "call": "aggregate3((address,bool,bytes)[])"
+          }
+        },`, 1))
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(t, err)
+
+	// The inner calls are to contracts that the user is not allowed to call directly.
+	data := createMulticallData(t, ethCommon.FromHex("0x70a08231"), "0x1111111111111111111111111111111111111111", "0x2222222222222222222222222222222222222222")
+	qr := createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xcA11bde05977b3631167028862bE2a173976CA11", "0x82ad56cb")
+	qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest).CallData[0].Data = data
+	status, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// The same inner call made directly is not allowed.
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0x1111111111111111111111111111111111111111", "0x70a08231")
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrCallNotAuthorized)
+
+	// If an inner call check is installed on the allowed call, it can reject the request.
+	callKey := "ethCall:2:000000000000000000000000ca11bde05977b3631167028862be2a173976ca11:82ad56cb"
+	opts, _ := perms.permMap["my_secret_key"].allowedCalls.get(callKey)
+	var checked []byte
+	opts.innerCallCheck = func(callData []byte) error {
+		checked = callData
+		return errors.New("inner calls are not allowed")
+	}
+	perms.permMap["my_secret_key"].allowedCalls.set(callKey, opts)
+	qr = createEthCallQueryRequest(t, vaa.ChainIDEthereum, "0xcA11bde05977b3631167028862bE2a173976CA11", "0x82ad56cb")
+	qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest).CallData[0].Data = data
+	_, _, err = validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "my_secret_key", createSignedQueryRequest(t, key, qr))
+	require.ErrorIs(t, err, ErrCallNotAuthorized)
+	assert.ErrorContains(t, err, "inner calls are not allowed")
+	assert.Equal(t, data, checked)
+}
+
+// BenchmarkValidateRequest measures validating a signed request with eth and Solana calls, which should allocate as little as possible
+// beyond unmarshaling the request.
+func BenchmarkValidateRequest(b *testing.B) {
+	perms, err := ParsePermissions([]byte(fuzzRequestConfig), common.UnsafeDevNet)
+	require.NoError(b, err)
+	key, err := ethCrypto.GenerateKey()
+	require.NoError(b, err)
+	qr := createEthCallQueryRequest(b, vaa.ChainIDEthereum, "0xB4FBF271143F4FBf7B91A5ded31805e42b2208d6", "0x06fdde03")
+	ethQuery := qr.PerChainQueries[0].Query.(*query.EthCallQueryRequest)
+	for _, to := range []string{"0x0000000000000000000000000000000000000002", "0x0000000000000000000000000000000000000003"} {
+		ethQuery.CallData = append(ethQuery.CallData, &query.EthCallData{To: ethCommon.HexToAddress(to).Bytes(), Data: ethCommon.FromHex("0x06fdde03")})
+	}
+	qr.PerChainQueries = append(qr.PerChainQueries,
+		&query.PerChainQueryRequest{
+			ChainId: vaa.ChainIDSolana,
+			Query: &query.SolanaAccountQueryRequest{
+				Commitment: "finalized",
+				Accounts:   [][query.SolanaPublicKeyLength]byte{solana.MustPublicKeyFromBase58("BVxyYhm498L79r4HMQ9sxZ5bi41DmJmeWZ7SCS7Cyvna")},
+			},
+		},
+		&query.PerChainQueryRequest{
+			ChainId: vaa.ChainIDSolana,
+			Query: &query.SolanaPdaQueryRequest{
+				Commitment: "finalized",
+				PDAs:       []query.SolanaPDAEntry{{ProgramAddress: solana.MustPublicKeyFromBase58("Bridge1p5gheXUvJ6jGWGeCsgPKgnE3YgdGKRVCMY9o"), Seeds: [][]byte{{1}}}},
+			},
+		},
+	)
+	sqr := createSignedQueryRequest(b, key, qr)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := validateRequest(context.Background(), zap.NewNop(), common.UnsafeDevNet, perms, nil, nil, nil, "unsigned_key", sqr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package ccq
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/certusone/wormhole/node/pkg/common"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	verifyEnvStr          *string
+	verifyPermFile        *string
+	verifyPermEnvVar      *string
+	verifyPermDir         *string
+	verifyMaxPermFileSize *int64
+)
+
+func init() {
+	verifyEnvStr = VerifyPermissionsCmd.Flags().String("env", "", "environment (devnet, testnet, mainnet)")
+	verifyPermFile = VerifyPermissionsCmd.Flags().String("permFile", "", "JSON file containing permissions configuration")
+	verifyPermEnvVar = VerifyPermissionsCmd.Flags().String("permEnvVar", "", "Environment variable containing permissions configuration JSON (takes precedence over permFile if set)")
+	verifyPermDir = VerifyPermissionsCmd.Flags().String("permDir", "", "Directory of permissions files that are merged together, such as one per team (instead of permFile)")
+	verifyMaxPermFileSize = VerifyPermissionsCmd.Flags().Int64("maxPermFileSize", DefaultMaxConfigSize, "Maximum size of the permissions file in bytes, including after decompression")
+	QueryServerCmd.AddCommand(VerifyPermissionsCmd)
+}
+
+var VerifyPermissionsCmd = &cobra.Command{
+	Use:   "verify-permissions",
+	Short: "Verify the permissions without starting the query server, reporting all problems found",
+	Run:   runVerifyPermissions,
+	Args:  cobra.NoArgs,
+}
+
+func runVerifyPermissions(cmd *cobra.Command, args []string) {
+	env, err := common.ParseEnvironment(*verifyEnvStr)
+	if err != nil || (env != common.UnsafeDevNet && env != common.TestNet && env != common.MainNet) {
+		if *verifyEnvStr == "" {
+			fmt.Println("Please specify --env")
+		} else {
+			fmt.Println("Invalid value for --env, should be devnet, testnet or mainnet")
+		}
+		os.Exit(1)
+	}
+
+	// The permissions are loaded the same way as by the server, so the same flags select the source.
+	src := permissionsSource{envVar: *verifyPermEnvVar, dir: *verifyPermDir, file: *verifyPermFile, maxSize: *verifyMaxPermFileSize}
+	if err := src.check(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	perms, err := src.load(zap.NewNop(), env)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, warning := range perms.Warnings() {
+		fmt.Printf("warning: %s\n", warning)
+	}
+
+	fmt.Printf("permissions from %s are valid\n", src)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"slices"
 	"strings"
 
 	"github.com/certusone/wormhole/node/pkg/common"
@@ -298,6 +299,7 @@ func (queryRequest *QueryRequest) UnmarshalFromReader(reader *bytes.Reader) erro
 		return fmt.Errorf("failed to read number of per chain queries: %w", err)
 	}
 
+	queryRequest.PerChainQueries = slices.Grow(queryRequest.PerChainQueries, int(numPerChainQueries))
 	for count := 0; count < int(numPerChainQueries); count++ {
 		perChainQuery := PerChainQueryRequest{}
 		err := perChainQuery.UnmarshalFromReader(reader)
@@ -577,6 +579,9 @@ func (ecd *EthCallQueryRequest) UnmarshalFromReader(reader *bytes.Reader) error
 		return fmt.Errorf("failed to read block id len: %w", err)
 	}
 
+	if err := checkRemainingLength(reader, blockIdLen, "block id"); err != nil {
+		return err
+	}
 	blockId := make([]byte, blockIdLen)
 	if n, err := reader.Read(blockId[:]); err != nil || n != int(blockIdLen) {
 		return fmt.Errorf("failed to read block id [%d]: %w", n, err)
@@ -588,6 +593,7 @@ func (ecd *EthCallQueryRequest) UnmarshalFromReader(reader *bytes.Reader) error
 		return fmt.Errorf("failed to read number of call data entries: %w", err)
 	}
 
+	ecd.CallData = slices.Grow(ecd.CallData, int(numCallData))
 	for count := 0; count < int(numCallData); count++ {
 		to := [EvmContractAddressLength]byte{}
 		if n, err := reader.Read(to[:]); err != nil || n != EvmContractAddressLength {
@@ -598,6 +604,9 @@ func (ecd *EthCallQueryRequest) UnmarshalFromReader(reader *bytes.Reader) error
 		if err := binary.Read(reader, binary.BigEndian, &dataLen); err != nil {
 			return fmt.Errorf("failed to read call Data len: %w", err)
 		}
+		if err := checkRemainingLength(reader, dataLen, "call data"); err != nil {
+			return err
+		}
 		data := make([]byte, dataLen)
 		if n, err := reader.Read(data[:]); err != nil || n != int(dataLen) {
 			return fmt.Errorf("failed to read call data [%d]: %w", n, err)
@@ -716,6 +725,9 @@ func (ecd *EthCallByTimestampQueryRequest) UnmarshalFromReader(reader *bytes.Rea
 		return fmt.Errorf("failed to read target block id hint len: %w", err)
 	}
 
+	if err := checkRemainingLength(reader, blockIdHintLen, "target block id hint"); err != nil {
+		return err
+	}
 	targetBlockIdHint := make([]byte, blockIdHintLen)
 	if n, err := reader.Read(targetBlockIdHint[:]); err != nil || n != int(blockIdHintLen) {
 		return fmt.Errorf("failed to read target block id hint [%d]: %w", n, err)
@@ -727,6 +739,9 @@ func (ecd *EthCallByTimestampQueryRequest) UnmarshalFromReader(reader *bytes.Rea
 		return fmt.Errorf("failed to read following block id hint len: %w", err)
 	}
 
+	if err := checkRemainingLength(reader, blockIdHintLen, "following block id hint"); err != nil {
+		return err
+	}
 	followingBlockIdHint := make([]byte, blockIdHintLen)
 	if n, err := reader.Read(followingBlockIdHint[:]); err != nil || n != int(blockIdHintLen) {
 		return fmt.Errorf("failed to read following block id hint [%d]: %w", n, err)
@@ -738,6 +753,7 @@ func (ecd *EthCallByTimestampQueryRequest) UnmarshalFromReader(reader *bytes.Rea
 		return fmt.Errorf("failed to read number of call data entries: %w", err)
 	}
 
+	ecd.CallData = slices.Grow(ecd.CallData, int(numCallData))
 	for count := 0; count < int(numCallData); count++ {
 		to := [EvmContractAddressLength]byte{}
 		if n, err := reader.Read(to[:]); err != nil || n != EvmContractAddressLength {
@@ -748,6 +764,9 @@ func (ecd *EthCallByTimestampQueryRequest) UnmarshalFromReader(reader *bytes.Rea
 		if err := binary.Read(reader, binary.BigEndian, &dataLen); err != nil {
 			return fmt.Errorf("failed to read call Data len: %w", err)
 		}
+		if err := checkRemainingLength(reader, dataLen, "call data"); err != nil {
+			return err
+		}
 		data := make([]byte, dataLen)
 		if n, err := reader.Read(data[:]); err != nil || n != int(dataLen) {
 			return fmt.Errorf("failed to read call data [%d]: %w", n, err)
@@ -878,6 +897,9 @@ func (ecd *EthCallWithFinalityQueryRequest) UnmarshalFromReader(reader *bytes.Re
 		return fmt.Errorf("failed to read target block id len: %w", err)
 	}
 
+	if err := checkRemainingLength(reader, blockIdLen, "block id"); err != nil {
+		return err
+	}
 	blockId := make([]byte, blockIdLen)
 	if n, err := reader.Read(blockId[:]); err != nil || n != int(blockIdLen) {
 		return fmt.Errorf("failed to read target block id [%d]: %w", n, err)
@@ -889,6 +911,9 @@ func (ecd *EthCallWithFinalityQueryRequest) UnmarshalFromReader(reader *bytes.Re
 		return fmt.Errorf("failed to read finality len: %w", err)
 	}
 
+	if err := checkRemainingLength(reader, finalityLen, "finality"); err != nil {
+		return err
+	}
 	finality := make([]byte, finalityLen)
 	if n, err := reader.Read(finality[:]); err != nil || n != int(finalityLen) {
 		return fmt.Errorf("failed to read finality [%d]: %w", n, err)
@@ -900,6 +925,7 @@ func (ecd *EthCallWithFinalityQueryRequest) UnmarshalFromReader(reader *bytes.Re
 		return fmt.Errorf("failed to read number of call data entries: %w", err)
 	}
 
+	ecd.CallData = slices.Grow(ecd.CallData, int(numCallData))
 	for count := 0; count < int(numCallData); count++ {
 		to := [EvmContractAddressLength]byte{}
 		if n, err := reader.Read(to[:]); err != nil || n != EvmContractAddressLength {
@@ -910,6 +936,9 @@ func (ecd *EthCallWithFinalityQueryRequest) UnmarshalFromReader(reader *bytes.Re
 		if err := binary.Read(reader, binary.BigEndian, &dataLen); err != nil {
 			return fmt.Errorf("failed to read call Data len: %w", err)
 		}
+		if err := checkRemainingLength(reader, dataLen, "call data"); err != nil {
+			return err
+		}
 		data := make([]byte, dataLen)
 		if n, err := reader.Read(data[:]); err != nil || n != int(dataLen) {
 			return fmt.Errorf("failed to read call data [%d]: %w", n, err)
@@ -1064,6 +1093,7 @@ func (saq *SolanaAccountQueryRequest) UnmarshalFromReader(reader *bytes.Reader)
 		return fmt.Errorf("failed to read number of account entries: %w", err)
 	}
 
+	saq.Accounts = slices.Grow(saq.Accounts, int(numAccounts))
 	for count := 0; count < int(numAccounts); count++ {
 		account := [SolanaPublicKeyLength]byte{}
 		if n, err := reader.Read(account[:]); err != nil || n != SolanaPublicKeyLength {
@@ -1201,6 +1231,7 @@ func (spda *SolanaPdaQueryRequest) UnmarshalFromReader(reader *bytes.Reader) err
 		return fmt.Errorf("failed to read number of PDAs: %w", err)
 	}
 
+	spda.PDAs = slices.Grow(spda.PDAs, int(numPDAs))
 	for count := 0; count < int(numPDAs); count++ {
 		programAddress := [SolanaPublicKeyLength]byte{}
 		if n, err := reader.Read(programAddress[:]); err != nil || n != SolanaPublicKeyLength {
@@ -1213,11 +1244,15 @@ func (spda *SolanaPdaQueryRequest) UnmarshalFromReader(reader *bytes.Reader) err
 			return fmt.Errorf("failed to read number of seeds: %w", err)
 		}
 
+		pda.Seeds = slices.Grow(pda.Seeds, int(numSeeds))
 		for count := 0; count < int(numSeeds); count++ {
 			seedLen := uint32(0)
 			if err := binary.Read(reader, binary.BigEndian, &seedLen); err != nil {
 				return fmt.Errorf("failed to read call Data len: %w", err)
 			}
+			if err := checkRemainingLength(reader, seedLen, "seed"); err != nil {
+				return err
+			}
 			seed := make([]byte, seedLen)
 			if n, err := reader.Read(seed[:]); err != nil || n != int(seedLen) {
 				return fmt.Errorf("failed to read seed [%d]: %w", n, err)
@@ -1309,3 +1344,12 @@ func (left *SolanaPdaQueryRequest) Equal(right *SolanaPdaQueryRequest) bool {
 
 	return true
 }
+
+// checkRemainingLength returns an error if a length read from a serialized request is more than the number of bytes left to read. This is
+// checked before allocating a buffer of that length, so that a short malformed request cannot cause a huge allocation.
+func checkRemainingLength(reader *bytes.Reader, length uint32, field string) error {
+	if int64(length) > int64(reader.Len()) {
+		return fmt.Errorf("%s length %d is more than the %d bytes remaining", field, length, reader.Len())
+	}
+	return nil
+}
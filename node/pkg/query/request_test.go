@@ -116,6 +116,13 @@ func TestQueryRequestUnmarshalWithExtraBytesShouldFail(t *testing.T) {
 	assert.EqualError(t, err, "excess bytes in unmarshal")
 }
 
+func TestQueryRequestUnmarshalWithHugeLengthShouldFail(t *testing.T) {
+	// An eth call whose block id claims to be about 3.8GB long, found by fuzzing the proxy.
+	var queryRequest QueryRequest
+	err := queryRequest.Unmarshal([]byte("\x01\x00\x00\x00\x01\x01\x00\x02\x01\xde\xd3\x18\x05\xe4+\"\b2"))
+	assert.ErrorContains(t, err, "block id length 3828032008 is more than the 1 bytes remaining")
+}
+
 func TestMarshalOfQueryRequestWithNoPerChainQueriesShouldFail(t *testing.T) {
 	queryRequest := &QueryRequest{
 		Nonce: 1,